@@ -0,0 +1,67 @@
+package kademlia
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// readAnchors reads the anchor nodes listed in the file at path. Each line
+// holds the host and port of one anchor. Blank lines and lines starting with
+// # are ignored. The IDs of the anchors are not known until they respond to
+// a ping.
+func readAnchors(path string) ([]*NetworkNode, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var anchors []*NetworkNode
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		host, port, err := net.SplitHostPort(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid anchor %q: %v", line, err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid anchor %q: IP required", line)
+		}
+		p, err := parsePort(port)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid anchor %q: %v", line, err)
+		}
+		anchors = append(anchors, &NetworkNode{IP: ip, Port: p})
+	}
+	return anchors, scanner.Err()
+}
+
+// addAnchor records the node with the given ID as an anchor, so that it is
+// not evicted from the routing table
+func (dht *DHT) addAnchor(id []byte) {
+	dht.anchorsMutex.Lock()
+	defer dht.anchorsMutex.Unlock()
+	dht.anchors[string(id)] = true
+}
+
+// forgetAnchor stops treating the node with the given ID as an anchor
+func (dht *DHT) forgetAnchor(id []byte) {
+	dht.anchorsMutex.Lock()
+	defer dht.anchorsMutex.Unlock()
+	delete(dht.anchors, string(id))
+}
+
+// isAnchor returns true if the node with the given ID is an anchor. This may
+// be called with the routing table locked.
+func (dht *DHT) isAnchor(id []byte) bool {
+	dht.anchorsMutex.Lock()
+	defer dht.anchorsMutex.Unlock()
+	return dht.anchors[string(id)]
+}
@@ -0,0 +1,71 @@
+package kademlia
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests reading an anchors file, ignoring blank lines and comments, and that
+// invalid anchors are rejected
+func TestReadAnchors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anchors")
+	err := os.WriteFile(path, []byte("# Anchors\n10.0.0.1:3000\n\n  [::1]:domain\n"), 0600)
+	assert.NoError(t, err)
+
+	anchors, err := readAnchors(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(anchors))
+	assert.Equal(t, "10.0.0.1", anchors[0].IP.String())
+	assert.Equal(t, 3000, anchors[0].Port)
+	assert.Equal(t, "::1", anchors[1].IP.String())
+	assert.Equal(t, 53, anchors[1].Port)
+
+	for _, line := range []string{"10.0.0.1", "example.com:3000", "10.0.0.1:notaport"} {
+		assert.NoError(t, os.WriteFile(path, []byte(line), 0600))
+		_, err = readAnchors(path)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), line)
+	}
+
+	_, err = readAnchors(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+// Tests that the anchors listed in the AnchorsFile are contacted on
+// Bootstrap, and are kept in the routing table when they stop responding
+// until they are removed explicitly
+func TestAnchorsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anchors")
+	assert.NoError(t, os.WriteFile(path, []byte("127.0.0.1:2\n"), 0600))
+
+	// The third node bootstraps only from the second, as an anchor
+	dhts, err := BuildNetwork(3, func(options *Options) {
+		if options.Port == "3" {
+			options.BootstrapNodes = nil
+			options.AnchorsFile = path
+		}
+	})
+	assert.NoError(t, err)
+
+	dht := dhts[2]
+	anchor := dhts[1].ht.Self
+	_, found := dht.Peer(anchor.ID)
+	assert.True(t, found)
+	assert.True(t, dht.isAnchor(anchor.ID))
+	assert.Equal(t, 2, dht.NumNodes())
+
+	assert.NoError(t, dhts[1].Disconnect())
+	_, err = dht.CheckAndRepairTable(context.Background())
+	assert.NoError(t, err)
+	_, found = dht.Peer(anchor.ID)
+	assert.True(t, found)
+
+	assert.True(t, dht.RemovePeer(anchor.ID))
+	assert.False(t, dht.isAnchor(anchor.ID))
+
+	assert.NoError(t, CloseNetwork([]*DHT{dhts[0], dhts[2]}))
+}
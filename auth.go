@@ -0,0 +1,171 @@
+package kademlia
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The length in bytes of the random nonce included in authenticated messages
+const nonceLength = 16
+
+var (
+	errUnauthenticatedMessage = errors.New("Message authentication failed")
+	errStaleMessage           = errors.New("Message timestamp outside of replay window")
+	errReplayedMessage        = errors.New("Message nonce already seen")
+)
+
+// authenticatedMessage is sent in place of a message when a NetworkKey is
+// used. The MAC covers the exact bytes of the encoded message rather than a
+// re-encoding of it, as gob numbers types in the order each process first
+// uses them so the same message may encode differently on each node.
+type authenticatedMessage struct {
+	Payload   []byte // The message, encoded by encodeMessage
+	Nonce     []byte
+	Timestamp int64
+	MAC       []byte
+}
+
+// isAuthError returns true if err is an error returned by authenticator.open
+// for a message which was read but could not be authenticated
+func isAuthError(err error) bool {
+	return errors.Is(err, errUnauthenticatedMessage) || errors.Is(err, errStaleMessage) || errors.Is(err, errReplayedMessage)
+}
+
+// authenticator signs outgoing messages and verifies incoming messages using
+// the NetworkKey shared by every node in a permissioned network. Each message
+// carries a random nonce and a timestamp covered by its MAC, so a captured
+// message can not be replayed: messages with a timestamp further than window
+// from the local clock are rejected, and the nonces of accepted messages are
+// remembered for long enough that a replay within the window is rejected.
+type authenticator struct {
+	key    []byte
+	window time.Duration
+
+	mutex     *sync.Mutex
+	nonces    map[string]time.Time // When each seen nonce may be forgotten
+	lastPrune time.Time
+}
+
+func newAuthenticator(key []byte, window time.Duration) *authenticator {
+	return &authenticator{
+		key:       key,
+		window:    window,
+		mutex:     &sync.Mutex{},
+		nonces:    make(map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// seal encodes msg, and returns it serialized with a nonce, timestamp and MAC
+func (a *authenticator) seal(msg *message) ([]byte, error) {
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &authenticatedMessage{
+		Payload:   payload,
+		Nonce:     make([]byte, nonceLength),
+		Timestamp: time.Now().UnixNano(),
+	}
+	_, err = rand.Read(envelope.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	envelope.MAC = a.mac(envelope)
+
+	var buffer bytes.Buffer
+	err = gob.NewEncoder(&buffer).Encode(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return frame(buffer.Bytes()), nil
+}
+
+// open reads a message serialized by seal from conn. The message is only
+// decoded once it has been verified.
+func (a *authenticator) open(conn io.Reader) (*message, error) {
+	data, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &authenticatedMessage{}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+
+	err = a.verify(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessage(envelope.Payload)
+}
+
+// verify returns an error if the MAC of envelope is invalid, its timestamp is
+// outside of the replay window, or its nonce has already been seen
+func (a *authenticator) verify(envelope *authenticatedMessage) error {
+	if len(envelope.Nonce) != nonceLength || !hmac.Equal(a.mac(envelope), envelope.MAC) {
+		return errUnauthenticatedMessage
+	}
+
+	now := time.Now()
+	timestamp := time.Unix(0, envelope.Timestamp)
+	if timestamp.Before(now.Add(-a.window)) || timestamp.After(now.Add(a.window)) {
+		return errStaleMessage
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.prune(now)
+
+	nonce := string(envelope.Nonce)
+	if _, seen := a.nonces[nonce]; seen {
+		return errReplayedMessage
+	}
+
+	// Once the timestamp has left the window the message is rejected as
+	// stale, so the nonce no longer needs to be remembered
+	a.nonces[nonce] = timestamp.Add(a.window)
+	return nil
+}
+
+// prune forgets nonces which no longer need to be remembered. To avoid
+// scanning every nonce on every message this is done at most once per window.
+// Must be called with the mutex held.
+func (a *authenticator) prune(now time.Time) {
+	if now.Sub(a.lastPrune) < a.window {
+		return
+	}
+	for nonce, expiry := range a.nonces {
+		if now.After(expiry) {
+			delete(a.nonces, nonce)
+		}
+	}
+	a.lastPrune = now
+}
+
+// mac returns the HMAC-SHA256 of the timestamp, nonce and payload of
+// envelope. The nonce has a fixed length, so the fields can not be shifted
+// into one another.
+func (a *authenticator) mac(envelope *authenticatedMessage) []byte {
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(envelope.Timestamp))
+
+	h := hmac.New(sha256.New, a.key)
+	h.Write(timestamp[:])
+	h.Write(envelope.Nonce)
+	h.Write(envelope.Payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,198 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests that a sealed message is accepted once after being sent over the
+// wire, that replaying it is rejected while a fresh message is accepted, and
+// that stale, tampered and wrongly keyed messages are rejected
+func TestAuthenticatorReplay(t *testing.T) {
+	netMsgInit()
+
+	sender := newAuthenticator([]byte("secret"), time.Minute)
+	receiver := newAuthenticator([]byte("secret"), time.Minute)
+
+	newMessage := func() *message {
+		id, _ := newID()
+		return &message{
+			Type:     messageTypeFindNode,
+			Sender:   &NetworkNode{ID: id, IP: net.ParseIP("127.0.0.1"), Port: 3000},
+			Receiver: &NetworkNode{ID: id, IP: net.ParseIP("127.0.0.1"), Port: 3001},
+			Data:     &queryDataFindNode{Target: id},
+		}
+	}
+
+	// open returns the error of the receiver opening data
+	open := func(data []byte) error {
+		_, err := receiver.open(bytes.NewReader(data))
+		return err
+	}
+
+	// envelope decodes the envelope of data sealed by an authenticator, and
+	// reserialize serializes a modified envelope again
+	envelope := func(data []byte) *authenticatedMessage {
+		frame, err := readFrame(bytes.NewReader(data))
+		assert.NoError(t, err)
+		e := &authenticatedMessage{}
+		assert.NoError(t, gob.NewDecoder(bytes.NewReader(frame)).Decode(e))
+		return e
+	}
+	reserialize := func(e *authenticatedMessage) []byte {
+		var buffer bytes.Buffer
+		assert.NoError(t, gob.NewEncoder(&buffer).Encode(e))
+		return frame(buffer.Bytes())
+	}
+
+	msg := newMessage()
+	captured, err := sender.seal(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, nonceLength, len(envelope(captured).Nonce))
+
+	received, err := receiver.open(bytes.NewReader(captured))
+	assert.NoError(t, err)
+	assert.Equal(t, msg.Data, received.Data)
+
+	assert.Equal(t, errReplayedMessage, open(captured))
+
+	fresh, err := sender.seal(newMessage())
+	assert.NoError(t, err)
+	assert.NoError(t, open(fresh))
+
+	// Changing the nonce of a replayed message invalidates its MAC
+	replayed := envelope(captured)
+	replayed.Nonce[0]++
+	assert.Equal(t, errUnauthenticatedMessage, open(reserialize(replayed)))
+
+	tampered, err := sender.seal(newMessage())
+	assert.NoError(t, err)
+	e := envelope(tampered)
+	e.Payload[len(e.Payload)-1]++
+	assert.Equal(t, errUnauthenticatedMessage, open(reserialize(e)))
+
+	wrongKey, err := newAuthenticator([]byte("other"), time.Minute).seal(newMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, errUnauthenticatedMessage, open(wrongKey))
+
+	// A message signed outside of the window is stale, even if its nonce has
+	// never been seen
+	stale, err := sender.seal(newMessage())
+	assert.NoError(t, err)
+	e = envelope(stale)
+	e.Timestamp = time.Now().Add(-time.Minute * 2).UnixNano()
+	e.MAC = sender.mac(e)
+	assert.Equal(t, errStaleMessage, open(reserialize(e)))
+}
+
+// authHelperPadding is encoded by the sealing helper process before any
+// message, so that it numbers gob types differently to the opening process
+type authHelperPadding struct {
+	Padding string
+}
+
+// Tests that a message sealed by one process is accepted by another which
+// numbers gob types differently, by running each in a helper process
+func TestAuthenticatorTypeOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sealed")
+	run := func(mode string) error {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestAuthHelperProcess$")
+		cmd.Env = append(os.Environ(), "KADEMLIA_AUTH_HELPER="+mode, "KADEMLIA_AUTH_SEALED="+path)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, output)
+		}
+		return nil
+	}
+
+	assert.NoError(t, run("seal"))
+	assert.NoError(t, run("open"))
+}
+
+// TestAuthHelperProcess seals or opens a message for TestAuthenticatorTypeOrder.
+// It does nothing unless run as a helper process.
+func TestAuthHelperProcess(t *testing.T) {
+	mode := os.Getenv("KADEMLIA_AUTH_HELPER")
+	if mode == "" {
+		return
+	}
+
+	netMsgInit()
+	a := newAuthenticator([]byte("secret"), time.Minute)
+	path := os.Getenv("KADEMLIA_AUTH_SEALED")
+	target := getIDWithValues(1)
+
+	var err error
+	switch mode {
+	case "seal":
+		err = gob.NewEncoder(io.Discard).Encode(&authHelperPadding{Padding: "padding"})
+		if err != nil {
+			break
+		}
+		var data []byte
+		data, err = a.seal(&message{
+			Type:     messageTypeFindNode,
+			Sender:   &NetworkNode{ID: target, IP: net.ParseIP("127.0.0.1"), Port: 3000},
+			Receiver: &NetworkNode{ID: target, IP: net.ParseIP("127.0.0.1"), Port: 3001},
+			Data:     &queryDataFindNode{Target: target},
+		})
+		if err == nil {
+			err = os.WriteFile(path, data, 0600)
+		}
+	case "open":
+		var data []byte
+		data, err = os.ReadFile(path)
+		if err != nil {
+			break
+		}
+		var msg *message
+		msg, err = a.open(bytes.NewReader(data))
+		if err == nil && !bytes.Equal(target, msg.Data.(*queryDataFindNode).Target) {
+			err = errors.New("Opened message has the wrong target")
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Tests that nodes sharing a NetworkKey can communicate, while a node with a
+// different key is ignored
+func TestNetworkKey(t *testing.T) {
+	dhts, err := BuildNetwork(3, func(options *Options) {
+		options.NetworkKey = []byte("secret")
+	})
+	assert.NoError(t, err)
+
+	for _, dht := range dhts {
+		assert.Equal(t, 2, dht.NumNodes())
+	}
+
+	assert.NoError(t, CloseNetwork(dhts))
+
+	// The second node knows the first, but its messages are dropped
+	dhts, err = BuildNetwork(2, func(options *Options) {
+		options.NetworkKey = []byte("secret")
+		options.TMsgTimeout = time.Millisecond * 100
+		if options.Port == "2" {
+			options.NetworkKey = []byte("other")
+		}
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dhts[0].NumNodes())
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
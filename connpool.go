@@ -0,0 +1,110 @@
+package kademlia
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var errPoolClosed = errors.New("Connection pool closed")
+
+// connPool keeps the connections dialled to send messages open, so that
+// further messages to the same address reuse them rather than each dialling
+// a new connection. A connection is closed once no message has been sent on
+// it for idle.
+type connPool struct {
+	idle time.Duration
+	dial func(addr string) (net.Conn, error)
+
+	mutex  *sync.Mutex
+	conns  map[string]*pooledConn
+	closed bool
+}
+
+// pooledConn is a connection held in a connPool
+type pooledConn struct {
+	net.Conn
+
+	// Held while writing so that messages are not interleaved
+	mutex *sync.Mutex
+
+	// Removes the connection from the pool once it has been idle
+	timer *time.Timer
+}
+
+func newConnPool(idle time.Duration, dial func(addr string) (net.Conn, error)) *connPool {
+	return &connPool{
+		idle:  idle,
+		dial:  dial,
+		mutex: &sync.Mutex{},
+		conns: make(map[string]*pooledConn),
+	}
+}
+
+// get returns the pooled connection to addr, dialling one if there is none
+func (p *connPool) get(addr string) (*pooledConn, error) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, errPoolClosed
+	}
+	if c := p.conns[addr]; c != nil {
+		c.timer.Reset(p.idle)
+		p.mutex.Unlock()
+		return c, nil
+	}
+	p.mutex.Unlock()
+
+	// Dial without holding the mutex so that messages to other addresses
+	// are not held up
+	conn, err := p.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		conn.Close()
+		return nil, errPoolClosed
+	}
+	if existing := p.conns[addr]; existing != nil {
+		// Another message dialled the same address at the same time
+		conn.Close()
+		existing.timer.Reset(p.idle)
+		return existing, nil
+	}
+	c := &pooledConn{Conn: conn, mutex: &sync.Mutex{}}
+	c.timer = time.AfterFunc(p.idle, func() {
+		p.remove(addr, c)
+	})
+	p.conns[addr] = c
+	return c, nil
+}
+
+// remove closes c and removes it from the pool, if it is still the pooled
+// connection to addr
+func (p *connPool) remove(addr string, c *pooledConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.conns[addr] != c {
+		return
+	}
+	delete(p.conns, addr)
+	c.timer.Stop()
+	c.Close()
+}
+
+// close closes every connection in the pool. Connections are no longer
+// pooled afterwards.
+func (p *connPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for addr, c := range p.conns {
+		c.timer.Stop()
+		c.Close()
+		delete(p.conns, addr)
+	}
+	p.closed = true
+}
@@ -2,22 +2,369 @@ package kademlia
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/gob"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math"
+	mrand "math/rand"
+	"net"
 	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	b58 "github.com/jbenet/go-base58"
 )
 
+const (
+	// IDCollisionKeepExisting ignores a node which has the same ID as a node
+	// already in the routing table, but a different address
+	IDCollisionKeepExisting = iota
+
+	// IDCollisionPing pings the existing node when a node with the same ID
+	// but a different address is seen. If the existing node does not respond
+	// the new node is pinged, and replaces the existing node if it responds.
+	IDCollisionPing
+
+	// IDCollisionUpdateAddress treats a node seen with the same ID as a node
+	// already in the routing table, but a different address, as the same
+	// peer having moved. The stored address is replaced with the new one.
+	IDCollisionUpdateAddress
+
+	// IDCollisionVerifyAddress pings the new address when a node with the
+	// same ID but a different address is seen, and replaces the stored
+	// address with the new one if it responds
+	IDCollisionVerifyAddress
+)
+
+const (
+	// SourceIPTrust accepts the IP a message claims its sender has, even if
+	// it differs from the address the message was received from
+	SourceIPTrust = iota
+
+	// SourceIPReject drops messages which claim a sender IP different to the
+	// address they were received from
+	SourceIPReject
+
+	// SourceIPCorrect replaces the sender IP claimed by a message with the
+	// address it was received from
+	SourceIPCorrect
+)
+
+const (
+	// LookupClosestFirst queries the alpha closest nodes which have not yet
+	// been queried in each round of an iterative lookup
+	LookupClosestFirst = iota
+
+	// LookupBreadthFirst queries all of the k closest nodes which have not
+	// yet been queried in each round of an iterative lookup. More of the
+	// keyspace is explored before the lookup converges, at the cost of
+	// sending more messages.
+	LookupBreadthFirst
+)
+
+// EvictionReason describes why a node was removed from the routing table
+type EvictionReason int
+
+const (
+	// EvictionBucketOverflow means the node was the least recently seen node
+	// in a full bucket, and was dropped to make room for a new node because
+	// it could not be pinged
+	EvictionBucketOverflow EvictionReason = iota
+
+	// EvictionUnresponsive means the node did not respond to a ping within
+	// TPingMax
+	EvictionUnresponsive
+
+	// EvictionRemoved means the node was removed with RemovePeer
+	EvictionRemoved
+
+	// EvictionBanned means the node's IP was refused after sending too many
+	// malformed packets
+	EvictionBanned
+
+	// EvictionReplaced means the node did not respond and was replaced by a
+	// responsive node with the same ID
+	EvictionReplaced
+)
+
+// String returns a human readable name for the reason
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionBucketOverflow:
+		return "bucket overflow"
+	case EvictionUnresponsive:
+		return "unresponsive"
+	case EvictionRemoved:
+		return "removed"
+	case EvictionBanned:
+		return "banned"
+	case EvictionReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+// LookupTermination describes why an iterative lookup stopped
+type LookupTermination int
+
+const (
+	// TerminationConverged means a round of the lookup found no node closer
+	// than those already queried, or a FIND_VALUE lookup found the value
+	TerminationConverged LookupTermination = iota
+
+	// TerminationMaxRounds means the lookup reached MaxLookupRounds
+	TerminationMaxRounds
+
+	// TerminationTimedOut means the lookup converged without any queried
+	// node responding within TMsgTimeout
+	TerminationTimedOut
+
+	// TerminationCancelled means the context of the lookup was cancelled
+	TerminationCancelled
+
+	// TerminationCandidatesFailed means there were no nodes to query, or
+	// every node in the shortlist could not be reached or returned an error
+	TerminationCandidatesFailed
+
+	// TerminationLoopDetected means several consecutive rounds returned only
+	// nodes which had already been queried
+	TerminationLoopDetected
+)
+
+// String returns a human readable name for the termination reason
+func (t LookupTermination) String() string {
+	switch t {
+	case TerminationConverged:
+		return "converged"
+	case TerminationMaxRounds:
+		return "max rounds"
+	case TerminationTimedOut:
+		return "timed out"
+	case TerminationCancelled:
+		return "cancelled"
+	case TerminationCandidatesFailed:
+		return "candidates failed"
+	case TerminationLoopDetected:
+		return "loop detected"
+	}
+	return "unknown"
+}
+
+// Lifecycle is the state of the local node, as reported by State
+type Lifecycle int
+
+const (
+	// LifecycleInitializing means the node has been created, but has not yet
+	// joined a network
+	LifecycleInitializing Lifecycle = iota
+
+	// LifecycleBootstrapping means Bootstrap is in progress
+	LifecycleBootstrapping
+
+	// LifecycleReady means the node has bootstrapped, or is listening and has
+	// no BootstrapNodes to bootstrap from
+	LifecycleReady
+
+	// LifecycleShuttingDown means Disconnect has been called
+	LifecycleShuttingDown
+)
+
+// String returns a human readable name for the state
+func (l Lifecycle) String() string {
+	switch l {
+	case LifecycleInitializing:
+		return "initializing"
+	case LifecycleBootstrapping:
+		return "bootstrapping"
+	case LifecycleReady:
+		return "ready"
+	case LifecycleShuttingDown:
+		return "shutting down"
+	}
+	return "unknown"
+}
+
+// The kinds of maintenance sweep reported to OnMaintenanceTick. Sweeps run
+// once a second, except for announcements which run every TAnnounce.
+const (
+	// Refreshes buckets in which no lookup has been made for TRefresh
+	MaintenanceRefresh = "refresh"
+
+	// Re-announces the local node with a lookup of its own ID
+	MaintenanceAnnounce = "announce"
+
+	// Republishes and replicates the keys in the local store which are due
+	MaintenanceReplicate = "replicate"
+
+	// Expires keys and other records which are no longer needed
+	MaintenanceExpire = "expire"
+)
+
+// ErrNoPeers is returned by Store when the local routing table is empty. The
+// data is still stored locally, but has not been replicated to the network.
+// If QueuePeerlessStores is set it is replicated once a node is added.
+var ErrNoPeers = errors.New("No peers available to store to")
+
+// ErrRandomUnavailable is returned by NewDHT when no ID is provided and random
+// data to generate one could not be read within TIDGeneration
+var ErrRandomUnavailable = errors.New("Timed out reading random data to generate an ID")
+
+// ErrInvalidPort is returned by NewDHT when Options.Port is neither a port
+// number nor a known service name
+var ErrInvalidPort = errors.New("Invalid port")
+
+// ErrInsufficientSubnets is returned by Bootstrap when the routing table does
+// not span MinBootstrapSubnets distinct subnets after bootstrapping
+var ErrInsufficientSubnets = errors.New("Too few distinct subnets found during bootstrap")
+
+// ErrIDPrefixMismatch is returned by NewDHT when Options.ID does not begin
+// with Options.IDPrefix, or the prefix is not shorter than node IDs
+var ErrIDPrefixMismatch = errors.New("ID does not begin with the IDPrefix")
+
+// ErrRateLimited is returned when a message can not be sent because the
+// MaxRPCRate has been reached and FailRateLimitedRPCs is set
+var ErrRateLimited = errors.New("Maximum RPC rate reached")
+
+// ErrInvalidKeyTransform is returned when the KeyTransform returns a key
+// which is not the same length as node IDs
+var ErrInvalidKeyTransform = errors.New("KeyTransform returned a key of the wrong length")
+
+// ErrLocalStoreFailed is returned by Store when the local store could not
+// persist the data, for example because its disk is full. The data is still
+// stored on the network, and the returned key is valid.
+var ErrLocalStoreFailed = errors.New("Could not store data locally")
+
 // DHT represents the state of the local node in the distributed hash table
 type DHT struct {
 	ht         *hashTable
 	options    *Options
 	networking networking
 	store      Store
+
+	negativeCache      map[string]time.Time
+	negativeCacheMutex *sync.Mutex
+
+	replicationStatus      map[string]*StoreReport
+	replicationStatusMutex *sync.Mutex
+
+	allowedNets []*net.IPNet
+
+	responsible      map[string]bool
+	responsibleMutex *sync.Mutex
+
+	// Closed and replaced each time a bucket gains its first node, waking
+	// stores waiting for peers
+	peersAdded      chan struct{}
+	peersAddedMutex *sync.Mutex
+
+	// The ID of the node which published each key held in the local store,
+	// or the local ID for keys published by the local node
+	publishers map[string]string
+
+	// The number of keys in publishers published by each other node
+	publisherKeys   map[string]int
+	publishersMutex *sync.Mutex
+
+	lookupLatency *latencyHistogram
+
+	// The time taken for queries of each message type to be answered
+	rpcLatency map[int]*latencyHistogram
+
+	// The outbound RPCs sent within the last TRPCWindow
+	rpcSchedule *rpcWindow
+
+	// Recently seen nodes which did not fit in the routing table
+	warmCache *warmCache
+
+	// Limits the rate of RPCs sent if MaxRPCRate is set
+	rpcLimiter *tokenBucket
+
+	// The iterative stores in progress, keyed by routing key
+	storeFlights *flightGroup
+
+	// The operations issued with each metrics label
+	labelCounts      map[string]*OperationCounts
+	labelCountsMutex *sync.Mutex
+
+	// The keys stored while the routing table was empty, which are stored to
+	// the network once a node is added
+	pendingStores      map[string]bool
+	pendingStoresMutex *sync.Mutex
+
+	// The ID of the last lookup started. Accessed atomically.
+	lookupCounter uint64
+
+	// The number of STOREs rejected because the key of their data was the
+	// wrong length. Accessed atomically.
+	malformedStores int64
+
+	maintenancePaused bool
+	maintenanceMutex  *sync.Mutex
+
+	// Returns the current time. Replaced in tests.
+	now func() time.Time
+
+	// When the local node is next due to re-announce itself. Only accessed
+	// by the timers goroutine.
+	nextAnnounce time.Time
+
+	// The lifecycle state of the node, when its socket was created, and
+	// whether OnBootstrapComplete has been called
+	state        Lifecycle
+	started      time.Time
+	bootstrapped bool
+	stateMutex   *sync.Mutex
+
+	// When each ping timeout within the last TChurnWindow occurred, and
+	// whether they currently reach the ChurnThreshold
+	pingTimeouts []time.Time
+	churning     bool
+	churnMutex   *sync.Mutex
+
+	// The IDs of the anchor nodes which have responded to a ping
+	anchors      map[string]bool
+	anchorsMutex *sync.Mutex
+
+	// The number of keys in the local store published by other nodes.
+	// Accessed atomically.
+	remoteKeys int64
+
+	// Held while storing to or deleting from the local store, so that each
+	// change is counted in remoteKeys exactly once
+	storeMutex *sync.Mutex
+}
+
+// StoreReport records the outcome of a store of a key to the network
+type StoreReport struct {
+	// The nodes a STORE was sent to
+	Targeted []*NetworkNode
+
+	// The targeted nodes which responded that they stored the data
+	Acked []*NetworkNode
+
+	// The targeted nodes to which the STORE could not be sent, which did not
+	// respond in time, or which responded that they could not store the data
+	Failed []*NetworkNode
+
+	// Why the lookup for the nodes to store to stopped. Stores to a recorded
+	// replica set are not preceded by a lookup, and report
+	// TerminationConverged.
+	Termination LookupTermination
+
+	// The ID of the lookup for the nodes to store to, as reported to the
+	// tracer added by WithLookupTracer. This is 0 if there was no lookup.
+	LookupID uint64
+
+	// Whether the local store held different data for the key, which the
+	// store replaced. Content addressed keys are never overwritten, as
+	// storing the same data again only refreshes its expiration.
+	Overwritten bool
 }
 
 // Options contains configuration options for the local node
@@ -27,7 +374,9 @@ type Options struct {
 	// The local IPv4 or IPv6 address
 	IP string
 
-	// The local port to listen for connections on
+	// The local port to listen for connections on, either a number or a
+	// service name resolved with net.LookupPort. If "0" the OS will choose
+	// an ephemeral port, which is then advertised to other nodes.
 	Port string
 
 	// Whether or not to use the STUN protocol to determine public IP and Port
@@ -46,6 +395,14 @@ type Options struct {
 	// initialized via dht.NewNetworkNode()
 	BootstrapNodes []*NetworkNode
 
+	// The path of a file listing anchor nodes: stable, long-lived peers which
+	// are pinged on every Bootstrap alongside the BootstrapNodes. Each line
+	// holds the IP and port of one anchor, e.g. "10.0.0.1:3000". Blank lines
+	// and lines starting with # are ignored. Anchors which respond are added
+	// to the routing table and are never evicted from it, other than by
+	// RemovePeer or ResetBucket.
+	AnchorsFile string
+
 	// The time after which a key/value pair expires;
 	// this is a time-to-live (TTL) from the original publication date
 	TExpire time.Duration
@@ -53,6 +410,13 @@ type Options struct {
 	// Seconds after which an otherwise unaccessed bucket must be refreshed
 	TRefresh time.Duration
 
+	// How often the local node re-announces itself by performing a
+	// FIND_NODE lookup of its own ID, which causes the nodes it contacts to
+	// refresh their entry for it. This is lighter than a full bucket refresh.
+	// Each interval is randomly varied by up to a tenth so that nodes started
+	// together do not announce together. Set to 0 to disable.
+	TAnnounce time.Duration
+
 	// The interval between Kademlia replication events, when a node is
 	// required to publish its entire database
 	TReplicate time.Duration
@@ -67,6 +431,399 @@ type Options struct {
 
 	// The maximum time to wait for a response to any message
 	TMsgTimeout time.Duration
+
+	// The time for which a failed lookup of a key is remembered. A Get for
+	// the same key within this window reports the value as not found without
+	// querying the network. Set to 0 to disable the negative cache.
+	TNegativeCache time.Duration
+
+	// The number of times a message is retried when it can not be sent
+	// because the socket send buffer is full. Defaults to 3. Set to a
+	// negative value to never retry.
+	SendRetries int
+
+	// The maximum number of keys stored to the network concurrently during a
+	// replication sweep. Defaults to alpha, which is also used if it is
+	// negative.
+	ReplicationConcurrency int
+
+	// The maximum number of nodes in a bucket pinged at once by
+	// CheckAndRepairTable. Defaults to 1, pinging one node at a time, which
+	// is also used if it is negative.
+	PingConcurrency int
+
+	// The maximum time Store waits for a node to be added to an empty
+	// routing table before giving up and returning ErrNoPeers. Set to 0 to
+	// return ErrNoPeers immediately.
+	TStoreWaitForPeers time.Duration
+
+	// If set, values held in the local store past their expiration are still
+	// returned by Get and served to FIND_VALUEs until they are removed by the
+	// next expiration sweep. By default they are treated as absent, and the
+	// lookup continues on the network. Requires a store implementing
+	// ExpirationStore, otherwise expired values are always served.
+	ServeExpiredValues bool
+
+	// If set, data stored while the routing table is empty is queued, and
+	// stored to the network as soon as a node is added rather than only at
+	// the next replication.
+	QueuePeerlessStores bool
+
+	// A list of CIDR ranges, e.g. "10.0.0.0/8", from which peers are
+	// accepted. Nodes with an address outside of these ranges are never added
+	// to the routing table and their messages are dropped. If empty, peers
+	// from any address are accepted.
+	AllowedCIDRs []string
+
+	// Called with a copy of a node before it is added to the routing table.
+	// If it returns false the node is not added. This allows custom
+	// admission policies, for example based on reputation or location, on
+	// top of AllowedCIDRs and StrictIDPrefix. Unlike other callbacks it is
+	// called synchronously, while handling messages from other nodes, so it
+	// must return quickly and must not block. It is not called for nodes
+	// already in the routing table.
+	AdmissionFilter func(n NetworkNode) bool
+
+	// Called when, due to a change in the routing table, the local node
+	// becomes one of the k closest known nodes to a key held in the local
+	// store. Called from its own goroutine.
+	OnBecameResponsible func(key []byte)
+
+	// Called with the index of a bucket when it gains its first node, with
+	// nowPopulated set, or loses its last node. Empty buckets are gaps in the
+	// local node's coverage of the keyspace. Called from its own goroutine, so
+	// changes in quick succession may be reported out of order.
+	OnBucketStateChange func(index int, nowPopulated bool)
+
+	// The maximum number of distinct keys a single remote node may publish
+	// on the local node. STOREs beyond this limit are rejected. STOREs from
+	// nodes replicating keys they did not publish are not counted. Set to 0
+	// for no limit.
+	MaxKeysPerPublisher int
+
+	// The maximum number of keys stored on behalf of other nodes. Once the
+	// store is near the limit, STOREs of keys at least ShedDistance from the
+	// local ID are rejected, and when keys are expired the keys most distant
+	// from the local ID are deleted until the limit is met. This keeps the
+	// store to the keys the node is most responsible for. Keys published by
+	// the local node are never deleted. Set to 0 for no limit.
+	MaxStoredKeys int
+
+	// The XOR distance from the local ID, as the index of its highest set
+	// bit, at which keys are rejected when the store is near MaxStoredKeys.
+	// Defaults to b-1, the furthest half of the keyspace.
+	ShedDistance int
+
+	// The upper bounds of the buckets used to record the latency of
+	// completed lookups, and of responses to individual RPCs. Must be in
+	// increasing order. If left empty a default
+	// set of buckets ranging from 10ms to 10s is used.
+	LookupLatencyBuckets []time.Duration
+
+	// A human readable name and version of this implementation, e.g.
+	// "kademlia/1.0", advertised to other nodes in ping responses
+	AgentName string
+
+	// The number of additional nodes queried one at a time, closest first,
+	// when a FIND_VALUE lookup converges without finding the value. Defaults
+	// to alpha.
+	FindValueRetryBreadth int
+
+	// Called with non-fatal socket errors, such as failures to dial, write
+	// to or read from a remote node. Called from its own goroutine.
+	OnTransportError func(err error)
+
+	// Called when the local node serves a value from its store in response
+	// to a FIND_VALUE from a remote node. Called from its own goroutine.
+	OnValueServed func(key []byte, to NetworkNode)
+
+	// Called when the local store fails to persist a key/value pair, either
+	// stored by the local node or received in a STORE from a remote node.
+	// Called from its own goroutine.
+	OnStoreError func(key []byte, err error)
+
+	// Called when a STORE from a remote node is rejected because the key of
+	// its data is not the same length as node IDs, for example because the
+	// Store or KeyTransform returned a key of the wrong length. Such keys
+	// cannot be routed. Called from its own goroutine.
+	OnMalformedStore func(from NetworkNode, key []byte)
+
+	// Called with one of the Maintenance kinds at the start of each
+	// maintenance sweep, so that applications can observe the cadence of
+	// sweeps or run their own periodic work alongside them. Called from its
+	// own goroutine.
+	OnMaintenanceTick func(kind string)
+
+	// Called with the number of nodes in the routing table the first time
+	// Bootstrap succeeds in finding any nodes. Never called again, even if
+	// Bootstrap is called again. Called from its own goroutine.
+	OnBootstrapComplete func(nodeCount int)
+
+	// Called with a copy of a node, and the reason, when the node is removed
+	// from the routing table. Called from its own goroutine.
+	OnNodeEvicted func(n NetworkNode, reason EvictionReason)
+
+	// The strategy used when a node is seen with the same ID as a node
+	// already in the routing table, but a different address. One of
+	// IDCollisionKeepExisting, IDCollisionPing, IDCollisionUpdateAddress or
+	// IDCollisionVerifyAddress. Defaults to IDCollisionKeepExisting.
+	IDCollisionPolicy int
+
+	// How the sender IP claimed by an inbound message is checked against the
+	// address the message was received from. A node which trusts claimed IPs
+	// can be made to send responses to a victim's address. One of
+	// SourceIPTrust, SourceIPReject or SourceIPCorrect. Defaults to
+	// SourceIPTrust. When rejecting, every node must advertise the address
+	// it sends from, so IP should not be a wildcard address.
+	SourceIPPolicy int
+
+	// The maximum number of RPCs per second sent to other nodes by the local
+	// node, across every lookup, store and maintenance task. Responses to
+	// other nodes are not limited. While the rate is exceeded, nodes which
+	// would displace another from a full bucket are not added, as the ping
+	// of the node they would displace is not sent. If 0, the rate is not
+	// limited.
+	MaxRPCRate int
+
+	// The number of RPCs which may be sent at once after a quiet period,
+	// above the MaxRPCRate. Defaults to MaxRPCRate, which is also used if it
+	// is negative.
+	RPCBurst int
+
+	// If true, RPCs beyond the MaxRPCRate fail with ErrRateLimited, and the
+	// node they were sent to is treated as unreachable. Otherwise they are
+	// delayed until the rate allows them to be sent.
+	FailRateLimitedRPCs bool
+
+	// The maximum number of rounds of messages sent during an iterative
+	// lookup. If reached, the lookup stops and returns the closest nodes found
+	// so far. Defaults to b.
+	MaxLookupRounds int
+
+	// The number of rounds a node may remain in the shortlist of an iterative
+	// lookup without becoming one of the closest k nodes found. Older nodes
+	// are dropped, bounding the shortlist of long lookups below its maximum
+	// size. If 0, nodes are only dropped once the shortlist is full.
+	MaxCandidateAge int
+
+	// The strategy used to select which nodes to query in each round of an
+	// iterative lookup. One of LookupClosestFirst or LookupBreadthFirst.
+	// Defaults to LookupClosestFirst.
+	LookupStrategy int
+
+	// The source of random data used to generate an ID if none is provided.
+	// Defaults to crypto/rand.Reader.
+	Rand io.Reader
+
+	// The maximum time to wait for Rand when generating an ID, as reading
+	// random data may block on some systems until the entropy pool has been
+	// seeded. Defaults to 5 seconds.
+	TIDGeneration time.Duration
+
+	// The number of pings which must time out within TChurnWindow for the
+	// network to be considered to be churning, for example during a mass
+	// restart. While it is, unresponsive nodes are kept in the routing table
+	// rather than evicted, so that the table is not drained of contacts which
+	// are about to come back. Set to 0 to always evict unresponsive nodes.
+	ChurnThreshold int
+
+	// The window over which ping timeouts are counted against the
+	// ChurnThreshold. Defaults to 1 minute.
+	TChurnWindow time.Duration
+
+	// The rolling window over which outbound RPCs are counted in the
+	// RPCSchedule. Defaults to 1 minute.
+	TRPCWindow time.Duration
+
+	// If set, the connection used to send messages to a node is kept open
+	// and reused for further messages to it, until no message has been sent
+	// on it for TConnIdle. This saves a handshake per message when the same
+	// nodes are queried repeatedly. Open connections count towards the
+	// remote node's MaxInboundConnections. Set to 0 to dial a new connection
+	// for every message.
+	TConnIdle time.Duration
+
+	// The maximum time Disconnect waits for background work, such as a
+	// lookup in progress or a message being handled, to finish. Once passed
+	// the socket is closed regardless and the work still pending is logged.
+	// Set to 0 to wait indefinitely.
+	TDisconnectTimeout time.Duration
+
+	// If true and the store implements SecureDeleter, expired data is
+	// deleted using SecureDelete so it is overwritten first. Has no effect
+	// on the MemoryStore.
+	SecureDelete bool
+
+	// The number of malformed packets received within TMalformedWindow after
+	// which connections from the IP which sent them are refused for
+	// TMalformedBan. Set to 0 to never refuse connections.
+	MalformedPacketLimit int
+
+	// The time for which connections are refused from an IP which has sent
+	// MalformedPacketLimit malformed packets. Defaults to 10 minutes.
+	TMalformedBan time.Duration
+
+	// The window within which malformed packets from an IP are counted
+	// towards the MalformedPacketLimit. Older packets are forgotten, so that
+	// occasional corruption from an honest node does not lead to a ban.
+	// Defaults to TMalformedBan.
+	TMalformedWindow time.Duration
+
+	// The minimum number of distinct subnets, /24 for IPv4 and /64 for IPv6,
+	// which the routing table must span for Bootstrap to succeed. This makes
+	// it harder for an attacker controlling a single subnet to surround a
+	// joining node. If too few subnets are found, lookups of random IDs are
+	// performed to find more, and ErrInsufficientSubnets is returned if there
+	// are still too few. Set to 0 to disable.
+	MinBootstrapSubnets int
+
+	// The number of nodes beyond k each bucket may hold while the node is
+	// bootstrapping, so that good contacts learned early are not evicted as
+	// buckets fill rapidly. Once Bootstrap returns, buckets are trimmed back
+	// to the k most recently seen nodes. If 0, buckets never exceed k.
+	BootstrapBucketGrace int
+
+	// If not 0, once Bootstrap has looked up its own ID it refreshes every
+	// bucket further away than its closest neighbour with a lookup of a
+	// random ID in the bucket, as described in the Kademlia paper, running up
+	// to this many lookups at once. The lookups are subject to MaxRPCRate.
+	// If 0 or negative, buckets are left to be refreshed by maintenance.
+	BootstrapConcurrency int
+
+	// The number of recently seen nodes to remember which could not be added
+	// to the routing table because their bucket was full. They are queried
+	// in lookups alongside the closest nodes in the routing table, and
+	// replace nodes removed from their bucket for not responding. If 0, no
+	// nodes are remembered.
+	WarmCacheSize int
+
+	// The maximum number of inbound connections open at once. Connections
+	// accepted beyond this limit are closed immediately. Set to 0 for no
+	// limit.
+	MaxInboundConnections int
+
+	// If true, values served in response to a FIND_VALUE are gzip
+	// compressed when the requester can decode them and compression makes
+	// them smaller. Values too large to fit in a response uncompressed are
+	// always compressed.
+	CompressValues bool
+
+	// A secret key shared by every node in a permissioned network. If set,
+	// every message is authenticated with an HMAC of its contents using this
+	// key, and messages which fail authentication are dropped. Each message
+	// also carries a nonce and timestamp so that captured messages can not be
+	// replayed.
+	NetworkKey []byte
+
+	// The maximum difference between the timestamp of an authenticated
+	// message and the local clock. Messages outside of this window, or with a
+	// nonce already seen within it, are dropped. Defaults to 1 minute.
+	TReplayWindow time.Duration
+
+	// If true, the routing table compares a prefix of node IDs before
+	// comparing the full IDs, which is faster when the table is densely
+	// populated.
+	IDPrefixCompare bool
+
+	// A prefix shared by the ID of every node in a sub-network of a
+	// hierarchical network. Generated IDs begin with the prefix, and NewDHT
+	// returns ErrIDPrefixMismatch if an ID without it is provided. Nodes
+	// within the sub-network are routed by the remaining bits of their IDs.
+	IDPrefix []byte
+
+	// If true, nodes with an ID which does not begin with IDPrefix are never
+	// added to the routing table and their messages are dropped
+	StrictIDPrefix bool
+
+	// The maximum number of nodes a key stored with StoreWithReplication is
+	// replicated to. Larger replication factors are reduced to this.
+	// Defaults to 2 * k.
+	MaxReplicationFactor int
+
+	// If true, the nodes each value was last stored to are recorded, so that
+	// Refresh and republishing can store to them directly rather than
+	// performing a lookup. The store must implement ReplicaSetStore.
+	RecordReplicas bool
+
+	// Applied to the key of data, its content hash, to produce the key under
+	// which it is stored and looked up in the network. For example, keys can
+	// be namespaced by hashing an application tag together with the content
+	// hash, so that applications sharing a network do not collide. Must
+	// return a key the same length as node IDs, and every node in the
+	// network should use the same KeyTransform. Store returns and Get accepts
+	// the untransformed key.
+	KeyTransform func(key []byte) []byte
+}
+
+// EffectiveConfig contains the configuration of the local node after
+// defaults have been applied to the provided Options
+type EffectiveConfig struct {
+	// The maximum number of contacts stored in a bucket
+	K int
+
+	// The degree of parallelism in network calls
+	Alpha int
+
+	// The length in bytes of node IDs and keys
+	IDLength int
+
+	// The address advertised to other nodes
+	IP   string
+	Port int
+
+	TExpire            time.Duration
+	TRefresh           time.Duration
+	TAnnounce          time.Duration
+	TReplicate         time.Duration
+	TRepublish         time.Duration
+	TPingMax           time.Duration
+	TMsgTimeout        time.Duration
+	TNegativeCache     time.Duration
+	TStoreWaitForPeers time.Duration
+	TIDGeneration      time.Duration
+	TMalformedBan      time.Duration
+	TMalformedWindow   time.Duration
+	TReplayWindow      time.Duration
+	TDisconnectTimeout time.Duration
+	TChurnWindow       time.Duration
+	TRPCWindow         time.Duration
+	TConnIdle          time.Duration
+
+	SendRetries            int
+	ReplicationConcurrency int
+	PingConcurrency        int
+	FindValueRetryBreadth  int
+	MaxLookupRounds        int
+	MaxCandidateAge        int
+	MaxReplicationFactor   int
+	LookupStrategy         int
+	MaxKeysPerPublisher    int
+	MaxStoredKeys          int
+	ShedDistance           int
+	MalformedPacketLimit   int
+	MaxInboundConnections  int
+	MinBootstrapSubnets    int
+	BootstrapBucketGrace   int
+	BootstrapConcurrency   int
+	WarmCacheSize          int
+	ChurnThreshold         int
+	IDCollisionPolicy      int
+	SourceIPPolicy         int
+	MaxRPCRate             int
+	RPCBurst               int
+	FailRateLimitedRPCs    bool
+	IDPrefixCompare        bool
+	IDPrefix               []byte
+	StrictIDPrefix         bool
+	SecureDelete           bool
+	CompressValues         bool
+	RecordReplicas         bool
+	QueuePeerlessStores    bool
+	ServeExpiredValues     bool
+	LookupLatencyBuckets   []time.Duration
+	AllowedCIDRs           []string
+	AgentName              string
+	AnchorsFile            string
 }
 
 // NewDHT initializes a new DHT node. A store and options struct must be
@@ -76,16 +833,56 @@ func NewDHT(store Store, options *Options) (*DHT, error) {
 
 	dht.options = options
 
+	if options.Rand == nil {
+		options.Rand = crand.Reader
+	}
+
+	if options.TIDGeneration == 0 {
+		options.TIDGeneration = time.Second * 5
+	}
+
 	ht, err := newHashTable(options)
 	if err != nil {
 		return nil, err
 	}
 
+	// A service name is replaced by the port it resolved to, so the socket
+	// is opened on the same port
+	options.Port = strconv.Itoa(ht.Self.Port)
+
 	dht.store = store
 	dht.ht = ht
 	dht.networking = &realNetworking{}
+	dht.negativeCache = make(map[string]time.Time)
+	dht.negativeCacheMutex = &sync.Mutex{}
+	dht.replicationStatus = make(map[string]*StoreReport)
+	dht.replicationStatusMutex = &sync.Mutex{}
+	dht.responsible = make(map[string]bool)
+	dht.responsibleMutex = &sync.Mutex{}
+	dht.peersAdded = make(chan struct{})
+	dht.peersAddedMutex = &sync.Mutex{}
+	dht.publishers = make(map[string]string)
+	dht.publisherKeys = make(map[string]int)
+	dht.publishersMutex = &sync.Mutex{}
+	dht.maintenanceMutex = &sync.Mutex{}
+	dht.stateMutex = &sync.Mutex{}
+	dht.churnMutex = &sync.Mutex{}
+	dht.anchors = make(map[string]bool)
+	dht.anchorsMutex = &sync.Mutex{}
+	dht.storeMutex = &sync.Mutex{}
+	dht.now = time.Now
+
+	for _, cidr := range options.AllowedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		dht.allowedNets = append(dht.allowedNets, ipNet)
+	}
 
 	store.Init()
+	dht.recordPublishers()
+	dht.countRemoteKeys()
 
 	if options.TExpire == 0 {
 		options.TExpire = time.Second * 86410
@@ -111,11 +908,95 @@ func NewDHT(store Store, options *Options) (*DHT, error) {
 		options.TMsgTimeout = time.Second * 2
 	}
 
+	if options.TChurnWindow == 0 {
+		options.TChurnWindow = time.Minute
+	}
+
+	if options.TRPCWindow == 0 {
+		options.TRPCWindow = time.Minute
+	}
+
+	if options.ShedDistance == 0 {
+		options.ShedDistance = b - 1
+	}
+
+	if options.SendRetries == 0 {
+		options.SendRetries = 3
+	} else if options.SendRetries < 0 {
+		options.SendRetries = 0
+	}
+
+	if options.ReplicationConcurrency <= 0 {
+		options.ReplicationConcurrency = alpha
+	}
+
+	if options.PingConcurrency <= 0 {
+		options.PingConcurrency = 1
+	}
+
+	if options.BootstrapConcurrency < 0 {
+		options.BootstrapConcurrency = 0
+	}
+
+	if options.MaxLookupRounds == 0 {
+		options.MaxLookupRounds = b
+	}
+
+	if options.TReplayWindow == 0 {
+		options.TReplayWindow = time.Minute
+	}
+
+	if options.MaxReplicationFactor == 0 {
+		options.MaxReplicationFactor = k * 2
+	}
+
+	if options.TMalformedBan == 0 {
+		options.TMalformedBan = time.Minute * 10
+	}
+
+	if options.TMalformedWindow == 0 {
+		options.TMalformedWindow = options.TMalformedBan
+	}
+
+	if options.FindValueRetryBreadth == 0 {
+		options.FindValueRetryBreadth = alpha
+	}
+
+	if len(options.LookupLatencyBuckets) == 0 {
+		options.LookupLatencyBuckets = defaultLatencyBuckets
+	}
+
+	if options.RPCBurst <= 0 {
+		options.RPCBurst = options.MaxRPCRate
+	}
+
+	if options.MaxRPCRate > 0 {
+		dht.rpcLimiter = newTokenBucket(options.MaxRPCRate, options.RPCBurst)
+	}
+
+	dht.lookupLatency = newLatencyHistogram(options.LookupLatencyBuckets)
+	dht.warmCache = newWarmCache(options.WarmCacheSize)
+	dht.storeFlights = newFlightGroup()
+	dht.labelCounts = make(map[string]*OperationCounts)
+	dht.labelCountsMutex = &sync.Mutex{}
+	dht.pendingStores = make(map[string]bool)
+	dht.pendingStoresMutex = &sync.Mutex{}
+	dht.rpcSchedule = newRPCWindow(options.TRPCWindow)
+	dht.rpcLatency = make(map[int]*latencyHistogram)
+	for t := range rpcNames {
+		dht.rpcLatency[t] = newLatencyHistogram(options.LookupLatencyBuckets)
+	}
+
 	return dht, nil
 }
 
+// getExpirationTime returns when data for key stored on the local node
+// expires. As in the Kademlia paper, the time to live is exponentially
+// inversely proportional to the number of nodes between the local node and
+// key: nodes among the k closest to key keep it for TExpire, and nodes
+// further away for exponentially less time.
 func (dht *DHT) getExpirationTime(key []byte) time.Time {
-	bucket := getBucketIndexFromDifferingBit(key, dht.ht.Self.ID)
+	bucket := dht.ht.getBucketIndex(key)
 	var total int
 	for i := 0; i < bucket; i++ {
 		total += dht.ht.getTotalNodesInBucket(i)
@@ -123,132 +1004,1201 @@ func (dht *DHT) getExpirationTime(key []byte) time.Time {
 	closer := dht.ht.getAllNodesInBucketCloserThan(bucket, key)
 	score := total + len(closer)
 
-	if score == 0 {
-		score = 1
-	}
-
-	if score > k {
+	if score <= k {
 		return time.Now().Add(dht.options.TExpire)
 	}
 
-	day := dht.options.TExpire
-	seconds := day.Nanoseconds() * int64(math.Exp(float64(k/score)))
-	dur := time.Second * time.Duration(seconds)
-	return time.Now().Add(dur)
+	ttl := float64(dht.options.TExpire) / math.Exp(float64(score-k)/float64(k))
+	return time.Now().Add(time.Duration(ttl))
 }
 
 // Store stores data on the network. This will trigger an iterateStore message.
 // The base58 encoded identifier will be returned if the store is successful.
+// If there are no known nodes to store the data to, the data is stored only
+// locally and the identifier is returned along with ErrNoPeers. If the local
+// store fails to persist the data it is still stored on the network, and the
+// identifier is returned along with an error wrapping ErrLocalStoreFailed.
 func (dht *DHT) Store(data []byte) (id string, err error) {
-	key := dht.store.GetKey(data)
-	expiration := dht.getExpirationTime(key)
-	replication := time.Now().Add(dht.options.TReplicate)
-	dht.store.Store(key, data, replication, expiration, true)
-	_, _, err = dht.iterate(iterateStore, key[:], data)
-	if err != nil {
-		return "", err
-	}
-	str := b58.Encode(key)
-	return str, nil
+	return dht.storeData(context.Background(), data, 0)
 }
 
-// Get retrieves data from the networking using key. Key is the base58 encoded
-// identifier of the data.
-func (dht *DHT) Get(key string) (data []byte, found bool, err error) {
-	keyBytes := b58.Decode(key)
-	value, exists := dht.store.Retrieve(keyBytes)
+// StoreContext stores data on the network like Store. If ctx is cancelled the
+// store returns the context's error. The iterative store stops unless another
+// store of the same data is waiting for it. If ctx carries a label added
+// by WithMetricsLabel, the store is counted against it in LabelMetrics.
+func (dht *DHT) StoreContext(ctx context.Context, data []byte) (id string, err error) {
+	return dht.storeData(ctx, data, 0)
+}
 
-	if len(keyBytes) != k {
-		return nil, false, errors.New("Invalid key")
+// StoreVerbose stores data on the network like Store, and also returns a
+// report of the nodes the data was sent to and which of them stored it, for
+// debugging where it is replicated. If the key is republished concurrently, the report may describe
+// the republish instead.
+func (dht *DHT) StoreVerbose(data []byte) (key string, report StoreReport, err error) {
+	key, err = dht.storeData(context.Background(), data, 0)
+	if key == "" {
+		return "", report, err
+	}
+	routingKey, _ := dht.routingKey(dht.store.GetKey(data))
+	dht.replicationStatusMutex.Lock()
+	if status, exists := dht.replicationStatus[string(routingKey)]; exists {
+		report = *status
 	}
+	dht.replicationStatusMutex.Unlock()
+	return key, report, err
+}
 
-	if !exists {
-		var err error
-		value, _, err = dht.iterate(iterateFindValue, keyBytes, nil)
-		if err != nil {
-			return nil, false, err
+// StoreWithReplication stores data on the network like Store, but replicates
+// it to replicas nodes rather than k, both now and each time it is
+// republished. The replication factor is persisted with the data, so the
+// store must implement ReplicationFactorStore. Factors above
+// MaxReplicationFactor are reduced to it.
+func (dht *DHT) StoreWithReplication(data []byte, replicas int) (id string, err error) {
+	if _, ok := dht.store.(ReplicationFactorStore); !ok {
+		return "", errors.New("Store does not support replication factors")
+	}
+	if replicas < 1 {
+		return "", errors.New("Replication factor must be at least 1")
+	}
+	return dht.storeData(context.Background(), data, replicas)
+}
+
+// storeData stores data locally and on the network. If replicas is not 0 it
+// is persisted as the replication factor of the data.
+func (dht *DHT) storeData(ctx context.Context, data []byte, replicas int) (id string, err error) {
+	dht.countOperation(ctx, func(c *OperationCounts) { c.Stores++ })
+	key, err := dht.routingKey(dht.store.GetKey(data))
+	if err != nil {
+		return "", err
+	}
+	var localErr error
+	overwritten, err := dht.storeValue(key, data, true)
+	if err != nil {
+		// The data is still stored on the network, so that it is not lost
+		dht.storeFailed(key, err)
+		localErr = fmt.Errorf("%w: %v", ErrLocalStoreFailed, err)
+	} else {
+		if replicas > 0 {
+			dht.setReplicationFactor(key, replicas)
 		}
-		if value != nil {
-			exists = true
+		dht.recordResponsibility(key)
+	}
+	dht.forgetNotFound(key)
+	str := b58.Encode(dht.store.GetKey(data))
+	if !dht.waitForPeers(ctx, dht.options.TStoreWaitForPeers) {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		dht.setReplicationStatus(key, &StoreReport{Termination: TerminationCandidatesFailed, Overwritten: overwritten})
+		if dht.options.QueuePeerlessStores && localErr == nil {
+			dht.queueStore(key)
 		}
+		return str, ErrNoPeers
 	}
-
-	return value, exists, nil
+	store := func(ctx context.Context) error {
+		_, _, err := dht.lookup(ctx, iterateStore, key[:], data, nil)
+		if err != nil {
+			return err
+		}
+		dht.recordReplicaSet(key)
+		return nil
+	}
+	if _, traced := ctx.Value(lookupTracerKey{}).(func(e LookupEvent)); traced {
+		// The tracer reports the lookup of this store alone
+		err = store(ctx)
+	} else {
+		// Concurrent identical stores share a single iterative store, which
+		// runs until it finishes or none of them is waiting for it
+		origin := rpcOrigin(ctx, RPCOriginStore)
+		// Data is content addressed, so its key identifies it
+		flightKey := fmt.Sprintf("%x/%d/%s", dht.store.GetKey(data), replicas, origin)
+		err = dht.storeFlights.do(ctx, flightKey, withRPCOrigin(context.Background(), origin), store)
+	}
+	if err != nil {
+		return "", err
+	}
+	if overwritten {
+		dht.reportOverwrite(key)
+	}
+	return str, localErr
 }
 
-// NumNodes returns the total number of nodes stored in the local routing table
-func (dht *DHT) NumNodes() int {
-	return dht.ht.totalNodes()
+// reportOverwrite marks the replication status of key as having overwritten
+// different data in the local store
+func (dht *DHT) reportOverwrite(key []byte) {
+	dht.replicationStatusMutex.Lock()
+	defer dht.replicationStatusMutex.Unlock()
+	if status, exists := dht.replicationStatus[string(key)]; exists {
+		status.Overwritten = true
+	}
 }
 
-// GetSelfID returns the base58 encoded identifier of the local node
-func (dht *DHT) GetSelfID() string {
-	str := b58.Encode(dht.ht.Self.ID)
-	return str
+// queueStore queues key, which was stored while the routing table was empty,
+// to be stored to the network once a node is added
+func (dht *DHT) queueStore(key []byte) {
+	dht.pendingStoresMutex.Lock()
+	defer dht.pendingStoresMutex.Unlock()
+	dht.pendingStores[string(key)] = true
 }
 
-// GetNetworkAddr returns the publicly accessible IP and Port of the local
-// node
-func (dht *DHT) GetNetworkAddr() string {
-	return dht.networking.getNetworkAddr()
+// storePending stores the data for every queued key to the network in its own
+// goroutine, and empties the queue
+func (dht *DHT) storePending() {
+	dht.pendingStoresMutex.Lock()
+	if len(dht.pendingStores) == 0 {
+		dht.pendingStoresMutex.Unlock()
+		return
+	}
+	keys := make([][]byte, 0, len(dht.pendingStores))
+	for key := range dht.pendingStores {
+		// Keys which have since expired are not stored
+		if _, exists := dht.store.Retrieve([]byte(key)); exists {
+			keys = append(keys, []byte(key))
+		}
+	}
+	dht.pendingStores = make(map[string]bool)
+	dht.pendingStoresMutex.Unlock()
+
+	go dht.replicate(withRPCOrigin(context.Background(), RPCOriginStore), keys)
 }
 
-// CreateSocket attempts to open a UDP socket on the port provided to options
-func (dht *DHT) CreateSocket() error {
-	ip := dht.options.IP
-	port := dht.options.Port
+// rejectMalformedStore records a STORE from a remote node rejected because the
+// key of its data could not be routed
+func (dht *DHT) rejectMalformedStore(from *NetworkNode, key []byte) {
+	atomic.AddInt64(&dht.malformedStores, 1)
+	dht.logf("Rejected STORE from %s with a key of %d bytes", b58.Encode(from.ID), len(key))
+	if dht.options.OnMalformedStore != nil {
+		go dht.options.OnMalformedStore(copyNetworkNode(from), key)
+	}
+}
 
-	if ip == "" {
-		ip = "0.0.0.0"
+// storeFromPeer stores the data of the STORE msg received from another node
+// in the local store. Returns true if the data is held once it returns.
+func (dht *DHT) storeFromPeer(msg *message) bool {
+	data := msg.Data.(*queryDataStore)
+	dht.addNode(newNode(msg.Sender))
+	dataKey := dht.store.GetKey(data.Data)
+	key, err := dht.routingKey(dataKey)
+	if err != nil || len(key) != len(dht.ht.Self.ID) {
+		dht.rejectMalformedStore(msg.Sender, dataKey)
+		return false
 	}
-	if port == "" {
-		port = "3000"
+	if dht.shouldShed(key) {
+		dht.logf("Rejected STORE of %s from %s as the store is near capacity", b58.Encode(key), b58.Encode(msg.Sender.ID))
+		return false
+	}
+	if dht.isOwnKey(key) {
+		// Our own value echoed back by replication. The data is content
+		// addressed so is unchanged, and keeping the local entry keeps it
+		// published and republished by us.
+		return true
+	}
+	// Only the publisher of the data is recorded, so that nodes replicating
+	// it are not counted towards MaxKeysPerPublisher
+	if data.Publishing && !dht.recordPublisher(key, msg.Sender.ID) {
+		return false
+	}
+	overwritten, err := dht.storeValue(key, data.Data, false)
+	if err != nil {
+		dht.storeFailed(key, err)
+		return false
+	}
+	if data.Publishing {
+		dht.setPublishedBy(key, msg.Sender.ID)
+	}
+	if overwritten {
+		dht.logf("Overwrote %s with different data from %s", b58.Encode(key), b58.Encode(msg.Sender.ID))
+	}
+	if data.Replicas > 0 {
+		dht.setReplicationFactor(key, data.Replicas)
+	}
+	dht.recordResponsibility(key)
+	return true
+}
+
+// storeFailed reports an error from the local store persisting key
+func (dht *DHT) storeFailed(key []byte, err error) {
+	dht.logf("Could not store %s locally: %v", b58.Encode(key), err)
+	if dht.options.OnStoreError != nil {
+		go dht.options.OnStoreError(key, err)
 	}
+}
 
-	netMsgInit()
-	dht.networking.init(dht.ht.Self)
+// Refresh stores the data for key, which must be held in the local store, to
+// the network again. If RecordReplicas is set and every node the data was
+// last stored to responds to a ping, the data is stored to them directly.
+// Otherwise a lookup is performed to find the closest nodes to store it to.
+func (dht *DHT) Refresh(key string) error {
+	keyBytes := b58.Decode(key)
+	if len(keyBytes) != k {
+		return errors.New("Invalid key")
+	}
 
-	publicHost, publicPort, err := dht.networking.createSocket(ip, port, dht.options.UseStun, dht.options.StunAddr)
+	keyBytes, err := dht.routingKey(keyBytes)
 	if err != nil {
 		return err
 	}
 
-	if dht.options.UseStun {
-		dht.ht.setSelfAddr(publicHost, publicPort)
+	data, exists := dht.store.Retrieve(keyBytes)
+	if !exists {
+		return errors.New("Key not held in local store")
 	}
+	return dht.refresh(context.Background(), keyBytes, data)
+}
 
+// refresh stores data to the recorded replica set of key if every node in it
+// is alive, and otherwise to the closest nodes found by a lookup. Its RPCs
+// are recorded against the origin carried by ctx, or as a store.
+func (dht *DHT) refresh(ctx context.Context, key []byte, data []byte) error {
+	origin := rpcOrigin(ctx, RPCOriginStore)
+	ctx = withRPCOrigin(ctx, origin)
+	replicas := dht.getReplicaSet(key)
+	if len(replicas) > 0 && dht.allAlive(ctx, replicas) {
+		dht.sendStores(ctx, origin, key, data, replicas, TerminationConverged, nil)
+		return nil
+	}
+	_, _, err := dht.lookup(ctx, iterateStore, key, data, nil)
+	if err != nil {
+		return err
+	}
+	dht.recordReplicaSet(key)
 	return nil
 }
 
-// Listen begins listening on the socket for incoming messages
-func (dht *DHT) Listen() error {
-	if !dht.networking.isInitialized() {
-		return errors.New("socket not created")
+// allAlive pings each of nodes at once, and returns true if all of them
+// respond
+func (dht *DHT) allAlive(ctx context.Context, nodes []*NetworkNode) bool {
+	var alive int64
+	wg := &sync.WaitGroup{}
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n *NetworkNode) {
+			defer wg.Done()
+			if dht.ping(ctx, n) {
+				atomic.AddInt64(&alive, 1)
+			}
+		}(n)
 	}
-	go dht.listen()
-	go dht.timers()
-	return dht.networking.listen()
+	wg.Wait()
+	return int(alive) == len(nodes)
 }
 
-// Bootstrap attempts to bootstrap the network using the BootstrapNodes provided
-// to the Options struct. This will trigger an iterativeFindNode to the provided
-// BootstrapNodes.
-func (dht *DHT) Bootstrap() error {
-	if len(dht.options.BootstrapNodes) == 0 {
+// recordReplicaSet persists the nodes which stored the data in the last store
+// of key as its replica set, if RecordReplicas is set and the store supports it
+func (dht *DHT) recordReplicaSet(key []byte) {
+	store, ok := dht.store.(ReplicaSetStore)
+	if !ok || !dht.options.RecordReplicas {
+		return
+	}
+	dht.replicationStatusMutex.Lock()
+	report := dht.replicationStatus[string(key)]
+	dht.replicationStatusMutex.Unlock()
+	if report == nil || len(report.Acked) == 0 {
+		return
+	}
+	err := store.SetReplicaSet(key, report.Acked)
+	if err != nil {
+		dht.logf("Failed to record replica set of %s: %v", b58.Encode(key), err)
+	}
+}
+
+// getReplicaSet returns the persisted replica set of key, or nil if it has
+// none or RecordReplicas is not set
+func (dht *DHT) getReplicaSet(key []byte) []*NetworkNode {
+	store, ok := dht.store.(ReplicaSetStore)
+	if !ok || !dht.options.RecordReplicas {
 		return nil
 	}
-	expectedResponses := []*expectedResponse{}
-	wg := &sync.WaitGroup{}
+	return store.GetReplicaSet(key)
+}
 
-	for _, bn := range dht.options.BootstrapNodes {
-		query := &message{}
-		query.Sender = dht.ht.Self
-		query.Receiver = bn
-		query.Type = messageTypePing
-		if bn.ID == nil {
-			res, err := dht.networking.sendMessage(query, true, -1)
-			if err != nil {
-				continue
+// routingKey applies the KeyTransform to key, returning the key under which
+// its data is stored and looked up in the network
+func (dht *DHT) routingKey(key []byte) ([]byte, error) {
+	if dht.options.KeyTransform == nil {
+		return key, nil
+	}
+	transformed := dht.options.KeyTransform(key)
+	if len(transformed) != len(dht.ht.Self.ID) {
+		return nil, ErrInvalidKeyTransform
+	}
+	return transformed, nil
+}
+
+// setReplicationFactor persists the replication factor of key, reduced to
+// MaxReplicationFactor, if the store supports it
+func (dht *DHT) setReplicationFactor(key []byte, replicas int) error {
+	store, ok := dht.store.(ReplicationFactorStore)
+	if !ok {
+		return nil
+	}
+	if replicas > dht.options.MaxReplicationFactor {
+		replicas = dht.options.MaxReplicationFactor
+	}
+	return store.SetReplicationFactor(key, replicas)
+}
+
+// getReplicationFactor returns the persisted replication factor of key, or 0
+// if it has none
+func (dht *DHT) getReplicationFactor(key []byte) int {
+	store, ok := dht.store.(ReplicationFactorStore)
+	if !ok {
+		return 0
+	}
+	return store.GetReplicationFactor(key)
+}
+
+// getReplicationLimit returns the number of nodes data for key is stored to
+func (dht *DHT) getReplicationLimit(key []byte) int {
+	replicas := dht.getReplicationFactor(key)
+	if replicas == 0 {
+		return k
+	}
+	return replicas
+}
+
+// storeValue stores a key/value pair in the local store with fresh
+// replication and expiration times. Keys are content addressed, so if the key
+// already exists with identical data only its times are refreshed and the
+// existing data is kept. Returns true if existing data for the key was
+// overwritten with different data. If publisher is set the local node is
+// recorded as the publisher of the key, and the count of keys held on behalf
+// of other nodes is updated as the key is added or changes publisher.
+func (dht *DHT) storeValue(key []byte, data []byte, publisher bool) (overwritten bool, err error) {
+	expiration := dht.getExpirationTime(key)
+	replication := time.Now().Add(dht.options.TReplicate)
+
+	dht.storeMutex.Lock()
+	defer dht.storeMutex.Unlock()
+	existing, exists := dht.store.Retrieve(key)
+	wasRemote := exists && !dht.isOwnKey(key)
+	if exists && bytes.Equal(existing, data) {
+		err = dht.store.Store(key, existing, replication, expiration, publisher)
+	} else {
+		overwritten = exists
+		err = dht.store.Store(key, data, replication, expiration, publisher)
+	}
+	if err != nil {
+		return false, err
+	}
+	if publisher {
+		dht.recordOwnKey(key)
+	}
+	if !wasRemote && !publisher {
+		atomic.AddInt64(&dht.remoteKeys, 1)
+	} else if wasRemote && publisher {
+		atomic.AddInt64(&dht.remoteKeys, -1)
+	}
+	return overwritten, nil
+}
+
+// retrieveLive returns the value of key from the local store. Unless
+// ServeExpiredValues is set, values past their expiration are treated as
+// absent.
+func (dht *DHT) retrieveLive(key []byte) (data []byte, found bool) {
+	data, found = dht.store.Retrieve(key)
+	if !found || dht.options.ServeExpiredValues {
+		return data, found
+	}
+	if store, ok := dht.store.(ExpirationStore); ok {
+		if expiration, exists := store.GetExpiration(key); exists && time.Now().After(expiration) {
+			return nil, false
+		}
+	}
+	return data, found
+}
+
+// waitForPeers waits up to timeout, or until ctx is done, for at least one
+// node to exist in the routing table. Returns false if the routing table is
+// still empty.
+func (dht *DHT) waitForPeers(ctx context.Context, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		dht.peersAddedMutex.Lock()
+		added := dht.peersAdded
+		dht.peersAddedMutex.Unlock()
+		if dht.NumNodes() > 0 {
+			return true
+		}
+		select {
+		case <-added:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// signalPeersAdded wakes the stores waiting for a node to be added to the
+// routing table
+func (dht *DHT) signalPeersAdded() {
+	dht.peersAddedMutex.Lock()
+	defer dht.peersAddedMutex.Unlock()
+	close(dht.peersAdded)
+	dht.peersAdded = make(chan struct{})
+}
+
+// Get retrieves data from the networking using key. Key is the base58 encoded
+// identifier of the data.
+func (dht *DHT) Get(key string) (data []byte, found bool, err error) {
+	data, found, _, err = dht.get(context.Background(), key, false, false)
+	return data, found, err
+}
+
+// GetContext retrieves data from the network using key in the same way as
+// Get. If ctx is cancelled the lookup stops and returns the context's error.
+// If ctx carries a label added by WithMetricsLabel, the get is counted
+// against it in LabelMetrics.
+func (dht *DHT) GetContext(ctx context.Context, key string) (data []byte, found bool, err error) {
+	data, found, _, err = dht.get(ctx, key, false, false)
+	return data, found, err
+}
+
+// ForceGet retrieves data from the network using key in the same way as Get,
+// but ignores any recent not found result recorded in the negative cache.
+func (dht *DHT) ForceGet(key string) (data []byte, found bool, err error) {
+	data, found, _, err = dht.get(context.Background(), key, true, false)
+	return data, found, err
+}
+
+// GetWithReplicas retrieves data from the network using key in the same way
+// as Get, and also returns the number of remote nodes observed holding it,
+// as a gauge of how well the data is replicated. The network is queried even
+// if the data is held locally. The lookup stops in the first round in which
+// a node returns the data, so replicas counts the nodes queried in that round
+// which hold it rather than every node in the network which does.
+func (dht *DHT) GetWithReplicas(key string) (data []byte, found bool, replicas int, err error) {
+	return dht.get(context.Background(), key, false, true)
+}
+
+// GetWithHint retrieves data from the network using key in the same way as
+// Get, but first sends a FIND_VALUE directly to hint, a node which is
+// likely to hold the value. If hint does not return the value, a full
+// iterative lookup is performed.
+func (dht *DHT) GetWithHint(key string, hint NetworkNode) (data []byte, found bool, err error) {
+	keyBytes := b58.Decode(key)
+	if len(keyBytes) != k {
+		return nil, false, errors.New("Invalid key")
+	}
+
+	keyBytes, err = dht.routingKey(keyBytes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if _, exists := dht.retrieveLive(keyBytes); !exists {
+		value := dht.findValueFromNode(context.Background(), &hint, keyBytes)
+		if value != nil {
+			dht.forgetNotFound(keyBytes)
+			return value, true, nil
+		}
+	}
+
+	data, found, _, err = dht.get(context.Background(), key, false, false)
+	return data, found, err
+}
+
+// FindNodeStream performs an iterative FIND_NODE lookup for target, sending
+// each node on the returned channel as it is discovered rather than waiting
+// for the lookup to converge. The node channel is closed once the lookup has
+// converged or ctx is cancelled, after which the error channel yields the
+// error the lookup stopped with, if any.
+func (dht *DHT) FindNodeStream(ctx context.Context, target []byte) (<-chan NetworkNode, <-chan error) {
+	nodes := make(chan NetworkNode)
+	errs := make(chan error, 1)
+
+	go func() {
+		_, _, err := dht.lookup(ctx, iterateFindNode, target, nil, func(n *NetworkNode) {
+			select {
+			case nodes <- copyNetworkNode(n):
+			case <-ctx.Done():
+			}
+		})
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			errs <- err
+		}
+		close(errs)
+		close(nodes)
+	}()
+
+	return nodes, errs
+}
+
+// FindNodeVerbose performs an iterative FIND_NODE lookup for target, and
+// returns copies of the closest nodes found along with why the lookup
+// stopped. If ctx is cancelled the lookup stops and returns the context's
+// error.
+func (dht *DHT) FindNodeVerbose(ctx context.Context, target []byte) (closest []NetworkNode, termination LookupTermination, err error) {
+	_, nodes, termination, err := dht.lookupVerbose(ctx, iterateFindNode, target, nil, nil, 0)
+	for _, n := range nodes {
+		closest = append(closest, copyNetworkNode(n))
+	}
+	return closest, termination, err
+}
+
+// FindNodeSets performs an iterative FIND_NODE lookup for target, and returns
+// up to sets disjoint groups of up to k of the closest nodes found, for
+// planning redundant storage across groups which share no nodes. The first
+// group holds the closest nodes, and each later group is progressively
+// farther from target. Fewer groups are returned if too few nodes are found.
+func (dht *DHT) FindNodeSets(target []byte, sets int) ([][]NetworkNode, error) {
+	if sets < 1 {
+		return nil, errors.New("Number of sets must be at least 1")
+	}
+
+	_, nodes, _, err := dht.lookupVerbose(context.Background(), iterateFindNode, target, nil, nil, sets*k)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nodes return the nodes closest to target, so farther groups are
+	// filled out from the local routing table
+	sl := &shortList{Nodes: nodes, Comparator: target}
+	sl.AppendClosest(dht.ht.getClosestContacts(sets*k, target, []*NetworkNode{}).Nodes, sets*k)
+	nodes = sl.Nodes
+
+	var groups [][]NetworkNode
+	for i := 0; i < len(nodes); i += k {
+		var group []NetworkNode
+		for j := i; j < i+k && j < len(nodes); j++ {
+			group = append(group, copyNetworkNode(nodes[j]))
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// findValueFromNode sends a single FIND_VALUE message for key to node, and
+// returns the value if node responds with it
+func (dht *DHT) findValueFromNode(ctx context.Context, node *NetworkNode, key []byte) []byte {
+	query := &message{}
+	query.Sender = dht.ht.Self
+	query.Receiver = node
+	query.Type = messageTypeFindValue
+	query.Data = &queryDataFindValue{Target: key, Encodings: supportedEncodings}
+
+	res, err := dht.sendQuery(ctx, RPCOriginLookup, query, true)
+	if err != nil {
+		return nil
+	}
+
+	select {
+	case result := <-res.ch:
+		if result == nil {
+			return nil
+		}
+		dht.observeResponse(res)
+		if result.Error != nil {
+			return nil
+		}
+		dht.addNode(newNode(result.Sender))
+		responseData, ok := result.Data.(*responseDataFindValue)
+		if !ok || responseData.Value == nil {
+			if ok && responseData.TooLarge {
+				dht.logf("Value %s held by %s is too large to be sent", b58.Encode(key), b58.Encode(result.Sender.ID))
+			}
+			return nil
+		}
+		value, err := decodeValue(responseData)
+		if err != nil {
+			dht.logf("Could not decode value from %s: %v", b58.Encode(result.Sender.ID), err)
+			return nil
+		}
+		return value
+	case <-time.After(dht.options.TMsgTimeout):
+		dht.networking.cancelResponse(res)
+		return nil
+	}
+}
+
+// get retrieves the data for key from the local store, or from the network if
+// it is not held locally. If remote is set the network is queried regardless,
+// and replicas is the number of nodes which returned the data.
+func (dht *DHT) get(ctx context.Context, key string, force bool, remote bool) (data []byte, found bool, replicas int, err error) {
+	dht.countOperation(ctx, func(c *OperationCounts) { c.Gets++ })
+	keyBytes := b58.Decode(key)
+	if len(keyBytes) != k {
+		return nil, false, 0, errors.New("Invalid key")
+	}
+
+	keyBytes, err = dht.routingKey(keyBytes)
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	value, exists := dht.retrieveLive(keyBytes)
+
+	if !exists && !force && dht.isRecentlyNotFound(keyBytes) {
+		return nil, false, 0, nil
+	}
+
+	if !exists || remote {
+		remoteValue, holders, err := dht.lookup(ctx, iterateFindValue, keyBytes, nil, nil)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		if remoteValue != nil {
+			value = remoteValue
+			exists = true
+			replicas = len(holders)
+			dht.forgetNotFound(keyBytes)
+		} else if !exists {
+			dht.rememberNotFound(keyBytes)
+		}
+	}
+
+	return value, exists, replicas, nil
+}
+
+// rememberNotFound records a failed lookup of key in the negative cache
+func (dht *DHT) rememberNotFound(key []byte) {
+	if dht.options.TNegativeCache == 0 {
+		return
+	}
+	dht.negativeCacheMutex.Lock()
+	defer dht.negativeCacheMutex.Unlock()
+	dht.negativeCache[string(key)] = time.Now().Add(dht.options.TNegativeCache)
+}
+
+// forgetNotFound removes key from the negative cache
+func (dht *DHT) forgetNotFound(key []byte) {
+	dht.negativeCacheMutex.Lock()
+	defer dht.negativeCacheMutex.Unlock()
+	delete(dht.negativeCache, string(key))
+}
+
+// isRecentlyNotFound returns true if a lookup for key failed within the
+// negative cache TTL
+func (dht *DHT) isRecentlyNotFound(key []byte) bool {
+	dht.negativeCacheMutex.Lock()
+	defer dht.negativeCacheMutex.Unlock()
+	expiration, exists := dht.negativeCache[string(key)]
+	if !exists {
+		return false
+	}
+	if time.Now().After(expiration) {
+		delete(dht.negativeCache, string(key))
+		return false
+	}
+	return true
+}
+
+// expireNotFound removes all entries from the negative cache whose TTL has
+// elapsed
+func (dht *DHT) expireNotFound() {
+	dht.negativeCacheMutex.Lock()
+	defer dht.negativeCacheMutex.Unlock()
+	for key, expiration := range dht.negativeCache {
+		if time.Now().After(expiration) {
+			delete(dht.negativeCache, key)
+		}
+	}
+}
+
+// ReplicationStatus returns the number of nodes targeted by the most recent
+// store or replication of key, and the number of those nodes which responded
+// that they stored it. Key is the base58 encoded identifier of the data. found is
+// false if the key has not been stored to the network by this node.
+func (dht *DHT) ReplicationStatus(key string) (targeted int, acked int, found bool) {
+	keyBytes, err := dht.routingKey(b58.Decode(key))
+	if err != nil {
+		return 0, 0, false
+	}
+	dht.replicationStatusMutex.Lock()
+	defer dht.replicationStatusMutex.Unlock()
+	status, exists := dht.replicationStatus[string(keyBytes)]
+	if !exists {
+		return 0, 0, false
+	}
+	return len(status.Targeted), len(status.Acked), true
+}
+
+func (dht *DHT) setReplicationStatus(key []byte, report *StoreReport) {
+	dht.replicationStatusMutex.Lock()
+	defer dht.replicationStatusMutex.Unlock()
+	dht.replicationStatus[string(key)] = report
+}
+
+// expireReplicationStatus removes the replication status of all keys which
+// are no longer held in the local store
+func (dht *DHT) expireReplicationStatus() {
+	dht.replicationStatusMutex.Lock()
+	keys := make([]string, 0, len(dht.replicationStatus))
+	for key := range dht.replicationStatus {
+		keys = append(keys, key)
+	}
+	dht.replicationStatusMutex.Unlock()
+
+	missing := dht.missingKeys(keys)
+	dht.replicationStatusMutex.Lock()
+	defer dht.replicationStatusMutex.Unlock()
+	for _, key := range missing {
+		delete(dht.replicationStatus, key)
+	}
+}
+
+// ExportStore writes every key/value pair held in the local store, along with
+// its replication and expiration times and publisher, to w. The result can be restored on
+// another node using ImportStore. If the store does not implement
+// EntryLister, only the keys returned by GetAllKeysForReplication are
+// written, and keys without a known expiration are written as expiring
+// TExpire from now.
+func (dht *DHT) ExportStore(w io.Writer) error {
+	entries := dht.storeEntries()
+	now := time.Now()
+	for i := range entries {
+		if entries[i].Replication.IsZero() {
+			entries[i].Replication = now.Add(dht.options.TReplicate)
+		}
+		if entries[i].Expiration.IsZero() {
+			entries[i].Expiration = now.Add(dht.options.TExpire)
+		}
+		if !entries[i].Publisher && len(entries[i].PublishedBy) == 0 {
+			entries[i].PublishedBy = dht.publishedBy(entries[i].Key)
+		}
+	}
+	enc := gob.NewEncoder(w)
+	return enc.Encode(entries)
+}
+
+// storeEntries returns the entries held in the local store. If the store does
+// not implement EntryLister, the keys returned by GetAllKeysForReplication
+// are listed instead, with whatever metadata the store's other optional
+// interfaces report. Times which are not known are left zero.
+func (dht *DHT) storeEntries() []StoreEntry {
+	if lister, ok := dht.store.(EntryLister); ok {
+		return lister.GetAllEntries()
+	}
+
+	var entries []StoreEntry
+	for _, key := range dht.store.GetAllKeysForReplication() {
+		data, found := dht.store.Retrieve(key)
+		if !found {
+			continue
+		}
+		entry := StoreEntry{
+			Key:       key,
+			Data:      data,
+			Publisher: dht.isOwnKey(key),
+			Replicas:  dht.getReplicationFactor(key),
+		}
+		if store, ok := dht.store.(ExpirationStore); ok {
+			entry.Expiration, _ = store.GetExpiration(key)
+		}
+		if store, ok := dht.store.(ReplicaSetStore); ok {
+			entry.ReplicaSet = store.GetReplicaSet(key)
+		}
+		if store, ok := dht.store.(PublisherStore); ok {
+			entry.PublishedBy = store.GetPublishedBy(key)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// ImportStore reads key/value pairs written by ExportStore from r into the
+// local store. Entries which have already expired are skipped.
+func (dht *DHT) ImportStore(r io.Reader) error {
+	var entries []StoreEntry
+	dec := gob.NewDecoder(r)
+	err := dec.Decode(&entries)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if time.Now().After(entry.Expiration) {
+			continue
+		}
+		err := dht.store.Store(entry.Key, entry.Data, entry.Replication, entry.Expiration, entry.Publisher)
+		if err != nil {
+			return err
+		}
+		if entry.Publisher {
+			dht.recordOwnKey(entry.Key)
+		} else if len(entry.PublishedBy) > 0 {
+			dht.publishersMutex.Lock()
+			dht.setPublisher(string(entry.Key), string(entry.PublishedBy))
+			dht.publishersMutex.Unlock()
+			dht.setPublishedBy(entry.Key, entry.PublishedBy)
+		}
+		if entry.Replicas > 0 {
+			err = dht.setReplicationFactor(entry.Key, entry.Replicas)
+			if err != nil {
+				return err
+			}
+		}
+		if store, ok := dht.store.(ReplicaSetStore); ok && len(entry.ReplicaSet) > 0 {
+			err = store.SetReplicaSet(entry.Key, entry.ReplicaSet)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	dht.countRemoteKeys()
+	return nil
+}
+
+// Config returns the effective configuration of the local node, including
+// any defaults applied to the Options provided to NewDHT
+func (dht *DHT) Config() EffectiveConfig {
+	return EffectiveConfig{
+		K:                      k,
+		Alpha:                  alpha,
+		IDLength:               len(dht.ht.Self.ID),
+		IP:                     dht.ht.Self.IP.String(),
+		Port:                   dht.ht.Self.Port,
+		TExpire:                dht.options.TExpire,
+		TRefresh:               dht.options.TRefresh,
+		TAnnounce:              dht.options.TAnnounce,
+		TReplicate:             dht.options.TReplicate,
+		TRepublish:             dht.options.TRepublish,
+		TPingMax:               dht.options.TPingMax,
+		TMsgTimeout:            dht.options.TMsgTimeout,
+		TNegativeCache:         dht.options.TNegativeCache,
+		TStoreWaitForPeers:     dht.options.TStoreWaitForPeers,
+		TIDGeneration:          dht.options.TIDGeneration,
+		TMalformedBan:          dht.options.TMalformedBan,
+		TMalformedWindow:       dht.options.TMalformedWindow,
+		TReplayWindow:          dht.options.TReplayWindow,
+		TDisconnectTimeout:     dht.options.TDisconnectTimeout,
+		TChurnWindow:           dht.options.TChurnWindow,
+		TRPCWindow:             dht.options.TRPCWindow,
+		TConnIdle:              dht.options.TConnIdle,
+		SendRetries:            dht.options.SendRetries,
+		ReplicationConcurrency: dht.options.ReplicationConcurrency,
+		PingConcurrency:        dht.options.PingConcurrency,
+		FindValueRetryBreadth:  dht.options.FindValueRetryBreadth,
+		MaxLookupRounds:        dht.options.MaxLookupRounds,
+		MaxCandidateAge:        dht.options.MaxCandidateAge,
+		MaxReplicationFactor:   dht.options.MaxReplicationFactor,
+		LookupStrategy:         dht.options.LookupStrategy,
+		MaxKeysPerPublisher:    dht.options.MaxKeysPerPublisher,
+		MaxStoredKeys:          dht.options.MaxStoredKeys,
+		ShedDistance:           dht.options.ShedDistance,
+		MalformedPacketLimit:   dht.options.MalformedPacketLimit,
+		MaxInboundConnections:  dht.options.MaxInboundConnections,
+		MinBootstrapSubnets:    dht.options.MinBootstrapSubnets,
+		BootstrapBucketGrace:   dht.options.BootstrapBucketGrace,
+		BootstrapConcurrency:   dht.options.BootstrapConcurrency,
+		WarmCacheSize:          dht.options.WarmCacheSize,
+		ChurnThreshold:         dht.options.ChurnThreshold,
+		IDCollisionPolicy:      dht.options.IDCollisionPolicy,
+		SourceIPPolicy:         dht.options.SourceIPPolicy,
+		MaxRPCRate:             dht.options.MaxRPCRate,
+		RPCBurst:               dht.options.RPCBurst,
+		FailRateLimitedRPCs:    dht.options.FailRateLimitedRPCs,
+		IDPrefixCompare:        dht.options.IDPrefixCompare,
+		IDPrefix:               append([]byte{}, dht.options.IDPrefix...),
+		StrictIDPrefix:         dht.options.StrictIDPrefix,
+		SecureDelete:           dht.options.SecureDelete,
+		CompressValues:         dht.options.CompressValues,
+		RecordReplicas:         dht.options.RecordReplicas,
+		QueuePeerlessStores:    dht.options.QueuePeerlessStores,
+		ServeExpiredValues:     dht.options.ServeExpiredValues,
+		LookupLatencyBuckets:   append([]time.Duration{}, dht.options.LookupLatencyBuckets...),
+		AllowedCIDRs:           append([]string{}, dht.options.AllowedCIDRs...),
+		AgentName:              dht.options.AgentName,
+		AnchorsFile:            dht.options.AnchorsFile,
+	}
+}
+
+// NumNodes returns the total number of nodes stored in the local routing table
+func (dht *DHT) NumNodes() int {
+	return dht.ht.totalNodes()
+}
+
+// Peer returns the address of the node with the given ID if it is present in
+// the local routing table. The returned NetworkNode is a copy.
+func (dht *DHT) Peer(id []byte) (NetworkNode, bool) {
+	return dht.ht.getNode(id)
+}
+
+// ForEachContact calls fn for every node in the local routing table along
+// with the index of the bucket it is stored in. fn is called on a snapshot
+// of the table taken when ForEachContact is called, so it is safe to use
+// while nodes are being added and fn may call back into the DHT.
+func (dht *DHT) ForEachContact(fn func(bucket int, n NetworkNode)) {
+	for i, bucket := range dht.ht.snapshot() {
+		for _, n := range bucket {
+			fn(i, n)
+		}
+	}
+}
+
+// BucketStats returns the number of buckets in the local routing table which
+// have been allocated, and the total number of buckets. Buckets are allocated
+// when the first node is added to them and released once they are empty.
+func (dht *DHT) BucketStats() (allocated int, total int) {
+	return dht.ht.bucketStats()
+}
+
+// PeerStats returns the information recorded about the node with the given ID
+// if it is present in the local routing table
+func (dht *DHT) PeerStats(id []byte) (PeerStats, bool) {
+	return dht.ht.getPeerStats(id)
+}
+
+// GetSelfID returns the base58 encoded identifier of the local node
+func (dht *DHT) GetSelfID() string {
+	str := b58.Encode(dht.ht.Self.ID)
+	return str
+}
+
+// GetNetworkAddr returns the publicly accessible IP and Port of the local
+// node
+func (dht *DHT) GetNetworkAddr() string {
+	return dht.networking.getNetworkAddr()
+}
+
+// SendBackpressureEvents returns the number of times sending a message had to
+// be retried because the socket send buffer was full
+func (dht *DHT) SendBackpressureEvents() int64 {
+	return dht.networking.getSendBackpressureEvents()
+}
+
+// MalformedPackets returns the number of inbound packets which were dropped
+// because they could not be decoded into a valid message
+func (dht *DHT) MalformedPackets() int64 {
+	return dht.networking.getMalformedPackets()
+}
+
+// MalformedStores returns the number of STOREs from remote nodes which were
+// rejected because the key of their data was not the same length as node IDs
+func (dht *DHT) MalformedStores() int64 {
+	return atomic.LoadInt64(&dht.malformedStores)
+}
+
+// LookupLatency returns a histogram of the time taken by completed FIND_NODE
+// and FIND_VALUE lookups
+func (dht *DHT) LookupLatency() Histogram {
+	return dht.lookupLatency.snapshot()
+}
+
+// RPCLatency returns a histogram for each RPC type, "PING", "FIND_NODE" and
+// "FIND_VALUE", of the time taken for the queries sent by the local node to
+// be answered. Queries which are not answered are not recorded. STOREs are
+// not answered, so their latency is not known.
+func (dht *DHT) RPCLatency() map[string]Histogram {
+	latency := make(map[string]Histogram)
+	for t, h := range dht.rpcLatency {
+		latency[rpcNames[t]] = h.snapshot()
+	}
+	return latency
+}
+
+// observeResponse records the time taken for the query of res to be answered
+func (dht *DHT) observeResponse(res *expectedResponse) {
+	if h := dht.rpcLatency[res.query.Type]; h != nil {
+		h.observe(time.Since(res.sent))
+	}
+}
+
+// CreateSocket attempts to open a UDP socket on the port provided to options
+func (dht *DHT) CreateSocket() error {
+	ip := dht.options.IP
+	port := dht.options.Port
+
+	if ip == "" {
+		ip = "0.0.0.0"
+	}
+	if port == "" {
+		port = "3000"
+	}
+
+	netMsgInit()
+	dht.networking.init(dht.ht.Self, dht.options)
+	dht.networking.setBanHandler(dht.removeNodesWithIP)
+
+	publicHost, publicPort, err := dht.networking.createSocket(ip, port, dht.options.UseStun, dht.options.StunAddr)
+	if err != nil {
+		return err
+	}
+
+	if dht.options.UseStun || port == "0" {
+		err = dht.ht.setSelfAddr(publicHost, publicPort)
+		if err != nil {
+			return err
+		}
+	}
+
+	dht.stateMutex.Lock()
+	dht.state = LifecycleInitializing
+	dht.started = time.Now()
+	dht.stateMutex.Unlock()
+
+	return nil
+}
+
+// Listen begins listening on the socket for incoming messages
+func (dht *DHT) Listen() error {
+	if !dht.networking.isInitialized() {
+		return errors.New("socket not created")
+	}
+	go dht.listen()
+	go dht.timers()
+	if len(dht.options.BootstrapNodes) == 0 {
+		dht.transitionState(LifecycleInitializing, LifecycleReady)
+	}
+	return dht.networking.listen()
+}
+
+// State returns the lifecycle state of the local node, and how long it has
+// been up since its socket was created. uptime is 0 if the socket has not
+// been created, or the node has disconnected.
+func (dht *DHT) State() (state Lifecycle, uptime time.Duration) {
+	dht.stateMutex.Lock()
+	defer dht.stateMutex.Unlock()
+	if !dht.started.IsZero() {
+		uptime = time.Since(dht.started)
+	}
+	return dht.state, uptime
+}
+
+// setState sets the lifecycle state of the local node, and returns its
+// previous state
+func (dht *DHT) setState(state Lifecycle) Lifecycle {
+	dht.stateMutex.Lock()
+	defer dht.stateMutex.Unlock()
+	previous := dht.state
+	dht.state = state
+	return previous
+}
+
+// transitionState sets the lifecycle state of the local node to state if it
+// is currently from
+func (dht *DHT) transitionState(from Lifecycle, state Lifecycle) {
+	dht.stateMutex.Lock()
+	defer dht.stateMutex.Unlock()
+	if dht.state == from {
+		dht.state = state
+	}
+}
+
+// Bootstrap attempts to bootstrap the network using the BootstrapNodes provided
+// to the Options struct. This will trigger an iterativeFindNode to the provided
+// BootstrapNodes.
+func (dht *DHT) Bootstrap() error {
+	return dht.BootstrapContext(context.Background())
+}
+
+// BootstrapContext bootstraps the network like Bootstrap. If ctx is cancelled
+// the pings and lookups of the bootstrap stop and the context's error is
+// returned.
+func (dht *DHT) BootstrapContext(ctx context.Context) error {
+	if len(dht.options.BootstrapNodes) == 0 && dht.options.AnchorsFile == "" {
+		dht.transitionState(LifecycleInitializing, LifecycleReady)
+		return nil
+	}
+
+	ctx = withRPCOrigin(ctx, RPCOriginMaintenance)
+	previous := dht.setState(LifecycleBootstrapping)
+	err := dht.bootstrap(ctx)
+	if err == nil {
+		err = dht.findSubnetDiversity(ctx)
+	}
+	if err != nil {
+		// A node which was ready before bootstrapping again stays ready
+		dht.transitionState(LifecycleBootstrapping, previous)
+		dht.trimBuckets()
+		return err
+	}
+	dht.transitionState(LifecycleBootstrapping, LifecycleReady)
+	dht.trimBuckets()
+	dht.bootstrapComplete()
+	return nil
+}
+
+// bucketCapacity returns the number of nodes a bucket may currently hold.
+// This is k, plus the BootstrapBucketGrace while bootstrapping.
+func (dht *DHT) bucketCapacity() int {
+	dht.stateMutex.Lock()
+	defer dht.stateMutex.Unlock()
+	if dht.state == LifecycleBootstrapping {
+		return k + dht.options.BootstrapBucketGrace
+	}
+	return k
+}
+
+// trimBuckets evicts the least recently seen nodes from each bucket holding
+// more than k nodes after bootstrapping
+func (dht *DHT) trimBuckets() {
+	if dht.options.BootstrapBucketGrace == 0 {
+		return
+	}
+	evicted := dht.ht.trimBuckets(k, dht.isAnchor)
+	for _, n := range evicted {
+		dht.nodeEvicted(n, EvictionBucketOverflow)
+	}
+	if len(evicted) > 0 {
+		dht.checkResponsibility()
+	}
+}
+
+// bootstrapComplete calls OnBootstrapComplete if this is the first bootstrap
+// to find any nodes
+func (dht *DHT) bootstrapComplete() {
+	nodes := dht.NumNodes()
+	if nodes == 0 || dht.options.OnBootstrapComplete == nil {
+		return
+	}
+	dht.stateMutex.Lock()
+	first := !dht.bootstrapped
+	dht.bootstrapped = true
+	dht.stateMutex.Unlock()
+	if first {
+		go dht.options.OnBootstrapComplete(nodes)
+	}
+}
+
+// findSubnetDiversity performs lookups of random IDs until the routing table
+// spans MinBootstrapSubnets distinct subnets, or maxDiversityLookups lookups
+// have been performed
+func (dht *DHT) findSubnetDiversity(ctx context.Context) error {
+	for i := 0; dht.ht.countSubnets() < dht.options.MinBootstrapSubnets; i++ {
+		if i >= maxDiversityLookups {
+			return ErrInsufficientSubnets
+		}
+		id := dht.ht.getRandomIDFromBucket(0)
+		_, _, err := dht.lookup(ctx, iterateFindNode, id, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bootstrap pings the BootstrapNodes and performs the lookup for Bootstrap
+func (dht *DHT) bootstrap(ctx context.Context) error {
+	expectedResponses := []*expectedResponse{}
+	wg := &sync.WaitGroup{}
+
+	nodes := dht.options.BootstrapNodes
+	anchors := make(map[*NetworkNode]bool)
+	if dht.options.AnchorsFile != "" {
+		loaded, err := readAnchors(dht.options.AnchorsFile)
+		if err != nil {
+			return err
+		}
+		for _, anchor := range loaded {
+			anchors[anchor] = true
+		}
+		nodes = append(loaded, nodes...)
+	}
+
+	for _, bn := range nodes {
+		query := &message{}
+		query.Sender = dht.ht.Self
+		query.Receiver = bn
+		query.Type = messageTypePing
+		if bn.ID == nil {
+			res, err := dht.sendQuery(ctx, RPCOriginMaintenance, query, true)
+			if err != nil {
+				continue
 			}
 			wg.Add(1)
 			expectedResponses = append(expectedResponses, res)
@@ -267,313 +2217,1538 @@ func (dht *DHT) Bootstrap() error {
 				case result := <-r.ch:
 					// If result is nil, channel was closed
 					if result != nil {
+						dht.observeResponse(r)
+						if anchors[r.node] {
+							dht.addAnchor(result.Sender.ID)
+						}
 						dht.addNode(newNode(result.Sender))
+						dht.recordPingResponse(result)
+					}
+					wg.Done()
+					return
+				case <-time.After(dht.options.TMsgTimeout):
+					dht.networking.cancelResponse(r)
+					wg.Done()
+					return
+				case <-ctx.Done():
+					dht.networking.cancelResponse(r)
+					wg.Done()
+					return
+				}
+			}(r)
+		}
+	}
+
+	wg.Wait()
+
+	if dht.NumNodes() > 0 {
+		_, _, err := dht.lookup(ctx, iterateFindNode, dht.ht.Self.ID, nil, nil)
+		if err != nil {
+			return err
+		}
+		return dht.refreshFurtherBuckets(ctx)
+	}
+
+	return nil
+}
+
+// refreshFurtherBuckets looks up a random ID in every bucket further away
+// than the closest bucket holding a node, running up to
+// BootstrapConcurrency lookups at once
+func (dht *DHT) refreshFurtherBuckets(ctx context.Context) error {
+	if dht.options.BootstrapConcurrency == 0 {
+		return nil
+	}
+
+	closest := -1
+	for i := 0; i < b; i++ {
+		if dht.ht.getTotalNodesInBucket(i) > 0 {
+			closest = i
+			break
+		}
+	}
+	if closest < 0 {
+		return nil
+	}
+
+	sem := make(chan struct{}, dht.options.BootstrapConcurrency)
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, b)
+	for i := closest + 1; i < b; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			id := dht.ht.getRandomIDFromBucket(b - i - 1)
+			_, _, err := dht.lookup(ctx, iterateFindNode, id, nil, nil)
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// AddPeer adds a node found outside of the network, for example by a local
+// discovery mechanism, to the local routing table. The node is pinged and
+// added with the ID it responds with, so that IDs advertised by discovery
+// mechanisms are not trusted. If node has an ID and the node responds with a
+// different one, it is not added.
+func (dht *DHT) AddPeer(node *NetworkNode) error {
+	if !dht.networking.isInitialized() {
+		return errors.New("socket not created")
+	}
+
+	query := &message{}
+	query.Sender = dht.ht.Self
+	query.Receiver = &NetworkNode{IP: node.IP, Port: node.Port}
+	query.Type = messageTypePing
+
+	res, err := dht.sendQuery(context.Background(), RPCOriginMaintenance, query, true)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case result := <-res.ch:
+		if result == nil {
+			return errors.New("Peer did not respond")
+		}
+		dht.observeResponse(res)
+		if node.ID != nil && !bytes.Equal(node.ID, result.Sender.ID) {
+			return errors.New("Peer responded with a different ID")
+		}
+		dht.addNode(newNode(result.Sender))
+		dht.recordPingResponse(result)
+		return nil
+	case <-time.After(dht.options.TPingMax):
+		dht.networking.cancelResponse(res)
+		return errors.New("Peer did not respond")
+	}
+}
+
+// RemovePeer removes the node with the given ID from the local routing table.
+// Returns false if the node was not in the routing table.
+func (dht *DHT) RemovePeer(id []byte) bool {
+	_, found := dht.ht.getNode(id)
+	if !found {
+		return false
+	}
+	dht.removeNode(id, EvictionRemoved)
+	return true
+}
+
+// CheckAndRepairTable pings every node in the routing table and removes those
+// which do not respond within TPingMax. Up to PingConcurrency nodes in a
+// bucket are pinged at once. Each bucket from which a node was removed is
+// then refreshed with a lookup of a random ID in that bucket in order to find
+// replacements. Returns the number of buckets repaired.
+func (dht *DHT) CheckAndRepairTable(ctx context.Context) (repaired int, err error) {
+	for i := 0; i < b; i++ {
+		var removed int64
+		sem := make(chan struct{}, dht.options.PingConcurrency)
+		wg := &sync.WaitGroup{}
+		for _, n := range dht.ht.getAllNodesInBucket(i) {
+			if ctx.Err() != nil {
+				break
+			}
+			if dht.isAnchor(n.ID) {
+				continue
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(n *NetworkNode) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if dht.ping(ctx, n) || ctx.Err() != nil {
+					return
+				}
+				if dht.recordPingTimeout() {
+					return
+				}
+				dht.removeNode(n.ID, EvictionUnresponsive)
+				atomic.AddInt64(&removed, 1)
+			}(n)
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return repaired, err
+		}
+
+		if removed > 0 {
+			id := dht.ht.getRandomIDFromBucket(b - i - 1)
+			_, _, err := dht.lookup(withRPCOrigin(ctx, RPCOriginMaintenance), iterateFindNode, id, nil, nil)
+			if err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+// ResetBucket removes every node from the bucket with the given index, for
+// example to recover from a bucket flooded by malicious nodes. Nodes in the
+// warm cache which belong in the bucket are forgotten too. If refresh is
+// true a lookup of a random ID in the bucket is then performed to repopulate
+// it from the rest of the network.
+func (dht *DHT) ResetBucket(index int, refresh bool) error {
+	return dht.ResetBucketContext(context.Background(), index, refresh)
+}
+
+// ResetBucketContext resets a bucket like ResetBucket. If ctx is cancelled
+// the lookup refreshing the bucket stops and the context's error is
+// returned.
+func (dht *DHT) ResetBucketContext(ctx context.Context, index int, refresh bool) error {
+	if index < 0 || index >= b {
+		return errors.New("Invalid bucket index")
+	}
+
+	dht.warmCache.removeMatching(func(id []byte) bool {
+		return dht.ht.getBucketIndex(id) == index
+	})
+	for _, n := range dht.ht.getAllNodesInBucket(index) {
+		dht.removeNode(n.ID, EvictionRemoved)
+	}
+
+	if !refresh {
+		return nil
+	}
+
+	id := dht.ht.getRandomIDFromBucket(b - index - 1)
+	_, _, err := dht.lookup(withRPCOrigin(ctx, RPCOriginMaintenance), iterateFindNode, id, nil, nil)
+	return err
+}
+
+// ping sends a ping to node and returns true if it responds within TPingMax
+func (dht *DHT) ping(ctx context.Context, node *NetworkNode) bool {
+	query := &message{}
+	query.Sender = dht.ht.Self
+	query.Receiver = node
+	query.Type = messageTypePing
+
+	res, err := dht.sendQuery(ctx, rpcOrigin(ctx, RPCOriginMaintenance), query, true)
+	if err != nil {
+		return false
+	}
+
+	select {
+	case result := <-res.ch:
+		if result == nil {
+			return false
+		}
+		dht.observeResponse(res)
+		dht.recordPingResponse(result)
+		return true
+	case <-time.After(dht.options.TPingMax):
+		dht.networking.cancelResponse(res)
+		return false
+	case <-ctx.Done():
+		dht.networking.cancelResponse(res)
+		return false
+	}
+}
+
+// recordPingTimeout records that a node in the routing table did not respond
+// to a ping, and returns true if the network is churning so the node should
+// not be evicted
+func (dht *DHT) recordPingTimeout() (churning bool) {
+	if dht.options.ChurnThreshold == 0 {
+		return false
+	}
+
+	dht.churnMutex.Lock()
+	defer dht.churnMutex.Unlock()
+
+	now := dht.now()
+	recent := dht.pingTimeouts[:0]
+	for _, t := range dht.pingTimeouts {
+		if now.Sub(t) < dht.options.TChurnWindow {
+			recent = append(recent, t)
+		}
+	}
+	dht.pingTimeouts = append(recent, now)
+
+	wasChurning := dht.churning
+	dht.churning = len(dht.pingTimeouts) >= dht.options.ChurnThreshold
+	if dht.churning && !wasChurning {
+		dht.logf("Detected churn with %d ping timeouts within %v, holding unresponsive nodes", len(dht.pingTimeouts), dht.options.TChurnWindow)
+	} else if !dht.churning && wasChurning {
+		dht.logf("Churn subsided, evicting unresponsive nodes")
+	}
+	return dht.churning
+}
+
+// recordPingResponse records the agent string advertised in a ping response
+// against the node which sent it
+func (dht *DHT) recordPingResponse(result *message) {
+	if responseData, ok := result.Data.(*responseDataPing); ok {
+		dht.ht.setNodeAgent(result.Sender.ID, responseData.Agent)
+	}
+}
+
+// Disconnect will trigger a disconnect from the network. All underlying sockets
+// will be closed. Background work still running after TDisconnectTimeout is
+// abandoned.
+func (dht *DHT) Disconnect() error {
+	// TODO if .CreateSocket() is called, but .Listen() is never called, we
+	// don't provide a way to close the socket
+	dht.stateMutex.Lock()
+	previous := dht.state
+	dht.state = LifecycleShuttingDown
+	dht.stateMutex.Unlock()
+
+	err := dht.networking.disconnect()
+
+	dht.stateMutex.Lock()
+	defer dht.stateMutex.Unlock()
+	if err != nil {
+		dht.state = previous
+		return err
+	}
+	dht.started = time.Time{}
+	return nil
+}
+
+// Iterate does an iterative search through the network. This can be done
+// for multiple reasons. These reasons include:
+//     iterativeStore - Used to store new information in the network.
+//     iterativeFindNode - Used to bootstrap the network.
+//     iterativeFindValue - Used to find a value among the network given a key.
+func (dht *DHT) iterate(t int, target []byte, data []byte) (value []byte, closest []*NetworkNode, err error) {
+	return dht.lookup(context.Background(), t, target, data, nil)
+}
+
+// lookup performs an iterate. If onContact is provided it is called with each
+// node the first time it is added to the shortlist. If ctx is cancelled the
+// lookup stops and returns the context's error. When a FIND_VALUE lookup finds
+// the value, closest contains the nodes which returned it in that round.
+func (dht *DHT) lookup(ctx context.Context, t int, target []byte, data []byte, onContact func(n *NetworkNode)) (value []byte, closest []*NetworkNode, err error) {
+	value, closest, _, err = dht.lookupVerbose(ctx, t, target, data, onContact, 0)
+	return value, closest, err
+}
+
+// lookupVerbose performs a lookup, and also returns why the lookup stopped. If
+// limit is not 0 the shortlist holds up to limit nodes, rather than the
+// shortlistLimit.
+func (dht *DHT) lookupVerbose(ctx context.Context, t int, target []byte, data []byte, onContact func(n *NetworkNode), limit int) (value []byte, closest []*NetworkNode, termination LookupTermination, err error) {
+	trace := dht.newLookupTrace(ctx, t)
+	trace.emit(LookupStarted, nil, 0)
+	defer func() {
+		trace.emit(LookupFinished, nil, termination)
+	}()
+
+	if t != iterateStore {
+		start := time.Now()
+		defer func() {
+			dht.lookupLatency.observe(time.Since(start))
+		}()
+	}
+
+	sl := dht.ht.getClosestContacts(alpha, target, []*NetworkNode{})
+	sl.AppendUniqueNetworkNodes(dht.warmCache.closest(alpha, target))
+	sort.Sort(sl)
+
+	// The shortlist is kept sorted, and holds only the closest nodes seen so
+	// far, so that its size is bounded however many nodes are returned
+	if limit == 0 {
+		limit = dht.shortlistLimit(t, target)
+	}
+
+	// We keep track of nodes contacted so far. We don't contact the same node
+	// twice.
+	var contacted = make(map[string]bool)
+
+	// We keep track of nodes reported to onContact so far, so that each node
+	// is only reported once
+	var reported = make(map[string]bool)
+	report := func(nodes []*NetworkNode) {
+		if onContact == nil {
+			return
+		}
+		for _, n := range nodes {
+			if !reported[string(n.ID)] {
+				reported[string(n.ID)] = true
+				onContact(n)
+			}
+		}
+	}
+
+	// According to the Kademlia white paper, after a round of FIND_NODE RPCs
+	// fails to provide a node closer than closestNode, we should send a
+	// FIND_NODE RPC to all remaining nodes in the shortlist that have not
+	// yet been contacted.
+	queryRest := false
+
+	// When an iterativeFindValue converges without finding the value, the
+	// value may still have been replicated to a node slightly further away.
+	// We then query the closest uncontacted nodes in the shortlist one at a
+	// time, up to FindValueRetryBreadth nodes.
+	retrying := false
+	retriesLeft := dht.options.FindValueRetryBreadth
+
+	// We keep a reference to the closestNode. If after performing a search
+	// we do not find a closer node, we stop searching.
+	if len(sl.Nodes) == 0 {
+		if t == iterateStore {
+			dht.setReplicationStatus(target, &StoreReport{Termination: TerminationCandidatesFailed, LookupID: trace.id})
+		}
+		return nil, nil, TerminationCandidatesFailed, nil
+	}
+
+	closestNode := sl.Nodes[0]
+
+	report(sl.Nodes)
+
+	if t == iterateFindNode {
+		bucket := dht.ht.getBucketIndex(target)
+		dht.ht.resetRefreshTimeForBucket(bucket)
+	}
+
+	removeFromShortlist := []*NetworkNode{}
+
+	// The number of closest nodes in the shortlist considered in each round
+	width := alpha
+	if dht.options.LookupStrategy == LookupBreadthFirst {
+		width = k
+	}
+
+	rounds := 0
+
+	// The round in which each node in the shortlist was first seen, used to
+	// drop nodes older than MaxCandidateAge
+	discovered := make(map[string]int)
+
+	// The number of consecutive rounds in which every node returned had
+	// already been queried. Colluding nodes may return each other in order to
+	// trap a lookup within a small cluster.
+	stalledRounds := 0
+
+	// Whether any node has responded. A lookup which converges without any
+	// responses has timed out.
+	responded := false
+	converged := func() LookupTermination {
+		if !responded {
+			return TerminationTimedOut
+		}
+		return TerminationConverged
+	}
+
+	for {
+		if rounds >= dht.options.MaxLookupRounds {
+			dht.logf("Lookup %d for %s stopped after %d rounds", trace.id, b58.Encode(target), rounds)
+			return dht.stopLookup(ctx, t, target, data, sl, TerminationMaxRounds, trace)
+		}
+		rounds++
+
+		if ctx.Err() != nil {
+			return nil, nil, TerminationCancelled, ctx.Err()
+		}
+
+		expectedResponses := []*expectedResponse{}
+		numExpectedResponses := 0
+
+		// Next we send messages to the first (closest) width nodes in the
+		// shortlist and wait for a response
+
+		for i, node := range sl.Nodes {
+			// Contact only width nodes
+			if i >= width && !queryRest && !retrying {
+				break
+			}
+
+			// Don't contact nodes already contacted
+			if contacted[string(node.ID)] == true {
+				continue
+			}
+
+			if retrying {
+				if len(expectedResponses) > 0 || retriesLeft == 0 {
+					break
+				}
+				retriesLeft--
+			}
+
+			contacted[string(node.ID)] = true
+			query := &message{}
+			query.Sender = dht.ht.Self
+			query.Receiver = node
+
+			switch t {
+			case iterateFindNode:
+				query.Type = messageTypeFindNode
+				queryData := &queryDataFindNode{}
+				queryData.Target = target
+				query.Data = queryData
+			case iterateFindValue:
+				query.Type = messageTypeFindValue
+				queryData := &queryDataFindValue{}
+				queryData.Target = target
+				queryData.Encodings = supportedEncodings
+				query.Data = queryData
+			case iterateStore:
+				query.Type = messageTypeFindNode
+				queryData := &queryDataFindNode{}
+				queryData.Target = target
+				query.Data = queryData
+			default:
+				panic("Unknown iterate type")
+			}
+
+			// Send the async queries and wait for a response
+			res, err := dht.sendQuery(ctx, trace.origin, query, true)
+			if err != nil {
+				// Node was unreachable for some reason. We will have to remove
+				// it from the shortlist, but we will keep it in our routing
+				// table in hopes that it might come back online in the future.
+				removeFromShortlist = append(removeFromShortlist, query.Receiver)
+				trace.emit(LookupQueryFailed, node, 0)
+				continue
+			}
+			trace.emit(LookupQuerySent, node, 0)
+
+			expectedResponses = append(expectedResponses, res)
+		}
+
+		for _, n := range removeFromShortlist {
+			sl.RemoveNode(n)
+		}
+
+		numExpectedResponses = len(expectedResponses)
+
+		// The channel is buffered so responses arriving after we stop waiting
+		// do not block
+		resultChan := make(chan (*message), len(expectedResponses))
+		for _, r := range expectedResponses {
+			go func(r *expectedResponse) {
+				select {
+				case result := <-r.ch:
+					if result == nil {
+						// Channel was closed
+						return
 					}
-					wg.Done()
+					dht.observeResponse(r)
+					dht.addNode(newNode(result.Sender))
+					trace.emit(LookupResponseReceived, r.node, 0)
+					resultChan <- result
 					return
 				case <-time.After(dht.options.TMsgTimeout):
 					dht.networking.cancelResponse(r)
-					wg.Done()
+					trace.emit(LookupQueryFailed, r.node, 0)
 					return
 				}
 			}(r)
 		}
+
+		var results []*message
+		if numExpectedResponses > 0 {
+		Loop:
+			for {
+				select {
+				case result := <-resultChan:
+					if result != nil {
+						results = append(results, result)
+					} else {
+						numExpectedResponses--
+					}
+					if len(results) == numExpectedResponses {
+						break Loop
+					}
+				case <-time.After(dht.options.TMsgTimeout):
+					break Loop
+				case <-ctx.Done():
+					return nil, nil, TerminationCancelled, ctx.Err()
+				}
+			}
+
+			if len(results) > 0 {
+				responded = true
+			}
+
+			var returned []*NetworkNode
+
+			// The nodes which returned the value, for FIND_VALUE lookups
+			var holders []*NetworkNode
+
+			for _, result := range results {
+				if result.Error != nil {
+					sl.RemoveNode(result.Receiver)
+					continue
+				}
+				switch t {
+				case iterateFindNode:
+					responseData := result.Data.(*responseDataFindNode)
+					sl.AppendClosest(responseData.Closest, limit)
+					returned = append(returned, responseData.Closest...)
+					report(responseData.Closest)
+				case iterateFindValue:
+					responseData := result.Data.(*responseDataFindValue)
+					// TODO When an iterativeFindValue succeeds, the initiator must
+					// store the key/value pair at the closest node seen which did
+					// not return the value.
+					if responseData.Value != nil {
+						decoded, err := decodeValue(responseData)
+						if err == nil {
+							value = decoded
+							holders = append(holders, result.Sender)
+							continue
+						}
+						dht.logf("Could not decode value from %s in lookup %d: %v", b58.Encode(result.Sender.ID), trace.id, err)
+					}
+					if responseData.TooLarge {
+						dht.logf("Value %s held by %s is too large to be sent in lookup %d", b58.Encode(target), b58.Encode(result.Sender.ID), trace.id)
+					}
+					sl.AppendClosest(responseData.Closest, limit)
+					returned = append(returned, responseData.Closest...)
+				case iterateStore:
+					responseData := result.Data.(*responseDataFindNode)
+					sl.AppendClosest(responseData.Closest, limit)
+					returned = append(returned, responseData.Closest...)
+				}
+			}
+
+			if value != nil {
+				return value, holders, TerminationConverged, nil
+			}
+
+			if hasUncontacted(returned, contacted) {
+				stalledRounds = 0
+			} else if len(returned) > 0 {
+				stalledRounds++
+			}
+		}
+
+		if !queryRest && len(sl.Nodes) == 0 {
+			if t == iterateStore {
+				dht.setReplicationStatus(target, &StoreReport{Termination: TerminationCandidatesFailed, LookupID: trace.id})
+			}
+			return nil, nil, TerminationCandidatesFailed, nil
+		}
+
+		if stalledRounds >= maxStalledRounds {
+			dht.logf("Lookup %d for %s stopped after %d rounds returning only nodes already queried", trace.id, b58.Encode(target), stalledRounds)
+			return dht.stopLookup(ctx, t, target, data, sl, TerminationLoopDetected, trace)
+		}
+
+		if dht.options.MaxCandidateAge > 0 {
+			keep := k
+			if t == iterateStore {
+				keep = dht.getReplicationLimit(target)
+			}
+			dht.pruneCandidates(sl, discovered, rounds, keep)
+		}
+
+		// If closestNode is unchanged then we are done
+		if sl.Nodes[0].Equal(*closestNode) || queryRest {
+			// We are done
+			switch t {
+			case iterateFindNode:
+				if !queryRest {
+					queryRest = true
+					continue
+				}
+				return nil, sl.Nodes, converged(), nil
+			case iterateFindValue:
+				if retriesLeft > 0 && hasUncontacted(sl.Nodes, contacted) {
+					retrying = true
+					continue
+				}
+				return nil, sl.Nodes, converged(), nil
+			case iterateStore:
+				// Data with a replication factor above k needs more nodes
+				// than the closest nodes usually return
+				if len(sl.Nodes) < dht.getReplicationLimit(target) && hasUncontacted(sl.Nodes, contacted) {
+					queryRest = true
+					continue
+				}
+				termination := converged()
+				dht.sendStores(ctx, trace.origin, target, data, sl.Nodes, termination, trace)
+				return nil, nil, termination, nil
+			}
+		} else {
+			closestNode = sl.Nodes[0]
+		}
+	}
+}
+
+// pruneCandidates removes the nodes in the sorted shortlist beyond the
+// closest keep which were first seen at least MaxCandidateAge rounds before
+// round. Nodes not yet in discovered are recorded as seen in round.
+func (dht *DHT) pruneCandidates(sl *shortList, discovered map[string]int, round int, keep int) {
+	nodes := sl.Nodes[:0]
+	for i, n := range sl.Nodes {
+		seen, known := discovered[string(n.ID)]
+		if !known {
+			seen = round
+			discovered[string(n.ID)] = round
+		}
+		if i < keep || round-seen < dht.options.MaxCandidateAge {
+			nodes = append(nodes, n)
+		}
+	}
+	sl.Nodes = nodes
+}
+
+// shortlistLimit returns the number of nodes kept in the shortlist of a
+// lookup. This is shortlistSize, or more if a store is replicated to more
+// nodes or a FIND_VALUE lookup queries more nodes one at a time after
+// converging.
+func (dht *DHT) shortlistLimit(t int, target []byte) int {
+	limit := shortlistSize
+	switch t {
+	case iterateStore:
+		if replicas := dht.getReplicationLimit(target); replicas > limit {
+			limit = replicas
+		}
+	case iterateFindValue:
+		if retries := k + dht.options.FindValueRetryBreadth; retries > limit {
+			limit = retries
+		}
+	}
+	return limit
+}
+
+// stopLookup ends a lookup before it has converged for the given reason,
+// returning the closest nodes found so far. For stores, the data is stored to
+// those nodes.
+func (dht *DHT) stopLookup(ctx context.Context, t int, target []byte, data []byte, sl *shortList, reason LookupTermination, trace *lookupTrace) (value []byte, closest []*NetworkNode, termination LookupTermination, err error) {
+	sort.Sort(sl)
+	if t == iterateStore {
+		dht.sendStores(ctx, trace.origin, target, data, sl.Nodes, reason, trace)
+		return nil, nil, reason, nil
+	}
+	return nil, sl.Nodes, reason, nil
+}
+
+// resolveIDCollision applies the IDCollisionPolicy to node, which has the
+// same ID as existing but a different address
+func (dht *DHT) resolveIDCollision(existing *NetworkNode, node *node) {
+	switch dht.options.IDCollisionPolicy {
+	case IDCollisionPing:
+		if dht.ping(context.Background(), existing) {
+			dht.ht.markNodeAsSeen(existing.ID)
+			return
+		}
+		if dht.ping(context.Background(), node.NetworkNode) {
+			dht.ht.replaceNode(node)
+			dht.ht.markNodeAsSeen(node.ID)
+			dht.nodeEvicted(*existing, EvictionReplaced)
+		}
+	case IDCollisionUpdateAddress:
+		dht.ht.replaceNode(node)
+		dht.ht.markNodeAsSeen(node.ID)
+	case IDCollisionVerifyAddress:
+		if dht.ping(context.Background(), node.NetworkNode) {
+			dht.ht.replaceNode(node)
+			dht.ht.markNodeAsSeen(node.ID)
+		}
+	}
+}
+
+// sendStores sends a STORE message for data to the first k nodes, or to as
+// many nodes as the replication factor of key, and waits for each to respond.
+// Nodes which do not store the data are replaced by the next of nodes. The
+// replication status of key is recorded along with why the lookup for nodes
+// stopped. The STOREs are reported to trace, which is nil if the nodes were
+// not found by a lookup.
+func (dht *DHT) sendStores(ctx context.Context, origin string, key []byte, data []byte, nodes []*NetworkNode, termination LookupTermination, trace *lookupTrace) {
+	replicas := dht.getReplicationFactor(key)
+	needed := dht.getReplicationLimit(key)
+	publishing := dht.isOwnKey(key)
+
+	report := &StoreReport{Termination: termination}
+	if trace != nil {
+		report.LookupID = trace.id
+	}
+	for next := 0; needed > 0 && next < len(nodes) && ctx.Err() == nil; {
+		end := next + needed
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		needed -= dht.storeToNodes(ctx, origin, data, replicas, publishing, nodes[next:end], report, trace)
+		next = end
 	}
+	dht.setReplicationStatus(key, report)
+}
+
+// storeToNodes sends a STORE message for data to each of nodes at once, and
+// waits for them to respond. Publishing is set if the local node published
+// the data. Each node is recorded in report, and the number of nodes which
+// stored the data is returned.
+func (dht *DHT) storeToNodes(ctx context.Context, origin string, data []byte, replicas int, publishing bool, nodes []*NetworkNode, report *StoreReport, trace *lookupTrace) int {
+	stored := make([]bool, len(nodes))
+	wg := &sync.WaitGroup{}
+	for i, n := range nodes {
+		query := &message{}
+		query.Receiver = n
+		query.Sender = dht.ht.Self
+		query.Type = messageTypeStore
+		queryData := &queryDataStore{}
+		queryData.Data = data
+		queryData.Replicas = replicas
+		queryData.Publishing = publishing
+		query.Data = queryData
+		report.Targeted = append(report.Targeted, n)
+		res, err := dht.sendQuery(ctx, origin, query, true)
+		if err != nil {
+			trace.emit(LookupQueryFailed, n, 0)
+			continue
+		}
+		trace.emit(LookupQuerySent, n, 0)
 
+		wg.Add(1)
+		go func(i int, res *expectedResponse) {
+			defer wg.Done()
+			stored[i] = dht.waitForStore(ctx, res, trace)
+		}(i, res)
+	}
 	wg.Wait()
 
-	if dht.NumNodes() > 0 {
-		_, _, err := dht.iterate(iterateFindNode, dht.ht.Self.ID, nil)
-		return err
+	acked := 0
+	for i, n := range nodes {
+		if stored[i] {
+			report.Acked = append(report.Acked, n)
+			acked++
+		} else {
+			report.Failed = append(report.Failed, n)
+		}
 	}
+	return acked
+}
 
-	return nil
+// waitForStore waits up to TMsgTimeout for the response to a STORE, and
+// returns true if the node responded that it stored the data
+func (dht *DHT) waitForStore(ctx context.Context, res *expectedResponse, trace *lookupTrace) bool {
+	select {
+	case result := <-res.ch:
+		if result == nil {
+			return false
+		}
+		dht.observeResponse(res)
+		response, ok := result.Data.(*responseDataStore)
+		if !ok || !response.Success {
+			trace.emit(LookupQueryFailed, res.node, 0)
+			return false
+		}
+		trace.emit(LookupResponseReceived, res.node, 0)
+		return true
+	case <-time.After(dht.options.TMsgTimeout):
+		dht.networking.cancelResponse(res)
+	case <-ctx.Done():
+		dht.networking.cancelResponse(res)
+	}
+	trace.emit(LookupQueryFailed, res.node, 0)
+	return false
 }
 
-// Disconnect will trigger a disconnect from the network. All underlying sockets
-// will be closed.
-func (dht *DHT) Disconnect() error {
-	// TODO if .CreateSocket() is called, but .Listen() is never called, we
-	// don't provide a way to close the socket
-	return dht.networking.disconnect()
+// sendQuery sends an RPC to another node, once the MaxRPCRate allows it. If
+// ctx is done while waiting the context's error is returned. The RPC is
+// recorded in the RPCSchedule against origin.
+func (dht *DHT) sendQuery(ctx context.Context, origin string, query *message, expectResponse bool) (*expectedResponse, error) {
+	if dht.rpcLimiter != nil {
+		if dht.options.FailRateLimitedRPCs {
+			if !dht.rpcLimiter.take() {
+				return nil, ErrRateLimited
+			}
+		} else if err := dht.rpcLimiter.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return dht.sendRPC(origin, query, expectResponse)
 }
 
-// Iterate does an iterative search through the network. This can be done
-// for multiple reasons. These reasons include:
-//     iterativeStore - Used to store new information in the network.
-//     iterativeFindNode - Used to bootstrap the network.
-//     iterativeFindValue - Used to find a value among the network given a key.
-func (dht *DHT) iterate(t int, target []byte, data []byte) (value []byte, closest []*NetworkNode, err error) {
-	sl := dht.ht.getClosestContacts(alpha, target, []*NetworkNode{})
+// trySendQuery sends an RPC to another node if the MaxRPCRate allows it to be
+// sent now, and fails with ErrRateLimited otherwise. It is used where
+// waiting would hold up the handling of messages from other nodes.
+func (dht *DHT) trySendQuery(origin string, query *message, expectResponse bool) (*expectedResponse, error) {
+	if dht.rpcLimiter != nil && !dht.rpcLimiter.take() {
+		return nil, ErrRateLimited
+	}
+	return dht.sendRPC(origin, query, expectResponse)
+}
 
-	// We keep track of nodes contacted so far. We don't contact the same node
-	// twice.
-	var contacted = make(map[string]bool)
+// sendRPC sends an RPC to another node regardless of the MaxRPCRate, and
+// records it in the RPCSchedule against origin
+func (dht *DHT) sendRPC(origin string, query *message, expectResponse bool) (*expectedResponse, error) {
+	res, err := dht.networking.sendMessage(query, expectResponse, -1)
+	if err == nil {
+		dht.rpcSchedule.record(dht.now(), origin, query.Type)
+	}
+	return res, err
+}
 
-	// According to the Kademlia white paper, after a round of FIND_NODE RPCs
-	// fails to provide a node closer than closestNode, we should send a
-	// FIND_NODE RPC to all remaining nodes in the shortlist that have not
-	// yet been contacted.
-	queryRest := false
+// logf logs to the Logger provided in the options, or to the standard logger
+// if none was provided
+func (dht *DHT) logf(format string, v ...interface{}) {
+	logf(&dht.options.Logger, format, v...)
+}
+
+// logf logs to logger, or to the standard logger if logger has no output
+func logf(logger *log.Logger, format string, v ...interface{}) {
+	if logger.Writer() == nil {
+		log.Printf(format, v...)
+		return
+	}
+	logger.Printf(format, v...)
+}
+
+// hasUncontacted returns true if any of nodes are not in contacted
+func hasUncontacted(nodes []*NetworkNode, contacted map[string]bool) bool {
+	for _, n := range nodes {
+		if !contacted[string(n.ID)] {
+			return true
+		}
+	}
+	return false
+}
+
+// addNode adds a node into the appropriate k bucket
+// we store these buckets in big-endian order so we look at the bits
+// from right to left in order to find the appropriate bucket
+func (dht *DHT) addNode(node *node) {
+	if !dht.isAllowedIP(node.IP) || !dht.isAllowedID(node.ID) {
+		return
+	}
+
+	index := dht.ht.getBucketIndex(node.ID)
+
+	// Make sure node doesn't already exist
+	// If it does, mark it as seen
+	if dht.ht.doesNodeExistInBucket(index, node.ID) {
+		existing, _ := dht.ht.getNode(node.ID)
+		if areNodesEqual(&existing, node.NetworkNode, false) {
+			dht.ht.markNodeAsSeen(node.ID)
+		} else {
+			dht.resolveIDCollision(&existing, node)
+		}
+		return
+	}
+
+	if dht.options.AdmissionFilter != nil && !dht.options.AdmissionFilter(copyNetworkNode(node.NetworkNode)) {
+		return
+	}
+
+	// Evicting a node may make us responsible for keys we were not
+	// responsible for before. This runs after the routing table is unlocked.
+	// Nodes which could not be added are kept in the warm cache instead.
+	// A bucket gaining its first node is reported once the routing table is
+	// unlocked too.
+	var evicted *NetworkNode
+	reason := EvictionBucketOverflow
+	added := false
+	populated := false
+	defer func() {
+		if added {
+			dht.warmCache.remove(node.ID)
+			dht.storePending()
+		} else {
+			dht.warmCache.add(copyNetworkNode(node.NetworkNode))
+		}
+		if populated {
+			dht.signalPeersAdded()
+			dht.bucketStateChanged(index, true)
+		}
+		if evicted != nil {
+			dht.nodeEvicted(*evicted, reason)
+			dht.checkResponsibility()
+		}
+	}()
+
+	capacity := dht.bucketCapacity()
+	dht.ht.mutex.Lock()
+	bucket := dht.ht.RoutingTable[index]
+	if len(bucket) < capacity {
+		dht.ht.RoutingTable[index] = append(bucket, node)
+		dht.ht.mutex.Unlock()
+		added = true
+		populated = len(bucket) == 0
+		return
+	}
+
+	// If the bucket is full we need to ping the first node to find out
+	// if it responds back in a reasonable amount of time. If not -
+	// we may remove it. The routing table is not held while waiting, so
+	// that lookups are not blocked by the ping. Anchors are never removed.
+	var n *NetworkNode
+	for _, v := range bucket {
+		if !dht.isAnchor(v.ID) {
+			n = v.NetworkNode
+			break
+		}
+	}
+	if n == nil {
+		dht.ht.mutex.Unlock()
+		return
+	}
+	oldest := copyNetworkNode(n)
+	dht.ht.mutex.Unlock()
+
+	query := &message{}
+	query.Receiver = n
+	query.Sender = dht.ht.Self
+	query.Type = messageTypePing
+	// Waiting for the MaxRPCRate would hold up the handling of messages, so
+	// if the ping cannot be sent now the oldest node is kept
+	res, err := dht.trySendQuery(RPCOriginMaintenance, query, true)
+	if err == ErrRateLimited {
+		return
+	}
+	if err == nil {
+		select {
+		case result := <-res.ch:
+			if result != nil {
+				dht.observeResponse(res)
+			}
+			return
+		case <-time.After(dht.options.TPingMax):
+			if dht.recordPingTimeout() {
+				// The oldest node is likely to come back
+				return
+			}
+			reason = EvictionUnresponsive
+		}
+	}
+
+	dht.ht.mutex.Lock()
+	defer dht.ht.mutex.Unlock()
+
+	// The bucket may have changed while the oldest node was pinged
+	bucket = dht.ht.RoutingTable[index]
+	position := -1
+	for i, v := range bucket {
+		if dht.ht.hasID(v, node.ID, node.idPrefix) {
+			added = true
+			return
+		}
+		if position == -1 && dht.ht.hasID(v, oldest.ID, getIDPrefix(oldest.ID)) {
+			position = i
+		}
+	}
+	if position == -1 {
+		if len(bucket) < capacity {
+			dht.ht.RoutingTable[index] = append(bucket, node)
+			added = true
+			populated = len(bucket) == 0
+		}
+		return
+	}
+	bucket = append(bucket[:position:position], bucket[position+1:]...)
+	dht.ht.RoutingTable[index] = append(bucket, node)
+	added = true
+	evicted = &oldest
+}
+
+// removeNode removes the node with the given ID from the routing table for
+// the given reason
+func (dht *DHT) removeNode(id []byte, reason EvictionReason) {
+	n, removed, emptied := dht.ht.removeNode(id)
+	if removed {
+		dht.forgetAnchor(id)
+		dht.nodeEvicted(n, reason)
+		if emptied {
+			dht.bucketStateChanged(dht.ht.getBucketIndex(id), false)
+		}
+		if reason == EvictionUnresponsive {
+			dht.replaceFromWarmCache(id)
+		}
+	}
+	dht.checkResponsibility()
+}
+
+// bucketStateChanged calls the OnBucketStateChange callback, if one was
+// provided
+func (dht *DHT) bucketStateChanged(index int, nowPopulated bool) {
+	if dht.options.OnBucketStateChange != nil {
+		go dht.options.OnBucketStateChange(index, nowPopulated)
+	}
+}
+
+// replaceFromWarmCache adds the most recently seen node in the warm cache
+// which belongs in the same bucket as id to the routing table
+func (dht *DHT) replaceFromWarmCache(id []byte) {
+	index := dht.ht.getBucketIndex(id)
+	n, found := dht.warmCache.take(func(cached []byte) bool {
+		return dht.ht.getBucketIndex(cached) == index
+	})
+	if found {
+		dht.addNode(newNode(&n))
+	}
+}
+
+// removeNodesWithIP removes every node with the given IP from the routing
+// table. It is called when the IP is banned.
+func (dht *DHT) removeNodesWithIP(ip string) {
+	for _, bucket := range dht.ht.snapshot() {
+		for _, n := range bucket {
+			if n.IP.String() == ip {
+				dht.removeNode(n.ID, EvictionBanned)
+			}
+		}
+	}
+}
+
+// nodeEvicted calls the OnNodeEvicted callback, if one was provided
+func (dht *DHT) nodeEvicted(n NetworkNode, reason EvictionReason) {
+	if dht.options.OnNodeEvicted != nil {
+		go dht.options.OnNodeEvicted(n, reason)
+	}
+}
+
+// isResponsibleFor returns true if fewer than k nodes in the routing table
+// are closer to key than the local node
+func (dht *DHT) isResponsibleFor(key []byte) bool {
+	selfDistance := getDistance(dht.ht.Self.ID, key)
+	closest := dht.ht.getClosestContacts(k, key, []*NetworkNode{})
+	closer := 0
+	for _, n := range closest.Nodes {
+		if getDistance(n.ID, key).Cmp(selfDistance) == -1 {
+			closer++
+		}
+	}
+	return closer < k
+}
+
+// recordResponsibility records whether the local node is currently
+// responsible for key, without firing OnBecameResponsible
+func (dht *DHT) recordResponsibility(key []byte) {
+	if dht.options.OnBecameResponsible == nil {
+		return
+	}
+	responsible := dht.isResponsibleFor(key)
+	dht.responsibleMutex.Lock()
+	defer dht.responsibleMutex.Unlock()
+	dht.responsible[string(key)] = responsible
+}
+
+// checkResponsibility re-evaluates whether the local node is responsible for
+// each key in the local store, and fires OnBecameResponsible for each key
+// the local node was not previously responsible for
+func (dht *DHT) checkResponsibility() {
+	if dht.options.OnBecameResponsible == nil {
+		return
+	}
+
+	// The store and routing table are read before locking, so that neither
+	// is held up by the other
+	current := make(map[string]bool)
+	for _, entry := range dht.storeEntries() {
+		current[string(entry.Key)] = dht.isResponsibleFor(entry.Key)
+	}
+
+	var became [][]byte
+	dht.responsibleMutex.Lock()
+	for key, responsible := range current {
+		previous, known := dht.responsible[key]
+		if known && !previous && responsible {
+			became = append(became, []byte(key))
+		}
+	}
+	dht.responsible = current
+	dht.responsibleMutex.Unlock()
 
-	// We keep a reference to the closestNode. If after performing a search
-	// we do not find a closer node, we stop searching.
-	if len(sl.Nodes) == 0 {
-		return nil, nil, nil
+	for _, key := range became {
+		go dht.options.OnBecameResponsible(key)
 	}
+}
 
-	closestNode := sl.Nodes[0]
+// recordPublisher records publisher as the node which published key. Returns
+// false if publisher has already published MaxKeysPerPublisher other keys, in
+// which case the store should be rejected.
+func (dht *DHT) recordPublisher(key []byte, publisher []byte) bool {
+	dht.publishersMutex.Lock()
+	defer dht.publishersMutex.Unlock()
 
-	if t == iterateFindNode {
-		bucket := getBucketIndexFromDifferingBit(target, dht.ht.Self.ID)
-		dht.ht.resetRefreshTimeForBucket(bucket)
+	if dht.publishers[string(key)] == string(publisher) {
+		return true
+	}
+	if dht.options.MaxKeysPerPublisher > 0 && dht.publisherKeys[string(publisher)] >= dht.options.MaxKeysPerPublisher {
+		return false
 	}
+	dht.setPublisher(string(key), string(publisher))
+	return true
+}
 
-	removeFromShortlist := []*NetworkNode{}
+// recordOwnKey records the local node as the publisher of key. Keys published
+// by the local node do not count towards MaxKeysPerPublisher.
+func (dht *DHT) recordOwnKey(key []byte) {
+	dht.publishersMutex.Lock()
+	defer dht.publishersMutex.Unlock()
+	dht.setPublisher(string(key), string(dht.ht.Self.ID))
+}
 
-	for {
-		expectedResponses := []*expectedResponse{}
-		numExpectedResponses := 0
+// setPublisher records publisher as the publisher of key, and updates the
+// count of keys of its previous publisher. Must be called with the
+// publishersMutex held.
+func (dht *DHT) setPublisher(key string, publisher string) {
+	dht.deletePublisher(key)
+	dht.publishers[key] = publisher
+	if publisher != string(dht.ht.Self.ID) {
+		dht.publisherKeys[publisher]++
+	}
+}
 
-		// Next we send messages to the first (closest) alpha nodes in the
-		// shortlist and wait for a response
+// deletePublisher forgets the publisher of key. Must be called with the
+// publishersMutex held.
+func (dht *DHT) deletePublisher(key string) {
+	previous, exists := dht.publishers[key]
+	if !exists {
+		return
+	}
+	delete(dht.publishers, key)
+	if previous == string(dht.ht.Self.ID) {
+		return
+	}
+	dht.publisherKeys[previous]--
+	if dht.publisherKeys[previous] == 0 {
+		delete(dht.publisherKeys, previous)
+	}
+}
 
-		for i, node := range sl.Nodes {
-			// Contact only alpha nodes
-			if i >= alpha && !queryRest {
-				break
-			}
+// setPublishedBy persists publisher as the node which published key, if the
+// store supports it
+func (dht *DHT) setPublishedBy(key []byte, publisher []byte) {
+	store, ok := dht.store.(PublisherStore)
+	if !ok {
+		return
+	}
+	err := store.SetPublishedBy(key, publisher)
+	if err != nil {
+		dht.logf("Failed to record the publisher of %s: %v", b58.Encode(key), err)
+	}
+}
 
-			// Don't contact nodes already contacted
-			if contacted[string(node.ID)] == true {
-				continue
-			}
+// publishedBy returns the ID of the other node which published key, or nil if
+// it is not known or key was published by the local node
+func (dht *DHT) publishedBy(key []byte) []byte {
+	dht.publishersMutex.Lock()
+	defer dht.publishersMutex.Unlock()
+	publisher, exists := dht.publishers[string(key)]
+	if !exists || publisher == string(dht.ht.Self.ID) {
+		return nil
+	}
+	return []byte(publisher)
+}
 
-			contacted[string(node.ID)] = true
-			query := &message{}
-			query.Sender = dht.ht.Self
-			query.Receiver = node
+// isOwnKey returns true if the local node is the publisher of key
+func (dht *DHT) isOwnKey(key []byte) bool {
+	dht.publishersMutex.Lock()
+	defer dht.publishersMutex.Unlock()
+	return dht.publishers[string(key)] == string(dht.ht.Self.ID)
+}
 
-			switch t {
-			case iterateFindNode:
-				query.Type = messageTypeFindNode
-				queryData := &queryDataFindNode{}
-				queryData.Target = target
-				query.Data = queryData
-			case iterateFindValue:
-				query.Type = messageTypeFindValue
-				queryData := &queryDataFindValue{}
-				queryData.Target = target
-				query.Data = queryData
-			case iterateStore:
-				query.Type = messageTypeFindNode
-				queryData := &queryDataFindNode{}
-				queryData.Target = target
-				query.Data = queryData
-			default:
-				panic("Unknown iterate type")
-			}
+// expirePublishers removes the publisher of all keys which are no longer
+// held in the local store
+func (dht *DHT) expirePublishers() {
+	dht.publishersMutex.Lock()
+	keys := make([]string, 0, len(dht.publishers))
+	for key := range dht.publishers {
+		keys = append(keys, key)
+	}
+	dht.publishersMutex.Unlock()
 
-			// Send the async queries and wait for a response
-			res, err := dht.networking.sendMessage(query, true, -1)
-			if err != nil {
-				// Node was unreachable for some reason. We will have to remove
-				// it from the shortlist, but we will keep it in our routing
-				// table in hopes that it might come back online in the future.
-				removeFromShortlist = append(removeFromShortlist, query.Receiver)
-				continue
-			}
+	missing := dht.missingKeys(keys)
+	dht.publishersMutex.Lock()
+	defer dht.publishersMutex.Unlock()
+	for _, key := range missing {
+		dht.deletePublisher(key)
+	}
+}
 
-			expectedResponses = append(expectedResponses, res)
+// missingKeys returns the keys which are not held in the local store. It is
+// used to expire state kept alongside the store without holding the state's
+// mutex while the store is read.
+func (dht *DHT) missingKeys(keys []string) []string {
+	var missing []string
+	for _, key := range keys {
+		if _, exists := dht.store.Retrieve([]byte(key)); !exists {
+			missing = append(missing, key)
 		}
+	}
+	return missing
+}
 
-		for _, n := range removeFromShortlist {
-			sl.RemoveNode(n)
+// isAllowedIP returns true if ip is within one of the AllowedCIDRs, or if no
+// AllowedCIDRs were provided
+func (dht *DHT) isAllowedIP(ip net.IP) bool {
+	if len(dht.allowedNets) == 0 {
+		return true
+	}
+	for _, ipNet := range dht.allowedNets {
+		if ipNet.Contains(ip) {
+			return true
 		}
+	}
+	return false
+}
 
-		numExpectedResponses = len(expectedResponses)
+// isAllowedID returns true if id begins with the IDPrefix, or if
+// StrictIDPrefix is not set
+func (dht *DHT) isAllowedID(id []byte) bool {
+	return !dht.options.StrictIDPrefix || bytes.HasPrefix(id, dht.options.IDPrefix)
+}
 
-		resultChan := make(chan (*message))
-		for _, r := range expectedResponses {
-			go func(r *expectedResponse) {
-				select {
-				case result := <-r.ch:
-					if result == nil {
-						// Channel was closed
-						return
-					}
-					dht.addNode(newNode(result.Sender))
-					resultChan <- result
-					return
-				case <-time.After(dht.options.TMsgTimeout):
-					dht.networking.cancelResponse(r)
-					return
-				}
-			}(r)
-		}
+// PauseMaintenance suspends all background maintenance, including bucket
+// refreshes, replication and expiration, without disconnecting. The node
+// continues to respond to messages while maintenance is paused.
+func (dht *DHT) PauseMaintenance() {
+	dht.maintenanceMutex.Lock()
+	defer dht.maintenanceMutex.Unlock()
+	dht.maintenancePaused = true
+}
 
-		var results []*message
-		if numExpectedResponses > 0 {
-		Loop:
-			for {
-				select {
-				case result := <-resultChan:
-					if result != nil {
-						results = append(results, result)
-					} else {
-						numExpectedResponses--
-					}
-					if len(results) == numExpectedResponses {
-						close(resultChan)
-						break Loop
-					}
-				case <-time.After(dht.options.TMsgTimeout):
-					close(resultChan)
-					break Loop
-				}
-			}
+// ResumeMaintenance resumes background maintenance suspended by
+// PauseMaintenance
+func (dht *DHT) ResumeMaintenance() {
+	dht.maintenanceMutex.Lock()
+	defer dht.maintenanceMutex.Unlock()
+	dht.maintenancePaused = false
+}
 
-			for _, result := range results {
-				if result.Error != nil {
-					sl.RemoveNode(result.Receiver)
-					continue
-				}
-				switch t {
-				case iterateFindNode:
-					responseData := result.Data.(*responseDataFindNode)
-					sl.AppendUniqueNetworkNodes(responseData.Closest)
-				case iterateFindValue:
-					responseData := result.Data.(*responseDataFindValue)
-					// TODO When an iterativeFindValue succeeds, the initiator must
-					// store the key/value pair at the closest node seen which did
-					// not return the value.
-					if responseData.Value != nil {
-						return responseData.Value, nil, nil
-					}
-					sl.AppendUniqueNetworkNodes(responseData.Closest)
-				case iterateStore:
-					responseData := result.Data.(*responseDataFindNode)
-					sl.AppendUniqueNetworkNodes(responseData.Closest)
-				}
-			}
+func (dht *DHT) isMaintenancePaused() bool {
+	dht.maintenanceMutex.Lock()
+	defer dht.maintenanceMutex.Unlock()
+	return dht.maintenancePaused
+}
+
+func (dht *DHT) timers() {
+	t := time.NewTicker(time.Second)
+	for {
+		select {
+		case <-t.C:
+			dht.tick()
+		case <-dht.networking.getDisconnect():
+			t.Stop()
+			dht.networking.timersFin()
+			return
 		}
+	}
+}
 
-		if !queryRest && len(sl.Nodes) == 0 {
-			return nil, nil, nil
+// tick runs a round of maintenance, unless maintenance is paused
+func (dht *DHT) tick() {
+	if dht.isMaintenancePaused() {
+		return
+	}
+	dht.maintain()
+}
+
+// maintain runs a single round of each maintenance sweep
+func (dht *DHT) maintain() {
+	// Refresh
+	dht.maintenanceTick(MaintenanceRefresh)
+	for i := 0; i < b; i++ {
+		if time.Since(dht.ht.getRefreshTimeForBucket(i)) > dht.options.TRefresh {
+			id := dht.ht.getRandomIDFromBucket(k)
+			dht.lookup(maintenanceContext, iterateFindNode, id, nil, nil)
 		}
+	}
 
-		sort.Sort(sl)
+	// Re-announce
+	dht.announceIfDue()
 
-		// If closestNode is unchanged then we are done
-		if bytes.Compare(sl.Nodes[0].ID, closestNode.ID) == 0 || queryRest {
-			// We are done
-			switch t {
-			case iterateFindNode:
-				if !queryRest {
-					queryRest = true
-					continue
-				}
-				return nil, sl.Nodes, nil
-			case iterateFindValue:
-				return nil, sl.Nodes, nil
-			case iterateStore:
-				for i, n := range sl.Nodes {
-					if i >= k {
-						return nil, nil, nil
-					}
+	// Replication. Queued stores are retried in case a node was added while
+	// they were being queued.
+	dht.maintenanceTick(MaintenanceReplicate)
+	if dht.NumNodes() > 0 {
+		dht.storePending()
+	}
+	keys := dht.store.GetAllKeysForReplication()
+	dht.replicate(maintenanceContext, keys)
+
+	// Expiration
+	dht.maintenanceTick(MaintenanceExpire)
+	dht.expireKeys()
+	dht.expireNotFound()
+	dht.expireReplicationStatus()
+	dht.expirePublishers()
+}
 
-					query := &message{}
-					query.Receiver = n
-					query.Sender = dht.ht.Self
-					query.Type = messageTypeStore
-					queryData := &queryDataStore{}
-					queryData.Data = data
-					query.Data = queryData
-					dht.networking.sendMessage(query, false, -1)
-				}
-				return nil, nil, nil
-			}
-		} else {
-			closestNode = sl.Nodes[0]
-		}
+// maintenanceTick reports the start of a maintenance sweep of the given kind
+// to the OnMaintenanceTick callback
+func (dht *DHT) maintenanceTick(kind string) {
+	if dht.options.OnMaintenanceTick != nil {
+		go dht.options.OnMaintenanceTick(kind)
 	}
 }
 
-// addNode adds a node into the appropriate k bucket
-// we store these buckets in big-endian order so we look at the bits
-// from right to left in order to find the appropriate bucket
-func (dht *DHT) addNode(node *node) {
-	index := getBucketIndexFromDifferingBit(dht.ht.Self.ID, node.ID)
+// announceIfDue re-announces the local node with a FIND_NODE lookup of its
+// own ID if TAnnounce has elapsed since it last did so. The first
+// announcement is scheduled on the first call.
+func (dht *DHT) announceIfDue() {
+	if dht.options.TAnnounce == 0 {
+		return
+	}
 
-	// Make sure node doesn't already exist
-	// If it does, mark it as seen
-	if dht.ht.doesNodeExistInBucket(index, node.ID) {
-		dht.ht.markNodeAsSeen(node.ID)
+	now := dht.now()
+	if dht.nextAnnounce.IsZero() {
+		dht.nextAnnounce = now.Add(jitter(dht.options.TAnnounce))
+		return
+	}
+	if now.Before(dht.nextAnnounce) {
 		return
 	}
 
-	dht.ht.mutex.Lock()
-	defer dht.ht.mutex.Unlock()
+	dht.nextAnnounce = now.Add(jitter(dht.options.TAnnounce))
+	dht.maintenanceTick(MaintenanceAnnounce)
+	dht.lookup(maintenanceContext, iterateFindNode, dht.ht.Self.ID, nil, nil)
+}
 
-	bucket := dht.ht.RoutingTable[index]
+// jitter returns d randomly varied by up to a tenth in either direction
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 10)
+	if spread == 0 {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(mrand.Int63n(2*spread+1))
+}
 
-	if len(bucket) == k {
-		// If the bucket is full we need to ping the first node to find out
-		// if it responds back in a reasonable amount of time. If not -
-		// we may remove it
-		n := bucket[0].NetworkNode
-		query := &message{}
-		query.Receiver = n
-		query.Sender = dht.ht.Self
-		query.Type = messageTypePing
-		res, err := dht.networking.sendMessage(query, true, -1)
-		if err != nil {
-			bucket = append(bucket, node)
-			bucket = bucket[1:]
-		} else {
-			select {
-			case <-res.ch:
-				return
-			case <-time.After(dht.options.TPingMax):
-				bucket = bucket[1:]
-				bucket = append(bucket, node)
+// expireKeys expires all key/values in the store due for expiration. If
+// SecureDelete is set and the store supports it, the expired key/values are
+// securely deleted first. Keys whose expiration the store does not report are
+// left to ExpireKeys.
+func (dht *DHT) expireKeys() {
+	if secureDeleter, ok := dht.store.(SecureDeleter); ok && dht.options.SecureDelete {
+		now := time.Now()
+		for _, entry := range dht.storeEntries() {
+			if !entry.Expiration.IsZero() && now.After(entry.Expiration) {
+				err := secureDeleter.SecureDelete(entry.Key)
+				if err != nil {
+					dht.logf("Failed to securely delete %s: %v", b58.Encode(entry.Key), err)
+				}
 			}
 		}
-	} else {
-		bucket = append(bucket, node)
 	}
+	dht.store.ExpireKeys()
+	dht.shedDistantKeys()
+	dht.countRemoteKeys()
+}
 
-	dht.ht.RoutingTable[index] = bucket
+// StoreUtilization returns the number of keys held in the local store on
+// behalf of other nodes, and the MaxStoredKeys they are limited to, or 0 if
+// there is no limit. Once used reaches 90% of capacity STOREs of keys distant
+// from the local ID are rejected.
+func (dht *DHT) StoreUtilization() (used int, capacity int) {
+	return int(atomic.LoadInt64(&dht.remoteKeys)), dht.options.MaxStoredKeys
 }
 
-func (dht *DHT) timers() {
-	t := time.NewTicker(time.Second)
-	for {
-		select {
-		case <-t.C:
-			// Refresh
-			for i := 0; i < b; i++ {
-				if time.Since(dht.ht.getRefreshTimeForBucket(i)) > dht.options.TRefresh {
-					id := dht.ht.getRandomIDFromBucket(k)
-					dht.iterate(iterateFindNode, id, nil)
-				}
-			}
+// countRemoteKeys recounts the keys in the local store published by other
+// nodes. The count is otherwise kept up to date as keys are stored and shed,
+// so this corrects it for keys removed by the store itself, for example by
+// ExpireKeys.
+func (dht *DHT) countRemoteKeys() {
+	dht.storeMutex.Lock()
+	defer dht.storeMutex.Unlock()
+	atomic.StoreInt64(&dht.remoteKeys, int64(len(dht.remoteEntries())))
+}
 
-			// Replication
-			keys := dht.store.GetAllKeysForReplication()
-			for _, key := range keys {
-				value, _ := dht.store.Retrieve(key)
-				dht.iterate(iterateStore, key, value)
-			}
+// recordPublishers records the publishers of the keys already held in the
+// local store, for example before a restart of a store persisted to disk
+func (dht *DHT) recordPublishers() {
+	entries := dht.storeEntries()
+	dht.publishersMutex.Lock()
+	defer dht.publishersMutex.Unlock()
+	for _, entry := range entries {
+		if entry.Publisher {
+			dht.setPublisher(string(entry.Key), string(dht.ht.Self.ID))
+		} else if len(entry.PublishedBy) > 0 {
+			dht.setPublisher(string(entry.Key), string(entry.PublishedBy))
+		}
+	}
+}
 
-			// Expiration
-			dht.store.ExpireKeys()
-		case <-dht.networking.getDisconnect():
-			t.Stop()
-			dht.networking.timersFin()
-			return
+// shouldShed returns true if a STORE of key from another node should be
+// rejected, because key is distant and the store is near MaxStoredKeys
+func (dht *DHT) shouldShed(key []byte) bool {
+	if dht.options.MaxStoredKeys == 0 {
+		return false
+	}
+	if dht.ht.getBucketIndex(key) < dht.options.ShedDistance {
+		return false
+	}
+	if _, exists := dht.store.Retrieve(key); exists {
+		return false
+	}
+	return float64(atomic.LoadInt64(&dht.remoteKeys)) >= storeShedLoad*float64(dht.options.MaxStoredKeys)
+}
+
+// shedDistantKeys deletes the keys stored on behalf of other nodes which are
+// most distant from the local ID, until at most MaxStoredKeys remain
+func (dht *DHT) shedDistantKeys() {
+	if dht.options.MaxStoredKeys == 0 {
+		return
+	}
+	entries := dht.remoteEntries()
+	excess := len(entries) - dht.options.MaxStoredKeys
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return getDistance(dht.ht.Self.ID, entries[i].Key).Cmp(getDistance(dht.ht.Self.ID, entries[j].Key)) > 0
+	})
+	for _, entry := range entries[:excess] {
+		dht.deleteRemoteKey(entry.Key)
+	}
+}
+
+// deleteRemoteKey deletes key, held on behalf of another node, from the local
+// store, securely if SecureDelete is set and the store supports it
+func (dht *DHT) deleteRemoteKey(key []byte) {
+	dht.storeMutex.Lock()
+	defer dht.storeMutex.Unlock()
+	if _, exists := dht.store.Retrieve(key); !exists || dht.isOwnKey(key) {
+		return
+	}
+	deleted := false
+	if secureDeleter, ok := dht.store.(SecureDeleter); ok && dht.options.SecureDelete {
+		err := secureDeleter.SecureDelete(key)
+		if err == nil {
+			deleted = true
+		} else {
+			dht.logf("Failed to securely delete %s: %v", b58.Encode(key), err)
+		}
+	}
+	if !deleted {
+		dht.store.Delete(key)
+	}
+	atomic.AddInt64(&dht.remoteKeys, -1)
+}
+
+// remoteEntries returns the entries in the local store which were published
+// by other nodes
+func (dht *DHT) remoteEntries() []StoreEntry {
+	var remote []StoreEntry
+	for _, entry := range dht.storeEntries() {
+		if !entry.Publisher {
+			remote = append(remote, entry)
 		}
 	}
+	return remote
+}
+
+// replicate stores each of keys to the network, running at most
+// ReplicationConcurrency stores at once
+func (dht *DHT) replicate(ctx context.Context, keys [][]byte) {
+	sem := make(chan struct{}, dht.options.ReplicationConcurrency)
+	wg := &sync.WaitGroup{}
+	for _, key := range keys {
+		value, _ := dht.store.Retrieve(key)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key []byte, value []byte) {
+			defer wg.Done()
+			dht.refresh(ctx, key, value)
+			<-sem
+		}(key, value)
+	}
+	wg.Wait()
 }
 
 func (dht *DHT) listen() {
@@ -585,11 +3760,14 @@ func (dht *DHT) listen() {
 				dht.networking.messagesFin()
 				return
 			}
+			if !dht.isAllowedIP(msg.Sender.IP) || !dht.isAllowedID(msg.Sender.ID) {
+				continue
+			}
 			switch msg.Type {
 			case messageTypeFindNode:
 				data := msg.Data.(*queryDataFindNode)
 				dht.addNode(newNode(msg.Sender))
-				closest := dht.ht.getClosestContacts(k, data.Target, []*NetworkNode{msg.Sender})
+				closest := dht.ht.getClosestContactsExcluding(k, data.Target, [][]byte{msg.Sender.ID})
 				response := &message{IsResponse: true}
 				response.Sender = dht.ht.Self
 				response.Receiver = msg.Sender
@@ -601,7 +3779,7 @@ func (dht *DHT) listen() {
 			case messageTypeFindValue:
 				data := msg.Data.(*queryDataFindValue)
 				dht.addNode(newNode(msg.Sender))
-				value, exists := dht.store.Retrieve(data.Target)
+				value, exists := dht.retrieveLive(data.Target)
 				response := &message{IsResponse: true}
 				response.ID = msg.ID
 				response.Receiver = msg.Sender
@@ -609,25 +3787,34 @@ func (dht *DHT) listen() {
 				response.Type = messageTypeFindValue
 				responseData := &responseDataFindValue{}
 				if exists {
-					responseData.Value = value
+					responseData.Value, responseData.Encoding = encodeResponseValue(value, data.Encodings, dht.options.CompressValues)
+					if responseData.Value == nil {
+						dht.logf("Value %s is too large to send to %s", b58.Encode(data.Target), b58.Encode(msg.Sender.ID))
+						responseData.TooLarge = true
+					} else if dht.options.OnValueServed != nil {
+						go dht.options.OnValueServed(data.Target, *msg.Sender)
+					}
 				} else {
-					closest := dht.ht.getClosestContacts(k, data.Target, []*NetworkNode{msg.Sender})
+					closest := dht.ht.getClosestContactsExcluding(k, data.Target, [][]byte{msg.Sender.ID})
 					responseData.Closest = closest.Nodes
 				}
 				response.Data = responseData
 				dht.networking.sendMessage(response, false, msg.ID)
 			case messageTypeStore:
-				data := msg.Data.(*queryDataStore)
-				dht.addNode(newNode(msg.Sender))
-				key := dht.store.GetKey(data.Data)
-				expiration := dht.getExpirationTime(key)
-				replication := time.Now().Add(dht.options.TReplicate)
-				dht.store.Store(key, data.Data, replication, expiration, false)
+				// The sender is told whether the data was stored, so that it
+				// can store to another node instead
+				response := &message{IsResponse: true}
+				response.Sender = dht.ht.Self
+				response.Receiver = msg.Sender
+				response.Type = messageTypeStore
+				response.Data = &responseDataStore{Success: dht.storeFromPeer(msg)}
+				dht.networking.sendMessage(response, false, msg.ID)
 			case messageTypePing:
 				response := &message{IsResponse: true}
 				response.Sender = dht.ht.Self
 				response.Receiver = msg.Sender
 				response.Type = messageTypePing
+				response.Data = &responseDataPing{Agent: dht.options.AgentName}
 				dht.networking.sendMessage(response, false, msg.ID)
 			}
 		case <-dht.networking.getDisconnect():
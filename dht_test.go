@@ -2,11 +2,20 @@ package kademlia
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"math/big"
 	"net"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	b58 "github.com/jbenet/go-base58"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -117,6 +126,68 @@ func TestBootstrapTwoNodes(t *testing.T) {
 	<-done
 }
 
+// Creates a DHT listening on an ephemeral port, and bootstraps another DHT
+// using the advertised port. Both should know about each other afterwards.
+func TestEphemeralPort(t *testing.T) {
+	done := make(chan bool)
+
+	id1, _ := newID()
+	dht1, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id1,
+		IP:   "127.0.0.1",
+		Port: "0",
+	})
+
+	err := dht1.CreateSocket()
+	assert.NoError(t, err)
+
+	port := dht1.ht.Self.Port
+	assert.NotEqual(t, 0, port)
+	assert.Equal(t, "[127.0.0.1]:"+strconv.Itoa(port), dht1.GetNetworkAddr())
+
+	dht2, _ := NewDHT(getInMemoryStore(), &Options{
+		BootstrapNodes: []*NetworkNode{
+			{
+				ID:   id1,
+				IP:   net.ParseIP("127.0.0.1"),
+				Port: port,
+			},
+		},
+		IP:   "127.0.0.1",
+		Port: "3001",
+	})
+
+	err = dht2.CreateSocket()
+	assert.NoError(t, err)
+
+	go func() {
+		go func() {
+			err := dht2.Bootstrap()
+			assert.NoError(t, err)
+
+			time.Sleep(50 * time.Millisecond)
+
+			err = dht2.Disconnect()
+			assert.NoError(t, err)
+
+			err = dht1.Disconnect()
+			assert.NoError(t, err)
+			done <- true
+		}()
+		err := dht2.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
+
+	err = dht1.Listen()
+	assert.Equal(t, "closed", err.Error())
+
+	assert.Equal(t, 1, dht1.NumNodes())
+	assert.Equal(t, 1, dht2.NumNodes())
+	<-done
+	<-done
+}
+
 // Creates three DHTs, bootstrap B using A, bootstrap C using B. A should know
 // about both B and C
 func TestBootstrapThreeNodes(t *testing.T) {
@@ -338,27 +409,21 @@ func TestReconnect(t *testing.T) {
 	}
 }
 
-// Create two DHTs and have them connect. Send a store message with 100mb
-// payload from one node to another. Ensure that the other node now has
-// this data in its store.
-func TestStoreAndFindLargeValue(t *testing.T) {
+// Creates two DHTs, and writes a malformed message from one to the other. The
+// receiving DHT should report the read error via OnTransportError.
+func TestOnTransportError(t *testing.T) {
 	done := make(chan bool)
+	transportErrors := make(chan error, 1)
 
-	id1, _ := newID()
 	dht1, _ := NewDHT(getInMemoryStore(), &Options{
-		ID:   id1,
 		IP:   "127.0.0.1",
 		Port: "3000",
+		OnTransportError: func(err error) {
+			transportErrors <- err
+		},
 	})
 
 	dht2, _ := NewDHT(getInMemoryStore(), &Options{
-		BootstrapNodes: []*NetworkNode{
-			{
-				ID:   id1,
-				IP:   net.ParseIP("127.0.0.1"),
-				Port: 3000,
-			},
-		},
 		IP:   "127.0.0.1",
 		Port: "3001",
 	})
@@ -381,21 +446,19 @@ func TestStoreAndFindLargeValue(t *testing.T) {
 		done <- true
 	}()
 
-	time.Sleep(1 * time.Second)
-
-	dht2.Bootstrap()
-
-	payload := [1000000]byte{}
-
-	key, err := dht1.Store(payload[:])
+	conn, err := dht2.networking.(*realNetworking).socket.DialTimeout("127.0.0.1:3000", time.Second)
 	assert.NoError(t, err)
 
-	time.Sleep(1 * time.Second)
-
-	value, exists, err := dht2.Get(key)
+	// An invalid uvarint length prefix
+	_, err = conn.Write([]byte{255, 255, 255, 255, 255, 255, 255, 255})
 	assert.NoError(t, err)
-	assert.Equal(t, true, exists)
-	assert.Equal(t, 0, bytes.Compare(payload[:], value))
+
+	select {
+	case err := <-transportErrors:
+		assert.Error(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("expected OnTransportError to be called")
+	}
 
 	err = dht1.Disconnect()
 	assert.NoError(t, err)
@@ -407,178 +470,3986 @@ func TestStoreAndFindLargeValue(t *testing.T) {
 	<-done
 }
 
-// Tests sending a message which results in an error when attempting to
-// send over uTP
-func TestNetworkingSendError(t *testing.T) {
-	networking := newMockNetworking()
-	id := getIDWithValues(0)
-	done := make(chan (int))
+// Creates two DHTs, and sends messages which fail validation from one to the
+// other. Once MalformedPacketLimit is reached the receiving DHT should refuse
+// connections from the sender.
+func TestMalformedPacketLimit(t *testing.T) {
+	done := make(chan bool)
 
-	dht, _ := NewDHT(getInMemoryStore(), &Options{
-		ID:   id,
-		Port: "3000",
-		IP:   "0.0.0.0",
-		BootstrapNodes: []*NetworkNode{{
-			ID:   getZerodIDWithNthByte(1, byte(255)),
-			Port: 3001,
-			IP:   net.ParseIP("0.0.0.0"),
-		},
-		},
+	dht1, _ := NewDHT(getInMemoryStore(), &Options{
+		IP:                   "127.0.0.1",
+		Port:                 "0",
+		MalformedPacketLimit: 2,
 	})
 
-	dht.networking = networking
-	dht.CreateSocket()
-
-	go func() {
-		dht.Listen()
-	}()
-
-	go func() {
-		v := <-networking.recv
-		assert.Nil(t, v)
-		close(done)
-	}()
-
-	networking.failNextSendMessage()
-
-	dht.Bootstrap()
-
-	dht.Disconnect()
-
-	<-done
-}
-
-// Tests sending a message which results in a successful send, but the node
-// never responds
-func TestNodeResponseSendError(t *testing.T) {
-	networking := newMockNetworking()
-	id := getIDWithValues(0)
-	done := make(chan (int))
+	logs := &lockedBuffer{mutex: &sync.Mutex{}}
+	dht1.options.Logger.SetOutput(logs)
 
-	dht, _ := NewDHT(getInMemoryStore(), &Options{
-		ID:   id,
-		Port: "3000",
-		IP:   "0.0.0.0",
-		BootstrapNodes: []*NetworkNode{{
-			ID:   getZerodIDWithNthByte(1, byte(255)),
-			Port: 3001,
-			IP:   net.ParseIP("0.0.0.0"),
-		},
-		},
+	dht2, _ := NewDHT(getInMemoryStore(), &Options{
+		IP:   "127.0.0.1",
+		Port: "0",
 	})
 
-	dht.networking = networking
-	dht.CreateSocket()
+	err := dht1.CreateSocket()
+	assert.NoError(t, err)
 
-	queries := 0
+	err = dht2.CreateSocket()
+	assert.NoError(t, err)
 
 	go func() {
-		dht.Listen()
+		err := dht1.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
 	}()
 
 	go func() {
-		for {
-			query := <-networking.recv
-			if query == nil {
-				return
-			}
-			if queries == 1 {
-				// Don't respond
-				close(done)
-			} else {
-				queries++
-				res := mockFindNodeResponse(query, getZerodIDWithNthByte(2, byte(255)))
-				networking.send <- res
-			}
-		}
+		err := dht2.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
 	}()
 
-	dht.Bootstrap()
+	// A FIND_NODE with no sender and the wrong data
+	malformed, _ := serializeMessage(&message{Type: messageTypeFindNode, Data: &queryDataStore{}})
 
-	assert.Equal(t, 1, dht.ht.totalNodes())
+	addr := "127.0.0.1:" + strconv.Itoa(dht1.ht.Self.Port)
+	conn, err := dht2.networking.(*realNetworking).socket.DialTimeout(addr, time.Second)
+	assert.NoError(t, err)
 
-	dht.Disconnect()
+	_, err = conn.Write(malformed)
+	assert.NoError(t, err)
+	_, err = conn.Write(malformed)
+	assert.NoError(t, err)
+
+	// The connection should be closed once the limit is reached
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), dht1.MalformedPackets())
+	assert.Contains(t, logs.String(), "Dropped malformed packet")
+
+	// Further connections should be refused
+	conn, err = dht2.networking.(*realNetworking).socket.DialTimeout(addr, time.Second)
+	if err == nil {
+		conn.Write(malformed)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int64(2), dht1.MalformedPackets())
+
+	err = dht1.Disconnect()
+	assert.NoError(t, err)
+
+	err = dht2.Disconnect()
+	assert.NoError(t, err)
 
 	<-done
+	<-done
 }
 
-// Tests a bucket refresh by setting a very low TRefresh value, adding a single
-// node to a bucket, and waiting for the refresh message for the bucket
-func TestBucketRefresh(t *testing.T) {
-	networking := newMockNetworking()
-	id := getIDWithValues(0)
-	done := make(chan (int))
-	refresh := make(chan (int))
+// Tests that inbound connections beyond MaxInboundConnections are refused,
+// and that closed connections no longer count towards the limit
+func TestMaxInboundConnections(t *testing.T) {
+	done := make(chan bool)
 
-	dht, _ := NewDHT(getInMemoryStore(), &Options{
-		ID:       id,
-		Port:     "3000",
-		IP:       "0.0.0.0",
-		TRefresh: time.Second * 2,
-		BootstrapNodes: []*NetworkNode{{
-			ID:   getZerodIDWithNthByte(1, byte(255)),
-			Port: 3001,
-			IP:   net.ParseIP("0.0.0.0"),
-		},
-		},
+	dht1, _ := NewDHT(getInMemoryStore(), &Options{
+		IP:                    "127.0.0.1",
+		Port:                  "0",
+		MaxInboundConnections: 2,
 	})
 
-	dht.networking = networking
-	dht.CreateSocket()
+	logs := &lockedBuffer{mutex: &sync.Mutex{}}
+	dht1.options.Logger.SetOutput(logs)
 
-	queries := 0
+	dht2, _ := NewDHT(getInMemoryStore(), &Options{
+		IP:   "127.0.0.1",
+		Port: "0",
+	})
+
+	err := dht1.CreateSocket()
+	assert.NoError(t, err)
+
+	err = dht2.CreateSocket()
+	assert.NoError(t, err)
 
 	go func() {
-		dht.Listen()
+		err := dht1.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
 	}()
 
 	go func() {
-		for {
-			query := <-networking.recv
-			if query == nil {
-				close(done)
-				return
-			}
-			queries++
+		err := dht2.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
 
-			res := mockFindNodeResponseEmpty(query)
-			networking.send <- res
+	rn := dht1.networking.(*realNetworking)
+	addr := "127.0.0.1:" + strconv.Itoa(dht1.ht.Self.Port)
+	dial := func() net.Conn {
+		conn, err := dht2.networking.(*realNetworking).socket.DialTimeout(addr, time.Second)
+		assert.NoError(t, err)
+		return conn
+	}
 
-			if queries == 2 {
-				close(refresh)
-			}
-		}
-	}()
+	// refused returns true if conn is closed by the remote node, rather than
+	// left open with nothing to read
+	refused := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		_, err := conn.Read(make([]byte, 1))
+		netErr, ok := err.(net.Error)
+		return !ok || !netErr.Timeout()
+	}
 
-	dht.Bootstrap()
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conns = append(conns, dial())
+	}
 
-	assert.Equal(t, 1, dht.ht.totalNodes())
+	assert.False(t, refused(conns[0]))
+	assert.False(t, refused(conns[1]))
+	assert.True(t, refused(conns[2]))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&rn.inboundConns))
+	assert.Contains(t, logs.String(), "Refused connection")
 
-	<-refresh
+	// Once a connection is closed a new one is accepted
+	conns[0].Close()
+	for i := 0; i < 100 && atomic.LoadInt64(&rn.inboundConns) != 1; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&rn.inboundConns))
 
-	dht.Disconnect()
+	conn := dial()
+	assert.False(t, refused(conn))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&rn.inboundConns))
+
+	conn.Close()
+	conns[1].Close()
+	for i := 0; i < 100 && atomic.LoadInt64(&rn.inboundConns) != 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&rn.inboundConns))
+
+	err = dht1.Disconnect()
+	assert.NoError(t, err)
+
+	err = dht2.Disconnect()
+	assert.NoError(t, err)
 
 	<-done
+	<-done
 }
 
-// Tets store replication by setting the TReplicate time to a very small value.
+// Tests that with TConnIdle set, repeated messages to a node reuse one
+// connection in each direction, which is closed once idle
+func TestConnectionReuse(t *testing.T) {
+	done := make(chan bool)
+
+	var dhts []*DHT
+	for i := 0; i < 2; i++ {
+		dht, _ := NewDHT(getInMemoryStore(), &Options{
+			IP:        "127.0.0.1",
+			Port:      "0",
+			TConnIdle: time.Millisecond * 200,
+		})
+		err := dht.CreateSocket()
+		assert.NoError(t, err)
+		go func() {
+			err := dht.Listen()
+			assert.Equal(t, "closed", err.Error())
+			done <- true
+		}()
+		dhts = append(dhts, dht)
+	}
+
+	inbound := func(dht *DHT) int64 {
+		return atomic.LoadInt64(&dht.networking.(*realNetworking).inboundConns)
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, dhts[1].ping(context.Background(), dhts[0].ht.Self))
+	}
+
+	assert.Equal(t, int64(1), inbound(dhts[0]))
+	assert.Equal(t, int64(1), inbound(dhts[1]))
+
+	for i := 0; i < 100 && inbound(dhts[0])+inbound(dhts[1]) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, int64(0), inbound(dhts[0]))
+	assert.Equal(t, int64(0), inbound(dhts[1]))
+
+	for _, dht := range dhts {
+		err := dht.Disconnect()
+		assert.NoError(t, err)
+		<-done
+	}
+}
+
+// Tests that when several responses arrive for one request, the first is
+// delivered and the rest are discarded without panicking
+func TestDuplicateResponses(t *testing.T) {
+	done := make(chan bool)
+
+	dht1, _ := NewDHT(getInMemoryStore(), &Options{
+		IP:   "127.0.0.1",
+		Port: "0",
+	})
+
+	dht2, _ := NewDHT(getInMemoryStore(), &Options{
+		IP:   "127.0.0.1",
+		Port: "0",
+	})
+
+	err := dht1.CreateSocket()
+	assert.NoError(t, err)
+
+	err = dht2.CreateSocket()
+	assert.NoError(t, err)
+
+	go func() {
+		err := dht1.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
+
+	go func() {
+		err := dht2.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
+
+	// dht2 ignores the query as it is addressed to a different ID, so the
+	// only responses are the forged ones
+	receiverID, _ := newID()
+	receiver := &NetworkNode{ID: receiverID, IP: dht2.ht.Self.IP, Port: dht2.ht.Self.Port}
+	query := &message{
+		Type:     messageTypeFindNode,
+		Sender:   dht1.ht.Self,
+		Receiver: receiver,
+		Data:     &queryDataFindNode{Target: receiverID},
+	}
+	res, err := dht1.networking.sendMessage(query, true, -1)
+	assert.NoError(t, err)
+
+	response, _ := serializeMessage(&message{
+		ID:         query.ID,
+		Type:       messageTypeFindNode,
+		IsResponse: true,
+		Sender:     receiver,
+		Receiver:   dht1.ht.Self,
+		Data:       &responseDataFindNode{Closest: []*NetworkNode{}},
+	})
+
+	addr := "127.0.0.1:" + strconv.Itoa(dht1.ht.Self.Port)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := dht2.networking.(*realNetworking).socket.DialTimeout(addr, time.Second)
+			assert.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write(response)
+			assert.NoError(t, err)
+			_, err = conn.Write(response)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case msg := <-res.ch:
+		assert.NotNil(t, msg)
+		assert.Equal(t, query.ID, msg.ID)
+	case <-time.After(time.Second):
+		t.Fatal("No response received")
+	}
+
+	// The channel is closed once the first response is delivered
+	_, open := <-res.ch
+	assert.False(t, open)
+
+	// Cancelling a response which has already arrived is harmless
+	dht1.networking.cancelResponse(res)
+
+	time.Sleep(time.Millisecond * 100)
+
+	err = dht1.Disconnect()
+	assert.NoError(t, err)
+
+	err = dht2.Disconnect()
+	assert.NoError(t, err)
+
+	<-done
+	<-done
+}
+
+// blockingStore is a MemoryStore which blocks when storing data received
+// from another node until release is closed
+type blockingStore struct {
+	*MemoryStore
+	entered chan (bool)
+	release chan (bool)
+}
+
+func (bs *blockingStore) Store(key []byte, data []byte, replication time.Time, expiration time.Time, publisher bool) error {
+	if !publisher {
+		bs.entered <- true
+		<-bs.release
+	}
+	return bs.MemoryStore.Store(key, data, replication, expiration, publisher)
+}
+
+// Tests that Disconnect returns once TDisconnectTimeout has passed, even
+// though a message is still being handled
+func TestDisconnectTimeout(t *testing.T) {
+	done := make(chan bool)
+
+	store := &blockingStore{
+		MemoryStore: getInMemoryStore(),
+		entered:     make(chan (bool), 1),
+		release:     make(chan (bool)),
+	}
+	dht1, _ := NewDHT(store, &Options{
+		IP:                 "127.0.0.1",
+		Port:               "0",
+		TDisconnectTimeout: time.Millisecond * 200,
+	})
+
+	logs := &lockedBuffer{mutex: &sync.Mutex{}}
+	dht1.options.Logger.SetOutput(logs)
+
+	dht2, _ := NewDHT(getInMemoryStore(), &Options{
+		IP:   "127.0.0.1",
+		Port: "0",
+	})
+
+	err := dht1.CreateSocket()
+	assert.NoError(t, err)
+
+	err = dht2.CreateSocket()
+	assert.NoError(t, err)
+
+	go func() {
+		err := dht1.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
+
+	go func() {
+		err := dht2.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
+
+	query := &message{
+		Type:     messageTypeStore,
+		Sender:   dht2.ht.Self,
+		Receiver: dht1.ht.Self,
+		Data:     &queryDataStore{Data: []byte("foo")},
+	}
+	_, err = dht2.networking.sendMessage(query, false, -1)
+	assert.NoError(t, err)
+
+	select {
+	case <-store.entered:
+	case <-time.After(time.Second):
+		t.Fatal("STORE was not handled")
+	}
+
+	start := time.Now()
+	err = dht1.Disconnect()
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Contains(t, logs.String(), "without waiting for message handler")
+
+	// The handler can still unwind after the socket is closed
+	close(store.release)
+
+	err = dht2.Disconnect()
+	assert.NoError(t, err)
+
+	<-done
+	<-done
+}
+
+// Create two DHTs and have them connect. Send a store message with 100mb
+// payload from one node to another. Ensure that the other node now has
+// this data in its store.
+func TestStoreAndFindLargeValue(t *testing.T) {
+	done := make(chan bool)
+
+	id1, _ := newID()
+	dht1, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id1,
+		IP:   "127.0.0.1",
+		Port: "3000",
+	})
+
+	dht2, _ := NewDHT(getInMemoryStore(), &Options{
+		BootstrapNodes: []*NetworkNode{
+			{
+				ID:   id1,
+				IP:   net.ParseIP("127.0.0.1"),
+				Port: 3000,
+			},
+		},
+		IP:   "127.0.0.1",
+		Port: "3001",
+	})
+
+	err := dht1.CreateSocket()
+	assert.NoError(t, err)
+
+	err = dht2.CreateSocket()
+	assert.NoError(t, err)
+
+	go func() {
+		err := dht1.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
+
+	go func() {
+		err := dht2.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	dht2.Bootstrap()
+
+	payload := [1000000]byte{}
+
+	key, err := dht1.Store(payload[:])
+	assert.NoError(t, err)
+
+	time.Sleep(1 * time.Second)
+
+	value, exists, err := dht2.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, true, exists)
+	assert.Equal(t, 0, bytes.Compare(payload[:], value))
+
+	err = dht1.Disconnect()
+	assert.NoError(t, err)
+
+	err = dht2.Disconnect()
+	assert.NoError(t, err)
+
+	<-done
+	<-done
+}
+
+// Creates two DHTs and retrieves a value held by one of them from the other.
+// The holder should report serving the value via OnValueServed.
+func TestOnValueServed(t *testing.T) {
+	done := make(chan bool)
+	served := make(chan NetworkNode, 1)
+	var servedKey []byte
+
+	id1, _ := newID()
+	dht1, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id1,
+		IP:   "127.0.0.1",
+		Port: "0",
+		OnValueServed: func(key []byte, to NetworkNode) {
+			servedKey = key
+			served <- to
+		},
+	})
+
+	err := dht1.CreateSocket()
+	assert.NoError(t, err)
+
+	id2, _ := newID()
+	dht2, _ := NewDHT(getInMemoryStore(), &Options{
+		ID: id2,
+		BootstrapNodes: []*NetworkNode{
+			{
+				ID:   id1,
+				IP:   net.ParseIP("127.0.0.1"),
+				Port: dht1.ht.Self.Port,
+			},
+		},
+		IP:   "127.0.0.1",
+		Port: "0",
+	})
+
+	err = dht2.CreateSocket()
+	assert.NoError(t, err)
+
+	go func() {
+		err := dht1.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
+
+	go func() {
+		err := dht2.Listen()
+		assert.Equal(t, "closed", err.Error())
+		done <- true
+	}()
+
+	key := dht1.store.GetKey([]byte("foo"))
+	dht1.storeValue(key, []byte("foo"), true)
+
+	dht2.Bootstrap()
+
+	value, exists, err := dht2.Get(b58.Encode(key))
+	assert.NoError(t, err)
+	assert.Equal(t, true, exists)
+	assert.Equal(t, []byte("foo"), value)
+
+	select {
+	case to := <-served:
+		assert.Equal(t, key, servedKey)
+		assert.Equal(t, id2, to.ID)
+		assert.Equal(t, dht2.ht.Self.Port, to.Port)
+	case <-time.After(time.Second):
+		t.Fatal("OnValueServed was not called")
+	}
+
+	err = dht1.Disconnect()
+	assert.NoError(t, err)
+
+	err = dht2.Disconnect()
+	assert.NoError(t, err)
+
+	<-done
+	<-done
+}
+
+// Tests sending a message which results in an error when attempting to
+// send over uTP
+func TestNetworkingSendError(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	go func() {
+		v := <-networking.recv
+		assert.Nil(t, v)
+		close(done)
+	}()
+
+	networking.failNextSendMessage()
+
+	dht.Bootstrap()
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests sending a message which results in a successful send, but the node
+// never responds
+func TestNodeResponseSendError(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	queries := 0
+
+	go func() {
+		dht.Listen()
+	}()
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				return
+			}
+			if queries == 1 {
+				// Don't respond
+				close(done)
+			} else {
+				queries++
+				res := mockFindNodeResponse(query, getZerodIDWithNthByte(2, byte(255)))
+				networking.send <- res
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	assert.Equal(t, 1, dht.ht.totalNodes())
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests a bucket refresh by setting a very low TRefresh value, adding a single
+// node to a bucket, and waiting for the refresh message for the bucket
+func TestBucketRefresh(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+	refresh := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:       id,
+		Port:     "3000",
+		IP:       "0.0.0.0",
+		TRefresh: time.Second * 2,
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	queries := 0
+
+	go func() {
+		dht.Listen()
+	}()
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			queries++
+
+			res := mockFindNodeResponseEmpty(query)
+			networking.send <- res
+
+			if queries == 2 {
+				close(refresh)
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	assert.Equal(t, 1, dht.ht.totalNodes())
+
+	<-refresh
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tets store replication by setting the TReplicate time to a very small value.
 // Stores some data, and then expects another store message in TReplicate time
 func TestStoreReplication(t *testing.T) {
 	networking := newMockNetworking()
 	id := getIDWithValues(0)
 	done := make(chan (int))
-	replicate := make(chan (int))
+	replicate := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:         id,
+		Port:       "3000",
+		IP:         "0.0.0.0",
+		TReplicate: time.Second * 2,
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	stores := 0
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			switch query.Type {
+			case messageTypeFindNode:
+				res := mockFindNodeResponseEmpty(query)
+				networking.send <- res
+			case messageTypeStore:
+				networking.send <- mockStoreResponse(query, true)
+				stores++
+				d := query.Data.(*queryDataStore)
+				assert.Equal(t, []byte("foo"), d.Data)
+				assert.True(t, d.Publishing)
+				if stores == 2 {
+					close(replicate)
+				}
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	dht.Store([]byte("foo"))
+
+	<-replicate
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests bounded parallelism of replication sweeps by holding the FIND_NODE
+// responses of each stored key for a short time, and ensuring no more than
+// ReplicationConcurrency keys are being replicated at once
+func TestStoreReplicationConcurrency(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+	replicated := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:                     id,
+		Port:                   "3000",
+		IP:                     "0.0.0.0",
+		ReplicationConcurrency: 2,
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	mutex := &sync.Mutex{}
+	bootstrapped := false
+	outstanding := 0
+	maxOutstanding := 0
+	stores := 0
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			switch query.Type {
+			case messageTypeFindNode:
+				mutex.Lock()
+				if !bootstrapped {
+					bootstrapped = true
+					mutex.Unlock()
+					networking.send <- mockFindNodeResponseEmpty(query)
+					continue
+				}
+				outstanding++
+				if outstanding > maxOutstanding {
+					maxOutstanding = outstanding
+				}
+				mutex.Unlock()
+				go func(query *message) {
+					time.Sleep(50 * time.Millisecond)
+					mutex.Lock()
+					outstanding--
+					mutex.Unlock()
+					networking.send <- mockFindNodeResponseEmpty(query)
+				}(query)
+			case messageTypeStore:
+				res := mockStoreResponse(query, true)
+				go func() {
+					networking.send <- res
+				}()
+				mutex.Lock()
+				stores++
+				if stores == 6 {
+					close(replicated)
+				}
+				mutex.Unlock()
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	for i := 0; i < 6; i++ {
+		data := []byte(strconv.Itoa(i))
+		dht.store.Store(dht.store.GetKey(data), data, time.Now(), time.Now().Add(time.Hour), true)
+	}
+
+	<-replicated
+
+	mutex.Lock()
+	assert.Equal(t, 2, maxOutstanding)
+	mutex.Unlock()
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests pausing maintenance by setting the TReplicate time to a very small
+// value. No replication should occur until maintenance is resumed.
+func TestPauseMaintenance(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:         id,
+		Port:       "3000",
+		IP:         "0.0.0.0",
+		TReplicate: time.Nanosecond,
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	stores := make(chan (int), 10)
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			switch query.Type {
+			case messageTypeFindNode:
+				res := mockFindNodeResponseEmpty(query)
+				networking.send <- res
+			case messageTypeStore:
+				networking.send <- mockStoreResponse(query, true)
+				stores <- 1
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	dht.PauseMaintenance()
+	dht.PauseMaintenance()
+
+	dht.Store([]byte("foo"))
+	<-stores
+
+	// The key is due for replication, but the round of maintenance is
+	// skipped. Queries are answered in order, so any STORE sent by the round
+	// has been counted once the lookup returns.
+	dht.tick()
+	_, _, err := dht.iterate(iterateFindNode, id, nil)
+	assert.NoError(t, err)
+	select {
+	case <-stores:
+		t.Fatal("expected no replication while maintenance is paused")
+	default:
+	}
+
+	dht.ResumeMaintenance()
+	dht.tick()
+
+	select {
+	case <-stores:
+	case <-time.After(time.Second * 3):
+		t.Fatal("expected replication after maintenance is resumed")
+	}
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Test Expiration by setting TExpire to a very low value. Store a value,
+// and then wait longer than TExpire. The value should no longer exist in
+// the store.
+func TestStoreExpiration(t *testing.T) {
+	id := getIDWithValues(0)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:      id,
+		Port:    "3000",
+		IP:      "0.0.0.0",
+		TExpire: time.Second,
+	})
+
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	k, _ := dht.Store([]byte("foo"))
+
+	v, exists, _ := dht.Get(k)
+	assert.Equal(t, true, exists)
+
+	assert.Equal(t, []byte("foo"), v)
+
+	<-time.After(time.Second * 3)
+
+	_, exists, _ = dht.Get(k)
+
+	assert.Equal(t, false, exists)
+
+	dht.Disconnect()
+}
+
+// Tests the negative cache by looking up a key which does not exist in the
+// network twice. The second lookup should not send any FIND_VALUE messages
+// unless it is forced.
+func TestNegativeCache(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:             id,
+		Port:           "3000",
+		IP:             "0.0.0.0",
+		TNegativeCache: time.Minute,
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	findValues := 0
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			switch query.Type {
+			case messageTypeFindNode:
+				res := mockFindNodeResponseEmpty(query)
+				networking.send <- res
+			case messageTypeFindValue:
+				findValues++
+				res := mockFindValueResponseEmpty(query)
+				networking.send <- res
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	key := b58.Encode(dht.store.GetKey([]byte("foo")))
+
+	_, exists, err := dht.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, false, exists)
+	assert.Equal(t, 1, findValues)
+
+	_, exists, err = dht.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, false, exists)
+	assert.Equal(t, 1, findValues)
+
+	_, exists, err = dht.ForceGet(key)
+	assert.NoError(t, err)
+	assert.Equal(t, false, exists)
+	assert.Equal(t, 2, findValues)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests replication status by storing a key to two nodes, one of which fails
+// to receive the STORE message
+func TestReplicationStatus(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	second := getZerodIDWithNthByte(2, byte(255))
+	networking.failStoresTo(second)
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			if query.Type == messageTypeFindNode {
+				var res *message
+				if bytes.Compare(query.Receiver.ID, second) == 0 {
+					res = mockFindNodeResponseEmpty(query)
+				} else {
+					res = mockFindNodeResponse(query, second)
+				}
+				// Both nodes are queried in the same round during the store,
+				// so respond without blocking the next query
+				go func() {
+					networking.send <- res
+				}()
+			}
+			if query.Type == messageTypeStore {
+				res := mockStoreResponse(query, true)
+				go func() {
+					networking.send <- res
+				}()
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	_, _, found := dht.ReplicationStatus(b58.Encode(dht.store.GetKey([]byte("foo"))))
+	assert.Equal(t, false, found)
+
+	key, err := dht.Store([]byte("foo"))
+	assert.NoError(t, err)
+
+	targeted, acked, found := dht.ReplicationStatus(key)
+	assert.Equal(t, true, found)
+	assert.Equal(t, 2, targeted)
+	assert.Equal(t, 1, acked)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that when a replica responds that it failed to store the data, the
+// data is stored to the next closest node instead
+func TestStoreFailedReplica(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	second := getZerodIDWithNthByte(2, byte(255))
+	stores := make(chan []byte, 2)
+
+	go func() {
+		failed := false
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			if query.Type == messageTypeFindNode {
+				var res *message
+				if bytes.Compare(query.Receiver.ID, second) == 0 {
+					res = mockFindNodeResponseEmpty(query)
+				} else {
+					res = mockFindNodeResponse(query, second)
+				}
+				go func() {
+					networking.send <- res
+				}()
+			}
+			if query.Type == messageTypeStore {
+				// The first replica fails to store the data
+				res := mockStoreResponse(query, failed)
+				failed = true
+				go func() {
+					networking.send <- res
+				}()
+				stores <- query.Receiver.ID
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	key, err := dht.StoreWithReplication([]byte("foo"), 1)
+	assert.NoError(t, err)
+
+	first := <-stores
+	select {
+	case next := <-stores:
+		assert.NotEqual(t, first, next)
+	case <-time.After(time.Second):
+		t.Fatal("expected the data to be stored to another node")
+	}
+
+	targeted, acked, found := dht.ReplicationStatus(key)
+	assert.Equal(t, true, found)
+	assert.Equal(t, 2, targeted)
+	assert.Equal(t, 1, acked)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that concurrent stores of the same data share a single iterative
+// store, while a store of different data runs its own
+func TestConcurrentStoresCoalesce(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	dht.addNode(newNode(&NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+
+	// The peer is slow to respond, so that the stores overlap
+	rpcs := make(map[int]int)
+	mutex := &sync.Mutex{}
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			mutex.Lock()
+			rpcs[query.Type]++
+			mutex.Unlock()
+			if query.Type == messageTypeFindNode {
+				res := mockFindNodeResponseEmpty(query)
+				go func() {
+					time.Sleep(time.Millisecond * 200)
+					networking.send <- res
+				}()
+			}
+			if query.Type == messageTypeStore {
+				res := mockStoreResponse(query, true)
+				go func() {
+					networking.send <- res
+				}()
+			}
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		data := "foo"
+		if i == 0 {
+			data = "bar"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := dht.Store([]byte(data))
+			assert.NoError(t, err)
+			assert.Equal(t, b58.Encode(dht.store.GetKey([]byte(data))), key)
+		}()
+	}
+	wg.Wait()
+
+	// The last STORE may have been sent but not yet counted
+	count := func(rpc int) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return rpcs[rpc]
+	}
+	for i := 0; i < 100 && count(messageTypeStore) < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 2, count(messageTypeFindNode))
+	assert.Equal(t, 2, count(messageTypeStore))
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that cancelling the context of the store leading a coalesced store
+// does not fail the other stores waiting for it, and that stores with
+// different replication factors are not coalesced
+func TestCoalescedStoreCancelled(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	dht.addNode(newNode(&NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+
+	findNodes := make(chan bool, 10)
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			if query.Type == messageTypeFindNode {
+				findNodes <- true
+				res := mockFindNodeResponseEmpty(query)
+				go func() {
+					time.Sleep(time.Millisecond * 200)
+					networking.send <- res
+				}()
+			}
+			if query.Type == messageTypeStore {
+				res := mockStoreResponse(query, true)
+				go func() {
+					networking.send <- res
+				}()
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := dht.StoreContext(ctx, []byte("foo"))
+		leader <- err
+	}()
+	<-findNodes
+
+	follower := make(chan error)
+	go func() {
+		_, err := dht.Store([]byte("foo"))
+		follower <- err
+	}()
+	replicated := make(chan error)
+	go func() {
+		_, err := dht.StoreWithReplication([]byte("foo"), 3)
+		replicated <- err
+	}()
+
+	// The store with a different replication factor runs its own lookup
+	<-findNodes
+
+	// Wait for the follower to join the leader's store
+	joined := func() bool {
+		dht.storeFlights.mutex.Lock()
+		defer dht.storeFlights.mutex.Unlock()
+		for _, f := range dht.storeFlights.flights {
+			if f.waiters == 2 {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 100 && !joined(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-leader)
+	assert.NoError(t, <-follower)
+	assert.NoError(t, <-replicated)
+	assert.Equal(t, 0, len(findNodes))
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that MaxRPCRate bounds the rate of RPCs sent by concurrent callers
+// once the burst is used up, and that excess RPCs fail instead if
+// FailRateLimitedRPCs is set
+func TestMaxRPCRate(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		networking := newMockNetworking()
+		done := make(chan (int))
+
+		// When failing, no tokens are added while the RPCs are sent
+		rate := 100
+		if fail {
+			rate = 1
+		}
+
+		dht, _ := NewDHT(getInMemoryStore(), &Options{
+			ID:                  getIDWithValues(0),
+			Port:                "3000",
+			IP:                  "0.0.0.0",
+			MaxRPCRate:          rate,
+			RPCBurst:            10,
+			FailRateLimitedRPCs: fail,
+		})
+
+		dht.networking = networking
+		dht.CreateSocket()
+
+		go func() {
+			dht.Listen()
+		}()
+
+		go func() {
+			for {
+				if <-networking.recv == nil {
+					close(done)
+					return
+				}
+			}
+		}()
+
+		peer := &NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}
+		var limited int64
+		start := time.Now()
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					_, err := dht.sendQuery(context.Background(), RPCOriginMaintenance, &message{Sender: dht.ht.Self, Receiver: peer, Type: messageTypePing}, false)
+					if err == ErrRateLimited {
+						atomic.AddInt64(&limited, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		elapsed := time.Since(start)
+
+		if fail {
+			assert.True(t, limited >= 39, "%d RPCs were rate limited", limited)
+		} else {
+			// 40 RPCs beyond the burst take at least 400ms at 100 per second
+			assert.Equal(t, int64(0), limited)
+			assert.True(t, elapsed >= time.Millisecond*390, "RPCs sent in %v", elapsed)
+		}
+
+		dht.Disconnect()
+
+		<-done
+	}
+}
+
+// Tests that RPCs waiting for the MaxRPCRate stop once their context is
+// cancelled, and that a full bucket's oldest node is kept without waiting
+// when the rate does not allow it to be pinged
+func TestMaxRPCRateNotBlocking(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:         getIDWithValues(0),
+		Port:       "3000",
+		IP:         "0.0.0.0",
+		MaxRPCRate: 1,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+		}
+	}()
+
+	// Every node is in the furthest bucket from the local node
+	nodeID := func(i int) []byte {
+		id := getIDWithValues(0)
+		id[0] = byte(255)
+		id[19] = byte(i)
+		return id
+	}
+	for i := 0; i < k; i++ {
+		dht.addNode(newNode(&NetworkNode{ID: nodeID(i), IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+	}
+	peer := &NetworkNode{ID: nodeID(0), IP: net.ParseIP("0.0.0.0"), Port: 3001}
+
+	// Use up the burst
+	_, err := dht.sendQuery(context.Background(), RPCOriginMaintenance, &message{Sender: dht.ht.Self, Receiver: peer, Type: messageTypePing}, false)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	_, err = dht.sendQuery(ctx, RPCOriginMaintenance, &message{Sender: dht.ht.Self, Receiver: peer, Type: messageTypePing}, false)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Millisecond*500)
+
+	start = time.Now()
+	dht.addNode(newNode(&NetworkNode{ID: nodeID(k), IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+	assert.True(t, time.Since(start) < time.Millisecond*500)
+	assert.Equal(t, k, dht.NumNodes())
+	_, found := dht.Peer(nodeID(0))
+	assert.True(t, found)
+	_, found = dht.Peer(nodeID(k))
+	assert.False(t, found)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that StoreVerbose reports the nodes targeted by the store, and which
+// of them received it
+func TestStoreVerbose(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	first := getZerodIDWithNthByte(1, byte(255))
+	second := getZerodIDWithNthByte(2, byte(255))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+		BootstrapNodes: []*NetworkNode{{
+			ID:   first,
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	networking.failStoresTo(second)
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			if query.Type == messageTypeFindNode {
+				var res *message
+				if bytes.Compare(query.Receiver.ID, second) == 0 {
+					res = mockFindNodeResponseEmpty(query)
+				} else {
+					res = mockFindNodeResponse(query, second)
+				}
+				go func() {
+					networking.send <- res
+				}()
+			}
+			if query.Type == messageTypeStore {
+				res := mockStoreResponse(query, true)
+				go func() {
+					networking.send <- res
+				}()
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	key, report, err := dht.StoreVerbose([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, b58.Encode(dht.store.GetKey([]byte("foo"))), key)
+	assert.Equal(t, TerminationConverged, report.Termination)
+
+	ids := func(nodes []*NetworkNode) map[string]bool {
+		result := make(map[string]bool)
+		for _, n := range nodes {
+			result[string(n.ID)] = true
+		}
+		return result
+	}
+	assert.Equal(t, map[string]bool{string(first): true, string(second): true}, ids(report.Targeted))
+	assert.Equal(t, map[string]bool{string(first): true}, ids(report.Acked))
+	assert.Equal(t, map[string]bool{string(second): true}, ids(report.Failed))
+
+	targeted, acked, _ := dht.ReplicationStatus(key)
+	assert.Equal(t, len(report.Targeted), targeted)
+	assert.Equal(t, len(report.Acked), acked)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that a node which receives a STORE but does not respond to it is not
+// reported as having stored the data
+func TestStoreUnacknowledged(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	peer := getZerodIDWithNthByte(1, byte(255))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:          getIDWithValues(0),
+		Port:        "3000",
+		IP:          "0.0.0.0",
+		TMsgTimeout: time.Millisecond * 100,
+		BootstrapNodes: []*NetworkNode{{
+			ID:   peer,
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			// STOREs are received but never responded to
+			if query.Type == messageTypeFindNode {
+				networking.send <- mockFindNodeResponseEmpty(query)
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	key, report, err := dht.StoreVerbose([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(report.Targeted))
+	assert.Equal(t, 0, len(report.Acked))
+	assert.Equal(t, 1, len(report.Failed))
+	assert.Equal(t, peer, report.Failed[0].ID)
+
+	_, acked, _ := dht.ReplicationStatus(key)
+	assert.Equal(t, 0, acked)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that keys stored with a replication factor are stored, and then
+// republished, to that many nodes. Factors above MaxReplicationFactor are
+// reduced to it.
+func TestStoreWithReplication(t *testing.T) {
+	dhts, err := BuildNetwork(50, func(options *Options) {
+		options.MaxReplicationFactor = 30
+	})
+	assert.NoError(t, err)
+
+	_, err = dhts[0].StoreWithReplication([]byte("foo"), 0)
+	assert.Error(t, err)
+
+	important, err := dhts[0].StoreWithReplication([]byte("foo"), 1000)
+	assert.NoError(t, err)
+	unimportant, err := dhts[0].StoreWithReplication([]byte("bar"), 5)
+	assert.NoError(t, err)
+	normal, err := dhts[0].Store([]byte("baz"))
+	assert.NoError(t, err)
+
+	expected := map[string]int{important: 30, unimportant: 5, normal: k}
+
+	for key, replicas := range expected {
+		targeted, _, found := dhts[0].ReplicationStatus(key)
+		assert.True(t, found)
+		assert.Equal(t, replicas, targeted)
+	}
+
+	// The replication factor is persisted with the data on the remote nodes,
+	// so it is honored when they republish it
+	factors := map[string]int{important: 30, unimportant: 5, normal: 0}
+	for key, replicas := range expected {
+		for _, dht := range dhts[1:] {
+			if _, exists := dht.store.Retrieve(b58.Decode(key)); !exists {
+				continue
+			}
+			// The factor is persisted just after the data is stored
+			for i := 0; i < 100 && dht.getReplicationFactor(b58.Decode(key)) != factors[key]; i++ {
+				time.Sleep(time.Millisecond * 10)
+			}
+			dht.replicate(maintenanceContext, [][]byte{b58.Decode(key)})
+			targeted, _, found := dht.ReplicationStatus(key)
+			assert.True(t, found)
+			assert.Equal(t, replicas, targeted)
+			break
+		}
+	}
+
+	for _, entry := range dhts[0].storeEntries() {
+		switch b58.Encode(entry.Key) {
+		case important:
+			assert.Equal(t, 30, entry.Replicas)
+		case unimportant:
+			assert.Equal(t, 5, entry.Replicas)
+		case normal:
+			assert.Equal(t, 0, entry.Replicas)
+		}
+	}
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// Tests that two applications with different key transforms store the same
+// data under different routing keys, while both retrieve it using the key
+// returned by Store
+func TestKeyTransform(t *testing.T) {
+	namespace := func(tag string) func(options *Options) {
+		return func(options *Options) {
+			options.KeyTransform = func(key []byte) []byte {
+				sum := sha1.Sum(append([]byte(tag), key...))
+				return sum[:]
+			}
+		}
+	}
+
+	first, err := BuildNetwork(5, namespace("first"))
+	assert.NoError(t, err)
+	second, err := BuildNetwork(5, namespace("second"))
+	assert.NoError(t, err)
+
+	firstKey, err := first[0].Store([]byte("foo"))
+	assert.NoError(t, err)
+	secondKey, err := second[0].Store([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, firstKey, secondKey)
+
+	_, exists := first[0].store.Retrieve(b58.Decode(firstKey))
+	assert.False(t, exists)
+
+	firstEntries := first[0].storeEntries()
+	secondEntries := second[0].storeEntries()
+	assert.Equal(t, 1, len(firstEntries))
+	assert.Equal(t, 1, len(secondEntries))
+	assert.NotEqual(t, firstEntries[0].Key, secondEntries[0].Key)
+
+	for _, dht := range append(first, second...) {
+		value, exists, err := dht.Get(firstKey)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, []byte("foo"), value)
+	}
+
+	targeted, _, found := first[0].ReplicationStatus(firstKey)
+	assert.True(t, found)
+	assert.Equal(t, 4, targeted)
+
+	assert.NoError(t, CloseNetwork(first))
+	assert.NoError(t, CloseNetwork(second))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		Port: "3000",
+		IP:   "127.0.0.1",
+		KeyTransform: func(key []byte) []byte {
+			return append([]byte("tag"), key...)
+		},
+	})
+	_, err = dht.Store([]byte("foo"))
+	assert.Equal(t, ErrInvalidKeyTransform, err)
+	_, _, err = dht.Get(firstKey)
+	assert.Equal(t, ErrInvalidKeyTransform, err)
+}
+
+// Tests that GetWithReplicas reports the number of nodes which returned the
+// value during the lookup
+func TestGetWithReplicas(t *testing.T) {
+	dhts, err := BuildNetwork(5)
+	assert.NoError(t, err)
+
+	key, err := dhts[0].Store([]byte("foo"))
+	assert.NoError(t, err)
+
+	// STOREs are delivered asynchronously
+	for _, dht := range dhts {
+		for i := 0; i < 100; i++ {
+			if _, exists := dht.store.Retrieve(b58.Decode(key)); exists {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// The value is stored on every node, and the alpha nodes queried in the
+	// first round all return it
+	getter := dhts[4]
+	value, found, replicas, err := getter.GetWithReplicas(key)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("foo"), value)
+	assert.Equal(t, alpha, replicas)
+
+	// Remove the value from one of the nodes queried in the first round
+	queried := getter.ht.getClosestContacts(alpha, b58.Decode(key), []*NetworkNode{})
+	for _, dht := range dhts {
+		if bytes.Equal(dht.ht.Self.ID, queried.Nodes[0].ID) {
+			dht.store.Delete(b58.Decode(key))
+		}
+	}
+
+	value, found, replicas, err = getter.GetWithReplicas(key)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("foo"), value)
+	assert.Equal(t, alpha-1, replicas)
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// Tests that the lifecycle state moves from initializing to bootstrapping to
+// ready while joining a network, back to ready if bootstrapping again fails,
+// and to shutting down on disconnect
+func TestState(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+	states := make(chan Lifecycle, 1)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+		BootstrapNodes: []*NetworkNode{{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		}},
+	})
+
+	state, uptime := dht.State()
+	assert.Equal(t, LifecycleInitializing, state)
+	assert.Equal(t, time.Duration(0), uptime)
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			if query.Type == messageTypeFindNode {
+				// Record the state while the bootstrap lookup is in progress
+				state, _ := dht.State()
+				states <- state
+				networking.send <- mockFindNodeResponseEmpty(query)
+			}
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 10)
+	state, uptime = dht.State()
+	assert.Equal(t, LifecycleInitializing, state)
+	assert.True(t, uptime > 0)
+
+	err := dht.Bootstrap()
+	assert.NoError(t, err)
+	assert.Equal(t, LifecycleBootstrapping, <-states)
+
+	state, _ = dht.State()
+	assert.Equal(t, LifecycleReady, state)
+
+	// A failed bootstrap of a ready node leaves it ready
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, dht.BootstrapContext(ctx))
+	state, _ = dht.State()
+	assert.Equal(t, LifecycleReady, state)
+
+	err = dht.Disconnect()
+	assert.NoError(t, err)
+
+	state, uptime = dht.State()
+	assert.Equal(t, LifecycleShuttingDown, state)
+	assert.Equal(t, time.Duration(0), uptime)
+
+	<-done
+
+	// A node with no bootstrap nodes is ready once it is listening
+	networking = newMockNetworking()
+	dht, _ = NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+	dht.networking = networking
+	dht.CreateSocket()
+	dht.Listen()
+
+	state, _ = dht.State()
+	assert.Equal(t, LifecycleReady, state)
+
+	dht.Disconnect()
+}
+
+// Tests that OnBootstrapComplete is called once, after the first successful
+// bootstrap, and not again when bootstrapping again or repairing the table
+func TestOnBootstrapComplete(t *testing.T) {
+	completed := make(chan (int), 10)
+
+	dhts, err := BuildNetwork(3, func(options *Options) {
+		if options.Port == "3" {
+			options.OnBootstrapComplete = func(nodeCount int) {
+				completed <- nodeCount
+			}
+		}
+	})
+	assert.NoError(t, err)
+
+	select {
+	case nodeCount := <-completed:
+		assert.Equal(t, 2, nodeCount)
+	case <-time.After(time.Second):
+		t.Fatal("OnBootstrapComplete was not called")
+	}
+
+	assert.NoError(t, dhts[2].Bootstrap())
+	_, err = dhts[2].CheckAndRepairTable(context.Background())
+	assert.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 0, len(completed))
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// Tests that when every peer found by the bootstrap lookup shares a subnet,
+// Bootstrap keeps looking up random IDs until it finds contacts in enough
+// distinct subnets, and fails if there are none to be found
+func TestMinBootstrapSubnets(t *testing.T) {
+	for _, diverse := range []bool{true, false} {
+		networking := newMockNetworking()
+		id := getIDWithValues(0)
+		done := make(chan (int))
+
+		bootstrapID, _ := newID()
+		dht, _ := NewDHT(getInMemoryStore(), &Options{
+			ID:   id,
+			Port: "3000",
+			IP:   "0.0.0.0",
+			BootstrapNodes: []*NetworkNode{
+				{ID: bootstrapID, IP: net.ParseIP("10.0.0.1"), Port: 3001},
+			},
+			MinBootstrapSubnets: 3,
+		})
+
+		dht.networking = networking
+		dht.CreateSocket()
+
+		go func() {
+			dht.Listen()
+		}()
+
+		var local []*NetworkNode
+		for i := 2; i <= 4; i++ {
+			nodeID, _ := newID()
+			local = append(local, &NetworkNode{ID: nodeID, IP: net.ParseIP("10.0.0." + strconv.Itoa(i)), Port: 3001})
+		}
+
+		subnets := 0
+		randomLookups := 0
+
+		go func() {
+			for {
+				query := <-networking.recv
+				if query == nil {
+					close(done)
+					return
+				}
+				res := mockFindNodeResponseEmpty(query)
+				res.Sender = query.Receiver
+				res.Data.(*responseDataFindNode).Closest = local
+				if !bytes.Equal(query.Data.(*queryDataFindNode).Target, id) {
+					randomLookups++
+					if diverse {
+						subnets++
+						nodeID, _ := newID()
+						ip := net.ParseIP("10.0." + strconv.Itoa(subnets) + ".1")
+						res.Data.(*responseDataFindNode).Closest = []*NetworkNode{{ID: nodeID, IP: ip, Port: 3001}}
+					}
+				}
+				go func() {
+					networking.send <- res
+				}()
+			}
+		}()
+
+		err := dht.Bootstrap()
+		assert.True(t, randomLookups > 0)
+		if diverse {
+			assert.NoError(t, err)
+			assert.True(t, dht.ht.countSubnets() >= 3)
+		} else {
+			assert.Equal(t, ErrInsufficientSubnets, err)
+			assert.Equal(t, 1, dht.ht.countSubnets())
+		}
+
+		dht.Disconnect()
+
+		<-done
+	}
+}
+
+// Tests that buckets may exceed k by the BootstrapBucketGrace while
+// bootstrapping, and are trimmed back to k once Bootstrap returns
+func TestBootstrapBucketGrace(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+	evicted := make(chan (NetworkNode), k)
+
+	// Every node is in the furthest bucket from the local node
+	nodeID := func(i int) []byte {
+		id := getIDWithValues(0)
+		id[0] = byte(255)
+		id[19] = byte(i)
+		return id
+	}
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+		BootstrapNodes: []*NetworkNode{
+			{ID: nodeID(0), IP: net.ParseIP("0.0.0.0"), Port: 3001},
+		},
+		BootstrapBucketGrace: k,
+		OnNodeEvicted: func(n NetworkNode, reason EvictionReason) {
+			assert.Equal(t, EvictionBucketOverflow, reason)
+			evicted <- n
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	var nodes []*NetworkNode
+	for i := 1; i <= k+10; i++ {
+		nodes = append(nodes, &NetworkNode{ID: nodeID(i), IP: net.ParseIP("0.0.0.0"), Port: 3001})
+	}
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			res := mockFindNodeResponseEmpty(query)
+			res.Sender = query.Receiver
+			res.Data.(*responseDataFindNode).Closest = nodes
+			go func() {
+				networking.send <- res
+			}()
+		}
+	}()
+
+	assert.NoError(t, dht.Bootstrap())
+	assert.Equal(t, k, dht.NumNodes())
+
+	// The bootstrap node and every node returned by it were held, before the
+	// least recently seen were evicted
+	for i := 0; i < 11; i++ {
+		<-evicted
+	}
+	_, found := dht.Peer(nodeID(0))
+	assert.False(t, found)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that bootstrapping with a BootstrapConcurrency refreshes the buckets
+// beyond the closest neighbour in parallel, reaching more buckets in the same
+// time than refreshing them one at a time
+func TestBootstrapConcurrency(t *testing.T) {
+	sequential := bootstrapRefreshedBuckets(t, 1)
+	parallel := bootstrapRefreshedBuckets(t, 8)
+	assert.True(t, sequential > 0)
+	assert.True(t, parallel > sequential, "parallel %d, sequential %d", parallel, sequential)
+}
+
+// Tests that BootstrapContext stops once its context is cancelled
+func TestBootstrapContextCancelled(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+		BootstrapNodes: []*NetworkNode{
+			{ID: getZerodIDWithNthByte(19, 1), IP: net.ParseIP("0.0.0.0"), Port: 3001},
+		},
+		BootstrapConcurrency: 8,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			networking.send <- mockFindNodeResponseEmpty(query)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, dht.BootstrapContext(ctx))
+	state, _ := dht.State()
+	assert.Equal(t, LifecycleInitializing, state)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// bootstrapRefreshedBuckets bootstraps against a single node which answers
+// every query after a delay, and returns the number of distinct buckets
+// looked up within a fixed window of the bootstrap starting
+func bootstrapRefreshedBuckets(t *testing.T, concurrency int) int {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+		BootstrapNodes: []*NetworkNode{
+			{ID: getZerodIDWithNthByte(19, 1), IP: net.ParseIP("0.0.0.0"), Port: 3001},
+		},
+		BootstrapConcurrency: concurrency,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	mutex := &sync.Mutex{}
+	buckets := make(map[int]bool)
+	var start time.Time
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			if query.Type == messageTypeFindNode {
+				mutex.Lock()
+				if start.IsZero() {
+					start = time.Now()
+				}
+				if time.Since(start) < 100*time.Millisecond {
+					target := query.Data.(*queryDataFindNode).Target
+					buckets[dht.ht.getBucketIndex(target)] = true
+				}
+				mutex.Unlock()
+			}
+			res := mockFindNodeResponseEmpty(query)
+			go func() {
+				time.Sleep(5 * time.Millisecond)
+				networking.send <- res
+			}()
+		}
+	}()
+
+	assert.NoError(t, dht.Bootstrap())
+
+	dht.Disconnect()
+
+	<-done
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(buckets)
+}
+
+// Tests that the local node re-announces itself with a FIND_NODE lookup of
+// its own ID once every TAnnounce, give or take the jitter
+func TestAnnounce(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+	announced := make(chan (*NetworkNode), k)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:        id,
+		Port:      "3000",
+		IP:        "0.0.0.0",
+		TAnnounce: time.Minute,
+	})
+
+	now := time.Now()
+	dht.now = func() time.Time {
+		return now
+	}
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	peers := []*NetworkNode{
+		{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001},
+		{ID: getZerodIDWithNthByte(2, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3002},
+	}
+	for _, p := range peers {
+		dht.addNode(newNode(p))
+	}
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			if query.Type == messageTypeFindNode {
+				assert.Equal(t, id, query.Data.(*queryDataFindNode).Target)
+				announced <- query.Receiver
+				res := mockFindNodeResponseEmpty(query)
+				go func() {
+					networking.send <- res
+				}()
+			}
+		}
+	}()
+
+	// The first call schedules the first announcement
+	dht.announceIfDue()
+	assert.Equal(t, 0, len(announced))
+
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Second * 53)
+		dht.announceIfDue()
+		assert.Equal(t, 0, len(announced))
+
+		now = now.Add(time.Second * 14)
+		dht.announceIfDue()
+		assert.Equal(t, len(peers), len(announced))
+
+		contacted := make(map[int]bool)
+		for range peers {
+			contacted[(<-announced).Port] = true
+		}
+		assert.Equal(t, map[int]bool{3001: true, 3002: true}, contacted)
+	}
+
+	// The DHT is not listening, so there are no timers to stop
+	close(networking.recv)
+
+	<-done
+}
+
+// Tests that OnMaintenanceTick is called for every sweep of each round of
+// maintenance, and for announcements only once they are due
+func TestOnMaintenanceTick(t *testing.T) {
+	ticks := make(chan string, 20)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:        getIDWithValues(0),
+		Port:      "3000",
+		IP:        "0.0.0.0",
+		TAnnounce: time.Minute,
+		OnMaintenanceTick: func(kind string) {
+			ticks <- kind
+		},
+	})
+
+	now := time.Now()
+	dht.now = func() time.Time {
+		return now
+	}
+
+	counts := func(n int) map[string]int {
+		result := make(map[string]int)
+		for i := 0; i < n; i++ {
+			select {
+			case kind := <-ticks:
+				result[kind]++
+			case <-time.After(time.Second):
+				t.Fatal("Maintenance tick not reported")
+			}
+		}
+		return result
+	}
+
+	// The first round schedules the first announcement
+	dht.maintain()
+	now = now.Add(time.Second * 53)
+	dht.maintain()
+	assert.Equal(t, map[string]int{
+		MaintenanceRefresh:   2,
+		MaintenanceReplicate: 2,
+		MaintenanceExpire:    2,
+	}, counts(6))
+
+	now = now.Add(time.Second * 14)
+	dht.maintain()
+	assert.Equal(t, map[string]int{
+		MaintenanceRefresh:   1,
+		MaintenanceAnnounce:  1,
+		MaintenanceReplicate: 1,
+		MaintenanceExpire:    1,
+	}, counts(4))
+	assert.Equal(t, 0, len(ticks))
+}
+
+// Tests retrieving a value which is served compressed, and that a value with
+// an unknown encoding is treated as not found
+func TestGetCompressedValue(t *testing.T) {
+	dhts, err := BuildNetwork(3, func(options *Options) {
+		options.CompressValues = true
+	})
+	assert.NoError(t, err)
+
+	data := bytes.Repeat([]byte("foo"), 1000)
+	key, err := dhts[0].Store(data)
+	assert.NoError(t, err)
+
+	dhts[2].store.Delete(b58.Decode(key))
+	value, found, err := dhts[2].Get(key)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, data, value)
+
+	assert.NoError(t, CloseNetwork(dhts))
+
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	logs := &lockedBuffer{mutex: &sync.Mutex{}}
+	dht.options.Logger.SetOutput(logs)
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	dht.addNode(newNode(&NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			if query.Type == messageTypeFindValue {
+				assert.Equal(t, supportedEncodings, query.Data.(*queryDataFindValue).Encodings)
+				res := mockFindNodeResponseEmpty(query)
+				res.Sender = query.Receiver
+				res.Data = &responseDataFindValue{Value: data, Encoding: 100}
+				networking.send <- res
+			}
+		}
+	}()
+
+	_, found, err = dht.Get(key)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Contains(t, logs.String(), "Could not decode value")
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that a value too large to be returned uncompressed is compressed so
+// that it can still be retrieved
+func TestGetValueAtMessageLimit(t *testing.T) {
+	// Compressing the value takes a while
+	dhts, err := BuildNetwork(2, func(options *Options) {
+		options.TMsgTimeout = time.Second * 30
+	})
+	assert.NoError(t, err)
+
+	data := make([]byte, maxMessageLength)
+	key := dhts[0].store.GetKey(data)
+	dhts[0].storeValue(key, data, true)
+
+	value, found, err := dhts[1].Get(b58.Encode(key))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, bytes.Equal(data, value))
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// Tests that values held locally past their expiration are neither returned
+// by Get nor served to other nodes, so the lookup continues on the network,
+// unless ServeExpiredValues is set
+func TestExpiredLocalValue(t *testing.T) {
+	dhts, err := BuildNetwork(3)
+	assert.NoError(t, err)
+
+	expired := time.Now().Add(-time.Second)
+
+	_, err = dhts[1].Store([]byte("foo"))
+	assert.NoError(t, err)
+	key := dhts[0].store.GetKey([]byte("foo"))
+	dhts[0].store.Store(key, []byte("stale"), time.Now().Add(time.Hour), expired, false)
+
+	value, found, err := dhts[0].Get(b58.Encode(key))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("foo"), value)
+
+	// Held only by a node on which it has expired
+	other := dhts[2].store.GetKey([]byte("bar"))
+	dhts[2].store.Store(other, []byte("bar"), time.Now().Add(time.Hour), expired, false)
+
+	_, found, err = dhts[0].Get(b58.Encode(other))
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	dhts[2].options.ServeExpiredValues = true
+	value, found, err = dhts[2].Get(b58.Encode(other))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("bar"), value)
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// Tests storing on a node with an empty routing table. The value should be
+// stored locally and ErrNoPeers returned. When TStoreWaitForPeers is set, the
+// store should instead proceed once a node is added, or stop once its context
+// is done.
+func TestStoreNoPeers(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	stored := make(chan (int))
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			switch query.Type {
+			case messageTypeFindNode:
+				res := mockFindNodeResponseEmpty(query)
+				networking.send <- res
+			case messageTypeStore:
+				networking.send <- mockStoreResponse(query, true)
+				close(stored)
+			}
+		}
+	}()
+
+	key, err := dht.Store([]byte("foo"))
+	assert.Equal(t, ErrNoPeers, err)
+	assert.NotEqual(t, "", key)
+
+	value, exists, err := dht.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, true, exists)
+	assert.Equal(t, []byte("foo"), value)
+
+	dht.options.TStoreWaitForPeers = time.Second * 5
+
+	// A store waiting for peers stops once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	_, err = dht.StoreContext(ctx, []byte("baz"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		dht.addNode(newNode(&NetworkNode{
+			ID:   getZerodIDWithNthByte(1, byte(255)),
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		}))
+	}()
+
+	_, err = dht.Store([]byte("bar"))
+	assert.NoError(t, err)
+
+	<-stored
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that with QueuePeerlessStores set, data stored on a node with an empty
+// routing table is stored to the network once a node is added
+func TestQueuePeerlessStores(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:                  getIDWithValues(0),
+		Port:                "3000",
+		IP:                  "0.0.0.0",
+		QueuePeerlessStores: true,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	stored := make(chan []byte, 1)
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			switch query.Type {
+			case messageTypeFindNode:
+				res := mockFindNodeResponseEmpty(query)
+				go func() {
+					networking.send <- res
+				}()
+			case messageTypeStore:
+				networking.send <- mockStoreResponse(query, true)
+				stored <- query.Data.(*queryDataStore).Data
+			}
+		}
+	}()
+
+	_, err := dht.Store([]byte("foo"))
+	assert.Equal(t, ErrNoPeers, err)
+
+	dht.addNode(newNode(&NetworkNode{
+		ID:   getZerodIDWithNthByte(1, byte(255)),
+		Port: 3001,
+		IP:   net.ParseIP("0.0.0.0"),
+	}))
+
+	select {
+	case data := <-stored:
+		assert.Equal(t, []byte("foo"), data)
+	case <-time.After(time.Second * 3):
+		t.Fatal("Queued store was not sent")
+	}
+
+	// The queue is emptied once stored
+	assert.Equal(t, 0, len(dht.pendingStores))
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests exporting the store of one node and importing it into another.
+// Expired entries should not be imported.
+func TestExportImportStore(t *testing.T) {
+	dht1, _ := NewDHT(getInMemoryStore(), &Options{
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	dht2, _ := NewDHT(getInMemoryStore(), &Options{
+		Port: "3001",
+		IP:   "0.0.0.0",
+	})
+
+	foo := dht1.store.GetKey([]byte("foo"))
+	bar := dht1.store.GetKey([]byte("bar"))
+	replication := time.Now().Add(time.Hour)
+	expiration := time.Now().Add(time.Hour * 2)
+	dht1.store.Store(foo, []byte("foo"), replication, expiration, true)
+	dht1.store.Store(bar, []byte("bar"), replication, time.Now().Add(-time.Second), false)
+
+	var buf bytes.Buffer
+	err := dht1.ExportStore(&buf)
+	assert.NoError(t, err)
+
+	err = dht2.ImportStore(&buf)
+	assert.NoError(t, err)
+
+	entries := dht2.storeEntries()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, foo, entries[0].Key)
+	assert.Equal(t, []byte("foo"), entries[0].Data)
+	assert.Equal(t, true, entries[0].Publisher)
+	assert.Equal(t, true, replication.Equal(entries[0].Replication))
+	assert.Equal(t, true, expiration.Equal(entries[0].Expiration))
+
+	_, exists := dht2.store.Retrieve(bar)
+	assert.Equal(t, false, exists)
+}
+
+// baseStore is embedded by minimalStore, as a field named Store would
+// collide with the Store method
+type baseStore interface {
+	Store
+}
+
+// minimalStore implements only the methods of the Store interface, hiding
+// the optional interfaces of the MemoryStore it wraps
+type minimalStore struct {
+	baseStore
+}
+
+// Tests that a store which does not implement EntryLister is listed using
+// GetAllKeysForReplication
+func TestExportStoreWithoutEntryLister(t *testing.T) {
+	ms := getInMemoryStore()
+	dht1, _ := NewDHT(&minimalStore{ms}, &Options{
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	dht2, _ := NewDHT(getInMemoryStore(), &Options{
+		Port: "3001",
+		IP:   "0.0.0.0",
+	})
+
+	_, ok := dht1.store.(EntryLister)
+	assert.False(t, ok)
+
+	foo := dht1.store.GetKey([]byte("foo"))
+	dht1.store.Store(foo, []byte("foo"), time.Now().Add(-time.Second), time.Now().Add(time.Hour), false)
+	dht1.countRemoteKeys()
+	used, _ := dht1.StoreUtilization()
+	assert.Equal(t, 1, used)
+
+	var buf bytes.Buffer
+	err := dht1.ExportStore(&buf)
+	assert.NoError(t, err)
+
+	err = dht2.ImportStore(&buf)
+	assert.NoError(t, err)
+
+	// The expiration is not known, so the key is given a full TExpire
+	entries := dht2.storeEntries()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, foo, entries[0].Key)
+	assert.Equal(t, []byte("foo"), entries[0].Data)
+	assert.True(t, entries[0].Expiration.After(time.Now().Add(dht2.options.TExpire-time.Minute)))
+}
+
+// Tests adding peers with and without a known ID. Peers are pinged, and
+// only added with the ID they respond with.
+func TestAddPeer(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	peerID := getZerodIDWithNthByte(1, byte(255))
+
+	// Pinging requires a socket
+	err := dht.AddPeer(&NetworkNode{ID: peerID, IP: net.ParseIP("0.0.0.0"), Port: 3001})
+	assert.Error(t, err)
+	assert.Equal(t, 0, dht.NumNodes())
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	unknownID := getZerodIDWithNthByte(2, byte(255))
+	actualID := getZerodIDWithNthByte(3, byte(255))
+	ids := map[int][]byte{3001: peerID, 3002: unknownID, 3003: actualID}
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			assert.Equal(t, messageTypePing, query.Type)
+			assert.Nil(t, query.Receiver.ID)
+			res := mockFindNodeResponseEmpty(query)
+			res.Sender = &NetworkNode{ID: ids[query.Receiver.Port], IP: query.Receiver.IP, Port: query.Receiver.Port}
+			networking.send <- res
+		}
+	}()
+
+	err = dht.AddPeer(&NetworkNode{ID: peerID, IP: net.ParseIP("0.0.0.0"), Port: 3001})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dht.NumNodes())
+
+	err = dht.AddPeer(&NetworkNode{IP: net.ParseIP("0.0.0.0"), Port: 3002})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dht.NumNodes())
+
+	peer, found := dht.Peer(unknownID)
+	assert.True(t, found)
+	assert.Equal(t, 3002, peer.Port)
+
+	// A peer claiming an ID it does not respond with is not added
+	forgedID := getZerodIDWithNthByte(4, byte(255))
+	err = dht.AddPeer(&NetworkNode{ID: forgedID, IP: net.ParseIP("0.0.0.0"), Port: 3003})
+	assert.Error(t, err)
+	assert.Equal(t, 2, dht.NumNodes())
+	_, found = dht.Peer(forgedID)
+	assert.False(t, found)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests retrieving a value using a hint which holds the value. Only a single
+// FIND_VALUE should be sent to the hint.
+func TestGetWithHint(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	hint := NetworkNode{
+		ID:   getZerodIDWithNthByte(1, byte(255)),
+		Port: 3001,
+		IP:   net.ParseIP("0.0.0.0"),
+	}
+
+	queries := 0
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			queries++
+			assert.Equal(t, messageTypeFindValue, query.Type)
+			assert.Equal(t, hint.ID, query.Receiver.ID)
+			res := mockFindValueResponse(query, []byte("foo"))
+			networking.send <- res
+		}
+	}()
+
+	key := b58.Encode(dht.store.GetKey([]byte("foo")))
+
+	value, exists, err := dht.GetWithHint(key, hint)
+	assert.NoError(t, err)
+	assert.Equal(t, true, exists)
+	assert.Equal(t, []byte("foo"), value)
+	assert.Equal(t, 1, queries)
+
+	// An expired local copy is not served, so hint is still queried. The hint
+	// is removed from the routing table so that a lookup can not find it.
+	dht.removeNode(hint.ID, EvictionRemoved)
+	keyBytes := b58.Decode(key)
+	dht.store.Store(keyBytes, []byte("foo"), time.Now().Add(time.Hour), time.Now().Add(-time.Second), false)
+	value, exists, err = dht.GetWithHint(key, hint)
+	assert.NoError(t, err)
+	assert.Equal(t, true, exists)
+	assert.Equal(t, []byte("foo"), value)
+	assert.Equal(t, 2, queries)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests limiting the number of keys stored per publisher. The third key
+// published by the first publisher should be rejected, while the second
+// publisher and keys replicated by the first publisher should be unaffected.
+// The publishers are persisted in the store, and exported with it.
+func TestMaxKeysPerPublisher(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:                  id,
+		Port:                "3000",
+		IP:                  "0.0.0.0",
+		MaxKeysPerPublisher: 2,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	publisher1 := &NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}
+	publisher2 := &NetworkNode{ID: getZerodIDWithNthByte(2, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3002}
+
+	// store returns whether the STORE was reported as stored
+	store := func(sender *NetworkNode, data string, publishing bool) bool {
+		networking.msgChan <- &message{
+			Sender:   sender,
+			Receiver: dht.ht.Self,
+			Type:     messageTypeStore,
+			Data:     &queryDataStore{Data: []byte(data), Publishing: publishing},
+		}
+		return (<-networking.recv).Data.(*responseDataStore).Success
+	}
+
+	assert.True(t, store(publisher1, "a", true))
+	assert.True(t, store(publisher1, "b", true))
+	assert.True(t, store(publisher1, "a", true))
+	assert.False(t, store(publisher1, "c", true))
+	assert.True(t, store(publisher2, "d", true))
+	assert.True(t, store(publisher1, "e", false))
+
+	for _, data := range []string{"a", "b", "d", "e"} {
+		_, exists := dht.store.Retrieve(dht.store.GetKey([]byte(data)))
+		assert.Equal(t, true, exists)
+	}
+
+	_, exists := dht.store.Retrieve(dht.store.GetKey([]byte("c")))
+	assert.Equal(t, false, exists)
+
+	memoryStore := dht.store.(*MemoryStore)
+	assert.Equal(t, publisher1.ID, memoryStore.GetPublishedBy(dht.store.GetKey([]byte("a"))))
+	assert.Equal(t, publisher2.ID, memoryStore.GetPublishedBy(dht.store.GetKey([]byte("d"))))
+	assert.Nil(t, memoryStore.GetPublishedBy(dht.store.GetKey([]byte("e"))))
+
+	// The limit still applies once the store is imported into another node
+	var buf bytes.Buffer
+	err := dht.ExportStore(&buf)
+	assert.NoError(t, err)
+
+	dht.Disconnect()
+
+	imported, _ := NewDHT(getInMemoryStore(), &Options{
+		Port:                "3001",
+		IP:                  "0.0.0.0",
+		MaxKeysPerPublisher: 2,
+	})
+	err = imported.ImportStore(&buf)
+	assert.NoError(t, err)
+
+	assert.False(t, imported.storeFromPeer(&message{
+		Sender:   publisher1,
+		Receiver: imported.ht.Self,
+		Type:     messageTypeStore,
+		Data:     &queryDataStore{Data: []byte("c"), Publishing: true},
+	}))
+	assert.True(t, imported.storeFromPeer(&message{
+		Sender:   publisher2,
+		Receiver: imported.ht.Self,
+		Type:     messageTypeStore,
+		Data:     &queryDataStore{Data: []byte("c"), Publishing: true},
+	}))
+}
+
+// Tests that a value published by the local node and stored back to it by
+// another node's replication remains published by the local node, with its
+// republish time unchanged
+func TestOwnValueEchoed(t *testing.T) {
+	networking := newMockNetworking()
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	// There are no peers, so the value is only stored locally
+	_, err := dht.Store([]byte("a"))
+	assert.Equal(t, ErrNoPeers, err)
+	entry := func(data string) StoreEntry {
+		for _, e := range dht.storeEntries() {
+			if string(e.Data) == data {
+				return e
+			}
+		}
+		t.Fatalf("%s is not stored", data)
+		return StoreEntry{}
+	}
+	published := entry("a")
+	assert.True(t, published.Publisher)
+
+	time.Sleep(time.Millisecond * 10)
+
+	peer := &NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}
+	for _, data := range []string{"a", "b"} {
+		networking.msgChan <- &message{
+			Sender:   peer,
+			Receiver: dht.ht.Self,
+			Type:     messageTypeStore,
+			Data:     &queryDataStore{Data: []byte(data)},
+		}
+		assert.True(t, (<-networking.recv).Data.(*responseDataStore).Success)
+	}
+
+	echoed := entry("a")
+	assert.True(t, echoed.Publisher)
+	assert.Equal(t, published.Replication, echoed.Replication)
+	assert.False(t, entry("b").Publisher)
+	assert.Equal(t, 1, len(dht.remoteEntries()))
+
+	dht.Disconnect()
+}
+
+// Tests that, as the store fills up, STOREs of keys in the far half of the
+// keyspace are rejected, and that the keys furthest from the local ID are
+// deleted first once the store is over capacity
+func TestMaxStoredKeys(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:            id,
+		Port:          "3000",
+		IP:            "0.0.0.0",
+		MaxStoredKeys: 10,
+		TExpire:       time.Hour,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	// Keys with the first bit set are in the far half of the keyspace
+	var near, far []string
+	for i := 0; len(near) < 12 || len(far) < 5; i++ {
+		data := strconv.Itoa(i)
+		if dht.store.GetKey([]byte(data))[0]&0x80 == 0 {
+			near = append(near, data)
+		} else {
+			far = append(far, data)
+		}
+	}
+	near = near[:12]
+	far = far[:5]
+
+	publisher := &NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}
+	// store returns whether the STORE was reported as stored
+	store := func(data string) bool {
+		networking.msgChan <- &message{
+			Sender:   publisher,
+			Receiver: dht.ht.Self,
+			Type:     messageTypeStore,
+			Data:     &queryDataStore{Data: []byte(data)},
+		}
+		return (<-networking.recv).Data.(*responseDataStore).Success
+	}
+
+	// The first far key is accepted as the store is not yet near capacity
+	for _, data := range near[:8] {
+		assert.True(t, store(data))
+	}
+	assert.True(t, store(far[0]))
+	for _, data := range far[1:] {
+		assert.False(t, store(data))
+	}
+	for _, data := range near[8:] {
+		assert.True(t, store(data))
+	}
+
+	stored := func(data string) bool {
+		_, exists := dht.store.Retrieve(dht.store.GetKey([]byte(data)))
+		return exists
+	}
+
+	assert.Equal(t, 13, len(dht.storeEntries()))
+	assert.True(t, stored(far[0]))
+	for _, data := range far[1:] {
+		assert.False(t, stored(data))
+	}
+
+	// The far key and the two furthest near keys are deleted
+	sort.Slice(near, func(i, j int) bool {
+		return bytes.Compare(dht.store.GetKey([]byte(near[i])), dht.store.GetKey([]byte(near[j]))) < 0
+	})
+	dht.expireKeys()
+	assert.Equal(t, 10, len(dht.storeEntries()))
+	assert.False(t, stored(far[0]))
+	for _, data := range near[:10] {
+		assert.True(t, stored(data))
+	}
+
+	dht.Disconnect()
+}
+
+// Tests that StoreUtilization counts the keys stored on behalf of other
+// nodes as STOREs are received and keys are expired
+func TestStoreUtilization(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:            id,
+		Port:          "3000",
+		IP:            "0.0.0.0",
+		MaxStoredKeys: 10,
+		TExpire:       time.Hour,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	used, capacity := dht.StoreUtilization()
+	assert.Equal(t, 0, used)
+	assert.Equal(t, 10, capacity)
+
+	publisher := &NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}
+	store := func(data string) {
+		networking.msgChan <- &message{
+			Sender:   publisher,
+			Receiver: dht.ht.Self,
+			Type:     messageTypeStore,
+			Data:     &queryDataStore{Data: []byte(data)},
+		}
+		<-networking.recv
+	}
+
+	store("a")
+	store("b")
+	store("c")
+	used, _ = dht.StoreUtilization()
+	assert.Equal(t, 3, used)
+
+	// Storing a key again does not count it twice
+	store("a")
+	used, _ = dht.StoreUtilization()
+	assert.Equal(t, 3, used)
+
+	// Keys published by the local node are not counted
+	dht.storeValue(dht.store.GetKey([]byte("d")), []byte("d"), true)
+	used, _ = dht.StoreUtilization()
+	assert.Equal(t, 3, used)
+
+	// Expire one of the stored keys
+	key := dht.store.GetKey([]byte("b"))
+	dht.store.Store(key, []byte("b"), time.Now().Add(time.Hour), time.Now().Add(-time.Second), false)
+	dht.expireKeys()
+	used, _ = dht.StoreUtilization()
+	assert.Equal(t, 2, used)
+	assert.Equal(t, 3, len(dht.storeEntries()))
+
+	// Publishing a key held on behalf of another node stops it being counted
+	dht.storeValue(dht.store.GetKey([]byte("c")), []byte("c"), true)
+	used, _ = dht.StoreUtilization()
+	assert.Equal(t, 1, used)
+
+	// Shedding a key stops it being counted without a recount
+	dht.deleteRemoteKey(dht.store.GetKey([]byte("a")))
+	used, _ = dht.StoreUtilization()
+	assert.Equal(t, 0, used)
+	assert.Equal(t, 2, len(dht.storeEntries()))
+
+	// Keys published by the local node are not shed
+	dht.deleteRemoteKey(dht.store.GetKey([]byte("c")))
+	assert.Equal(t, 2, len(dht.storeEntries()))
+
+	dht.Disconnect()
+}
+
+// Tests that storing a key which already exists with identical data only
+// refreshes its expiration time, and does not replace the stored data
+func TestStoreValueRefresh(t *testing.T) {
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	original := []byte("foo")
+	key := dht.store.GetKey(original)
+	expiration := time.Now().Add(time.Minute)
+	dht.store.Store(key, original, time.Now(), expiration, false)
+
+	overwritten, err := dht.storeValue(key, []byte("foo"), false)
+	assert.NoError(t, err)
+	assert.Equal(t, false, overwritten)
+
+	entries := dht.storeEntries()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, true, entries[0].Expiration.After(expiration))
+
+	// The originally stored slice should have been kept
+	assert.Equal(t, &original[0], &entries[0].Data[0])
+}
+
+// fixedKeyStore is a MemoryStore which keys all data by the same key, as a
+// store of mutable values would
+type fixedKeyStore struct {
+	*MemoryStore
+}
+
+func (s *fixedKeyStore) GetKey(data []byte) []byte {
+	return getZerodIDWithNthByte(0, byte(1))
+}
+
+// Tests that StoreVerbose reports when different data already held for the
+// key was overwritten
+func TestStoreReportOverwritten(t *testing.T) {
+	dht, _ := NewDHT(&fixedKeyStore{getInMemoryStore()}, &Options{
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	_, report, err := dht.StoreVerbose([]byte("foo"))
+	assert.Equal(t, ErrNoPeers, err)
+	assert.False(t, report.Overwritten)
+
+	_, report, err = dht.StoreVerbose([]byte("foo"))
+	assert.Equal(t, ErrNoPeers, err)
+	assert.False(t, report.Overwritten)
+
+	_, report, err = dht.StoreVerbose([]byte("bar"))
+	assert.Equal(t, ErrNoPeers, err)
+	assert.True(t, report.Overwritten)
+}
+
+// Tests that the agent string is advertised in ping responses, and that the
+// agent string of a bootstrap node is recorded against its contact
+func TestAgentName(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+	bootstrapID := getZerodIDWithNthByte(1, byte(255))
+	pongs := make(chan (*message))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:        id,
+		Port:      "3000",
+		IP:        "0.0.0.0",
+		AgentName: "local/1.0",
+		BootstrapNodes: []*NetworkNode{{
+			Port: 3001,
+			IP:   net.ParseIP("0.0.0.0"),
+		},
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			switch query.Type {
+			case messageTypePing:
+				if query.IsResponse {
+					pongs <- query
+					continue
+				}
+				res := &message{IsResponse: true, Type: messageTypePing}
+				res.Sender = &NetworkNode{ID: bootstrapID, IP: net.ParseIP("0.0.0.0"), Port: 3001}
+				res.Receiver = query.Sender
+				res.Data = &responseDataPing{Agent: "remote/2.0"}
+				networking.send <- res
+			case messageTypeFindNode:
+				networking.send <- mockFindNodeResponseEmpty(query)
+			}
+		}
+	}()
+
+	dht.Bootstrap()
+
+	stats, found := dht.PeerStats(bootstrapID)
+	assert.Equal(t, true, found)
+	assert.Equal(t, "remote/2.0", stats.Agent)
+
+	networking.msgChan <- &message{
+		Sender:   &NetworkNode{ID: bootstrapID, IP: net.ParseIP("0.0.0.0"), Port: 3001},
+		Receiver: dht.ht.Self,
+		Type:     messageTypePing,
+	}
+
+	pong := <-pongs
+	assert.Equal(t, "local/1.0", pong.Data.(*responseDataPing).Agent)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests retrieving a value held only by the third closest node to the key.
+// The only node initially known is the closest node, which returns the second
+// and third closest nodes. The lookup converges on the closest node, and then
+// retries the next closest nodes in turn.
+func TestFindValueRetry(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:                    id,
+		Port:                  "3000",
+		IP:                    "0.0.0.0",
+		FindValueRetryBreadth: 2,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	key := dht.store.GetKey([]byte("foo"))
+	var nodes []*NetworkNode
+	for i := 1; i <= 3; i++ {
+		nodeID := append([]byte{}, key...)
+		nodeID[19] ^= byte(i)
+		nodes = append(nodes, &NetworkNode{ID: nodeID, IP: net.ParseIP("0.0.0.0"), Port: 3001})
+	}
+
+	dht.addNode(newNode(nodes[0]))
+
+	var queried [][]byte
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			queried = append(queried, query.Receiver.ID)
+			res := mockFindValueResponseEmpty(query)
+			switch {
+			case bytes.Compare(query.Receiver.ID, nodes[0].ID) == 0:
+				res.Data.(*responseDataFindValue).Closest = []*NetworkNode{nodes[2], nodes[1]}
+			case bytes.Compare(query.Receiver.ID, nodes[2].ID) == 0:
+				res.Data.(*responseDataFindValue).Value = []byte("foo")
+			}
+			networking.send <- res
+		}
+	}()
+
+	value, exists, err := dht.Get(b58.Encode(key))
+	assert.NoError(t, err)
+	assert.Equal(t, true, exists)
+	assert.Equal(t, []byte("foo"), value)
+	assert.Equal(t, [][]byte{nodes[0].ID, nodes[1].ID, nodes[2].ID}, queried)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that a lookup stops once responses keep returning only nodes which
+// have already been queried, as colluding nodes would to trap the lookup
+func TestLookupRoutingLoop(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	var logs bytes.Buffer
+	dht.options.Logger.SetOutput(&logs)
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	// The three closest nodes return the three furthest nodes, which only
+	// return the three closest nodes
+	target := getIDWithValues(1)
+	var colluders []*NetworkNode
+	for i := 1; i <= 6; i++ {
+		nodeID := append([]byte{}, target...)
+		nodeID[19] ^= byte(i)
+		colluders = append(colluders, &NetworkNode{ID: nodeID, IP: net.ParseIP("0.0.0.0"), Port: 3001})
+		dht.addNode(newNode(colluders[i-1]))
+	}
+
+	queried := 0
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			queried++
+			res := mockFindValueResponseEmpty(query)
+			if query.Receiver.ID[19]^target[19] <= 3 {
+				res.Data.(*responseDataFindValue).Closest = colluders[3:]
+			} else {
+				res.Data.(*responseDataFindValue).Closest = colluders[:3]
+			}
+			go func() {
+				networking.send <- res
+			}()
+		}
+	}()
+
+	_, closest, err := dht.iterate(iterateFindValue, target, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(closest))
+
+	// The three closest nodes, then two retries returning only nodes already
+	// queried
+	assert.Equal(t, 5, queried)
+	assert.Contains(t, logs.String(), "returning only nodes already queried")
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that the breadth-first lookup strategy queries more nodes than the
+// closest-first strategy on the same topology
+func TestLookupStrategy(t *testing.T) {
+	queried := map[int]int{}
+
+	for _, strategy := range []int{LookupClosestFirst, LookupBreadthFirst} {
+		networking := newMockNetworking()
+		done := make(chan (int))
+
+		dht, _ := NewDHT(getInMemoryStore(), &Options{
+			ID:                    getIDWithValues(0),
+			Port:                  "3000",
+			IP:                    "0.0.0.0",
+			FindValueRetryBreadth: 1,
+			LookupStrategy:        strategy,
+		})
+
+		dht.networking = networking
+		dht.CreateSocket()
+
+		go func() {
+			dht.Listen()
+		}()
+
+		// The node in the routing table knows of 10 nodes closer to the
+		// target, each of which knows of the same 10 nodes
+		target := getIDWithValues(1)
+		far := append([]byte{}, target...)
+		far[10] ^= byte(255)
+		dht.addNode(newNode(&NetworkNode{ID: far, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+
+		var closer []*NetworkNode
+		for i := 1; i <= 10; i++ {
+			nodeID := append([]byte{}, target...)
+			nodeID[19] ^= byte(i)
+			closer = append(closer, &NetworkNode{ID: nodeID, IP: net.ParseIP("0.0.0.0"), Port: 3001})
+		}
+
+		go func() {
+			for {
+				query := <-networking.recv
+				if query == nil {
+					close(done)
+					return
+				}
+				queried[strategy]++
+				res := mockFindValueResponseEmpty(query)
+				res.Data.(*responseDataFindValue).Closest = closer
+				go func() {
+					networking.send <- res
+				}()
+			}
+		}()
+
+		_, _, err := dht.iterate(iterateFindValue, target, nil)
+		assert.NoError(t, err)
+
+		dht.Disconnect()
+
+		<-done
+	}
+
+	// The far node, the 3 closest nodes, then a single retry
+	assert.Equal(t, 5, queried[LookupClosestFirst])
+
+	// The far node, then all of the closer nodes
+	assert.Equal(t, 11, queried[LookupBreadthFirst])
+}
+
+// Tests that FindNodeStream sends each node as it is discovered, and closes
+// the channel once the lookup converges or is cancelled
+func TestFindNodeStream(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+	queries := make(chan *message)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(255),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			queries <- query
+		}
+	}()
+
+	// Each node knows only of the next node, which is closer to the target
+	target := getIDWithValues(0)
+	idA := getZerodIDWithNthByte(5, byte(1))
+	idB := getZerodIDWithNthByte(10, byte(1))
+	idC := getZerodIDWithNthByte(15, byte(1))
+	dht.addNode(newNode(&NetworkNode{ID: idA, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+
+	nodes, errs := dht.FindNodeStream(context.Background(), target)
+
+	// Each node should be sent before the response from the node which
+	// returned it is received
+	n := <-nodes
+	assert.Equal(t, idA, n.ID)
+	query := <-queries
+	assert.Equal(t, idA, query.Receiver.ID)
+	networking.send <- mockFindNodeResponse(query, idB)
+
+	n = <-nodes
+	assert.Equal(t, idB, n.ID)
+	query = <-queries
+	assert.Equal(t, idB, query.Receiver.ID)
+	networking.send <- mockFindNodeResponse(query, idC)
+
+	n = <-nodes
+	assert.Equal(t, idC, n.ID)
+	query = <-queries
+	assert.Equal(t, idC, query.Receiver.ID)
+	networking.send <- mockFindNodeResponseEmpty(query)
+
+	_, ok := <-nodes
+	assert.False(t, ok)
+	err := <-errs
+	assert.NoError(t, err)
+
+	// Cancelling the lookup should close the channel
+	ctx, cancel := context.WithCancel(context.Background())
+	nodes, errs = dht.FindNodeStream(ctx, target)
+	<-nodes
+	cancel()
+	for range nodes {
+	}
+	err = <-errs
+	assert.Equal(t, context.Canceled, err)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that FindNodeSets returns disjoint sets of nodes, each farther from
+// the target than the one before
+func TestFindNodeSets(t *testing.T) {
+	dhts, err := BuildNetwork(2*k + 10)
+	assert.NoError(t, err)
+
+	target := getIDWithValues(0)
+	sets, err := dhts[0].FindNodeSets(target, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(sets))
+
+	seen := make(map[string]bool)
+	var furthest *big.Int
+	for _, set := range sets {
+		assert.Equal(t, k, len(set))
+		for _, n := range set {
+			assert.False(t, seen[string(n.ID)])
+			seen[string(n.ID)] = true
+
+			distance := getDistance(n.ID, target)
+			if furthest != nil {
+				assert.Equal(t, 1, distance.Cmp(furthest))
+			}
+			furthest = distance
+		}
+	}
+
+	_, err = dhts[0].FindNodeSets(target, 0)
+	assert.Error(t, err)
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// Tests that the effective configuration contains the defaults applied to
+// options which were not provided
+func TestConfig(t *testing.T) {
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		Port:        "3000",
+		IP:          "127.0.0.1",
+		TMsgTimeout: time.Second * 5,
+		AgentName:   "test/1.0",
+	})
+
+	config := dht.Config()
+	assert.Equal(t, k, config.K)
+	assert.Equal(t, alpha, config.Alpha)
+	assert.Equal(t, 20, config.IDLength)
+	assert.Equal(t, "127.0.0.1", config.IP)
+	assert.Equal(t, 3000, config.Port)
+	assert.Equal(t, time.Second*5, config.TMsgTimeout)
+	assert.Equal(t, time.Second*86410, config.TExpire)
+	assert.Equal(t, time.Second*3600, config.TRefresh)
+	assert.Equal(t, time.Second*3600, config.TReplicate)
+	assert.Equal(t, time.Second*86400, config.TRepublish)
+	assert.Equal(t, time.Second, config.TPingMax)
+	assert.Equal(t, 3, config.SendRetries)
+	assert.Equal(t, alpha, config.ReplicationConcurrency)
+	assert.Equal(t, alpha, config.FindValueRetryBreadth)
+	assert.Equal(t, defaultLatencyBuckets, config.LookupLatencyBuckets)
+	assert.Equal(t, "test/1.0", config.AgentName)
+
+	// A negative number of retries disables retrying, and a negative
+	// bootstrap concurrency disables refreshing buckets, while other negative
+	// concurrencies and bursts are replaced by the default
+	dht, _ = NewDHT(getInMemoryStore(), &Options{
+		Port:                   "3000",
+		IP:                     "127.0.0.1",
+		SendRetries:            -1,
+		ReplicationConcurrency: -1,
+		PingConcurrency:        -1,
+		BootstrapConcurrency:   -1,
+		MaxRPCRate:             10,
+		RPCBurst:               -1,
+	})
+	assert.Equal(t, 0, dht.Config().SendRetries)
+	assert.Equal(t, alpha, dht.Config().ReplicationConcurrency)
+	assert.Equal(t, 1, dht.Config().PingConcurrency)
+	assert.Equal(t, 0, dht.Config().BootstrapConcurrency)
+	assert.Equal(t, 10, dht.Config().RPCBurst)
+}
+
+// Tests that FindNodeVerbose reports a lookup answered by its only peer as
+// converged, a lookup which its peer never answers as timed out, and a lookup
+// with a cancelled context as cancelled
+func TestLookupTermination(t *testing.T) {
+	for _, responsive := range []bool{true, false} {
+		networking := newMockNetworking()
+		done := make(chan (int))
+
+		dht, _ := NewDHT(getInMemoryStore(), &Options{
+			ID:          getIDWithValues(0),
+			Port:        "3000",
+			IP:          "0.0.0.0",
+			TMsgTimeout: time.Millisecond * 50,
+		})
+
+		dht.networking = networking
+		dht.CreateSocket()
+
+		go func() {
+			dht.Listen()
+		}()
+
+		peer := &NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}
+		dht.addNode(newNode(peer))
+
+		go func() {
+			for {
+				query := <-networking.recv
+				if query == nil {
+					close(done)
+					return
+				}
+				if responsive {
+					res := mockFindNodeResponseEmpty(query)
+					go func() {
+						networking.send <- res
+					}()
+				}
+			}
+		}()
+
+		closest, termination, err := dht.FindNodeVerbose(context.Background(), getIDWithValues(0))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(closest))
+		if responsive {
+			assert.Equal(t, TerminationConverged, termination)
+		} else {
+			assert.Equal(t, TerminationTimedOut, termination)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, termination, err = dht.FindNodeVerbose(ctx, getIDWithValues(0))
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, TerminationCancelled, termination)
+
+		dht.Disconnect()
+
+		<-done
+	}
+}
+
+// Tests limiting the number of lookup rounds. Each node responds with a node
+// closer to the target than itself, so without a limit the lookup would
+// continue until it ran out of IDs.
+func TestMaxLookupRounds(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
 
 	dht, _ := NewDHT(getInMemoryStore(), &Options{
-		ID:         id,
-		Port:       "3000",
-		IP:         "0.0.0.0",
-		TReplicate: time.Second * 2,
+		ID:              id,
+		Port:            "3000",
+		IP:              "0.0.0.0",
+		MaxLookupRounds: 5,
+	})
+
+	var logs bytes.Buffer
+	dht.options.Logger.SetOutput(&logs)
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	idWithCounter := func(c int) []byte {
+		id := getIDWithValues(0)
+		id[18] = byte(c >> 8)
+		id[19] = byte(c)
+		return id
+	}
+
+	dht.addNode(newNode(&NetworkNode{ID: idWithCounter(60000), IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+
+	queries := 0
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			queries++
+			c := int(query.Receiver.ID[18])<<8 | int(query.Receiver.ID[19])
+			networking.send <- mockFindNodeResponse(query, idWithCounter(c-1))
+		}
+	}()
+
+	_, closest, err := dht.iterate(iterateFindNode, getIDWithValues(0), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, queries)
+	assert.Equal(t, idWithCounter(60000-5), closest[0].ID)
+	assert.Contains(t, logs.String(), "stopped after 5 rounds")
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that MaxCandidateAge bounds the shortlist of a long lookup below its
+// maximum size. Each node responds with one node closer to the target than
+// any seen before, and k-1 distant nodes which are never closest.
+func TestMaxCandidateAge(t *testing.T) {
+	lookup := func(maxAge int) []*NetworkNode {
+		networking := newMockNetworking()
+		done := make(chan (int))
+
+		dht, _ := NewDHT(getInMemoryStore(), &Options{
+			ID:              getIDWithValues(0),
+			Port:            "3000",
+			IP:              "0.0.0.0",
+			MaxLookupRounds: 20,
+			MaxCandidateAge: maxAge,
+		})
+		dht.options.Logger.SetOutput(&lockedBuffer{mutex: &sync.Mutex{}})
+
+		dht.networking = networking
+		dht.CreateSocket()
+
+		go func() {
+			dht.Listen()
+		}()
+
+		dht.addNode(newNode(&NetworkNode{ID: getZerodIDWithNthByte(0, byte(1)), IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+
+		closer := 0
+		distant := 0
+		go func() {
+			for {
+				query := <-networking.recv
+				if query == nil {
+					close(done)
+					return
+				}
+
+				// Each closer node differs from the target in a lower bit
+				closer++
+				id := getIDWithValues(0)
+				bit := 150 - closer
+				id[len(id)-1-bit/8] = byte(1) << uint(bit%8)
+				nodes := []*NetworkNode{{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3001}}
+				for len(nodes) < k {
+					distant++
+					id := getIDWithValues(0)
+					id[0] = byte(255)
+					id[1] = byte(distant >> 8)
+					id[2] = byte(distant)
+					nodes = append(nodes, &NetworkNode{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3001})
+				}
+
+				res := mockFindNodeResponse(query, nil)
+				res.Data.(*responseDataFindNode).Closest = nodes
+				go func() {
+					networking.send <- res
+				}()
+			}
+		}()
+
+		_, closest, err := dht.iterate(iterateFindNode, getIDWithValues(0), nil)
+		assert.NoError(t, err)
+
+		dht.Disconnect()
+		<-done
+		return closest
+	}
+
+	// The lookup makes the same progress with and without dropping nodes
+	bound := k + 2*alpha*k
+	unbounded := lookup(0)
+	bounded := lookup(2)
+	assert.True(t, len(unbounded) > bound)
+	assert.True(t, len(unbounded) <= shortlistSize)
+	assert.True(t, len(bounded) <= bound)
+	assert.Equal(t, unbounded[0].ID, bounded[0].ID)
+}
+
+// lockedBuffer is a bytes.Buffer which may be written to by a logger while
+// being read from by a test
+type lockedBuffer struct {
+	mutex *sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// mockDiskStore is a MemoryStore which simulates data persisted to disk, and
+// implements SecureDeleter
+type mockDiskStore struct {
+	*MemoryStore
+	disk            map[string][]byte
+	securelyDeleted chan []byte
+}
+
+func (s *mockDiskStore) Store(key []byte, data []byte, replication time.Time, expiration time.Time, publisher bool) error {
+	s.disk[string(key)] = append([]byte{}, data...)
+	return s.MemoryStore.Store(key, data, replication, expiration, publisher)
+}
+
+func (s *mockDiskStore) SecureDelete(key []byte) error {
+	data := s.disk[string(key)]
+	for i := range data {
+		data[i] = 0
+	}
+	s.MemoryStore.Delete(key)
+	s.securelyDeleted <- data
+	return nil
+}
+
+// Tests that expired data is securely deleted when the store supports it
+func TestSecureDelete(t *testing.T) {
+	networking := newMockNetworking()
+	store := &mockDiskStore{
+		MemoryStore:     getInMemoryStore(),
+		disk:            make(map[string][]byte),
+		securelyDeleted: make(chan []byte, 1),
+	}
+
+	dht, _ := NewDHT(store, &Options{
+		ID:           getIDWithValues(0),
+		Port:         "3000",
+		IP:           "0.0.0.0",
+		SecureDelete: true,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	key := store.GetKey([]byte("foo"))
+	store.Store(key, []byte("foo"), time.Now().Add(time.Hour), time.Now().Add(-time.Second), true)
+	store.Store(store.GetKey([]byte("bar")), []byte("bar"), time.Now().Add(time.Hour), time.Now().Add(time.Hour), true)
+
+	go func() {
+		dht.Listen()
+	}()
+
+	select {
+	case data := <-store.securelyDeleted:
+		assert.Equal(t, []byte{0, 0, 0}, data)
+	case <-time.After(time.Second * 3):
+		t.Fatal("Expired data was not securely deleted")
+	}
+
+	_, found := store.Retrieve(key)
+	assert.False(t, found)
+	_, found = store.Retrieve(store.GetKey([]byte("bar")))
+	assert.True(t, found)
+
+	dht.Disconnect()
+}
+
+// failingStore is a MemoryStore which fails to persist any data, as a disk
+// backed store would when its disk is full
+type failingStore struct {
+	*MemoryStore
+}
+
+func (s *failingStore) Store(key []byte, data []byte, replication time.Time, expiration time.Time, publisher bool) error {
+	return errors.New("disk full")
+}
+
+// Tests that local store failures are returned by Store, which still stores
+// to the network, and that failures storing inbound STOREs are reported
+// without disrupting the node
+func TestStoreError(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+	failures := make(chan []byte, 2)
+
+	dht, _ := NewDHT(&failingStore{getInMemoryStore()}, &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
 		BootstrapNodes: []*NetworkNode{{
 			ID:   getZerodIDWithNthByte(1, byte(255)),
 			Port: 3001,
 			IP:   net.ParseIP("0.0.0.0"),
-		},
+		}},
+		OnStoreError: func(key []byte, err error) {
+			failures <- key
 		},
 	})
 
@@ -589,8 +4460,8 @@ func TestStoreReplication(t *testing.T) {
 		dht.Listen()
 	}()
 
-	stores := 0
-
+	stores := make(chan []byte, 1)
+	responses := make(chan bool, 1)
 	go func() {
 		for {
 			query := <-networking.recv
@@ -598,69 +4469,330 @@ func TestStoreReplication(t *testing.T) {
 				close(done)
 				return
 			}
+			if query.IsResponse {
+				responses <- query.Data.(*responseDataStore).Success
+				continue
+			}
 
 			switch query.Type {
 			case messageTypeFindNode:
 				res := mockFindNodeResponseEmpty(query)
-				networking.send <- res
+				go func() {
+					networking.send <- res
+				}()
 			case messageTypeStore:
-				stores++
-				d := query.Data.(*queryDataStore)
-				assert.Equal(t, []byte("foo"), d.Data)
-				if stores == 2 {
-					close(replicate)
-				}
+				res := mockStoreResponse(query, true)
+				go func() {
+					networking.send <- res
+				}()
+				stores <- query.Data.(*queryDataStore).Data
 			}
 		}
 	}()
 
 	dht.Bootstrap()
 
-	dht.Store([]byte("foo"))
+	key, err := dht.Store([]byte("foo"))
+	assert.True(t, errors.Is(err, ErrLocalStoreFailed))
+	assert.Equal(t, b58.Encode(dht.store.GetKey([]byte("foo"))), key)
+	assert.Equal(t, []byte("foo"), <-stores)
+	assert.Equal(t, dht.store.GetKey([]byte("foo")), <-failures)
 
-	<-replicate
+	sender := &NetworkNode{
+		ID:   getZerodIDWithNthByte(1, byte(255)),
+		Port: 3001,
+		IP:   net.ParseIP("0.0.0.0"),
+	}
+	networking.msgChan <- &message{
+		Sender:   sender,
+		Receiver: dht.ht.Self,
+		Type:     messageTypeStore,
+		Data:     &queryDataStore{Data: []byte("bar")},
+	}
+	assert.False(t, <-responses)
+	assert.Equal(t, dht.store.GetKey([]byte("bar")), <-failures)
+	used, _ := dht.StoreUtilization()
+	assert.Equal(t, 0, used)
 
 	dht.Disconnect()
 
 	<-done
 }
 
-// Test Expiration by setting TExpire to a very low value. Store a value,
-// and then wait longer than TExpire. The value should no longer exist in
-// the store.
-func TestStoreExpiration(t *testing.T) {
-	id := getIDWithValues(0)
+// longKeyStore is a MemoryStore which keys data by its SHA-256 hash, which is
+// longer than node IDs
+type longKeyStore struct {
+	*MemoryStore
+}
 
-	dht, _ := NewDHT(getInMemoryStore(), &Options{
-		ID:      id,
-		Port:    "3000",
-		IP:      "0.0.0.0",
-		TExpire: time.Second,
+func (s *longKeyStore) GetKey(data []byte) []byte {
+	sha := sha256.Sum256(data)
+	return sha[:]
+}
+
+// Tests that a STORE whose data has a key of the wrong length is rejected and
+// counted without being stored
+func TestMalformedStore(t *testing.T) {
+	networking := newMockNetworking()
+	rejected := make(chan []byte, 1)
+
+	dht, _ := NewDHT(&longKeyStore{getInMemoryStore()}, &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+		OnMalformedStore: func(from NetworkNode, key []byte) {
+			rejected <- key
+		},
 	})
 
+	dht.networking = networking
 	dht.CreateSocket()
 
 	go func() {
 		dht.Listen()
 	}()
 
-	k, _ := dht.Store([]byte("foo"))
+	sender := &NetworkNode{
+		ID:   getZerodIDWithNthByte(1, byte(255)),
+		Port: 3001,
+		IP:   net.ParseIP("0.0.0.0"),
+	}
+	networking.msgChan <- &message{
+		Sender:   sender,
+		Receiver: dht.ht.Self,
+		Type:     messageTypeStore,
+		Data:     &queryDataStore{Data: []byte("foo")},
+	}
+	assert.False(t, (<-networking.recv).Data.(*responseDataStore).Success)
 
-	v, exists, _ := dht.Get(k)
-	assert.Equal(t, true, exists)
+	// The node keeps serving messages
+	networking.msgChan <- &message{Sender: sender, Receiver: dht.ht.Self, Type: messageTypePing}
+	<-networking.recv
 
-	assert.Equal(t, []byte("foo"), v)
+	assert.Equal(t, int64(1), dht.MalformedStores())
+	assert.Equal(t, 32, len(<-rejected))
+	assert.Equal(t, 0, len(dht.storeEntries()))
 
-	<-time.After(time.Second * 3)
+	dht.Disconnect()
+}
 
-	_, exists, _ = dht.Get(k)
+// Tests each source IP policy by sending a FIND_NODE from one node which
+// claims to have been sent from a different IP
+func TestSourceIPPolicy(t *testing.T) {
+	for _, policy := range []int{SourceIPTrust, SourceIPReject, SourceIPCorrect} {
+		dhts, err := BuildNetwork(2, func(options *Options) {
+			options.SourceIPPolicy = policy
+		})
+		assert.NoError(t, err)
 
-	assert.Equal(t, false, exists)
+		id := getZerodIDWithNthByte(3, byte(255))
+		_, err = dhts[1].networking.sendMessage(&message{
+			Sender:   &NetworkNode{ID: id, IP: net.ParseIP("10.0.0.1"), Port: 2},
+			Receiver: dhts[0].ht.Self,
+			Type:     messageTypeFindNode,
+			Data:     &queryDataFindNode{Target: id},
+		}, false, -1)
+		assert.NoError(t, err)
 
-	dht.Disconnect()
+		var peer NetworkNode
+		found := false
+		for i := 0; i < 10 && !found; i++ {
+			time.Sleep(time.Millisecond * 10)
+			peer, found = dhts[0].Peer(id)
+		}
+
+		switch policy {
+		case SourceIPTrust:
+			assert.True(t, found)
+			assert.Equal(t, "10.0.0.1", peer.IP.String())
+		case SourceIPReject:
+			assert.False(t, found)
+		case SourceIPCorrect:
+			assert.True(t, found)
+			assert.Equal(t, "127.0.0.1", peer.IP.String())
+		}
+
+		assert.NoError(t, CloseNetwork(dhts))
+	}
 }
 
 func getInMemoryStore() *MemoryStore {
 	memStore := &MemoryStore{}
 	return memStore
 }
+
+// Tests that the nodes a value is stored to are recorded, that Refresh stores
+// to them directly while they are alive, and that it falls back to a lookup
+// once one of them has gone offline
+func TestRefreshRecordedReplicas(t *testing.T) {
+	dhts, err := BuildNetwork(4, func(options *Options) {
+		options.RecordReplicas = true
+	})
+	assert.NoError(t, err)
+
+	dht := dhts[0]
+	store := dht.store.(ReplicaSetStore)
+	data := []byte("foo")
+	key, err := dht.Store(data)
+	assert.NoError(t, err)
+
+	routingKey := dht.store.GetKey(data)
+	assert.Equal(t, 3, len(store.GetReplicaSet(routingKey)))
+
+	targeted := func() []*NetworkNode {
+		dht.replicationStatusMutex.Lock()
+		defer dht.replicationStatusMutex.Unlock()
+		return dht.replicationStatus[string(routingKey)].Targeted
+	}
+
+	// Narrow the recorded set, so that storing to it directly can be told
+	// apart from storing to the nodes found by a lookup
+	first := dhts[1].ht.Self
+	assert.NoError(t, store.SetReplicaSet(routingKey, []*NetworkNode{first}))
+	assert.NoError(t, dht.Refresh(key))
+	assert.Equal(t, 1, len(targeted()))
+	assert.Equal(t, first.ID, targeted()[0].ID)
+
+	// The recorded node is offline, so the closest nodes are looked up, and
+	// those which could be stored to are recorded instead
+	assert.NoError(t, dhts[1].Disconnect())
+	assert.NoError(t, dht.Refresh(key))
+	assert.Equal(t, 3, len(targeted()))
+	replicas := store.GetReplicaSet(routingKey)
+	assert.Equal(t, 2, len(replicas))
+	for _, n := range replicas {
+		assert.NotEqual(t, first.ID, n.ID)
+	}
+
+	assert.Error(t, dht.Refresh(b58.Encode(dht.store.GetKey([]byte("bar")))))
+	assert.NoError(t, CloseNetwork(append(dhts[:1:1], dhts[2:]...)))
+}
+
+// Tests that the events and RPCs of a lookup share its lookup ID, that
+// concurrent lookups have different IDs, and that the ID of the lookup made
+// by a store is recorded in its report
+func TestLookupTracer(t *testing.T) {
+	dhts, err := BuildNetwork(10)
+	assert.NoError(t, err)
+
+	mutex := &sync.Mutex{}
+	var events [2][]LookupEvent
+
+	wg := &sync.WaitGroup{}
+	for i := range events {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := WithLookupTracer(context.Background(), func(e LookupEvent) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				events[i] = append(events[i], e)
+			})
+			_, _, err := dhts[0].FindNodeVerbose(ctx, getIDWithValues(byte(i)))
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	mutex.Lock()
+	var ids [2]uint64
+	for i, lookup := range events {
+		counts := make(map[LookupEventType]int)
+		for _, e := range lookup {
+			assert.Equal(t, lookup[0].LookupID, e.LookupID)
+			counts[e.Type]++
+		}
+		ids[i] = lookup[0].LookupID
+		assert.Equal(t, LookupStarted, lookup[0].Type)
+		assert.Equal(t, 1, counts[LookupStarted])
+		assert.Equal(t, 1, counts[LookupFinished])
+		assert.True(t, counts[LookupQuerySent] > 0)
+		assert.True(t, counts[LookupResponseReceived] > 0)
+	}
+	mutex.Unlock()
+	assert.NotEqual(t, uint64(0), ids[0])
+	assert.NotEqual(t, ids[0], ids[1])
+
+	var storeID uint64
+	ctx := WithLookupTracer(context.Background(), func(e LookupEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		storeID = e.LookupID
+	})
+	data := []byte("traced")
+	_, err = dhts[0].StoreContext(ctx, data)
+	assert.NoError(t, err)
+
+	routingKey, _ := dhts[0].routingKey(dhts[0].store.GetKey(data))
+	dhts[0].replicationStatusMutex.Lock()
+	report := dhts[0].replicationStatus[string(routingKey)]
+	dhts[0].replicationStatusMutex.Unlock()
+	mutex.Lock()
+	assert.NotEqual(t, uint64(0), storeID)
+	assert.Equal(t, storeID, report.LookupID)
+	mutex.Unlock()
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// Tests that no events of a lookup are reported after LookupFinished, for
+// example by queries which time out after the lookup has stopped
+func TestLookupTraceFinished(t *testing.T) {
+	var events []LookupEvent
+	ctx := WithLookupTracer(context.Background(), func(e LookupEvent) {
+		events = append(events, e)
+	})
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+	trace := dht.newLookupTrace(ctx, iterateFindNode)
+	node := &NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3001}
+
+	trace.emit(LookupStarted, nil, 0)
+	trace.emit(LookupQuerySent, node, 0)
+	trace.emit(LookupFinished, nil, TerminationCancelled)
+	trace.emit(LookupQueryFailed, node, 0)
+	trace.emit(LookupFinished, nil, TerminationConverged)
+
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, LookupFinished, events[2].Type)
+	assert.Equal(t, TerminationCancelled, events[2].Termination)
+}
+
+// Benchmarks storing and getting values concurrently on a small network. Run
+// with -race to check the locking of the store and routing table.
+func BenchmarkStoreAndGet(b *testing.B) {
+	dhts, err := BuildNetwork(5)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer CloseNetwork(dhts)
+
+	var counter int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&counter, 1)
+			dht := dhts[i%int64(len(dhts))]
+			data := []byte(strconv.FormatInt(i, 10))
+
+			key, err := dht.Store(data)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			// The local node always holds the values it stores, while other
+			// nodes may look it up before the STOREs reach them
+			value, found, err := dht.Get(key)
+			if err != nil || !found || !bytes.Equal(data, value) {
+				b.Errorf("Stored value %q not found: %v", data, err)
+				return
+			}
+			dhts[(i+1)%int64(len(dhts))].Get(key)
+		}
+	})
+}
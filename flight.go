@@ -0,0 +1,88 @@
+package kademlia
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls for the same key, so that the work
+// for a key is only done once however many callers ask for it at the same
+// time. Callers arriving while the work is in progress wait for it and share
+// its result.
+type flightGroup struct {
+	mutex   *sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call in progress in a flightGroup
+type flight struct {
+	// Closed once the call has returned and err is set
+	done chan struct{}
+	err  error
+
+	// The number of callers waiting for the call to return. Once every
+	// caller has stopped waiting the call is cancelled with cancel.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		mutex:   &sync.Mutex{},
+		flights: make(map[string]*flight),
+	}
+}
+
+// do calls fn, unless a call for key is already in progress in which case its
+// result is waited for instead. fn runs in its own goroutine with a context
+// derived from base rather than from the context of any one caller, so that
+// the cancellation of one caller does not fail the others. If ctx is
+// cancelled while waiting the context's error is returned, and once no caller
+// is waiting the context fn runs with is cancelled.
+func (g *flightGroup) do(ctx context.Context, key string, base context.Context, fn func(ctx context.Context) error) error {
+	g.mutex.Lock()
+	f := g.flights[key]
+	if f == nil {
+		runCtx, cancel := context.WithCancel(base)
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go g.run(runCtx, key, f, fn)
+	}
+	f.waiters++
+	g.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		g.mutex.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Callers arriving later start a new call rather than waiting for
+			// the cancelled one
+			g.remove(key, f)
+			f.cancel()
+		}
+		g.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// run calls fn for the flight f, and removes f once it has returned
+func (g *flightGroup) run(ctx context.Context, key string, f *flight, fn func(ctx context.Context) error) {
+	f.err = fn(ctx)
+
+	g.mutex.Lock()
+	g.remove(key, f)
+	g.mutex.Unlock()
+	f.cancel()
+	close(f.done)
+}
+
+// remove removes f as the call in progress for key, unless it has already
+// been replaced. Must be called with the mutex held.
+func (g *flightGroup) remove(key string, f *flight) {
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
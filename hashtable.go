@@ -3,6 +3,8 @@ package kademlia
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"math"
 	"math/big"
 	"math/rand"
@@ -29,6 +31,23 @@ const (
 
 	// the maximum number of contacts stored in a bucket
 	k = 20
+
+	// the number of nodes held in the shortlist of an iterative lookup. Nodes
+	// beyond the closest k are kept as candidates to query once the lookup
+	// converges, and are dropped after MaxCandidateAge rounds if it is set.
+	shortlistSize = 10 * k
+
+	// the number of consecutive rounds of an iterative lookup returning only
+	// nodes which have already been queried before the lookup is stopped
+	maxStalledRounds = 2
+
+	// the maximum number of lookups of random IDs performed after bootstrap
+	// to find contacts in MinBootstrapSubnets distinct subnets
+	maxDiversityLookups = 10
+
+	// the fraction of MaxStoredKeys above which STOREs of distant keys are
+	// rejected
+	storeShedLoad = 0.9
 )
 
 // hashTable represents the hashtable state
@@ -41,11 +60,19 @@ type hashTable struct {
 	// [ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ][ ]
 	//  ^                                                           ^
 	//  └ Least recently seen                    Most recently seen ┘
-	RoutingTable [][]*node // 160x20
+	// Buckets are keyed by index and only allocated once they hold a node
+	RoutingTable map[int][]*node // up to b buckets of up to k nodes
 
 	mutex *sync.Mutex
 
+	idPrefixCompare bool
+
 	refreshMap [b]time.Time
+
+	// When set, returns the bucket index of an ID in place of its differing
+	// bit. This lets package tests construct skewed routing tables and
+	// observe every bucket decision.
+	bucketIndex func(id []byte) int
 }
 
 func newHashTable(options *Options) (*hashTable, error) {
@@ -55,14 +82,23 @@ func newHashTable(options *Options) (*hashTable, error) {
 
 	ht.mutex = &sync.Mutex{}
 	ht.Self = &NetworkNode{}
+	ht.idPrefixCompare = options.IDPrefixCompare
+
+	if len(options.IDPrefix) >= b/8 {
+		return nil, ErrIDPrefixMismatch
+	}
 
 	if options.ID != nil {
+		if !bytes.HasPrefix(options.ID, options.IDPrefix) {
+			return nil, ErrIDPrefixMismatch
+		}
 		ht.Self.ID = options.ID
 	} else {
-		id, err := newID()
+		id, err := readID(options.Rand, options.TIDGeneration)
 		if err != nil {
 			return nil, err
 		}
+		copy(id, options.IDPrefix)
 		ht.Self.ID = id
 	}
 
@@ -79,16 +115,14 @@ func newHashTable(options *Options) (*hashTable, error) {
 		ht.resetRefreshTimeForBucket(i)
 	}
 
-	for i := 0; i < b; i++ {
-		ht.RoutingTable = append(ht.RoutingTable, []*node{})
-	}
+	ht.RoutingTable = make(map[int][]*node)
 
 	return ht, nil
 }
 
 func (ht *hashTable) setSelfAddr(ip string, port string) error {
 	ht.Self.IP = net.ParseIP(ip)
-	p, err := strconv.Atoi(port)
+	p, err := parsePort(port)
 	if err != nil {
 		return err
 	}
@@ -96,6 +130,19 @@ func (ht *hashTable) setSelfAddr(ip string, port string) error {
 	return nil
 }
 
+// parsePort returns the number of port, which is either a port number or a
+// service name such as "domain"
+func parsePort(port string) (int, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		p, err = net.LookupPort("udp", port)
+	}
+	if err != nil || p < 0 || p > math.MaxUint16 {
+		return 0, fmt.Errorf("%w %q", ErrInvalidPort, port)
+	}
+	return p, nil
+}
+
 func (ht *hashTable) resetRefreshTimeForBucket(bucket int) {
 	ht.mutex.Lock()
 	defer ht.mutex.Unlock()
@@ -111,11 +158,12 @@ func (ht *hashTable) getRefreshTimeForBucket(bucket int) time.Time {
 func (ht *hashTable) markNodeAsSeen(node []byte) {
 	ht.mutex.Lock()
 	defer ht.mutex.Unlock()
-	index := getBucketIndexFromDifferingBit(ht.Self.ID, node)
+	index := ht.getBucketIndex(node)
 	bucket := ht.RoutingTable[index]
+	prefix := getIDPrefix(node)
 	nodeIndex := -1
 	for i, v := range bucket {
-		if bytes.Compare(v.ID, node) == 0 {
+		if ht.hasID(v, node, prefix) {
 			nodeIndex = i
 			break
 		}
@@ -133,20 +181,156 @@ func (ht *hashTable) markNodeAsSeen(node []byte) {
 func (ht *hashTable) doesNodeExistInBucket(bucket int, node []byte) bool {
 	ht.mutex.Lock()
 	defer ht.mutex.Unlock()
+	prefix := getIDPrefix(node)
 	for _, v := range ht.RoutingTable[bucket] {
-		if bytes.Compare(v.ID, node) == 0 {
+		if ht.hasID(v, node, prefix) {
 			return true
 		}
 	}
 	return false
 }
 
+// getNode returns a copy of the node with the given ID if it exists in the
+// routing table
+func (ht *hashTable) getNode(id []byte) (NetworkNode, bool) {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+	index := ht.getBucketIndex(id)
+	prefix := getIDPrefix(id)
+	for _, v := range ht.RoutingTable[index] {
+		if ht.hasID(v, id, prefix) {
+			return copyNetworkNode(v.NetworkNode), true
+		}
+	}
+	return NetworkNode{}, false
+}
+
+// snapshot returns a copy of every bucket in the routing table. The nodes
+// are copies, so the result may be read without holding the mutex.
+func (ht *hashTable) snapshot() [][]NetworkNode {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+	buckets := make([][]NetworkNode, b)
+	for i, bucket := range ht.RoutingTable {
+		for _, v := range bucket {
+			buckets[i] = append(buckets[i], copyNetworkNode(v.NetworkNode))
+		}
+	}
+	return buckets
+}
+
+func copyNetworkNode(n *NetworkNode) NetworkNode {
+	return NetworkNode{
+		ID:   append([]byte{}, n.ID...),
+		IP:   append(net.IP{}, n.IP...),
+		Port: n.Port,
+	}
+}
+
+// replaceNode replaces the node in the routing table which has the same ID as
+// n with n, keeping its position in the bucket
+func (ht *hashTable) replaceNode(n *node) {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+	index := ht.getBucketIndex(n.ID)
+	for i, v := range ht.RoutingTable[index] {
+		if ht.hasID(v, n.ID, n.idPrefix) {
+			ht.RoutingTable[index][i] = n
+			return
+		}
+	}
+}
+
+// setNodeAgent sets the agent string of the node with the given ID if it
+// exists in the routing table
+func (ht *hashTable) setNodeAgent(id []byte, agent string) {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+	index := ht.getBucketIndex(id)
+	prefix := getIDPrefix(id)
+	for _, v := range ht.RoutingTable[index] {
+		if ht.hasID(v, id, prefix) {
+			v.agent = agent
+			return
+		}
+	}
+}
+
+// getPeerStats returns the recorded stats of the node with the given ID if
+// it exists in the routing table
+func (ht *hashTable) getPeerStats(id []byte) (PeerStats, bool) {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+	index := ht.getBucketIndex(id)
+	prefix := getIDPrefix(id)
+	for _, v := range ht.RoutingTable[index] {
+		if ht.hasID(v, id, prefix) {
+			return PeerStats{
+				Agent: v.agent,
+			}, true
+		}
+	}
+	return PeerStats{}, false
+}
+
+// trimBuckets removes the least recently seen nodes from each bucket holding
+// more than size nodes, and returns copies of them. Nodes for which keep
+// returns true are not removed.
+func (ht *hashTable) trimBuckets(size int, keep func(id []byte) bool) []NetworkNode {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+	var removed []NetworkNode
+	for index, bucket := range ht.RoutingTable {
+		excess := len(bucket) - size
+		if excess <= 0 {
+			continue
+		}
+		var trimmed []*node
+		for _, v := range bucket {
+			if excess > 0 && !keep(v.ID) {
+				removed = append(removed, copyNetworkNode(v.NetworkNode))
+				excess--
+				continue
+			}
+			trimmed = append(trimmed, v)
+		}
+		ht.RoutingTable[index] = trimmed
+	}
+	return removed
+}
+
+// getClosestContacts returns up to num of the nodes in the routing table
+// closest to target, sorted by distance, excluding ignoredNodes. Ignored nodes
+// are matched by ID, as with getClosestContactsExcluding.
 func (ht *hashTable) getClosestContacts(num int, target []byte, ignoredNodes []*NetworkNode) *shortList {
+	excludeIDs := make([][]byte, len(ignoredNodes))
+	for i, n := range ignoredNodes {
+		excludeIDs[i] = n.ID
+	}
+	return ht.getClosestContactsExcluding(num, target, excludeIDs)
+}
+
+// getClosestContactsExcluding returns up to num of the nodes in the routing
+// table closest to target, sorted by distance, other than the nodes with the
+// IDs in excludeIDs. Excluded nodes are only left out of the returned
+// shortlist: they stay in the routing table, and a caller may still add them
+// to the shortlist later, for example when another node returns them. The
+// shortlist is filled from the remaining nodes, so excluded nodes do not
+// reduce its length while enough other nodes are known. If num is 0 or
+// negative an empty shortlist is returned.
+func (ht *hashTable) getClosestContactsExcluding(num int, target []byte, excludeIDs [][]byte) *shortList {
+	sl := &shortList{}
+	sl.Comparator = target
+
+	if num <= 0 {
+		return sl
+	}
+
 	ht.mutex.Lock()
 	defer ht.mutex.Unlock()
 	// First we need to build the list of adjacent indices to our target
 	// in order
-	index := getBucketIndexFromDifferingBit(ht.Self.ID, target)
+	index := ht.getBucketIndex(target)
 	indexList := []int{index}
 	i := index - 1
 	j := index + 1
@@ -161,22 +345,25 @@ func (ht *hashTable) getClosestContacts(num int, target []byte, ignoredNodes []*
 		j++
 	}
 
-	sl := &shortList{}
-
 	leftToAdd := num
 
+	excludePrefixes := make([]uint64, len(excludeIDs))
+	for i, id := range excludeIDs {
+		excludePrefixes[i] = getIDPrefix(id)
+	}
+
 	// Next we select alpha contacts and add them to the short list
 	for leftToAdd > 0 && len(indexList) > 0 {
 		index, indexList = indexList[0], indexList[1:]
 		bucketContacts := len(ht.RoutingTable[index])
 		for i := 0; i < bucketContacts; i++ {
-			ignored := false
-			for j := 0; j < len(ignoredNodes); j++ {
-				if bytes.Compare(ht.RoutingTable[index][i].ID, ignoredNodes[j].ID) == 0 {
-					ignored = true
+			excluded := false
+			for j := 0; j < len(excludeIDs); j++ {
+				if ht.hasID(ht.RoutingTable[index][i], excludeIDs[j], excludePrefixes[j]) {
+					excluded = true
 				}
 			}
-			if !ignored {
+			if !excluded {
 				sl.AppendUnique([]*node{ht.RoutingTable[index][i]})
 				leftToAdd--
 				if leftToAdd == 0 {
@@ -191,23 +378,71 @@ func (ht *hashTable) getClosestContacts(num int, target []byte, ignoredNodes []*
 	return sl
 }
 
-func (ht *hashTable) removeNode(ID []byte) {
+// removeNode removes the node with the given ID from the routing table, and
+// returns a copy of it. Returns false if the node was not found. emptied is
+// true if the node was the last in its bucket.
+func (ht *hashTable) removeNode(ID []byte) (removed NetworkNode, found bool, emptied bool) {
 	ht.mutex.Lock()
 	defer ht.mutex.Unlock()
 
-	index := getBucketIndexFromDifferingBit(ht.Self.ID, ID)
+	index := ht.getBucketIndex(ID)
 	bucket := ht.RoutingTable[index]
+	prefix := getIDPrefix(ID)
 
 	for i, v := range bucket {
-		if bytes.Compare(v.ID, ID) == 0 {
+		if ht.hasID(v, ID, prefix) {
+			removed = copyNetworkNode(v.NetworkNode)
+			found = true
 			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
 		}
 	}
 
+	if len(bucket) == 0 {
+		delete(ht.RoutingTable, index)
+		return removed, found, found
+	}
+
 	ht.RoutingTable[index] = bucket
+	return removed, found, false
+}
+
+// countSubnets returns the number of distinct subnets spanned by the nodes in
+// the routing table
+func (ht *hashTable) countSubnets() int {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+	subnets := make(map[string]bool)
+	for _, bucket := range ht.RoutingTable {
+		for _, n := range bucket {
+			subnets[getSubnet(n.IP)] = true
+		}
+	}
+	return len(subnets)
+}
+
+// getSubnet returns the /24 subnet of an IPv4 address, or the /64 subnet of
+// an IPv6 address
+func getSubnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// hasID returns true if n has the given ID. prefix must be the result of
+// getIDPrefix(id). If idPrefixCompare is set the prefixes are compared first,
+// so the full IDs are only compared when the prefixes match.
+func (ht *hashTable) hasID(n *node, id []byte, prefix uint64) bool {
+	if ht.idPrefixCompare && n.idPrefix != prefix {
+		return false
+	}
+	return bytes.Equal(n.ID, id)
 }
 
 func (ht *hashTable) getAllNodesInBucketCloserThan(bucket int, id []byte) [][]byte {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
 	b := ht.RoutingTable[bucket]
 	var nodes [][]byte
 	for _, v := range b {
@@ -223,6 +458,16 @@ func (ht *hashTable) getAllNodesInBucketCloserThan(bucket int, id []byte) [][]by
 	return nodes
 }
 
+func (ht *hashTable) getAllNodesInBucket(bucket int) []*NetworkNode {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+	var nodes []*NetworkNode
+	for _, v := range ht.RoutingTable[bucket] {
+		nodes = append(nodes, v.NetworkNode)
+	}
+	return nodes
+}
+
 func (ht *hashTable) getTotalNodesInBucket(bucket int) int {
 	ht.mutex.Lock()
 	defer ht.mutex.Unlock()
@@ -230,12 +475,12 @@ func (ht *hashTable) getTotalNodesInBucket(bucket int) int {
 }
 
 func (ht *hashTable) getDistance(id1 []byte, id2 []byte) *big.Int {
-	var dst [k]byte
-	for i := 0; i < k; i++ {
+	dst := make([]byte, len(id1))
+	for i := 0; i < len(id1) && i < len(id2); i++ {
 		dst[i] = id1[i] ^ id2[i]
 	}
 	ret := big.NewInt(0)
-	return ret.SetBytes(dst[:])
+	return ret.SetBytes(dst)
 }
 
 func (ht *hashTable) getRandomIDFromBucket(bucket int) []byte {
@@ -271,7 +516,7 @@ func (ht *hashTable) getRandomIDFromBucket(bucket int) []byte {
 	id = append(id, firstByte)
 
 	// Randomize each remaining byte
-	for i := byteIndex + 1; i < 20; i++ {
+	for i := byteIndex + 1; i < len(ht.Self.ID); i++ {
 		randomByte := byte(rand.Intn(256))
 		id = append(id, randomByte)
 	}
@@ -279,9 +524,23 @@ func (ht *hashTable) getRandomIDFromBucket(bucket int) []byte {
 	return id
 }
 
+// getBucketIndex returns the index of the bucket id belongs in relative to the
+// local node
+func (ht *hashTable) getBucketIndex(id []byte) int {
+	if ht.bucketIndex != nil {
+		return ht.bucketIndex(id)
+	}
+	return getBucketIndexFromDifferingBit(ht.Self.ID, id)
+}
+
+// getBucketIndexFromDifferingBit returns the index of the bucket id2 belongs
+// in relative to id1. The index is the position of the first differing bit
+// counted from the rightmost bit, so it ranges from 0 to len(id1)*8-1.
 func getBucketIndexFromDifferingBit(id1 []byte, id2 []byte) int {
+	bits := len(id1) * 8
+
 	// Look at each byte from left to right
-	for j := 0; j < len(id1); j++ {
+	for j := 0; j < len(id1) && j < len(id2); j++ {
 		// xor the byte
 		xor := id1[j] ^ id2[j]
 
@@ -290,7 +549,7 @@ func getBucketIndexFromDifferingBit(id1 []byte, id2 []byte) int {
 			if hasBit(xor, uint(i)) {
 				byteIndex := j * 8
 				bitIndex := i
-				return b - (byteIndex + bitIndex) - 1
+				return bits - (byteIndex + bitIndex) - 1
 			}
 		}
 	}
@@ -300,6 +559,14 @@ func getBucketIndexFromDifferingBit(id1 []byte, id2 []byte) int {
 	return 0
 }
 
+// bucketStats returns the number of buckets which have been allocated because
+// they hold at least one node, and the total number of buckets
+func (ht *hashTable) bucketStats() (allocated int, total int) {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+	return len(ht.RoutingTable), b
+}
+
 func (ht *hashTable) totalNodes() int {
 	ht.mutex.Lock()
 	defer ht.mutex.Unlock()
@@ -310,11 +577,31 @@ func (ht *hashTable) totalNodes() int {
 	return total
 }
 
-// newID generates a new random ID
-func newID() ([]byte, error) {
-	result := make([]byte, 20)
-	_, err := rand.Read(result)
-	return result, err
+// readID generates a new random ID from r. If r does not provide the data
+// within timeout ErrRandomUnavailable is returned. The read is left running
+// in the background in that case, as it cannot be interrupted.
+func readID(r io.Reader, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		id  []byte
+		err error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		id := make([]byte, 20)
+		_, err := io.ReadFull(r, id)
+		ch <- result{id, err}
+	}()
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return res.id, nil
+	case <-time.After(timeout):
+		return nil, ErrRandomUnavailable
+	}
 }
 
 // Simple helper function to determine the value of a particular
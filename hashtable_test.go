@@ -2,9 +2,16 @@ package kademlia
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"math"
+	"math/big"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -62,6 +69,7 @@ func TestFindNodeAllBuckets(t *testing.T) {
 
 	dht.Bootstrap()
 
+	assert.Equal(t, b, len(dht.ht.RoutingTable))
 	for _, v := range dht.ht.RoutingTable {
 		assert.Equal(t, 1, len(v))
 	}
@@ -175,3 +183,1349 @@ func TestGetRandomIDFromBucket(t *testing.T) {
 
 	dht.Disconnect()
 }
+
+func TestPeer(t *testing.T) {
+	id := getIDWithValues(0)
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	peerID := getZerodIDWithNthByte(1, byte(255))
+	dht.addNode(newNode(&NetworkNode{
+		ID:   peerID,
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: 3001,
+	}))
+
+	peer, found := dht.Peer(peerID)
+	assert.Equal(t, true, found)
+	assert.Equal(t, peerID, peer.ID)
+	assert.Equal(t, "127.0.0.1", peer.IP.String())
+	assert.Equal(t, 3001, peer.Port)
+
+	// Modifying the copy should not modify the routing table
+	peer.ID[0] = byte(1)
+	peer, found = dht.Peer(peerID)
+	assert.Equal(t, true, found)
+	assert.Equal(t, peerID, peer.ID)
+
+	_, found = dht.Peer(getZerodIDWithNthByte(2, byte(255)))
+	assert.Equal(t, false, found)
+}
+
+// Tests that asking for zero or a negative number of closest contacts returns
+// an empty shortlist
+func TestGetClosestContactsNone(t *testing.T) {
+	id := getIDWithValues(0)
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	for i := 0; i < 3; i++ {
+		dht.addNode(newNode(&NetworkNode{
+			ID:   getZerodIDWithNthByte(i+1, byte(255)),
+			IP:   net.ParseIP("127.0.0.1"),
+			Port: 3001 + i,
+		}))
+	}
+
+	target := getIDWithValues(255)
+	for _, num := range []int{0, -1, -k} {
+		sl := dht.ht.getClosestContacts(num, target, []*NetworkNode{})
+		assert.Equal(t, 0, sl.Len())
+		assert.Equal(t, target, sl.Comparator)
+	}
+
+	sl := dht.ht.getClosestContacts(1, target, []*NetworkNode{})
+	assert.Equal(t, 1, sl.Len())
+}
+
+// Tests that buckets are only allocated while they hold nodes
+func TestBucketStats(t *testing.T) {
+	id := getIDWithValues(0)
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	allocated, total := dht.BucketStats()
+	assert.Equal(t, 0, allocated)
+	assert.Equal(t, b, total)
+
+	// Lookups against an empty table should not allocate buckets
+	sl := dht.ht.getClosestContacts(k, getIDWithValues(255), []*NetworkNode{})
+	assert.Equal(t, 0, sl.Len())
+	allocated, _ = dht.BucketStats()
+	assert.Equal(t, 0, allocated)
+
+	id1 := getZerodIDWithNthByte(0, byte(255))
+	id2 := getZerodIDWithNthByte(0, byte(254))
+	id3 := getZerodIDWithNthByte(19, byte(1))
+	for _, nodeID := range [][]byte{id1, id2, id3} {
+		dht.addNode(newNode(&NetworkNode{ID: nodeID, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+	}
+
+	allocated, total = dht.BucketStats()
+	assert.Equal(t, 2, allocated)
+	assert.Equal(t, b, total)
+
+	sl = dht.ht.getClosestContacts(k, getIDWithValues(255), []*NetworkNode{})
+	assert.Equal(t, 3, sl.Len())
+
+	dht.removeNode(id3, EvictionRemoved)
+	allocated, _ = dht.BucketStats()
+	assert.Equal(t, 1, allocated)
+
+	dht.removeNode(id1, EvictionRemoved)
+	allocated, _ = dht.BucketStats()
+	assert.Equal(t, 1, allocated)
+
+	dht.removeNode(id2, EvictionRemoved)
+	allocated, _ = dht.BucketStats()
+	assert.Equal(t, 0, allocated)
+}
+
+// Tests iterating over the routing table while nodes are concurrently being
+// added to it. Run with -race.
+func TestForEachContact(t *testing.T) {
+	id := getIDWithValues(0)
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	for i := 0; i < 10; i++ {
+		dht.addNode(newNode(&NetworkNode{
+			ID:   getZerodIDWithNthByte(i, byte(255)),
+			IP:   net.ParseIP("127.0.0.1"),
+			Port: 3001,
+		}))
+	}
+
+	done := make(chan bool)
+	go func() {
+		for i := 10; i < 20; i++ {
+			for j := 1; j < 16; j++ {
+				dht.addNode(newNode(&NetworkNode{
+					ID:   getZerodIDWithNthByte(i, byte(j)),
+					IP:   net.ParseIP("127.0.0.1"),
+					Port: 3001,
+				}))
+			}
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 20; i++ {
+		total := 0
+		dht.ForEachContact(func(bucket int, n NetworkNode) {
+			assert.Equal(t, getBucketIndexFromDifferingBit(id, n.ID), bucket)
+			n.ID[0] = byte(255)
+			total++
+		})
+		assert.True(t, total >= 10)
+	}
+
+	<-done
+
+	total := 0
+	dht.ForEachContact(func(bucket int, n NetworkNode) {
+		total++
+	})
+	assert.Equal(t, 160, total)
+
+	// Modifying the nodes passed to fn should not modify the routing table
+	_, found := dht.Peer(getZerodIDWithNthByte(1, byte(255)))
+	assert.True(t, found)
+}
+
+// Tests that OnBucketStateChange reports a bucket gaining its first node and
+// losing its last, and nothing when a populated bucket gains or loses a node
+func TestOnBucketStateChange(t *testing.T) {
+	type change struct {
+		index     int
+		populated bool
+	}
+	changes := make(chan change, 10)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+		OnBucketStateChange: func(index int, nowPopulated bool) {
+			changes <- change{index, nowPopulated}
+		},
+	})
+
+	// received returns the next n changes, in any order, and checks that no
+	// others follow
+	received := func(n int) map[change]bool {
+		got := make(map[change]bool)
+		for i := 0; i < n; i++ {
+			select {
+			case c := <-changes:
+				got[c] = true
+			case <-time.After(time.Second):
+				t.Fatal("expected OnBucketStateChange to be called")
+			}
+		}
+		select {
+		case c := <-changes:
+			t.Fatalf("unexpected change %v", c)
+		case <-time.After(time.Millisecond * 50):
+		}
+		return got
+	}
+
+	first := getZerodIDWithNthByte(1, byte(255))
+	second := getZerodIDWithNthByte(1, byte(254))
+	other := getZerodIDWithNthByte(2, byte(255))
+	for _, id := range [][]byte{first, second, other} {
+		dht.addNode(newNode(&NetworkNode{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+	}
+
+	index := dht.ht.getBucketIndex(first)
+	otherIndex := dht.ht.getBucketIndex(other)
+	assert.Equal(t, index, dht.ht.getBucketIndex(second))
+	assert.NotEqual(t, index, otherIndex)
+	assert.Equal(t, map[change]bool{{index, true}: true, {otherIndex, true}: true}, received(2))
+
+	dht.removeNode(first, EvictionRemoved)
+	assert.Equal(t, map[change]bool{}, received(0))
+	dht.removeNode(second, EvictionRemoved)
+	dht.removeNode(second, EvictionRemoved)
+	assert.Equal(t, map[change]bool{{index, false}: true}, received(1))
+
+	dht.addNode(newNode(&NetworkNode{ID: first, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+	assert.Equal(t, map[change]bool{{index, true}: true}, received(1))
+}
+
+// Tests that only nodes within the AllowedCIDRs are added to the routing
+// table, and that messages from other nodes are dropped
+func TestAllowedCIDRs(t *testing.T) {
+	_, err := NewDHT(getInMemoryStore(), &Options{
+		Port:         "3000",
+		IP:           "0.0.0.0",
+		AllowedCIDRs: []string{"10.0.0.0"},
+	})
+	assert.Error(t, err)
+
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:           id,
+		Port:         "3000",
+		IP:           "0.0.0.0",
+		AllowedCIDRs: []string{"10.0.0.0/8"},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	allowed := &NetworkNode{
+		ID:   getZerodIDWithNthByte(1, byte(255)),
+		IP:   net.ParseIP("10.1.2.3"),
+		Port: 3001,
+	}
+	rejected := &NetworkNode{
+		ID:   getZerodIDWithNthByte(2, byte(255)),
+		IP:   net.ParseIP("192.168.1.1"),
+		Port: 3001,
+	}
+
+	dht.addNode(newNode(allowed))
+	dht.addNode(newNode(rejected))
+
+	_, found := dht.Peer(allowed.ID)
+	assert.Equal(t, true, found)
+	_, found = dht.Peer(rejected.ID)
+	assert.Equal(t, false, found)
+
+	networking.msgChan <- &message{Sender: rejected, Receiver: dht.ht.Self, Type: messageTypePing}
+	networking.msgChan <- &message{Sender: allowed, Receiver: dht.ht.Self, Type: messageTypePing}
+
+	response := <-networking.recv
+	assert.Equal(t, allowed, response.Receiver)
+
+	dht.Disconnect()
+}
+
+// Tests that nodes rejected by the AdmissionFilter never enter the routing
+// table, and that the filter is given the node being added
+func TestAdmissionFilter(t *testing.T) {
+	rejected := &NetworkNode{
+		ID:   getZerodIDWithNthByte(2, byte(255)),
+		IP:   net.ParseIP("10.0.0.2"),
+		Port: 3001,
+	}
+
+	var seen []NetworkNode
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+		AdmissionFilter: func(n NetworkNode) bool {
+			seen = append(seen, n)
+			return !bytes.Equal(n.ID, rejected.ID)
+		},
+	})
+
+	allowed := &NetworkNode{
+		ID:   getZerodIDWithNthByte(1, byte(255)),
+		IP:   net.ParseIP("10.0.0.1"),
+		Port: 3001,
+	}
+
+	dht.addNode(newNode(allowed))
+	dht.addNode(newNode(rejected))
+
+	// Nodes already in the routing table are not filtered again
+	dht.addNode(newNode(allowed))
+
+	_, found := dht.Peer(allowed.ID)
+	assert.Equal(t, true, found)
+	_, found = dht.Peer(rejected.ID)
+	assert.Equal(t, false, found)
+	assert.Equal(t, 1, dht.NumNodes())
+
+	assert.Equal(t, 2, len(seen))
+	assert.Equal(t, allowed.ID, seen[0].ID)
+	assert.Equal(t, rejected.ID, seen[1].ID)
+}
+
+// Tests that generated IDs begin with the IDPrefix, that a provided ID without
+// it is rejected, and that peers with a foreign prefix are rejected in strict
+// mode
+func TestIDPrefix(t *testing.T) {
+	prefix := []byte{0xab, 0xcd}
+
+	dht, err := NewDHT(getInMemoryStore(), &Options{
+		Port:     "3000",
+		IP:       "0.0.0.0",
+		IDPrefix: prefix,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, prefix, dht.ht.Self.ID[:2])
+
+	_, err = NewDHT(getInMemoryStore(), &Options{
+		ID:       getIDWithValues(0),
+		Port:     "3000",
+		IP:       "0.0.0.0",
+		IDPrefix: prefix,
+	})
+	assert.Equal(t, ErrIDPrefixMismatch, err)
+
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	copy(id, prefix)
+	dht, _ = NewDHT(getInMemoryStore(), &Options{
+		ID:             id,
+		Port:           "3000",
+		IP:             "0.0.0.0",
+		IDPrefix:       prefix,
+		StrictIDPrefix: true,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	allowedID := getZerodIDWithNthByte(2, byte(255))
+	copy(allowedID, prefix)
+	allowed := &NetworkNode{ID: allowedID, IP: net.ParseIP("0.0.0.0"), Port: 3001}
+	rejected := &NetworkNode{ID: getZerodIDWithNthByte(0, byte(0xab)), IP: net.ParseIP("0.0.0.0"), Port: 3002}
+
+	dht.addNode(newNode(allowed))
+	dht.addNode(newNode(rejected))
+
+	_, found := dht.Peer(allowed.ID)
+	assert.Equal(t, true, found)
+	_, found = dht.Peer(rejected.ID)
+	assert.Equal(t, false, found)
+
+	networking.msgChan <- &message{Sender: rejected, Receiver: dht.ht.Self, Type: messageTypePing}
+	networking.msgChan <- &message{Sender: allowed, Receiver: dht.ht.Self, Type: messageTypePing}
+
+	response := <-networking.recv
+	assert.Equal(t, allowed, response.Receiver)
+
+	dht.Disconnect()
+}
+
+// Tests that OnBecameResponsible fires when a node closer to a stored key is
+// removed from a routing table holding k such nodes
+func TestOnBecameResponsible(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	responsible := make(chan []byte, 1)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+		OnBecameResponsible: func(key []byte) {
+			responsible <- key
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	data := []byte("foo")
+	key := dht.store.GetKey(data)
+
+	// Each of these nodes is closer to the key than the local node
+	var nodes []*NetworkNode
+	for i := 0; i < k; i++ {
+		nodeID := append([]byte{}, key...)
+		nodeID[19] ^= byte(i + 1)
+		n := &NetworkNode{ID: nodeID, IP: net.ParseIP("0.0.0.0"), Port: 3001 + i}
+		nodes = append(nodes, n)
+		dht.addNode(newNode(n))
+	}
+
+	networking.msgChan <- &message{
+		Sender:   nodes[0],
+		Receiver: dht.ht.Self,
+		Type:     messageTypeStore,
+		Data:     &queryDataStore{Data: data},
+	}
+	<-networking.recv
+
+	select {
+	case <-responsible:
+		t.Fatal("expected local node not to be responsible")
+	default:
+	}
+
+	dht.removeNode(nodes[5].ID, EvictionRemoved)
+
+	select {
+	case r := <-responsible:
+		assert.Equal(t, key, r)
+	case <-time.After(time.Second):
+		t.Fatal("expected OnBecameResponsible to be called")
+	}
+
+	dht.Disconnect()
+}
+
+// Tests repairing the routing table. One of two nodes does not respond to
+// pings and should be removed, and the refresh of its bucket should find a
+// replacement.
+func TestCheckAndRepairTable(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:       id,
+		Port:     "3000",
+		IP:       "0.0.0.0",
+		TPingMax: time.Millisecond * 100,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	alive := getZerodIDWithNthByte(1, byte(255))
+	dead := getZerodIDWithNthByte(2, byte(255))
+	replacement := getZerodIDWithNthByte(2, byte(255))
+	replacement[3] = byte(1)
+
+	dht.addNode(newNode(&NetworkNode{ID: alive, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+	dht.addNode(newNode(&NetworkNode{ID: dead, IP: net.ParseIP("0.0.0.0"), Port: 3002}))
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			switch query.Type {
+			case messageTypePing:
+				if bytes.Compare(query.Receiver.ID, dead) == 0 {
+					continue
+				}
+				networking.send <- mockFindNodeResponseEmpty(query)
+			case messageTypeFindNode:
+				if bytes.Compare(query.Receiver.ID, alive) == 0 {
+					networking.send <- mockFindNodeResponse(query, replacement)
+				} else {
+					networking.send <- mockFindNodeResponseEmpty(query)
+				}
+			}
+		}
+	}()
+
+	repaired, err := dht.CheckAndRepairTable(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, repaired)
+
+	_, found := dht.Peer(alive)
+	assert.Equal(t, true, found)
+	_, found = dht.Peer(dead)
+	assert.Equal(t, false, found)
+	_, found = dht.Peer(replacement)
+	assert.Equal(t, true, found)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that CheckAndRepairTable pings no more than PingConcurrency nodes of a
+// bucket at once
+func TestPingConcurrency(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:              getIDWithValues(0),
+		Port:            "3000",
+		IP:              "0.0.0.0",
+		PingConcurrency: 3,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	for i := 0; i < 8; i++ {
+		id := getZerodIDWithNthByte(1, byte(255))
+		id[3] = byte(i)
+		dht.addNode(newNode(&NetworkNode{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3001 + i}))
+	}
+
+	var outstanding, maxOutstanding, pinged int64
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+
+			if query.Type == messageTypePing {
+				atomic.AddInt64(&pinged, 1)
+				go func() {
+					n := atomic.AddInt64(&outstanding, 1)
+					for {
+						m := atomic.LoadInt64(&maxOutstanding)
+						if n <= m || atomic.CompareAndSwapInt64(&maxOutstanding, m, n) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond * 20)
+					atomic.AddInt64(&outstanding, -1)
+					networking.send <- mockFindNodeResponseEmpty(query)
+				}()
+			}
+		}
+	}()
+
+	repaired, err := dht.CheckAndRepairTable(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, repaired)
+	assert.Equal(t, 8, dht.NumNodes())
+	assert.Equal(t, int64(8), atomic.LoadInt64(&pinged))
+	peak := atomic.LoadInt64(&maxOutstanding)
+	assert.True(t, peak <= 3)
+	assert.True(t, peak > 1)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that once enough pings time out together to indicate churn, the
+// remaining unresponsive nodes are kept until they recover, and that nodes
+// are evicted as usual once the churn has subsided
+func TestChurnThreshold(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:             id,
+		Port:           "3000",
+		IP:             "0.0.0.0",
+		TPingMax:       time.Millisecond * 50,
+		TMsgTimeout:    time.Millisecond * 50,
+		ChurnThreshold: 3,
+	})
+
+	now := time.Now()
+	dht.now = func() time.Time {
+		return now
+	}
+
+	logs := &lockedBuffer{mutex: &sync.Mutex{}}
+	dht.options.Logger.SetOutput(logs)
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	for i := 1; i <= 5; i++ {
+		dht.addNode(newNode(&NetworkNode{ID: getZerodIDWithNthByte(i, byte(255)), IP: net.ParseIP("0.0.0.0"), Port: 3000 + i}))
+	}
+
+	// Every node is down, then all but the third recover
+	downMutex := &sync.Mutex{}
+	down := map[int]bool{3001: true, 3002: true, 3003: true, 3004: true, 3005: true}
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			downMutex.Lock()
+			respond := query.Type == messageTypePing && !down[query.Receiver.Port]
+			downMutex.Unlock()
+			if respond {
+				networking.send <- mockFindNodeResponseEmpty(query)
+			}
+		}
+	}()
+
+	_, err := dht.CheckAndRepairTable(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, dht.NumNodes())
+	assert.Contains(t, logs.String(), "Detected churn")
+
+	now = now.Add(dht.options.TChurnWindow)
+	downMutex.Lock()
+	down = map[int]bool{3003: true}
+	downMutex.Unlock()
+
+	_, err = dht.CheckAndRepairTable(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dht.NumNodes())
+	assert.Contains(t, logs.String(), "Churn subsided")
+
+	_, found := dht.Peer(getZerodIDWithNthByte(3, byte(255)))
+	assert.False(t, found)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests resetting a bucket poisoned with unresponsive nodes. The refresh
+// which follows should repopulate it with a different node.
+func TestResetBucket(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:            id,
+		Port:          "3000",
+		IP:            "0.0.0.0",
+		WarmCacheSize: 5,
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	honest := getZerodIDWithNthByte(1, byte(255))
+	replacement := getZerodIDWithNthByte(2, byte(255))
+	replacement[3] = byte(1)
+	index := getBucketIndexFromDifferingBit(id, replacement)
+
+	dht.addNode(newNode(&NetworkNode{ID: honest, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+
+	var poisoned [][]byte
+	for i := 0; i < 5; i++ {
+		poisonedID := getZerodIDWithNthByte(2, byte(255))
+		poisonedID[19] = byte(i + 1)
+		poisoned = append(poisoned, poisonedID)
+		dht.addNode(newNode(&NetworkNode{ID: poisonedID, IP: net.ParseIP("0.0.0.0"), Port: 4000 + i}))
+	}
+	assert.Equal(t, 5, dht.ht.getTotalNodesInBucket(index))
+
+	// Nodes in the warm cache are only forgotten if they belong in the bucket
+	cachedPoisoned := getZerodIDWithNthByte(2, byte(255))
+	cachedPoisoned[18] = byte(1)
+	cachedHonest := getZerodIDWithNthByte(3, byte(255))
+	dht.warmCache.add(NetworkNode{ID: cachedPoisoned, IP: net.ParseIP("0.0.0.0"), Port: 5000})
+	dht.warmCache.add(NetworkNode{ID: cachedHonest, IP: net.ParseIP("0.0.0.0"), Port: 5001})
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			if query.Type == messageTypeFindNode {
+				res := mockFindNodeResponseEmpty(query)
+				if bytes.Equal(query.Receiver.ID, honest) {
+					res = mockFindNodeResponse(query, replacement)
+				}
+				go func() {
+					networking.send <- res
+				}()
+			}
+		}
+	}()
+
+	assert.Error(t, dht.ResetBucket(b, false))
+
+	err := dht.ResetBucket(index, true)
+	assert.NoError(t, err)
+
+	for _, poisonedID := range poisoned {
+		_, found := dht.Peer(poisonedID)
+		assert.False(t, found)
+	}
+	_, found := dht.Peer(replacement)
+	assert.True(t, found)
+	_, found = dht.Peer(honest)
+	assert.True(t, found)
+	assert.Equal(t, 1, dht.ht.getTotalNodesInBucket(index))
+
+	// The cached node from another bucket was kept as a lookup candidate and
+	// added once it responded, while the cached node from the reset bucket was
+	// forgotten
+	_, found = dht.Peer(cachedHonest)
+	assert.True(t, found)
+	_, found = dht.Peer(cachedPoisoned)
+	assert.False(t, found)
+	assert.Equal(t, 0, len(dht.warmCache.closest(5, id)))
+
+	// The refresh stops once the caller's context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, dht.ResetBucketContext(ctx, index, true))
+	assert.Equal(t, 0, dht.ht.getTotalNodesInBucket(index))
+
+	dht.Disconnect()
+
+	<-done
+}
+
+func TestGetBucketIndexFromDifferingBit(t *testing.T) {
+	tests := []struct {
+		id1      []byte
+		id2      []byte
+		expected int
+	}{
+		// 1 byte IDs
+		{[]byte{0x00}, []byte{0x00}, 0},
+		{[]byte{0x00}, []byte{0x80}, 7},
+		{[]byte{0x00}, []byte{0x01}, 0},
+		{[]byte{0x10}, []byte{0x18}, 3},
+
+		// 2 byte IDs
+		{[]byte{0x00, 0x00}, []byte{0x00, 0x01}, 0},
+		{[]byte{0x00, 0x00}, []byte{0x01, 0x00}, 8},
+		{[]byte{0x80, 0x00}, []byte{0x00, 0x00}, 15},
+		{[]byte{0x00, 0x0f}, []byte{0x00, 0x1f}, 4},
+
+		// 20 byte IDs
+		{getIDWithValues(0), getIDWithValues(0), 0},
+		{getIDWithValues(0), getZerodIDWithNthByte(0, 0x80), 159},
+		{getIDWithValues(0), getZerodIDWithNthByte(19, 0x01), 0},
+		{getIDWithValues(0), getZerodIDWithNthByte(1, 0xff), 151},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getBucketIndexFromDifferingBit(test.id1, test.id2))
+		assert.Equal(t, test.expected, getBucketIndexFromDifferingBit(test.id2, test.id1))
+
+		// Distances and random IDs are computed over the whole ID
+		ht := &hashTable{Self: &NetworkNode{ID: test.id1}, mutex: &sync.Mutex{}}
+		xor := make([]byte, len(test.id1))
+		for i := range xor {
+			xor[i] = test.id1[i] ^ test.id2[i]
+		}
+		assert.Equal(t, new(big.Int).SetBytes(xor), ht.getDistance(test.id1, test.id2))
+
+		r := ht.getRandomIDFromBucket(len(test.id1)*8 - test.expected - 1)
+		assert.Equal(t, len(test.id1), len(r))
+		assert.True(t, getBucketIndexFromDifferingBit(test.id1, r) <= test.expected)
+	}
+}
+
+// Tests each ID collision policy by adding three nodes with the same ID but
+// different addresses. Only the second node responds to pings.
+func TestIDCollisionPolicy(t *testing.T) {
+	policies := []int{
+		IDCollisionKeepExisting,
+		IDCollisionPing,
+		IDCollisionUpdateAddress,
+		IDCollisionVerifyAddress,
+	}
+	for _, policy := range policies {
+		networking := newMockNetworking()
+		id := getIDWithValues(0)
+		done := make(chan (int))
+
+		dht, _ := NewDHT(getInMemoryStore(), &Options{
+			ID:                id,
+			Port:              "3000",
+			IP:                "0.0.0.0",
+			TPingMax:          time.Millisecond * 100,
+			IDCollisionPolicy: policy,
+		})
+
+		dht.networking = networking
+		dht.CreateSocket()
+
+		go func() {
+			dht.Listen()
+		}()
+
+		go func() {
+			for {
+				query := <-networking.recv
+				if query == nil {
+					close(done)
+					return
+				}
+				if query.Type == messageTypePing && query.Receiver.Port == 3002 {
+					res := mockFindNodeResponseEmpty(query)
+					res.Sender = query.Receiver
+					networking.send <- res
+				}
+			}
+		}()
+
+		peerID := getZerodIDWithNthByte(1, byte(255))
+		dht.addNode(newNode(&NetworkNode{ID: peerID, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+		dht.addNode(newNode(&NetworkNode{ID: peerID, IP: net.ParseIP("0.0.0.0"), Port: 3002}))
+
+		assert.Equal(t, 1, dht.NumNodes())
+		peer, _ := dht.Peer(peerID)
+		switch policy {
+		case IDCollisionKeepExisting:
+			assert.Equal(t, 3001, peer.Port)
+		default:
+			assert.Equal(t, 3002, peer.Port)
+		}
+
+		// The peer moves again, to an address which does not respond
+		dht.addNode(newNode(&NetworkNode{ID: peerID, IP: net.ParseIP("0.0.0.0"), Port: 3003}))
+
+		assert.Equal(t, 1, dht.NumNodes())
+		peer, _ = dht.Peer(peerID)
+		switch policy {
+		case IDCollisionKeepExisting:
+			assert.Equal(t, 3001, peer.Port)
+		case IDCollisionUpdateAddress:
+			assert.Equal(t, 3003, peer.Port)
+		default:
+			assert.Equal(t, 3002, peer.Port)
+		}
+
+		dht.Disconnect()
+
+		<-done
+	}
+}
+
+// Tests that OnNodeEvicted reports the reason for each way in which a node
+// can be removed from the routing table
+func TestEvictionReasons(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+	evictions := make(chan EvictionReason)
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:                id,
+		Port:              "3000",
+		IP:                "0.0.0.0",
+		TPingMax:          time.Millisecond * 100,
+		IDCollisionPolicy: IDCollisionPing,
+		OnNodeEvicted: func(n NetworkNode, reason EvictionReason) {
+			evictions <- reason
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	// Only the node on port 4000 responds to pings
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			if query.Type == messageTypePing && query.Receiver.Port == 4000 {
+				res := mockFindNodeResponseEmpty(query)
+				res.Sender = query.Receiver
+				networking.send <- res
+			}
+		}
+	}()
+
+	expectEviction := func(expected EvictionReason) {
+		select {
+		case reason := <-evictions:
+			assert.Equal(t, expected, reason)
+		case <-time.After(time.Second):
+			t.Fatalf("expected eviction for reason %s", expected)
+		}
+	}
+
+	// Fill a bucket
+	for i := 0; i < k; i++ {
+		dht.addNode(newNode(&NetworkNode{
+			ID:   getZerodIDWithNthByte(0, byte(0x80|i)),
+			IP:   net.ParseIP("0.0.0.0"),
+			Port: 3001 + i,
+		}))
+	}
+
+	networking.failNextSendMessage()
+	dht.addNode(newNode(&NetworkNode{ID: getZerodIDWithNthByte(0, byte(0xf0)), IP: net.ParseIP("0.0.0.0"), Port: 3100}))
+	expectEviction(EvictionBucketOverflow)
+
+	dht.addNode(newNode(&NetworkNode{ID: getZerodIDWithNthByte(0, byte(0xf1)), IP: net.ParseIP("0.0.0.0"), Port: 3101}))
+	expectEviction(EvictionUnresponsive)
+
+	assert.True(t, dht.RemovePeer(getZerodIDWithNthByte(0, byte(0x82))))
+	expectEviction(EvictionRemoved)
+	assert.False(t, dht.RemovePeer(getZerodIDWithNthByte(0, byte(0x82))))
+
+	dht.addNode(newNode(&NetworkNode{ID: getZerodIDWithNthByte(1, byte(255)), IP: net.ParseIP("10.0.0.1"), Port: 3200}))
+	networking.banHandler("10.0.0.1")
+	expectEviction(EvictionBanned)
+	_, found := dht.Peer(getZerodIDWithNthByte(1, byte(255)))
+	assert.False(t, found)
+
+	peerID := getZerodIDWithNthByte(2, byte(255))
+	dht.addNode(newNode(&NetworkNode{ID: peerID, IP: net.ParseIP("0.0.0.0"), Port: 3300}))
+	dht.addNode(newNode(&NetworkNode{ID: peerID, IP: net.ParseIP("0.0.0.0"), Port: 4000}))
+	expectEviction(EvictionReplaced)
+
+	assert.Equal(t, k, dht.NumNodes())
+
+	dht.Disconnect()
+
+	<-done
+}
+
+type blockingReader struct {
+	unblock chan bool
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.unblock
+	return 0, io.EOF
+}
+
+// Tests generating an ID from the provided source of random data, and that
+// NewDHT fails rather than hanging if no random data is available
+func TestGenerateIDTimeout(t *testing.T) {
+	dht, err := NewDHT(getInMemoryStore(), &Options{
+		Port: "3000",
+		IP:   "0.0.0.0",
+		Rand: bytes.NewReader(getIDWithValues(7)),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, getIDWithValues(7), dht.ht.Self.ID)
+
+	_, err = NewDHT(getInMemoryStore(), &Options{
+		Port: "3000",
+		IP:   "0.0.0.0",
+		Rand: bytes.NewReader([]byte{1, 2, 3}),
+	})
+	assert.Error(t, err)
+
+	r := &blockingReader{unblock: make(chan bool)}
+	defer close(r.unblock)
+
+	start := time.Now()
+	_, err = NewDHT(getInMemoryStore(), &Options{
+		Port:          "3000",
+		IP:            "0.0.0.0",
+		Rand:          r,
+		TIDGeneration: time.Millisecond * 50,
+	})
+	assert.Equal(t, ErrRandomUnavailable, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+// Tests that comparing ID prefixes never reports IDs which only share a
+// prefix as equal
+func TestIDPrefixCompare(t *testing.T) {
+	assert.Equal(t, uint64(0), getIDPrefix(getIDWithValues(0)))
+	assert.Equal(t, uint64(1)<<56, getIDPrefix([]byte{1}))
+
+	for _, enabled := range []bool{false, true} {
+		ht, _ := newHashTable(&Options{
+			ID:              getIDWithValues(0),
+			Port:            "3000",
+			IP:              "0.0.0.0",
+			IDPrefixCompare: enabled,
+		})
+
+		// Both IDs share the first 8 bytes and the same bucket
+		id1 := getIDWithValues(255)
+		id2 := getIDWithValues(255)
+		id2[19] = 0
+
+		n1 := newNode(&NetworkNode{ID: id1, IP: net.ParseIP("0.0.0.0"), Port: 3001})
+		assert.Equal(t, getIDPrefix(id2), n1.idPrefix)
+		index := getBucketIndexFromDifferingBit(ht.Self.ID, id1)
+		ht.RoutingTable[index] = append(ht.RoutingTable[index], n1)
+
+		assert.True(t, ht.doesNodeExistInBucket(index, id1))
+		assert.False(t, ht.doesNodeExistInBucket(index, id2))
+
+		_, found := ht.getNode(id1)
+		assert.True(t, found)
+		_, found = ht.getNode(id2)
+		assert.False(t, found)
+
+		sl := ht.getClosestContacts(k, id1, []*NetworkNode{{ID: id2}})
+		assert.Equal(t, 1, sl.Len())
+		sl = ht.getClosestContacts(k, id1, []*NetworkNode{{ID: id1}})
+		assert.Equal(t, 0, sl.Len())
+
+		ht.removeNode(id2)
+		assert.Equal(t, 1, ht.totalNodes())
+		ht.removeNode(id1)
+		assert.Equal(t, 0, ht.totalNodes())
+	}
+}
+
+// Tests that a node which could not be added to its full bucket is kept in
+// the warm cache, queried by a later lookup, and added to the routing table
+// once an unresponsive node is removed from its bucket
+func TestWarmCache(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:            getIDWithValues(0),
+		Port:          "3000",
+		IP:            "0.0.0.0",
+		WarmCacheSize: 5,
+	})
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	dht.ht.bucketIndex = func(id []byte) int {
+		return 0
+	}
+
+	var ids [][]byte
+	for i := 1; i <= k; i++ {
+		id := getZerodIDWithNthByte(19, byte(i))
+		ids = append(ids, id)
+		dht.addNode(newNode(&NetworkNode{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+	}
+
+	queried := make(map[string]bool)
+	mutex := &sync.Mutex{}
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			if query.Type == messageTypeFindNode {
+				mutex.Lock()
+				queried[string(query.Receiver.ID)] = true
+				mutex.Unlock()
+			}
+			res := mockFindNodeResponseEmpty(query)
+			go func() {
+				networking.send <- res
+			}()
+		}
+	}()
+
+	// The oldest node responds to its ping, so the newcomer is not added
+	newcomer := getZerodIDWithNthByte(0, byte(1))
+	dht.addNode(newNode(&NetworkNode{ID: newcomer, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+	_, found := dht.Peer(newcomer)
+	assert.False(t, found)
+
+	_, _, err := dht.iterate(iterateFindNode, newcomer, nil)
+	assert.NoError(t, err)
+	mutex.Lock()
+	assert.True(t, queried[string(newcomer)])
+	mutex.Unlock()
+
+	dht.removeNode(ids[0], EvictionUnresponsive)
+	_, found = dht.Peer(newcomer)
+	assert.True(t, found)
+	assert.Equal(t, k, dht.NumNodes())
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Tests that nodes excluded by ID are absent from the closest contacts
+// whichever bucket they are in, and that the shortlist is filled from the
+// remaining nodes
+func TestGetClosestContactsExcluding(t *testing.T) {
+	ht, _ := newHashTable(&Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	// Each node is in a different bucket
+	var ids [][]byte
+	for i := 0; i < 10; i++ {
+		id := getZerodIDWithNthByte(i, byte(255))
+		ids = append(ids, id)
+		index := getBucketIndexFromDifferingBit(ht.Self.ID, id)
+		ht.RoutingTable[index] = append(ht.RoutingTable[index], newNode(&NetworkNode{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3001}))
+	}
+
+	// Exclude the node closest to the target, and nodes in the nearest and
+	// furthest buckets
+	target := ids[5]
+	excluded := [][]byte{ids[5], ids[9], ids[0]}
+	isExcluded := func(id []byte) bool {
+		for _, e := range excluded {
+			if bytes.Equal(e, id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	sl := ht.getClosestContactsExcluding(k, target, excluded)
+	assert.Equal(t, 7, sl.Len())
+	for _, n := range sl.Nodes {
+		assert.False(t, isExcluded(n.ID))
+	}
+
+	sl = ht.getClosestContactsExcluding(3, target, excluded)
+	assert.Equal(t, 3, sl.Len())
+	for _, n := range sl.Nodes {
+		assert.False(t, isExcluded(n.ID))
+	}
+
+	// Excluded nodes are left in the routing table
+	assert.Equal(t, 10, ht.totalNodes())
+	sl = ht.getClosestContactsExcluding(1, target, nil)
+	assert.Equal(t, ids[5], sl.Nodes[0].ID)
+}
+
+// Tests that a routing table skewed by forcing every node into the furthest
+// bucket still finds and removes nodes, and returns them sorted by distance
+func TestSkewedBucketIndex(t *testing.T) {
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+
+	var decisions [][]byte
+	dht.ht.bucketIndex = func(id []byte) int {
+		decisions = append(decisions, id)
+		return b - 1
+	}
+
+	var ids [][]byte
+	for i := 1; i <= 10; i++ {
+		id := getZerodIDWithNthByte(19, byte(i))
+		ids = append(ids, id)
+		dht.addNode(newNode(&NetworkNode{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3000 + i}))
+	}
+
+	assert.Equal(t, 10, len(decisions))
+	buckets := dht.ht.snapshot()
+	assert.Equal(t, 10, len(buckets[b-1]))
+	assert.Equal(t, 10, dht.NumNodes())
+
+	// Nodes are found in the bucket they were forced into
+	for _, id := range ids {
+		_, found := dht.ht.getNode(id)
+		assert.True(t, found)
+	}
+
+	// Contacts are taken from the target's bucket in the order they were
+	// seen, so with every node in one bucket the closest are only found once
+	// the whole bucket is taken
+	target := getZerodIDWithNthByte(19, byte(4))
+	sl := dht.ht.getClosestContacts(3, target, nil)
+	assert.Equal(t, 3, sl.Len())
+	assert.Equal(t, ids[0], sl.Nodes[0].ID)
+	sl = dht.ht.getClosestContacts(k, target, nil)
+	assert.Equal(t, 10, sl.Len())
+	assert.Equal(t, ids[3], sl.Nodes[0].ID)
+	assert.Equal(t, ids[4], sl.Nodes[1].ID)
+	assert.Equal(t, ids[5], sl.Nodes[2].ID)
+
+	decisions = nil
+	dht.ht.removeNode(ids[3])
+	assert.Equal(t, [][]byte{ids[3]}, decisions)
+	assert.Equal(t, 9, dht.NumNodes())
+	_, found := dht.ht.getNode(ids[3])
+	assert.False(t, found)
+}
+
+// Tests that the routing table can be read while a node added to a full
+// bucket waits for the oldest node to respond to a ping, and that the oldest
+// node is kept once it responds
+func TestAddNodeToFullBucketDoesNotBlock(t *testing.T) {
+	networking := newMockNetworking()
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:       getIDWithValues(0),
+		Port:     "3000",
+		IP:       "0.0.0.0",
+		TPingMax: time.Hour,
+	})
+	dht.networking = networking
+	dht.CreateSocket()
+
+	dht.ht.bucketIndex = func(id []byte) int {
+		return 0
+	}
+
+	var ids [][]byte
+	for i := 1; i <= k; i++ {
+		id := getZerodIDWithNthByte(19, byte(i))
+		ids = append(ids, id)
+		dht.addNode(newNode(&NetworkNode{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3000 + i}))
+	}
+
+	added := make(chan (int))
+	newcomer := getZerodIDWithNthByte(18, byte(1))
+	go func() {
+		dht.addNode(newNode(&NetworkNode{ID: newcomer, IP: net.ParseIP("0.0.0.0"), Port: 4000}))
+		close(added)
+	}()
+
+	query := <-networking.recv
+	assert.Equal(t, messageTypePing, query.Type)
+	assert.Equal(t, ids[0], query.Receiver.ID)
+
+	// The ping is outstanding, but lookups are not held up by it
+	sl := dht.ht.getClosestContacts(k, ids[0], nil)
+	assert.Equal(t, k, sl.Len())
+	assert.Equal(t, k, dht.NumNodes())
+
+	networking.send <- mockFindNodeResponseEmpty(query)
+	<-added
+	assert.Equal(t, k, dht.NumNodes())
+	_, found := dht.Peer(ids[0])
+	assert.True(t, found)
+	_, found = dht.Peer(newcomer)
+	assert.False(t, found)
+}
+
+// Tests that the port may be a number or a service name, and that any other
+// port is rejected with an error naming it
+func TestPort(t *testing.T) {
+	ht, err := newHashTable(&Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3000, ht.Self.Port)
+
+	ht, err = newHashTable(&Options{
+		ID:   getIDWithValues(0),
+		Port: "domain",
+		IP:   "0.0.0.0",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 53, ht.Self.Port)
+
+	for _, port := range []string{"notaport", "70000"} {
+		_, err = newHashTable(&Options{
+			ID:   getIDWithValues(0),
+			Port: port,
+			IP:   "0.0.0.0",
+		})
+		assert.True(t, errors.Is(err, ErrInvalidPort))
+		assert.Contains(t, err.Error(), port)
+	}
+}
+
+func benchmarkGetClosestContacts(b *testing.B, idPrefixCompare bool) {
+	ht, _ := newHashTable(&Options{
+		ID:              getIDWithValues(0),
+		Port:            "3000",
+		IP:              "0.0.0.0",
+		IDPrefixCompare: idPrefixCompare,
+	})
+
+	// Populate the table as densely as possible, and ignore every node in it
+	var ignored []*NetworkNode
+	for i := 0; i < 10000; i++ {
+		id, _ := newID()
+		index := getBucketIndexFromDifferingBit(ht.Self.ID, id)
+		if len(ht.RoutingTable[index]) < k {
+			n := &NetworkNode{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3001}
+			ht.RoutingTable[index] = append(ht.RoutingTable[index], newNode(n))
+			ignored = append(ignored, &NetworkNode{ID: append([]byte{}, id...)})
+		}
+	}
+
+	target, _ := newID()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ht.getClosestContacts(k, target, ignored)
+	}
+}
+
+func BenchmarkGetClosestContacts(b *testing.B) {
+	benchmarkGetClosestContacts(b, false)
+}
+
+func BenchmarkGetClosestContactsIDPrefixCompare(b *testing.B) {
+	benchmarkGetClosestContacts(b, true)
+}
@@ -0,0 +1,60 @@
+package kademlia
+
+// ClosestIterator pages through the nodes in a snapshot of the routing table
+// in order of distance from a target, for example for admin tools listing the
+// closest nodes without performing a lookup. The snapshot is taken when the
+// iterator is created, so pages are consistent while the routing table
+// changes. It is not safe for concurrent use.
+type ClosestIterator struct {
+	nodes  []NetworkNode
+	cursor int
+}
+
+// ClosestIterator returns an iterator over every node in the local routing
+// table, closest to target first
+func (dht *DHT) ClosestIterator(target []byte) *ClosestIterator {
+	sl := dht.ht.getClosestContacts(dht.ht.totalNodes(), target, nil)
+	nodes := make([]NetworkNode, len(sl.Nodes))
+	for i, n := range sl.Nodes {
+		nodes[i] = copyNetworkNode(n)
+	}
+	return &ClosestIterator{nodes: nodes}
+}
+
+// Next returns up to n of the nodes after the cursor, and advances the cursor
+// past them. An empty slice is returned once every node has been returned.
+func (it *ClosestIterator) Next(n int) []NetworkNode {
+	if n < 0 {
+		n = 0
+	}
+	end := it.cursor + n
+	if end > len(it.nodes) {
+		end = len(it.nodes)
+	}
+	page := append([]NetworkNode{}, it.nodes[it.cursor:end]...)
+	it.cursor = end
+	return page
+}
+
+// Cursor returns the number of nodes returned so far. Passing it to Seek
+// resumes iteration from the same position.
+func (it *ClosestIterator) Cursor() int {
+	return it.cursor
+}
+
+// Seek moves the cursor to a position previously returned by Cursor. Cursors
+// beyond the end of the snapshot end the iteration.
+func (it *ClosestIterator) Seek(cursor int) {
+	if cursor < 0 {
+		cursor = 0
+	}
+	if cursor > len(it.nodes) {
+		cursor = len(it.nodes)
+	}
+	it.cursor = cursor
+}
+
+// Len returns the number of nodes in the snapshot
+func (it *ClosestIterator) Len() int {
+	return len(it.nodes)
+}
@@ -0,0 +1,183 @@
+// Package mdns discovers kademlia peers on the local network using mDNS and
+// adds them to the routing table of a DHT. It is useful for development and
+// edge deployments where there is no bootstrap node.
+package mdns
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	b58 "github.com/jbenet/go-base58"
+	"github.com/prettymuchbryce/kademlia"
+)
+
+const (
+	// DefaultService is the mDNS service name advertised and browsed for if no
+	// Service is provided to the Options
+	DefaultService = "_kademlia._udp"
+
+	// DefaultInterval is how often the local network is browsed for peers if
+	// no Interval is provided to the Options
+	DefaultInterval = time.Second * 10
+
+	// How long each browse of the local network lasts
+	browseTimeout = time.Second
+
+	// The TXT record field holding the base58 encoded ID of the node
+	idField = "id="
+)
+
+// Entry is a service instance found on the local network
+type Entry struct {
+	// IP is the address of the host advertising the service
+	IP net.IP
+
+	// Port is the advertised port of the service
+	Port int
+
+	// Info contains the fields of the service's TXT record
+	Info []string
+}
+
+// Provider is an mDNS implementation. NewProvider returns the default
+// Provider.
+type Provider interface {
+	// Advertise announces the service on the local network with the given
+	// port and TXT record until the returned io.Closer is closed
+	Advertise(service string, port int, info []string) (io.Closer, error)
+
+	// Browse sends every instance of the service found on the local network
+	// to entries, and returns once timeout has elapsed
+	Browse(service string, timeout time.Duration, entries chan<- *Entry) error
+}
+
+// Options contains configuration options for the Bridge
+type Options struct {
+	// The mDNS service name to advertise and browse for. Defaults to
+	// DefaultService.
+	Service string
+
+	// How often to browse the local network for peers. Defaults to
+	// DefaultInterval.
+	Interval time.Duration
+}
+
+// Bridge advertises the local node using mDNS and adds the peers it finds to
+// the routing table of the DHT
+type Bridge struct {
+	dht      *kademlia.DHT
+	provider Provider
+	options  *Options
+
+	advertisement io.Closer
+	stop          chan bool
+	wg            *sync.WaitGroup
+}
+
+// NewBridge creates a Bridge for the given DHT. The DHT's socket should be
+// created before the Bridge is started so the advertised port is known.
+func NewBridge(dht *kademlia.DHT, provider Provider, options *Options) *Bridge {
+	if options == nil {
+		options = &Options{}
+	}
+	if options.Service == "" {
+		options.Service = DefaultService
+	}
+	if options.Interval == 0 {
+		options.Interval = DefaultInterval
+	}
+
+	return &Bridge{
+		dht:      dht,
+		provider: provider,
+		options:  options,
+		wg:       &sync.WaitGroup{},
+	}
+}
+
+// Start advertises the local node and begins browsing for peers
+func (b *Bridge) Start() error {
+	if b.stop != nil {
+		return errors.New("Bridge already started")
+	}
+
+	info := []string{idField + b.dht.GetSelfID()}
+	advertisement, err := b.provider.Advertise(b.options.Service, b.dht.Config().Port, info)
+	if err != nil {
+		return err
+	}
+
+	b.advertisement = advertisement
+	b.stop = make(chan bool)
+	b.wg.Add(1)
+	go b.browse()
+
+	return nil
+}
+
+// Stop stops advertising the local node and browsing for peers
+func (b *Bridge) Stop() error {
+	if b.stop == nil {
+		return nil
+	}
+	close(b.stop)
+	b.wg.Wait()
+	b.stop = nil
+	return b.advertisement.Close()
+}
+
+func (b *Bridge) browse() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		entries := make(chan *Entry)
+		go func() {
+			b.provider.Browse(b.options.Service, browseTimeout, entries)
+			close(entries)
+		}()
+
+		for entry := range entries {
+			b.addPeer(entry)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *Bridge) addPeer(entry *Entry) {
+	node := &kademlia.NetworkNode{
+		IP:   entry.IP,
+		Port: entry.Port,
+	}
+
+	self := b.dht.GetSelfID()
+
+	for _, field := range entry.Info {
+		if strings.HasPrefix(field, idField) {
+			id := strings.TrimPrefix(field, idField)
+			if id == self {
+				return
+			}
+			node.ID = b58.Decode(id)
+		}
+	}
+
+	// The peer is pinged and added with the ID it responds with. A valid
+	// advertised ID must match it, while an invalid one is ignored.
+	if len(node.ID) != len(b58.Decode(self)) {
+		node.ID = nil
+	}
+
+	b.dht.AddPeer(node)
+}
@@ -0,0 +1,117 @@
+package mdns
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	b58 "github.com/jbenet/go-base58"
+	"github.com/prettymuchbryce/kademlia"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockProvider struct {
+	mutex   *sync.Mutex
+	entries []*Entry
+	info    []string
+	port    int
+	closed  bool
+}
+
+func (p *mockProvider) Advertise(service string, port int, info []string) (io.Closer, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.port = port
+	p.info = info
+	return p, nil
+}
+
+func (p *mockProvider) Browse(service string, timeout time.Duration, entries chan<- *Entry) error {
+	p.mutex.Lock()
+	found := p.entries
+	p.mutex.Unlock()
+	for _, e := range found {
+		entries <- e
+	}
+	return nil
+}
+
+func (p *mockProvider) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	return nil
+}
+
+// Tests that the bridge advertises the local node, and adds the peers
+// surfaced by the provider to the routing table while ignoring itself. Peers
+// are pinged before they are added.
+func TestBridge(t *testing.T) {
+	id := make([]byte, 20)
+	dht, _ := kademlia.NewDHT(&kademlia.MemoryStore{}, &kademlia.Options{
+		ID:   id,
+		Port: "0",
+		IP:   "127.0.0.1",
+	})
+
+	peerID := make([]byte, 20)
+	peerID[0] = byte(255)
+	peer, _ := kademlia.NewDHT(&kademlia.MemoryStore{}, &kademlia.Options{
+		ID:   peerID,
+		Port: "0",
+		IP:   "127.0.0.1",
+	})
+
+	done := make(chan bool)
+	for _, d := range []*kademlia.DHT{dht, peer} {
+		err := d.CreateSocket()
+		assert.NoError(t, err)
+		go func(d *kademlia.DHT) {
+			d.Listen()
+			done <- true
+		}(d)
+	}
+	port := dht.Config().Port
+	peerPort := peer.Config().Port
+
+	provider := &mockProvider{
+		mutex: &sync.Mutex{},
+		entries: []*Entry{
+			{IP: net.ParseIP("127.0.0.1"), Port: port, Info: []string{"id=" + b58.Encode(id)}},
+			{IP: net.ParseIP("127.0.0.1"), Port: peerPort, Info: []string{"id=" + b58.Encode(peerID)}},
+		},
+	}
+
+	bridge := NewBridge(dht, provider, &Options{Interval: time.Millisecond * 10})
+	err := bridge.Start()
+	assert.NoError(t, err)
+
+	err = bridge.Start()
+	assert.Error(t, err)
+
+	for i := 0; i < 100 && dht.NumNodes() == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	assert.Equal(t, 1, dht.NumNodes())
+	found, ok := dht.Peer(peerID)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", found.IP.String())
+	assert.Equal(t, peerPort, found.Port)
+
+	err = bridge.Stop()
+	assert.NoError(t, err)
+
+	provider.mutex.Lock()
+	assert.Equal(t, port, provider.port)
+	assert.Equal(t, []string{"id=" + dht.GetSelfID()}, provider.info)
+	assert.True(t, provider.closed)
+	provider.mutex.Unlock()
+
+	assert.NoError(t, dht.Disconnect())
+	assert.NoError(t, peer.Disconnect())
+	<-done
+	<-done
+}
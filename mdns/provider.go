@@ -0,0 +1,73 @@
+package mdns
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+// NewProvider returns a Provider backed by github.com/hashicorp/mdns
+func NewProvider() Provider {
+	return &hashicorpProvider{}
+}
+
+type hashicorpProvider struct{}
+
+func (p *hashicorpProvider) Advertise(service string, port int, info []string) (io.Closer, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	zone, err := mdns.NewMDNSService(host, service, "", "", port, nil, info)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := mdns.NewServer(&mdns.Config{Zone: zone})
+	if err != nil {
+		return nil, err
+	}
+
+	return &advertisement{server: server}, nil
+}
+
+func (p *hashicorpProvider) Browse(service string, timeout time.Duration, entries chan<- *Entry) error {
+	found := make(chan *mdns.ServiceEntry)
+	done := make(chan bool)
+
+	go func() {
+		for e := range found {
+			ip := e.AddrV4
+			if ip == nil {
+				ip = e.AddrV6
+			}
+			entries <- &Entry{
+				IP:   ip,
+				Port: e.Port,
+				Info: e.InfoFields,
+			}
+		}
+		close(done)
+	}()
+
+	params := mdns.DefaultParams(service)
+	params.Timeout = timeout
+	params.Entries = found
+	err := mdns.Query(params)
+
+	close(found)
+	<-done
+
+	return err
+}
+
+type advertisement struct {
+	server *mdns.Server
+}
+
+func (a *advertisement) Close() error {
+	return a.server.Shutdown()
+}
@@ -0,0 +1,255 @@
+package kademlia
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The default bucket boundaries used for latency histograms
+var defaultLatencyBuckets = []time.Duration{
+	time.Millisecond * 10,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Millisecond * 2500,
+	time.Second * 5,
+	time.Second * 10,
+}
+
+// The names of the RPC types recorded by RPCLatency
+var rpcNames = map[int]string{
+	messageTypePing:      "PING",
+	messageTypeFindNode:  "FIND_NODE",
+	messageTypeFindValue: "FIND_VALUE",
+}
+
+// Histogram is a snapshot of a distribution of durations. Counts[i] is the
+// number of durations greater than Bounds[i-1] and less than or equal to
+// Bounds[i]. The final element of Counts is the number of durations greater
+// than every bound.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+}
+
+// Total returns the number of durations recorded in the histogram
+func (h Histogram) Total() uint64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	return total
+}
+
+// latencyHistogram records durations into a fixed set of buckets
+type latencyHistogram struct {
+	mutex  *sync.Mutex
+	bounds []time.Duration
+	counts []uint64
+}
+
+func newLatencyHistogram(bounds []time.Duration) *latencyHistogram {
+	return &latencyHistogram{
+		mutex:  &sync.Mutex{},
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+}
+
+func (h *latencyHistogram) snapshot() Histogram {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return Histogram{
+		Bounds: append([]time.Duration{}, h.bounds...),
+		Counts: append([]uint64{}, h.counts...),
+	}
+}
+
+// metricsLabelKey is the context key of the label added by WithMetricsLabel
+type metricsLabelKey struct{}
+
+// WithMetricsLabel returns a copy of ctx carrying label, for example the name
+// of the application issuing an operation. Operations issued with the
+// returned context by StoreContext and GetContext are counted against label
+// in LabelMetrics, so that load can be attributed to each application.
+func WithMetricsLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, metricsLabelKey{}, label)
+}
+
+// OperationCounts is the number of operations issued with a metrics label
+type OperationCounts struct {
+	Stores uint64
+	Gets   uint64
+}
+
+// LabelMetrics returns the number of operations issued with each label added
+// by WithMetricsLabel
+func (dht *DHT) LabelMetrics() map[string]OperationCounts {
+	dht.labelCountsMutex.Lock()
+	defer dht.labelCountsMutex.Unlock()
+	metrics := make(map[string]OperationCounts)
+	for label, counts := range dht.labelCounts {
+		metrics[label] = *counts
+	}
+	return metrics
+}
+
+// countOperation applies count to the operation counts of the label carried
+// by ctx, if it carries one
+func (dht *DHT) countOperation(ctx context.Context, count func(c *OperationCounts)) {
+	label, ok := ctx.Value(metricsLabelKey{}).(string)
+	if !ok {
+		return
+	}
+	dht.labelCountsMutex.Lock()
+	defer dht.labelCountsMutex.Unlock()
+	counts := dht.labelCounts[label]
+	if counts == nil {
+		counts = &OperationCounts{}
+		dht.labelCounts[label] = counts
+	}
+	count(counts)
+}
+
+// The causes of outbound RPCs recorded by RPCSchedule
+const (
+	// RPCs sent for lookups and other requests made by the application,
+	// other than stores
+	RPCOriginLookup = "lookup"
+
+	// RPCs sent for stores made by the application, including the lookup
+	// for the nodes to store to
+	RPCOriginStore = "store"
+
+	// RPCs sent by background work such as bootstrapping, bucket refreshes,
+	// announcements, replication and liveness pings
+	RPCOriginMaintenance = "maintenance"
+)
+
+// rpcOriginKey is the context key of the origin added by withRPCOrigin
+type rpcOriginKey struct{}
+
+// maintenanceContext is the context of RPCs sent by background work
+var maintenanceContext = withRPCOrigin(context.Background(), RPCOriginMaintenance)
+
+// withRPCOrigin returns a copy of ctx recording that the RPCs sent with it
+// are caused by origin
+func withRPCOrigin(ctx context.Context, origin string) context.Context {
+	return context.WithValue(ctx, rpcOriginKey{}, origin)
+}
+
+// rpcOrigin returns the origin carried by ctx, or def if it carries none
+func rpcOrigin(ctx context.Context, def string) string {
+	if origin, ok := ctx.Value(rpcOriginKey{}).(string); ok {
+		return origin
+	}
+	return def
+}
+
+// RPCSchedule is the number of outbound RPCs sent within a rolling window,
+// by their origin and type, for planning network capacity
+type RPCSchedule struct {
+	Window time.Duration
+
+	// The number of RPCs sent by origin, and then by RPC type, for example
+	// Counts[RPCOriginMaintenance]["PING"]
+	Counts map[string]map[string]uint64
+}
+
+// Total returns the number of RPCs sent for origin within the window
+func (s RPCSchedule) Total(origin string) uint64 {
+	var total uint64
+	for _, c := range s.Counts[origin] {
+		total += c
+	}
+	return total
+}
+
+// Rate returns the average number of RPCs sent for origin per second over
+// the window
+func (s RPCSchedule) Rate(origin string) float64 {
+	return float64(s.Total(origin)) / s.Window.Seconds()
+}
+
+// RPCSchedule returns the outbound RPCs sent within the last TRPCWindow
+func (dht *DHT) RPCSchedule() RPCSchedule {
+	return dht.rpcSchedule.snapshot(dht.now())
+}
+
+// rpcEvent is an RPC recorded by an rpcWindow
+type rpcEvent struct {
+	at      time.Time
+	origin  string
+	rpcType int
+}
+
+// rpcWindow records the RPCs sent within a rolling window
+type rpcWindow struct {
+	mutex  *sync.Mutex
+	window time.Duration
+	events []rpcEvent
+}
+
+func newRPCWindow(window time.Duration) *rpcWindow {
+	return &rpcWindow{
+		mutex:  &sync.Mutex{},
+		window: window,
+	}
+}
+
+func (w *rpcWindow) record(now time.Time, origin string, rpcType int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.expire(now)
+	w.events = append(w.events, rpcEvent{at: now, origin: origin, rpcType: rpcType})
+}
+
+// expire removes the events older than the window. Must be called with the
+// mutex held.
+func (w *rpcWindow) expire(now time.Time) {
+	i := 0
+	for i < len(w.events) && now.Sub(w.events[i].at) >= w.window {
+		i++
+	}
+	w.events = append(w.events[:0], w.events[i:]...)
+}
+
+func (w *rpcWindow) snapshot(now time.Time) RPCSchedule {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.expire(now)
+	schedule := RPCSchedule{
+		Window: w.window,
+		Counts: make(map[string]map[string]uint64),
+	}
+	for _, e := range w.events {
+		counts := schedule.Counts[e.origin]
+		if counts == nil {
+			counts = make(map[string]uint64)
+			schedule.Counts[e.origin] = counts
+		}
+		counts[rpcName(e.rpcType)]++
+	}
+	return schedule
+}
+
+// rpcName returns the name of an RPC type
+func rpcName(rpcType int) string {
+	if rpcType == messageTypeStore {
+		return "STORE"
+	}
+	return rpcNames[rpcType]
+}
@@ -0,0 +1,251 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	b58 "github.com/jbenet/go-base58"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram([]time.Duration{time.Millisecond, time.Second})
+	h.observe(time.Millisecond)
+	h.observe(time.Millisecond * 2)
+	h.observe(time.Minute)
+	h.observe(time.Minute)
+
+	s := h.snapshot()
+	assert.Equal(t, []time.Duration{time.Millisecond, time.Second}, s.Bounds)
+	assert.Equal(t, []uint64{1, 1, 2}, s.Counts)
+	assert.Equal(t, uint64(4), s.Total())
+}
+
+// Performs three lookups, each with a different simulated response latency,
+// and checks each lands in a different bucket of the lookup latency histogram
+func TestLookupLatency(t *testing.T) {
+	networking := newMockNetworking()
+	id := getIDWithValues(0)
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   id,
+		Port: "3000",
+		IP:   "0.0.0.0",
+		LookupLatencyBuckets: []time.Duration{
+			time.Millisecond * 50,
+			time.Millisecond * 150,
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	dht.addNode(newNode(&NetworkNode{
+		ID:   getZerodIDWithNthByte(1, byte(255)),
+		Port: 3001,
+		IP:   net.ParseIP("0.0.0.0"),
+	}))
+
+	delay := make(chan time.Duration, 1)
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			time.Sleep(<-delay)
+			networking.send <- mockFindValueResponseEmpty(query)
+		}
+	}()
+
+	key := b58.Encode(dht.store.GetKey([]byte("foo")))
+	for _, d := range []time.Duration{0, time.Millisecond * 100, time.Millisecond * 200} {
+		delay <- d
+		_, _, err := dht.Get(key)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []uint64{1, 1, 1}, dht.LookupLatency().Counts)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Sends one query of each RPC type, each answered with a different simulated
+// latency, and checks each lands in a different bucket of its RPC type's
+// latency histogram
+func TestRPCLatency(t *testing.T) {
+	networking := newMockNetworking()
+	done := make(chan (int))
+
+	dht, _ := NewDHT(getInMemoryStore(), &Options{
+		ID:   getIDWithValues(0),
+		Port: "3000",
+		IP:   "0.0.0.0",
+		LookupLatencyBuckets: []time.Duration{
+			time.Millisecond * 50,
+			time.Millisecond * 150,
+		},
+	})
+
+	dht.networking = networking
+	dht.CreateSocket()
+
+	go func() {
+		dht.Listen()
+	}()
+
+	peer := &NetworkNode{
+		ID:   getZerodIDWithNthByte(1, byte(255)),
+		Port: 3001,
+		IP:   net.ParseIP("0.0.0.0"),
+	}
+	dht.addNode(newNode(peer))
+
+	go func() {
+		for {
+			query := <-networking.recv
+			if query == nil {
+				close(done)
+				return
+			}
+			switch query.Type {
+			case messageTypePing:
+				networking.send <- mockFindNodeResponseEmpty(query)
+			case messageTypeFindNode:
+				time.Sleep(time.Millisecond * 100)
+				networking.send <- mockFindNodeResponseEmpty(query)
+			case messageTypeFindValue:
+				time.Sleep(time.Millisecond * 200)
+				networking.send <- mockFindValueResponseEmpty(query)
+			}
+		}
+	}()
+
+	assert.True(t, dht.ping(context.Background(), peer))
+	_, _, err := dht.iterate(iterateFindNode, getIDWithValues(0), nil)
+	assert.NoError(t, err)
+	_, _, err = dht.Get(b58.Encode(dht.store.GetKey([]byte("foo"))))
+	assert.NoError(t, err)
+
+	latency := dht.RPCLatency()
+	assert.Equal(t, 3, len(latency))
+	assert.Equal(t, []uint64{1, 0, 0}, latency["PING"].Counts)
+	assert.Equal(t, []uint64{0, 1, 0}, latency["FIND_NODE"].Counts)
+	assert.Equal(t, []uint64{0, 0, 1}, latency["FIND_VALUE"].Counts)
+
+	dht.Disconnect()
+
+	<-done
+}
+
+// Issues stores and gets with two metrics labels and without a label, and
+// checks that only the labeled operations are counted, against their label
+func TestLabelMetrics(t *testing.T) {
+	dhts, err := BuildNetwork(3)
+	assert.NoError(t, err)
+	dht := dhts[0]
+
+	maps := WithMetricsLabel(context.Background(), "maps")
+	chat := WithMetricsLabel(context.Background(), "chat")
+
+	key, err := dht.StoreContext(maps, []byte("tiles"))
+	assert.NoError(t, err)
+	_, err = dht.StoreContext(maps, []byte("roads"))
+	assert.NoError(t, err)
+	_, err = dht.StoreContext(chat, []byte("hello"))
+	assert.NoError(t, err)
+	_, err = dht.Store([]byte("unlabeled"))
+	assert.NoError(t, err)
+
+	data, found, err := dht.GetContext(chat, key)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("tiles"), data)
+	_, _, err = dht.Get(key)
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]OperationCounts{
+		"maps": {Stores: 2},
+		"chat": {Stores: 1, Gets: 1},
+	}, dht.LabelMetrics())
+	assert.Equal(t, 0, len(dhts[1].LabelMetrics()))
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// Tests that RPCs older than the window are dropped from the RPCSchedule
+func TestRPCWindow(t *testing.T) {
+	w := newRPCWindow(time.Minute)
+	start := time.Now()
+	w.record(start, RPCOriginLookup, messageTypeFindNode)
+	w.record(start.Add(time.Second*30), RPCOriginStore, messageTypeStore)
+	w.record(start.Add(time.Second*30), RPCOriginStore, messageTypeFindNode)
+
+	s := w.snapshot(start.Add(time.Second * 45))
+	assert.Equal(t, time.Minute, s.Window)
+	assert.Equal(t, map[string]map[string]uint64{
+		RPCOriginLookup: {"FIND_NODE": 1},
+		RPCOriginStore:  {"STORE": 1, "FIND_NODE": 1},
+	}, s.Counts)
+	assert.Equal(t, 2.0/60, s.Rate(RPCOriginStore))
+
+	s = w.snapshot(start.Add(time.Second * 75))
+	assert.Equal(t, map[string]map[string]uint64{
+		RPCOriginStore: {"STORE": 1, "FIND_NODE": 1},
+	}, s.Counts)
+
+	s = w.snapshot(start.Add(time.Second * 90))
+	assert.Equal(t, 0, len(s.Counts))
+}
+
+// Tests that the RPCs sent by lookups, stores and maintenance are each
+// recorded against their origin
+func TestRPCSchedule(t *testing.T) {
+	dhts, err := BuildNetwork(5)
+	assert.NoError(t, err)
+	dht := dhts[1]
+
+	// Bootstrapping is maintenance
+	before := dht.RPCSchedule()
+	assert.Equal(t, uint64(0), before.Total(RPCOriginLookup))
+	assert.Equal(t, uint64(0), before.Total(RPCOriginStore))
+	assert.True(t, before.Total(RPCOriginMaintenance) > 0)
+
+	_, err = dht.Store([]byte("foo"))
+	assert.NoError(t, err)
+	_, found, err := dht.Get(b58.Encode(dht.store.GetKey([]byte("bar"))))
+	assert.NoError(t, err)
+	assert.False(t, found)
+	_, err = dht.CheckAndRepairTable(context.Background())
+	assert.NoError(t, err)
+
+	after := dht.RPCSchedule()
+	assert.Equal(t, []string{"FIND_VALUE"}, sortedKeys(after.Counts[RPCOriginLookup]))
+	assert.Equal(t, []string{"FIND_NODE", "STORE"}, sortedKeys(after.Counts[RPCOriginStore]))
+	assert.Equal(t, uint64(4), after.Counts[RPCOriginStore]["STORE"])
+	assert.Equal(t, uint64(4), after.Counts[RPCOriginMaintenance]["PING"]-before.Counts[RPCOriginMaintenance]["PING"])
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// sortedKeys returns the sorted keys of counts
+func sortedKeys(counts map[string]uint64) []string {
+	var result []string
+	for k := range counts {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
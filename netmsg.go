@@ -2,11 +2,25 @@ package kademlia
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// The maximum length of a serialized message which will be read
+const maxMessageLength = 1 << 26
+
+// The maximum length of a value which can be returned in a FIND_VALUE
+// response, leaving room within maxMessageLength for the rest of the message
+const maxResponseValueLength = maxMessageLength - 1<<16
+
+// errMalformedMessage is wrapped by errors returned when data could not be
+// decoded into a valid message
+var errMalformedMessage = errors.New("Malformed message")
+
 const (
 	messageTypePing = iota
 	messageTypeStore
@@ -29,12 +43,14 @@ type queryDataFindNode struct {
 }
 
 type queryDataFindValue struct {
-	Target []byte
+	Target    []byte
+	Encodings []int // The value encodings the requester can decode besides valueEncodingRaw
 }
 
 type queryDataStore struct {
 	Data       []byte
 	Publishing bool // Whether or not we are the original publisher
+	Replicas   int  // The replication factor of the data, or 0 for the default
 }
 
 type responseDataFindNode struct {
@@ -42,14 +58,96 @@ type responseDataFindNode struct {
 }
 
 type responseDataFindValue struct {
-	Closest []*NetworkNode
-	Value   []byte
+	Closest  []*NetworkNode
+	Value    []byte
+	Encoding int  // How Value is encoded
+	TooLarge bool // Set instead of Value when the value is too large to send
 }
 
 type responseDataStore struct {
 	Success bool
 }
 
+type responseDataPing struct {
+	Agent string
+}
+
+const (
+	// valueEncodingRaw means a value is sent as stored
+	valueEncodingRaw = iota
+
+	// valueEncodingGzip means a value is gzip compressed
+	valueEncodingGzip
+)
+
+// supportedEncodings are the value encodings the local node can decode
+// besides valueEncodingRaw
+var supportedEncodings = []int{valueEncodingGzip}
+
+// errUnknownEncoding is returned when a value has an encoding which can not
+// be decoded
+var errUnknownEncoding = errors.New("Unknown value encoding")
+
+// encodeValue returns value in the most compact encoding which the
+// requester can decode, and the encoding used
+func encodeValue(value []byte, accepted []int) ([]byte, int) {
+	for _, encoding := range accepted {
+		if encoding != valueEncodingGzip {
+			continue
+		}
+		var buffer bytes.Buffer
+		w := gzip.NewWriter(&buffer)
+		_, err := w.Write(value)
+		if err == nil {
+			err = w.Close()
+		}
+		if err == nil && buffer.Len() < len(value) {
+			return buffer.Bytes(), valueEncodingGzip
+		}
+	}
+	return value, valueEncodingRaw
+}
+
+// encodeResponseValue returns value encoded for a FIND_VALUE response, and
+// the encoding used. The value is compressed if compress is set, or if it is
+// otherwise too large to send. nil is returned if the value is too large to
+// send even when compressed.
+func encodeResponseValue(value []byte, accepted []int, compress bool) ([]byte, int) {
+	encoded, encoding := value, valueEncodingRaw
+	if compress || len(value) > maxResponseValueLength {
+		encoded, encoding = encodeValue(value, accepted)
+	}
+	if len(encoded) > maxResponseValueLength {
+		return nil, valueEncodingRaw
+	}
+	return encoded, encoding
+}
+
+// decodeValue returns the value held in data, decoding it according to its
+// encoding
+func decodeValue(data *responseDataFindValue) ([]byte, error) {
+	switch data.Encoding {
+	case valueEncodingRaw:
+		return data.Value, nil
+	case valueEncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data.Value))
+		if err != nil {
+			return nil, err
+		}
+		// Limit the decompressed size so a small response can not exhaust
+		// memory
+		value, err := io.ReadAll(io.LimitReader(r, maxMessageLength+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(value) > maxMessageLength {
+			return nil, errors.New("Decompressed value exceeds maximum length")
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("%w: %d", errUnknownEncoding, data.Encoding)
+}
+
 func netMsgInit() {
 	gob.Register(&queryDataFindNode{})
 	gob.Register(&queryDataFindValue{})
@@ -57,29 +155,65 @@ func netMsgInit() {
 	gob.Register(&responseDataFindNode{})
 	gob.Register(&responseDataFindValue{})
 	gob.Register(&responseDataStore{})
+	gob.Register(&responseDataPing{})
 }
 
 func serializeMessage(q *message) ([]byte, error) {
+	data, err := encodeMessage(q)
+	if err != nil {
+		return nil, err
+	}
+	return frame(data), nil
+}
+
+func deserializeMessage(conn io.Reader) (*message, error) {
+	data, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessage(data)
+}
+
+// encodeMessage returns the gob encoding of q
+func encodeMessage(q *message) ([]byte, error) {
 	var msgBuffer bytes.Buffer
 	enc := gob.NewEncoder(&msgBuffer)
 	err := enc.Encode(q)
 	if err != nil {
 		return nil, err
 	}
+	return msgBuffer.Bytes(), nil
+}
+
+// decodeMessage decodes a message encoded by encodeMessage
+func decodeMessage(data []byte) (*message, error) {
+	reader := bytes.NewBuffer(data)
+	msg := &message{}
+	dec := gob.NewDecoder(reader)
+
+	err := dec.Decode(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
 
-	length := msgBuffer.Len()
+	return msg, nil
+}
 
+// frame prefixes data with its length, so that it can be read from a stream
+// by readFrame
+func frame(data []byte) []byte {
 	var lengthBytes [8]byte
-	binary.PutUvarint(lengthBytes[:], uint64(length))
+	binary.PutUvarint(lengthBytes[:], uint64(len(data)))
 
 	var result []byte
 	result = append(result, lengthBytes[:]...)
-	result = append(result, msgBuffer.Bytes()...)
+	result = append(result, data...)
 
-	return result, nil
+	return result
 }
 
-func deserializeMessage(conn io.Reader) (*message, error) {
+// readFrame reads data written by frame from conn
+func readFrame(conn io.Reader) ([]byte, error) {
 	lengthBytes := make([]byte, 8)
 	_, err := conn.Read(lengthBytes)
 	if err != nil {
@@ -89,7 +223,11 @@ func deserializeMessage(conn io.Reader) (*message, error) {
 	lengthReader := bytes.NewBuffer(lengthBytes)
 	length, err := binary.ReadUvarint(lengthReader)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+
+	if length > maxMessageLength {
+		return nil, fmt.Errorf("%w: length %d exceeds maximum", errMalformedMessage, length)
 	}
 
 	msgBytes := make([]byte, length)
@@ -98,14 +236,44 @@ func deserializeMessage(conn io.Reader) (*message, error) {
 		return nil, err
 	}
 
-	reader := bytes.NewBuffer(msgBytes)
-	msg := &message{}
-	dec := gob.NewDecoder(reader)
+	return msgBytes, nil
+}
 
-	err = dec.Decode(msg)
-	if err != nil {
-		return nil, err
+// validateMessage returns an error wrapping errMalformedMessage if msg is
+// missing a sender, or its data does not match its type
+func validateMessage(msg *message) error {
+	if msg.Sender == nil {
+		return fmt.Errorf("%w: missing sender", errMalformedMessage)
 	}
 
-	return msg, nil
+	valid := false
+	if msg.IsResponse {
+		switch msg.Type {
+		case messageTypeFindNode:
+			_, valid = msg.Data.(*responseDataFindNode)
+		case messageTypeFindValue:
+			_, valid = msg.Data.(*responseDataFindValue)
+		case messageTypeStore:
+			_, valid = msg.Data.(*responseDataStore)
+		case messageTypePing:
+			valid = true
+		}
+	} else {
+		switch msg.Type {
+		case messageTypeFindNode:
+			_, valid = msg.Data.(*queryDataFindNode)
+		case messageTypeFindValue:
+			_, valid = msg.Data.(*queryDataFindValue)
+		case messageTypeStore:
+			_, valid = msg.Data.(*queryDataStore)
+		case messageTypePing:
+			valid = true
+		}
+	}
+
+	if !valid {
+		return fmt.Errorf("%w: unexpected data for message type %d", errMalformedMessage, msg.Type)
+	}
+
+	return nil
 }
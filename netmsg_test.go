@@ -2,6 +2,8 @@ package kademlia
 
 import (
 	"bytes"
+	"encoding/gob"
+	"errors"
 	"net"
 	"testing"
 
@@ -39,3 +41,170 @@ func TestSerializeNetMsg(t *testing.T) {
 
 	assert.Equal(t, msg, deserialized)
 }
+
+func TestSerializePingResponse(t *testing.T) {
+	netMsgInit()
+	var conn bytes.Buffer
+
+	msg := &message{}
+	msg.Type = messageTypePing
+	msg.IsResponse = true
+	msg.Data = &responseDataPing{
+		Agent: "kademlia/1.0",
+	}
+
+	serialized, err := serializeMessage(msg)
+	if err != nil {
+		panic(err)
+	}
+
+	conn.Write(serialized)
+
+	deserialized, err := deserializeMessage(&conn)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, "kademlia/1.0", deserialized.Data.(*responseDataPing).Agent)
+}
+
+// Tests that the nodes in a FIND_NODE response survive serialization, and are
+// encoded more compactly than their fields would be
+func TestSerializeFindNodeResponse(t *testing.T) {
+	netMsgInit()
+	var conn bytes.Buffer
+
+	type plainNode struct {
+		ID   []byte
+		IP   net.IP
+		Port int
+	}
+
+	var closest []*NetworkNode
+	var plain []*plainNode
+	for i := 0; i < k; i++ {
+		id, _ := newID()
+		closest = append(closest, &NetworkNode{ID: id, IP: net.ParseIP("192.168.0.1"), Port: 3000 + i})
+		plain = append(plain, &plainNode{ID: id, IP: net.ParseIP("192.168.0.1"), Port: 3000 + i})
+	}
+
+	msg := &message{}
+	msg.Type = messageTypeFindNode
+	msg.IsResponse = true
+	msg.Data = &responseDataFindNode{
+		Closest: closest,
+	}
+
+	serialized, err := serializeMessage(msg)
+	if err != nil {
+		panic(err)
+	}
+
+	conn.Write(serialized)
+
+	deserialized, err := deserializeMessage(&conn)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.Equal(t, closest, deserialized.Data.(*responseDataFindNode).Closest)
+
+	var compact, uncompact bytes.Buffer
+	gob.NewEncoder(&compact).Encode(closest)
+	gob.NewEncoder(&uncompact).Encode(plain)
+	assert.True(t, compact.Len() < uncompact.Len())
+}
+
+// Tests that validation rejects messages whose data does not match their type
+func TestValidateMessage(t *testing.T) {
+	sender := &NetworkNode{ID: getIDWithValues(1)}
+
+	assert.NoError(t, validateMessage(&message{Sender: sender, Type: messageTypePing}))
+	assert.NoError(t, validateMessage(&message{Sender: sender, Type: messageTypeFindNode, Data: &queryDataFindNode{}}))
+	assert.NoError(t, validateMessage(&message{Sender: sender, Type: messageTypeFindValue, IsResponse: true, Data: &responseDataFindValue{}}))
+
+	err := validateMessage(&message{Type: messageTypePing})
+	assert.True(t, errors.Is(err, errMalformedMessage))
+
+	err = validateMessage(&message{Sender: sender, Type: messageTypeFindNode, Data: &queryDataStore{}})
+	assert.True(t, errors.Is(err, errMalformedMessage))
+
+	err = validateMessage(&message{Sender: sender, Type: messageTypeFindNode, IsResponse: true, Data: &responseDataFindValue{}})
+	assert.True(t, errors.Is(err, errMalformedMessage))
+
+	err = validateMessage(&message{Sender: sender, Type: 100})
+	assert.True(t, errors.Is(err, errMalformedMessage))
+}
+
+// Tests that values are only compressed when the requester accepts it and it
+// makes them smaller, that compressed values decode to the original, and that
+// unknown encodings are rejected
+func TestValueEncoding(t *testing.T) {
+	value := bytes.Repeat([]byte("foo"), 1000)
+
+	encoded, encoding := encodeValue(value, nil)
+	assert.Equal(t, valueEncodingRaw, encoding)
+	assert.Equal(t, value, encoded)
+
+	encoded, encoding = encodeValue(value, supportedEncodings)
+	assert.Equal(t, valueEncodingGzip, encoding)
+	assert.True(t, len(encoded) < len(value))
+
+	decoded, err := decodeValue(&responseDataFindValue{Value: encoded, Encoding: encoding})
+	assert.NoError(t, err)
+	assert.Equal(t, value, decoded)
+
+	// Compressing a tiny value makes it larger
+	encoded, encoding = encodeValue([]byte("a"), supportedEncodings)
+	assert.Equal(t, valueEncodingRaw, encoding)
+	assert.Equal(t, []byte("a"), encoded)
+
+	_, err = decodeValue(&responseDataFindValue{Value: value, Encoding: valueEncodingGzip})
+	assert.Error(t, err)
+
+	_, err = decodeValue(&responseDataFindValue{Value: value, Encoding: 100})
+	assert.True(t, errors.Is(err, errUnknownEncoding))
+}
+
+// Tests that values are only compressed for a response when requested or
+// required, and that values which can not fit in a response are rejected
+func TestEncodeResponseValue(t *testing.T) {
+	value := bytes.Repeat([]byte("foo"), 1000)
+
+	encoded, encoding := encodeResponseValue(value, supportedEncodings, false)
+	assert.Equal(t, valueEncodingRaw, encoding)
+	assert.Equal(t, value, encoded)
+
+	encoded, encoding = encodeResponseValue(value, supportedEncodings, true)
+	assert.Equal(t, valueEncodingGzip, encoding)
+	assert.True(t, len(encoded) < len(value))
+
+	// Without compression the value can not be sent
+	encoded, _ = encodeResponseValue(make([]byte, maxResponseValueLength+1), nil, false)
+	assert.Nil(t, encoded)
+}
+
+// Feeds random bytes to the inbound message handling. Malformed input should
+// be rejected with an error rather than causing a panic.
+func FuzzDeserializeMessage(f *testing.F) {
+	netMsgInit()
+
+	msg := &message{
+		Sender:   &NetworkNode{ID: getIDWithValues(1), IP: net.ParseIP("127.0.0.1"), Port: 3000},
+		Receiver: &NetworkNode{ID: getIDWithValues(2), IP: net.ParseIP("127.0.0.1"), Port: 3001},
+		Type:     messageTypeFindNode,
+		Data:     &queryDataFindNode{Target: getIDWithValues(3)},
+	}
+	serialized, _ := serializeMessage(msg)
+	f.Add(serialized)
+	f.Add([]byte{255, 255, 255, 255, 255, 255, 255, 255})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := deserializeMessage(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		validateMessage(msg)
+	})
+}
@@ -1,11 +1,16 @@
 package kademlia
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"io"
+	"log"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/anacrolix/utp"
@@ -16,19 +21,26 @@ var (
 	errorValueNotFound = errors.New("Value not found")
 )
 
+// The time to wait before the first retry of a message which could not be
+// written due to a full send buffer. Doubled on each subsequent retry.
+const sendRetryBackoff = time.Millisecond * 10
+
 type networking interface {
 	sendMessage(*message, bool, int64) (*expectedResponse, error)
 	getMessage() chan (*message)
 	messagesFin()
 	timersFin()
 	getDisconnect() chan (int)
-	init(self *NetworkNode)
+	init(self *NetworkNode, options *Options)
 	createSocket(host string, port string, useStun bool, stunAddr string) (publicHost string, publicPort string, err error)
 	listen() error
 	disconnect() error
 	cancelResponse(*expectedResponse)
 	isInitialized() bool
 	getNetworkAddr() string
+	getSendBackpressureEvents() int64
+	getMalformedPackets() int64
+	setBanHandler(fn func(ip string))
 }
 
 type realNetworking struct {
@@ -49,6 +61,68 @@ type realNetworking struct {
 	self          *NetworkNode
 	msgCounter    int64
 	remoteAddress string
+	sendRetries   int
+
+	// The maximum time disconnect waits for the timers and message handler
+	// goroutines to finish. 0 waits indefinitely.
+	disconnectTimeout time.Duration
+
+	// Reuses connections to send messages if TConnIdle is set
+	connIdle time.Duration
+	pool     *connPool
+
+	onTransportError func(err error)
+	logger           *log.Logger
+
+	// The number of writes which failed temporarily due to a full send
+	// buffer. Accessed atomically.
+	backpressureEvents int64
+
+	// The number of inbound packets dropped because they were malformed.
+	// Accessed atomically.
+	malformedPackets int64
+
+	malformedPacketLimit int
+	tMalformedBan        time.Duration
+	tMalformedWindow     time.Duration
+	malformedSources     map[string]*malformedSource
+
+	// When sources whose malformed packets have all left the window were
+	// last removed from malformedSources
+	malformedSwept time.Time
+
+	// Returns the current time. Replaced in tests.
+	now func() time.Time
+
+	// Called with the IP of a source when it is banned
+	onBan func(ip string)
+
+	// The number of inbound connections currently open. Accessed
+	// atomically.
+	inboundConns          int64
+	maxInboundConnections int
+
+	// Signs and verifies messages if a NetworkKey was provided
+	auth *authenticator
+
+	sourceIPPolicy int
+}
+
+// malformedSource records the malformed packets received from an IP
+type malformedSource struct {
+	// When each malformed packet within the window was received, oldest
+	// first
+	received    []time.Time
+	bannedUntil time.Time
+}
+
+// prune forgets the malformed packets received before since
+func (ms *malformedSource) prune(since time.Time) {
+	i := 0
+	for i < len(ms.received) && ms.received[i].Before(since) {
+		i++
+	}
+	ms.received = ms.received[i:]
 }
 
 type expectedResponse struct {
@@ -56,17 +130,33 @@ type expectedResponse struct {
 	query *message
 	node  *NetworkNode
 	id    int64
+	sent  time.Time
 }
 
-func (rn *realNetworking) init(self *NetworkNode) {
+func (rn *realNetworking) init(self *NetworkNode, options *Options) {
 	rn.self = self
+	rn.sendRetries = options.SendRetries
+	rn.onTransportError = options.OnTransportError
+	rn.logger = &options.Logger
+	rn.malformedPacketLimit = options.MalformedPacketLimit
+	rn.tMalformedBan = options.TMalformedBan
+	rn.tMalformedWindow = options.TMalformedWindow
+	rn.now = time.Now
+	rn.maxInboundConnections = options.MaxInboundConnections
+	rn.disconnectTimeout = options.TDisconnectTimeout
+	rn.connIdle = options.TConnIdle
+	rn.sourceIPPolicy = options.SourceIPPolicy
+	if len(options.NetworkKey) > 0 {
+		rn.auth = newAuthenticator(options.NetworkKey, options.TReplayWindow)
+	}
+	rn.malformedSources = make(map[string]*malformedSource)
 	rn.mutex = &sync.Mutex{}
 	rn.sendChan = make(chan (*message))
 	rn.recvChan = make(chan (*message))
 	rn.dcStartChan = make(chan (int), 10)
 	rn.dcEndChan = make(chan (int))
-	rn.dcTimersChan = make(chan (int))
-	rn.dcMessageChan = make(chan (int))
+	rn.dcTimersChan = make(chan (int), 1)
+	rn.dcMessageChan = make(chan (int), 1)
 	rn.responseMap = make(map[int64]*expectedResponse)
 	rn.aliveConns = &sync.WaitGroup{}
 	rn.connected = false
@@ -85,6 +175,118 @@ func (rn *realNetworking) getNetworkAddr() string {
 	return rn.remoteAddress
 }
 
+func (rn *realNetworking) getSendBackpressureEvents() int64 {
+	return atomic.LoadInt64(&rn.backpressureEvents)
+}
+
+func (rn *realNetworking) getMalformedPackets() int64 {
+	return atomic.LoadInt64(&rn.malformedPackets)
+}
+
+func (rn *realNetworking) setBanHandler(fn func(ip string)) {
+	rn.onBan = fn
+}
+
+// recordMalformedPacket counts a malformed packet received from addr. It
+// returns true if the IP of addr has now sent MalformedPacketLimit malformed
+// packets within TMalformedWindow, and connections from it should be refused.
+func (rn *realNetworking) recordMalformedPacket(addr net.Addr, err error) bool {
+	atomic.AddInt64(&rn.malformedPackets, 1)
+	logf(rn.logger, "Dropped malformed packet from %s: %v", addr, err)
+
+	if rn.malformedPacketLimit == 0 {
+		return false
+	}
+
+	ip := addrIP(addr)
+	now := rn.now()
+
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+
+	rn.sweepMalformedSources(now)
+
+	source := rn.malformedSources[ip]
+	if source == nil {
+		source = &malformedSource{}
+		rn.malformedSources[ip] = source
+	}
+	source.prune(now.Add(-rn.tMalformedWindow))
+	source.received = append(source.received, now)
+	if len(source.received) < rn.malformedPacketLimit {
+		return false
+	}
+	source.received = nil
+	source.bannedUntil = now.Add(rn.tMalformedBan)
+	if rn.onBan != nil {
+		go rn.onBan(ip)
+	}
+	return true
+}
+
+// isBanned returns true if connections from the IP of addr are being refused
+// because it sent too many malformed packets
+func (rn *realNetworking) isBanned(addr net.Addr) bool {
+	ip := addrIP(addr)
+
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+
+	source := rn.malformedSources[ip]
+	if source == nil {
+		return false
+	}
+	now := rn.now()
+	if now.After(source.bannedUntil) {
+		source.prune(now.Add(-rn.tMalformedWindow))
+		if len(source.received) == 0 {
+			delete(rn.malformedSources, ip)
+		}
+		return false
+	}
+	return true
+}
+
+// sweepMalformedSources removes the sources which are not banned and whose
+// malformed packets have all left the window, so that sources which are not
+// heard from again are not remembered forever. The sources are swept at most
+// once per window. Must be called with the mutex held.
+func (rn *realNetworking) sweepMalformedSources(now time.Time) {
+	if now.Sub(rn.malformedSwept) < rn.tMalformedWindow {
+		return
+	}
+	rn.malformedSwept = now
+	since := now.Add(-rn.tMalformedWindow)
+	for ip, source := range rn.malformedSources {
+		source.prune(since)
+		if len(source.received) == 0 && now.After(source.bannedUntil) {
+			delete(rn.malformedSources, ip)
+		}
+	}
+}
+
+// acceptInbound counts a new inbound connection from addr. It returns false,
+// without counting the connection, if MaxInboundConnections are already open
+// and the connection should be refused.
+func (rn *realNetworking) acceptInbound(addr net.Addr) bool {
+	open := atomic.AddInt64(&rn.inboundConns, 1)
+	if rn.maxInboundConnections > 0 && open > int64(rn.maxInboundConnections) {
+		atomic.AddInt64(&rn.inboundConns, -1)
+		logf(rn.logger, "Refused connection from %s: %d inbound connections already open", addr, rn.maxInboundConnections)
+		return false
+	}
+	return true
+}
+
+// addrIP returns the IP of addr, or its string form if it has no port
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 func (rn *realNetworking) messagesFin() {
 	rn.dcMessageChan <- 1
 }
@@ -131,6 +333,13 @@ func (rn *realNetworking) createSocket(host string, port string, useStun bool, s
 		host = h.IP()
 		port = strconv.Itoa(int(h.Port()))
 		remoteAddress = "[" + host + "]" + ":" + port
+	} else if port == "0" {
+		// The OS chose an ephemeral port for us
+		_, port, err = net.SplitHostPort(socket.Addr().String())
+		if err != nil {
+			return "", "", err
+		}
+		remoteAddress = "[" + host + "]" + ":" + port
 	}
 
 	rn.remoteAddress = remoteAddress
@@ -139,6 +348,12 @@ func (rn *realNetworking) createSocket(host string, port string, useStun bool, s
 
 	rn.socket = socket
 
+	if rn.connIdle > 0 {
+		rn.pool = newConnPool(rn.connIdle, func(addr string) (net.Conn, error) {
+			return socket.DialTimeout(addr, time.Second)
+		})
+	}
+
 	return host, port, nil
 }
 
@@ -151,18 +366,25 @@ func (rn *realNetworking) sendMessage(msg *message, expectResponse bool, id int6
 	msg.ID = id
 	rn.mutex.Unlock()
 
-	conn, err := rn.socket.DialTimeout("["+msg.Receiver.IP.String()+"]:"+strconv.Itoa(msg.Receiver.Port), time.Second)
-	if err != nil {
-		return nil, err
+	var data []byte
+	var err error
+	if rn.auth != nil {
+		data, err = rn.auth.seal(msg)
+	} else {
+		data, err = serializeMessage(msg)
 	}
-
-	data, err := serializeMessage(msg)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = conn.Write(data)
+	addr := "[" + msg.Receiver.IP.String() + "]:" + strconv.Itoa(msg.Receiver.Port)
+	if rn.pool != nil {
+		err = rn.sendPooled(addr, data)
+	} else {
+		err = rn.send(addr, data)
+	}
 	if err != nil {
+		rn.reportTransportError(err)
 		return nil, err
 	}
 
@@ -170,10 +392,11 @@ func (rn *realNetworking) sendMessage(msg *message, expectResponse bool, id int6
 		rn.mutex.Lock()
 		defer rn.mutex.Unlock()
 		expectedResponse := &expectedResponse{
-			ch:    make(chan (*message)),
+			ch:    make(chan (*message), 1),
 			node:  msg.Receiver,
 			query: msg,
 			id:    id,
+			sent:  time.Now(),
 		}
 		// TODO we need a way to automatically clean these up as there are
 		// cases where they won't be removed manually
@@ -184,29 +407,138 @@ func (rn *realNetworking) sendMessage(msg *message, expectResponse bool, id int6
 	return nil, nil
 }
 
+// send dials addr and writes data to a new connection. Responses arrive on a
+// connection dialled by the receiver, so the connection is only used to send
+// the message.
+func (rn *realNetworking) send(addr string, data []byte) error {
+	conn, err := rn.socket.DialTimeout(addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return rn.write(conn, data)
+}
+
+// sendPooled writes data to the pooled connection to addr. The remote node
+// may have closed a pooled connection since it was last used, so a failed
+// write is retried once on a new connection.
+func (rn *realNetworking) sendPooled(addr string, data []byte) error {
+	for retried := false; ; retried = true {
+		conn, err := rn.pool.get(addr)
+		if err != nil {
+			return err
+		}
+		conn.mutex.Lock()
+		err = rn.write(conn, data)
+		conn.mutex.Unlock()
+		if err == nil {
+			return nil
+		}
+		rn.pool.remove(addr, conn)
+		if retried {
+			return err
+		}
+	}
+}
+
+// write writes data to conn. If the write fails because the send buffer is
+// full it is retried with an exponential backoff up to sendRetries times.
+func (rn *realNetworking) write(conn io.Writer, data []byte) error {
+	backoff := sendRetryBackoff
+	for retries := 0; ; retries++ {
+		n, err := conn.Write(data)
+		if err == nil {
+			return nil
+		}
+		if !isTemporarySendError(err) || retries >= rn.sendRetries {
+			return err
+		}
+		atomic.AddInt64(&rn.backpressureEvents, 1)
+		data = data[n:]
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// reportTransportError passes a non-fatal socket error to the
+// OnTransportError callback. The callback is run in its own goroutine so that
+// it can not block socket I/O.
+func (rn *realNetworking) reportTransportError(err error) {
+	if rn.onTransportError != nil {
+		go rn.onTransportError(err)
+	}
+}
+
+// isTemporarySendError returns true if err indicates that a write failed
+// only because the send buffer was full at the time
+func isTemporarySendError(err error) bool {
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK) || errors.Is(err, syscall.ENOBUFS) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && !netErr.Timeout() {
+		return netErr.Temporary()
+	}
+	return false
+}
+
 func (rn *realNetworking) cancelResponse(res *expectedResponse) {
 	rn.mutex.Lock()
 	defer rn.mutex.Unlock()
-	close(rn.responseMap[res.query.ID].ch)
-	delete(rn.responseMap, res.query.ID)
+	if rn.responseMap[res.query.ID] != nil {
+		close(rn.responseMap[res.query.ID].ch)
+		delete(rn.responseMap, res.query.ID)
+	}
 }
 
 func (rn *realNetworking) disconnect() error {
 	rn.mutex.Lock()
-	defer rn.mutex.Unlock()
 	if !rn.connected {
+		rn.mutex.Unlock()
 		return errors.New("not connected")
 	}
+	rn.connected = false
+	rn.mutex.Unlock()
+
+	// The mutex is not held while waiting, as the goroutines may need it to
+	// finish what they are doing
 	rn.dcStartChan <- 1
 	rn.dcStartChan <- 1
-	<-rn.dcTimersChan
-	<-rn.dcMessageChan
+
+	ctx := context.Background()
+	if rn.disconnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rn.disconnectTimeout)
+		defer cancel()
+	}
+
+	var pending []string
+	select {
+	case <-rn.dcTimersChan:
+	case <-ctx.Done():
+		pending = append(pending, "timers")
+	}
+	select {
+	case <-rn.dcMessageChan:
+	case <-ctx.Done():
+		pending = append(pending, "message handler")
+	}
+
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if len(pending) > 0 {
+		// The channels are left open for the goroutines to signal on once
+		// they unwind
+		logf(rn.logger, "Disconnected after %v without waiting for %s", rn.disconnectTimeout, strings.Join(pending, " and "))
+	} else {
+		close(rn.dcTimersChan)
+		close(rn.dcMessageChan)
+	}
 	close(rn.sendChan)
-	close(rn.recvChan)
-	close(rn.dcTimersChan)
-	close(rn.dcMessageChan)
+	if rn.pool != nil {
+		rn.pool.close()
+	}
 	err := rn.socket.CloseNow()
-	rn.connected = false
 	rn.initialized = false
 	close(rn.dcEndChan)
 	return err
@@ -222,18 +554,59 @@ func (rn *realNetworking) listen() error {
 			return err
 		}
 
+		if rn.isBanned(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+
+		if !rn.acceptInbound(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+
 		go func(conn net.Conn) {
+			defer atomic.AddInt64(&rn.inboundConns, -1)
+			defer conn.Close()
 			for {
 				// Wait for messages
-				msg, err := deserializeMessage(conn)
+				var msg *message
+				var err error
+				if rn.auth != nil {
+					msg, err = rn.auth.open(conn)
+				} else {
+					msg, err = deserializeMessage(conn)
+				}
+				if isAuthError(err) {
+					logf(rn.logger, "Dropped message from %s: %v", conn.RemoteAddr(), err)
+					continue
+				}
 				if err != nil {
 					if err.Error() == "EOF" {
 						// Node went bye bye
+					} else {
+						if errors.Is(err, errMalformedMessage) {
+							rn.recordMalformedPacket(conn.RemoteAddr(), err)
+						}
+						rn.reportTransportError(err)
 					}
-					// TODO should we penalize this node somehow ? Ban it ?
+					// The rest of the stream can not be decoded
 					return
 				}
 
+				err = validateMessage(msg)
+				if err != nil {
+					if rn.recordMalformedPacket(conn.RemoteAddr(), err) {
+						conn.Close()
+						return
+					}
+					continue
+				}
+
+				if !checkSourceIP(msg, conn.RemoteAddr().String(), rn.sourceIPPolicy) {
+					logf(rn.logger, "Dropped message from %s claiming IP %s", conn.RemoteAddr(), msg.Sender.IP)
+					continue
+				}
+
 				isPing := msg.Type == messageTypePing
 
 				if !areNodesEqual(msg.Receiver, rn.self, isPing) {
@@ -249,62 +622,38 @@ func (rn *realNetworking) listen() error {
 				rn.mutex.Lock()
 				if rn.connected {
 					if msg.IsResponse {
-						if rn.responseMap[msg.ID] == nil {
-							// We were not expecting this response
+						res := rn.responseMap[msg.ID]
+						if res == nil {
+							// We were not expecting this response, or it is a
+							// duplicate of one already received
 							rn.mutex.Unlock()
 							continue
 						}
 
-						if !areNodesEqual(rn.responseMap[msg.ID].node, msg.Sender, isPing) {
+						if !areNodesEqual(res.node, msg.Sender, isPing) {
 							// TODO should we penalize this node somehow ? Ban it ?
 							rn.mutex.Unlock()
 							continue
 						}
 
-						if msg.Type != rn.responseMap[msg.ID].query.Type {
-							close(rn.responseMap[msg.ID].ch)
-							delete(rn.responseMap, msg.ID)
-							rn.mutex.Unlock()
-							continue
-						}
-
-						if !msg.IsResponse {
-							close(rn.responseMap[msg.ID].ch)
-							delete(rn.responseMap, msg.ID)
-							rn.mutex.Unlock()
-							continue
-						}
-
-						resChan := rn.responseMap[msg.ID].ch
-						rn.mutex.Unlock()
-						resChan <- msg
-						rn.mutex.Lock()
-						close(rn.responseMap[msg.ID].ch)
+						// The response is removed from the map before the
+						// mutex is released, so any duplicate is discarded
+						// above rather than sent to a closed channel
 						delete(rn.responseMap, msg.ID)
 						rn.mutex.Unlock()
-					} else {
-						assertion := false
-						switch msg.Type {
-						case messageTypeFindNode:
-							_, assertion = msg.Data.(*queryDataFindNode)
-						case messageTypeFindValue:
-							_, assertion = msg.Data.(*queryDataFindValue)
-						case messageTypeStore:
-							_, assertion = msg.Data.(*queryDataStore)
-						default:
-							assertion = true
-						}
 
-						if !assertion {
-							fmt.Printf("Received bad message %v from %+v", msg.Type, msg.Sender)
-							close(rn.responseMap[msg.ID].ch)
-							delete(rn.responseMap, msg.ID)
-							rn.mutex.Unlock()
-							continue
+						if msg.Type == res.query.Type {
+							res.ch <- msg
 						}
-
-						rn.recvChan <- msg
+						close(res.ch)
+					} else {
+						// The mutex is released first so that a busy message
+						// handler can not block disconnect
 						rn.mutex.Unlock()
+						select {
+						case rn.recvChan <- msg:
+						case <-rn.dcEndChan:
+						}
 					}
 				} else {
 					rn.mutex.Unlock()
@@ -313,3 +662,27 @@ func (rn *realNetworking) listen() error {
 		}(conn)
 	}
 }
+
+// checkSourceIP applies the SourceIPPolicy policy to msg, which was received
+// from addr. Returns false if msg should be dropped.
+func checkSourceIP(msg *message, addr string, policy int) bool {
+	if policy == SourceIPTrust {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.Equal(msg.Sender.IP) {
+		return true
+	}
+	if policy == SourceIPReject {
+		return false
+	}
+	msg.Sender.IP = ip
+	return true
+}
@@ -1,8 +1,16 @@
 package kademlia
 
 import (
+	"bytes"
 	"errors"
 	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 type mockNetworking struct {
@@ -12,8 +20,12 @@ type mockNetworking struct {
 	dcTimersChan  chan (int)
 	dcMessageChan chan (int)
 	msgChan       chan (*message)
+	responses     map[int]chan (*message)
+	mutex         *sync.Mutex
 	failNext      bool
+	failStores    map[string]bool
 	msgCounter    int64
+	banHandler    func(ip string)
 }
 
 func newMockNetworking() *mockNetworking {
@@ -29,6 +41,18 @@ func (net *mockNetworking) getNetworkAddr() string {
 	return ""
 }
 
+func (net *mockNetworking) getSendBackpressureEvents() int64 {
+	return 0
+}
+
+func (net *mockNetworking) getMalformedPackets() int64 {
+	return 0
+}
+
+func (net *mockNetworking) setBanHandler(fn func(ip string)) {
+	net.banHandler = fn
+}
+
 func (net *mockNetworking) disconnect() error {
 	close(net.dc)
 	<-net.dcTimersChan
@@ -50,13 +74,47 @@ func (net *mockNetworking) createSocket(host string, port string, useStun bool,
 func (net *mockNetworking) cancelResponse(*expectedResponse) {
 }
 
-func (net *mockNetworking) init(self *NetworkNode) {
+func (net *mockNetworking) init(self *NetworkNode, options *Options) {
 	net.recv = make(chan (*message))
 	net.send = make(chan (*message))
 	net.msgChan = make(chan (*message))
 	net.dcMessageChan = make(chan (int))
 	net.dcTimersChan = make(chan (int))
 	net.dc = make(chan (int))
+	net.responses = make(map[int]chan (*message))
+	net.mutex = &sync.Mutex{}
+	go net.routeResponses()
+}
+
+// routeResponses delivers each response sent by a test to a query of the same
+// type, so that concurrent queries of different types are not given each
+// other's responses
+func (net *mockNetworking) routeResponses() {
+	for res := range net.send {
+		net.responseChan(res.Type) <- res
+	}
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+	for _, ch := range net.responses {
+		close(ch)
+	}
+	net.responses = nil
+}
+
+func (net *mockNetworking) responseChan(messageType int) chan (*message) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+	if net.responses == nil {
+		ch := make(chan (*message))
+		close(ch)
+		return ch
+	}
+	ch, ok := net.responses[messageType]
+	if !ok {
+		ch = make(chan (*message))
+		net.responses[messageType] = ch
+	}
+	return ch
 }
 
 func (net *mockNetworking) messagesFin() {
@@ -79,6 +137,13 @@ func (net *mockNetworking) failNextSendMessage() {
 	net.failNext = true
 }
 
+func (net *mockNetworking) failStoresTo(id []byte) {
+	if net.failStores == nil {
+		net.failStores = make(map[string]bool)
+	}
+	net.failStores[string(id)] = true
+}
+
 func (net *mockNetworking) sendMessage(q *message, expectResponse bool, id int64) (*expectedResponse, error) {
 	if id == 0 {
 		id = net.msgCounter
@@ -88,9 +153,12 @@ func (net *mockNetworking) sendMessage(q *message, expectResponse bool, id int64
 		net.failNext = false
 		return nil, errors.New("MockNetworking Error")
 	}
+	if q.Type == messageTypeStore && net.failStores[string(q.Receiver.ID)] {
+		return nil, errors.New("MockNetworking Error")
+	}
 	net.recv <- q
 	if expectResponse {
-		return &expectedResponse{ch: net.send, query: q, node: q.Receiver, id: id}, nil
+		return &expectedResponse{ch: net.responseChan(q.Type), query: q, node: q.Receiver, id: id, sent: time.Now()}, nil
 	}
 	return nil, nil
 }
@@ -126,3 +194,104 @@ func mockFindNodeResponseEmpty(query *message) *message {
 	r.Data = responseData
 	return r
 }
+
+func mockStoreResponse(query *message, success bool) *message {
+	r := &message{}
+	r.Receiver = query.Sender
+	r.Sender = &NetworkNode{ID: query.Receiver.ID, IP: net.ParseIP("0.0.0.0"), Port: 3001}
+	r.Type = query.Type
+	r.IsResponse = true
+	r.Data = &responseDataStore{Success: success}
+	return r
+}
+
+func mockFindValueResponse(query *message, value []byte) *message {
+	r := mockFindValueResponseEmpty(query)
+	r.Data.(*responseDataFindValue).Value = value
+	return r
+}
+
+func mockFindValueResponseEmpty(query *message) *message {
+	r := &message{}
+	n := newNode(&NetworkNode{})
+	n.ID = query.Sender.ID
+	n.IP = query.Sender.IP
+	n.Port = query.Sender.Port
+	r.Receiver = n.NetworkNode
+	r.Sender = &NetworkNode{ID: query.Receiver.ID, IP: net.ParseIP("0.0.0.0"), Port: 3001}
+	r.Type = query.Type
+	r.IsResponse = true
+	responseData := &responseDataFindValue{}
+	responseData.Closest = []*NetworkNode{}
+	r.Data = responseData
+	return r
+}
+
+// flakyWriter simulates a socket with a full send buffer by failing the
+// first failures writes with EAGAIN
+type flakyWriter struct {
+	failures int
+	buf      bytes.Buffer
+}
+
+func (w *flakyWriter) Write(data []byte) (int, error) {
+	if w.failures > 0 {
+		w.failures--
+		return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.EAGAIN)}
+	}
+	return w.buf.Write(data)
+}
+
+// Tests that writes which fail due to a full send buffer are retried
+func TestWriteRetriesOnBackpressure(t *testing.T) {
+	rn := &realNetworking{sendRetries: 3}
+
+	w := &flakyWriter{failures: 2}
+	err := rn.write(w, []byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("foo"), w.buf.Bytes())
+	assert.Equal(t, int64(2), rn.getSendBackpressureEvents())
+
+	w = &flakyWriter{failures: 4}
+	err = rn.write(w, []byte("foo"))
+	assert.Error(t, err)
+	assert.Equal(t, 0, w.buf.Len())
+	assert.Equal(t, int64(5), rn.getSendBackpressureEvents())
+}
+
+// Tests that only malformed packets received within TMalformedWindow count
+// towards the MalformedPacketLimit, and that sources whose packets have all
+// left the window are forgotten
+func TestMalformedPacketWindow(t *testing.T) {
+	options := &Options{
+		MalformedPacketLimit: 3,
+		TMalformedBan:        time.Minute,
+		TMalformedWindow:     time.Hour,
+	}
+	options.Logger.SetOutput(&bytes.Buffer{})
+	rn := &realNetworking{}
+	rn.init(&NetworkNode{}, options)
+	now := time.Now()
+	rn.now = func() time.Time {
+		return now
+	}
+
+	honest := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3000}
+	for i := 0; i < 5; i++ {
+		assert.False(t, rn.recordMalformedPacket(honest, errMalformedMessage))
+		now = now.Add(time.Hour)
+	}
+	assert.False(t, rn.isBanned(honest))
+
+	attacker := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 3000}
+	assert.False(t, rn.recordMalformedPacket(attacker, errMalformedMessage))
+	assert.False(t, rn.recordMalformedPacket(attacker, errMalformedMessage))
+	assert.True(t, rn.recordMalformedPacket(attacker, errMalformedMessage))
+	assert.True(t, rn.isBanned(attacker))
+
+	// Once the ban and window have passed, neither source is remembered
+	now = now.Add(time.Hour * 2)
+	assert.False(t, rn.recordMalformedPacket(&net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 3000}, errMalformedMessage))
+	assert.Equal(t, 1, len(rn.malformedSources))
+	assert.False(t, rn.isBanned(attacker))
+}
@@ -2,8 +2,12 @@ package kademlia
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
 	"math/big"
 	"net"
+	"sort"
 	"strconv"
 )
 
@@ -19,11 +23,37 @@ type NetworkNode struct {
 	Port int
 }
 
+// Equal returns true if n and other are the same peer. Peers are identified
+// by their IDs, so nodes with the same ID are equal even if their addresses
+// differ, and nodes with different IDs are not equal even if they share an
+// address. Nodes whose IDs are not yet known, such as bootstrap nodes, can
+// only be identified by address, so they are equal if their addresses are.
+func (n NetworkNode) Equal(other NetworkNode) bool {
+	if len(n.ID) == 0 && len(other.ID) == 0 {
+		return n.IP.Equal(other.IP) && n.Port == other.Port
+	}
+	return bytes.Equal(n.ID, other.ID)
+}
+
 // node represents a node in the network locally
 // a separate struct due to the fact that we may want to add some metadata
 // here later such as RTT, or LastSeen time
 type node struct {
 	*NetworkNode
+
+	// The agent string advertised by the node in its ping responses
+	agent string
+
+	// The first bytes of the node's ID, used to avoid comparing full IDs
+	idPrefix uint64
+}
+
+// PeerStats contains information the local node has recorded about a node in
+// its routing table
+type PeerStats struct {
+	// The agent string advertised by the node, e.g. "kademlia/1.0". Empty if
+	// the node has not advertised one.
+	Agent string
 }
 
 // NewNetworkNode creates a new NetworkNode for bootstrapping
@@ -35,12 +65,89 @@ func NewNetworkNode(ip string, port string) *NetworkNode {
 	}
 }
 
+// MarshalBinary encodes the node compactly as the length of the ID followed
+// by the ID, the length of the IP followed by the IP packed into 4 bytes for
+// IPv4 or 16 bytes for IPv6, and the port as 2 bytes. It is used whenever a
+// NetworkNode is sent over the wire.
+func (n NetworkNode) MarshalBinary() ([]byte, error) {
+	if len(n.ID) > math.MaxUint8 {
+		return nil, errors.New("ID too long to encode")
+	}
+	if n.Port < 0 || n.Port > math.MaxUint16 {
+		return nil, errors.New("Port out of range")
+	}
+
+	ip := n.IP.To4()
+	if ip == nil {
+		ip = n.IP.To16()
+	}
+
+	data := make([]byte, 0, 1+len(n.ID)+1+len(ip)+2)
+	data = append(data, byte(len(n.ID)))
+	data = append(data, n.ID...)
+	data = append(data, byte(len(ip)))
+	data = append(data, ip...)
+
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(n.Port))
+	return append(data, port[:]...), nil
+}
+
+// UnmarshalBinary decodes a node encoded by MarshalBinary
+func (n *NetworkNode) UnmarshalBinary(data []byte) error {
+	errInvalid := errors.New("Invalid NetworkNode encoding")
+
+	if len(data) < 1 {
+		return errInvalid
+	}
+	idLength := int(data[0])
+	data = data[1:]
+	if len(data) < idLength+1 {
+		return errInvalid
+	}
+	var id []byte
+	if idLength > 0 {
+		id = append([]byte{}, data[:idLength]...)
+	}
+	data = data[idLength:]
+
+	ipLength := int(data[0])
+	data = data[1:]
+	if len(data) != ipLength+2 {
+		return errInvalid
+	}
+	var ip net.IP
+	switch ipLength {
+	case 0:
+	case net.IPv4len:
+		ip = net.IPv4(data[0], data[1], data[2], data[3])
+	case net.IPv6len:
+		ip = append(net.IP{}, data[:ipLength]...)
+	default:
+		return errInvalid
+	}
+
+	n.ID = id
+	n.IP = ip
+	n.Port = int(binary.BigEndian.Uint16(data[ipLength:]))
+	return nil
+}
+
 func newNode(networkNode *NetworkNode) *node {
 	n := &node{}
 	n.NetworkNode = networkNode
+	n.idPrefix = getIDPrefix(networkNode.ID)
 	return n
 }
 
+// getIDPrefix returns the first 8 bytes of id as an integer. IDs shorter
+// than 8 bytes are padded with zeros.
+func getIDPrefix(id []byte) uint64 {
+	var prefix [8]byte
+	copy(prefix[:], id)
+	return binary.BigEndian.Uint64(prefix[:])
+}
+
 // nodeList is used in order to sort a list of arbitrary nodes against a
 // comparator. These nodes are sorted by xor distance
 type shortList struct {
@@ -74,7 +181,7 @@ func areNodesEqual(n1 *NetworkNode, n2 *NetworkNode, allowNilID bool) bool {
 
 func (n *shortList) RemoveNode(node *NetworkNode) {
 	for i := 0; i < n.Len(); i++ {
-		if bytes.Compare(n.Nodes[i].ID, node.ID) == 0 {
+		if n.Nodes[i].Equal(*node) {
 			n.Nodes = append(n.Nodes[:i], n.Nodes[i+1:]...)
 			return
 		}
@@ -85,7 +192,7 @@ func (n *shortList) AppendUniqueNetworkNodes(nodes []*NetworkNode) {
 	for _, vv := range nodes {
 		exists := false
 		for _, v := range n.Nodes {
-			if bytes.Compare(v.ID, vv.ID) == 0 {
+			if v.Equal(*vv) {
 				exists = true
 				break
 			}
@@ -100,7 +207,7 @@ func (n *shortList) AppendUnique(nodes []*node) {
 	for _, vv := range nodes {
 		exists := false
 		for _, v := range n.Nodes {
-			if bytes.Compare(v.ID, vv.ID) == 0 {
+			if v.Equal(*vv.NetworkNode) {
 				exists = true
 				break
 			}
@@ -111,6 +218,37 @@ func (n *shortList) AppendUnique(nodes []*node) {
 	}
 }
 
+// AppendClosest adds the nodes which are not already in the shortlist, keeping
+// it sorted by distance to the comparator and dropping the furthest nodes so
+// that it holds at most limit nodes. The shortlist must already be sorted.
+func (n *shortList) AppendClosest(nodes []*NetworkNode, limit int) {
+	for _, vv := range nodes {
+		exists := false
+		for _, v := range n.Nodes {
+			if v.Equal(*vv) {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+
+		distance := getDistance(vv.ID, n.Comparator)
+		i := sort.Search(len(n.Nodes), func(i int) bool {
+			return getDistance(n.Nodes[i].ID, n.Comparator).Cmp(distance) == 1
+		})
+		if i >= limit {
+			continue
+		}
+		if len(n.Nodes) < limit {
+			n.Nodes = append(n.Nodes, nil)
+		}
+		copy(n.Nodes[i+1:], n.Nodes[i:])
+		n.Nodes[i] = vv
+	}
+}
+
 func (n *shortList) Len() int {
 	return len(n.Nodes)
 }
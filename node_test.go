@@ -2,6 +2,8 @@ package kademlia
 
 import (
 	"math/big"
+	"math/rand"
+	"net"
 	"sort"
 	"testing"
 
@@ -67,6 +69,87 @@ func TestShortList(t *testing.T) {
 	assert.Equal(t, n4, nl.Nodes[3])
 }
 
+// Tests that AppendClosest keeps the shortlist sorted, ignores nodes already
+// in it, and drops the furthest nodes beyond the limit
+func TestShortListAppendClosest(t *testing.T) {
+	comparator := getIDWithValues(0)
+	n1 := &NetworkNode{ID: getZerodIDWithNthByte(19, 1)}
+	n2 := &NetworkNode{ID: getZerodIDWithNthByte(18, 1)}
+	n3 := &NetworkNode{ID: getZerodIDWithNthByte(17, 1)}
+	n4 := &NetworkNode{ID: getZerodIDWithNthByte(16, 1)}
+
+	nl := &shortList{Comparator: comparator}
+	nl.AppendClosest([]*NetworkNode{n3, n4, n2}, 3)
+	assert.Equal(t, []*NetworkNode{n2, n3, n4}, nl.Nodes)
+
+	nl.AppendClosest([]*NetworkNode{n2, n1}, 3)
+	assert.Equal(t, []*NetworkNode{n1, n2, n3}, nl.Nodes)
+
+	nl.AppendClosest([]*NetworkNode{n4}, 3)
+	assert.Equal(t, []*NetworkNode{n1, n2, n3}, nl.Nodes)
+}
+
+// Tests that nodes are equal when they have the same ID, regardless of their
+// addresses, and that nodes without IDs are compared by address
+func TestNetworkNodeEqual(t *testing.T) {
+	node := NetworkNode{ID: getZerodIDWithNthByte(19, 1), IP: net.ParseIP("10.0.0.1"), Port: 3000}
+
+	moved := NetworkNode{ID: getZerodIDWithNthByte(19, 1), IP: net.ParseIP("10.0.0.2"), Port: 3001}
+	assert.True(t, node.Equal(moved))
+	assert.True(t, moved.Equal(node))
+
+	other := NetworkNode{ID: getZerodIDWithNthByte(19, 2), IP: net.ParseIP("10.0.0.1"), Port: 3000}
+	assert.False(t, node.Equal(other))
+	assert.False(t, other.Equal(node))
+
+	unknown := NetworkNode{IP: net.ParseIP("10.0.0.1"), Port: 3000}
+	assert.False(t, node.Equal(unknown))
+	assert.False(t, unknown.Equal(node))
+	assert.True(t, unknown.Equal(NetworkNode{IP: net.ParseIP("10.0.0.1"), Port: 3000}))
+	assert.False(t, unknown.Equal(NetworkNode{IP: net.ParseIP("10.0.0.1"), Port: 3001}))
+
+	// The shortlist treats a node seen at a new address as the same node
+	sl := &shortList{Nodes: []*NetworkNode{&node}}
+	sl.AppendUniqueNetworkNodes([]*NetworkNode{&moved, &other})
+	assert.Equal(t, 2, sl.Len())
+	sl.RemoveNode(&moved)
+	assert.Equal(t, []*NetworkNode{&other}, sl.Nodes)
+}
+
+// Tests encoding nodes with IPv4 and IPv6 addresses and decoding them again
+func TestNetworkNodeBinary(t *testing.T) {
+	nodes := []NetworkNode{
+		{ID: getIDWithValues(1), IP: net.ParseIP("127.0.0.1"), Port: 3000},
+		{ID: getIDWithValues(2), IP: net.ParseIP("2001:db8::1"), Port: 65535},
+		{IP: net.ParseIP("10.0.0.1"), Port: 3001},
+		{ID: getIDWithValues(3)},
+	}
+
+	for _, n := range nodes {
+		data, err := n.MarshalBinary()
+		assert.NoError(t, err)
+
+		var decoded NetworkNode
+		err = decoded.UnmarshalBinary(data)
+		assert.NoError(t, err)
+		assert.Equal(t, n, decoded)
+	}
+
+	// IPv4 addresses are packed into 4 bytes
+	data, _ := nodes[0].MarshalBinary()
+	assert.Equal(t, 1+20+1+4+2, len(data))
+	data, _ = nodes[1].MarshalBinary()
+	assert.Equal(t, 1+20+1+16+2, len(data))
+
+	_, err := NetworkNode{Port: 65536}.MarshalBinary()
+	assert.Error(t, err)
+
+	var decoded NetworkNode
+	assert.Error(t, decoded.UnmarshalBinary([]byte{}))
+	assert.Error(t, decoded.UnmarshalBinary(data[:len(data)-1]))
+	assert.Error(t, decoded.UnmarshalBinary([]byte{0, 3, 1, 2, 3, 0, 0}))
+}
+
 func getZerodIDWithNthByte(n int, v byte) []byte {
 	id := getIDWithValues(0)
 	id[n] = v
@@ -76,3 +159,34 @@ func getZerodIDWithNthByte(n int, v byte) []byte {
 func getIDWithValues(b byte) []byte {
 	return []byte{b, b, b, b, b, b, b, b, b, b, b, b, b, b, b, b, b, b, b, b}
 }
+
+// newID generates a new random ID
+func newID() ([]byte, error) {
+	result := make([]byte, 20)
+	_, err := rand.Read(result)
+	return result, err
+}
+
+// Aggregates the responses of a lookup in a large simulated network, in which
+// every response returns k different nodes, and checks that the shortlist
+// never holds more than k nodes however many are returned
+func BenchmarkShortListAggregation(b *testing.B) {
+	network := make([]*NetworkNode, 100000)
+	for i := range network {
+		id, _ := newID()
+		network[i] = &NetworkNode{ID: id, IP: net.ParseIP("0.0.0.0"), Port: 3000}
+	}
+	target, _ := newID()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sl := &shortList{Comparator: target}
+		for j := 0; j+k <= len(network); j += k {
+			sl.AppendClosest(network[j:j+k], k)
+			if cap(sl.Nodes) > 2*k {
+				b.Fatalf("Shortlist grew to %d nodes", cap(sl.Nodes))
+			}
+		}
+	}
+}
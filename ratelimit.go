@@ -0,0 +1,76 @@
+package kademlia
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of an operation to rate per second, allowing
+// bursts of up to burst operations after a quiet period
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mutex  *sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		mutex:  &sync.Mutex{},
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last call. Must be called with
+// the mutex held.
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// take takes a token if one is available, and returns false otherwise
+func (tb *tokenBucket) take() bool {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	tb.refill(time.Now())
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// wait takes a token, blocking until one is available or ctx is done, in
+// which case the context's error is returned. Tokens are never taken before
+// they are available, so callers which give up waiting do not delay those
+// which come after them.
+func (tb *tokenBucket) wait(ctx context.Context) error {
+	for {
+		tb.mutex.Lock()
+		tb.refill(time.Now())
+		if tb.tokens >= 1 {
+			tb.tokens--
+			tb.mutex.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+		tb.mutex.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
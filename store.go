@@ -34,6 +34,95 @@ type Store interface {
 	GetKey(data []byte) []byte
 }
 
+// EntryLister may be implemented by a Store to list every key/value pair it
+// holds along with its metadata. It is used to export the store and to find
+// the keys held on behalf of other nodes. Stores which do not implement it
+// are listed using GetAllKeysForReplication, which may omit keys which are
+// not yet due for replication.
+type EntryLister interface {
+	// GetAllEntries should return every key/value pair held in the store
+	// along with its metadata.
+	GetAllEntries() []StoreEntry
+}
+
+// SecureDeleter may be implemented by a Store which persists data, for
+// example to disk, so that expired data can be overwritten before it is
+// deleted rather than left recoverable. It is used when the SecureDelete
+// option is set.
+type SecureDeleter interface {
+	// SecureDelete should overwrite the stored data for key and then delete
+	// the key/value pair from the Store.
+	SecureDelete(key []byte) error
+}
+
+// ReplicationFactorStore may be implemented by a Store to persist the number
+// of nodes individual keys are replicated to, as set by StoreWithReplication.
+// Keys without a replication factor are replicated to k nodes.
+type ReplicationFactorStore interface {
+	// SetReplicationFactor should record the number of nodes the data for
+	// key is replicated to.
+	SetReplicationFactor(key []byte, replicas int) error
+
+	// GetReplicationFactor should return the replication factor recorded for
+	// key, or 0 if none was recorded.
+	GetReplicationFactor(key []byte) int
+}
+
+// ReplicaSetStore may be implemented by a Store to persist the nodes each
+// key was last stored to, as recorded when the RecordReplicas option is set
+type ReplicaSetStore interface {
+	// SetReplicaSet should record the nodes the data for key was stored to,
+	// replacing any previously recorded.
+	SetReplicaSet(key []byte, nodes []*NetworkNode) error
+
+	// GetReplicaSet should return the nodes recorded for key, or nil if none
+	// were recorded.
+	GetReplicaSet(key []byte) []*NetworkNode
+}
+
+// PublisherStore may be implemented by a Store to persist the ID of the node
+// which published each key held on its behalf, so that MaxKeysPerPublisher is
+// still enforced after a restart
+type PublisherStore interface {
+	// SetPublishedBy should record the ID of the node which published the
+	// data for key.
+	SetPublishedBy(key []byte, publisher []byte) error
+
+	// GetPublishedBy should return the ID recorded for key, or nil if none
+	// was recorded.
+	GetPublishedBy(key []byte) []byte
+}
+
+// ExpirationStore may be implemented by a Store to report when individual
+// keys expire, so that values held past their expiration but not yet removed
+// by ExpireKeys are not returned by Get or served to other nodes
+type ExpirationStore interface {
+	// GetExpiration should return the expiration time of key, and false if
+	// the key is not held.
+	GetExpiration(key []byte) (expiration time.Time, found bool)
+}
+
+// StoreEntry is a single key/value pair held in a Store along with its
+// metadata
+type StoreEntry struct {
+	Key         []byte
+	Data        []byte
+	Replication time.Time
+	Expiration  time.Time
+
+	// Whether or not the local node is the original publisher
+	Publisher bool
+
+	// The number of nodes the data is replicated to, or 0 for the default
+	Replicas int
+
+	// The nodes the data was last stored to, if recorded
+	ReplicaSet []*NetworkNode
+
+	// The ID of the other node which published the data, if recorded
+	PublishedBy []byte
+}
+
 // MemoryStore is a simple in-memory key/value store used for unit testing, and
 // the CLI example
 type MemoryStore struct {
@@ -41,6 +130,10 @@ type MemoryStore struct {
 	data         map[string][]byte
 	replicateMap map[string]time.Time
 	expireMap    map[string]time.Time
+	publisherMap map[string]bool
+	replicasMap  map[string]int
+	replicaSets  map[string][]NetworkNode
+	publishedBy  map[string][]byte
 }
 
 // GetAllKeysForReplication should return the keys of all data to be
@@ -66,6 +159,10 @@ func (ms *MemoryStore) ExpireKeys() {
 		if time.Now().After(v) {
 			delete(ms.replicateMap, k)
 			delete(ms.expireMap, k)
+			delete(ms.publisherMap, k)
+			delete(ms.replicasMap, k)
+			delete(ms.replicaSets, k)
+			delete(ms.publishedBy, k)
 			delete(ms.data, k)
 		}
 	}
@@ -77,6 +174,10 @@ func (ms *MemoryStore) Init() {
 	ms.mutex = &sync.Mutex{}
 	ms.replicateMap = make(map[string]time.Time)
 	ms.expireMap = make(map[string]time.Time)
+	ms.publisherMap = make(map[string]bool)
+	ms.replicasMap = make(map[string]int)
+	ms.replicaSets = make(map[string][]NetworkNode)
+	ms.publishedBy = make(map[string][]byte)
 }
 
 // GetKey returns the key for data
@@ -92,6 +193,7 @@ func (ms *MemoryStore) Store(key []byte, data []byte, replication time.Time, exp
 	defer ms.mutex.Unlock()
 	ms.replicateMap[string(key)] = replication
 	ms.expireMap[string(key)] = expiration
+	ms.publisherMap[string(key)] = publisher
 	ms.data[string(key)] = data
 	return nil
 }
@@ -110,5 +212,101 @@ func (ms *MemoryStore) Delete(key []byte) {
 	defer ms.mutex.Unlock()
 	delete(ms.replicateMap, string(key))
 	delete(ms.expireMap, string(key))
+	delete(ms.publisherMap, string(key))
+	delete(ms.replicasMap, string(key))
+	delete(ms.replicaSets, string(key))
+	delete(ms.publishedBy, string(key))
 	delete(ms.data, string(key))
 }
+
+// SetReplicationFactor records the number of nodes the data for key is
+// replicated to
+func (ms *MemoryStore) SetReplicationFactor(key []byte, replicas int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.replicasMap[string(key)] = replicas
+	return nil
+}
+
+// GetReplicationFactor returns the replication factor recorded for key, or 0
+// if none was recorded
+func (ms *MemoryStore) GetReplicationFactor(key []byte) int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.replicasMap[string(key)]
+}
+
+// SetReplicaSet records the nodes the data for key was stored to
+func (ms *MemoryStore) SetReplicaSet(key []byte, nodes []*NetworkNode) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	set := make([]NetworkNode, len(nodes))
+	for i, n := range nodes {
+		set[i] = copyNetworkNode(n)
+	}
+	ms.replicaSets[string(key)] = set
+	return nil
+}
+
+// GetReplicaSet returns the nodes recorded for key, or nil if none were
+// recorded
+func (ms *MemoryStore) GetReplicaSet(key []byte) []*NetworkNode {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.getReplicaSet(string(key))
+}
+
+// SetPublishedBy records the ID of the node which published the data for key
+func (ms *MemoryStore) SetPublishedBy(key []byte, publisher []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.publishedBy[string(key)] = append([]byte{}, publisher...)
+	return nil
+}
+
+// GetPublishedBy returns the ID recorded for key, or nil if none was recorded
+func (ms *MemoryStore) GetPublishedBy(key []byte) []byte {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.publishedBy[string(key)]
+}
+
+// GetExpiration returns the expiration time of key
+func (ms *MemoryStore) GetExpiration(key []byte) (expiration time.Time, found bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	expiration, found = ms.expireMap[string(key)]
+	return expiration, found
+}
+
+// getReplicaSet returns copies of the nodes recorded for key. Must be called
+// with the mutex held.
+func (ms *MemoryStore) getReplicaSet(key string) []*NetworkNode {
+	var nodes []*NetworkNode
+	for _, n := range ms.replicaSets[key] {
+		n := copyNetworkNode(&n)
+		nodes = append(nodes, &n)
+	}
+	return nodes
+}
+
+// GetAllEntries returns every key/value pair held in the MemoryStore along
+// with its metadata
+func (ms *MemoryStore) GetAllEntries() []StoreEntry {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var entries []StoreEntry
+	for k, v := range ms.data {
+		entries = append(entries, StoreEntry{
+			Key:         []byte(k),
+			Data:        v,
+			Replication: ms.replicateMap[k],
+			Expiration:  ms.expireMap[k],
+			Publisher:   ms.publisherMap[k],
+			Replicas:    ms.replicasMap[k],
+			ReplicaSet:  ms.getReplicaSet(k),
+			PublishedBy: ms.publishedBy[k],
+		})
+	}
+	return entries
+}
@@ -0,0 +1,351 @@
+package kademlia
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BuildNetwork creates n DHTs connected to each other over an in-memory
+// transport, and bootstraps each of them against the first so their routing
+// tables are populated. It is intended for testing applications built on the
+// DHT without opening sockets. Each function in configure is called with the
+// options of every node before it is created. Node IDs are generated
+// deterministically unless configure provides an ID or Rand. The network
+// should be shut down with CloseNetwork.
+func BuildNetwork(n int, configure ...func(options *Options)) ([]*DHT, error) {
+	if n < 1 {
+		return nil, errors.New("Network must contain at least one node")
+	}
+
+	transport := &memoryTransport{
+		mutex: &sync.Mutex{},
+		nodes: make(map[string]*memoryNetworking),
+	}
+
+	var dhts []*DHT
+	for i := 0; i < n; i++ {
+		options := &Options{
+			IP:   "127.0.0.1",
+			Port: strconv.Itoa(i + 1),
+			Rand: rand.New(rand.NewSource(int64(i))),
+		}
+		if i > 0 {
+			first := dhts[0].ht.Self
+			options.BootstrapNodes = []*NetworkNode{
+				{ID: first.ID, IP: first.IP, Port: first.Port},
+			}
+		}
+		for _, c := range configure {
+			c(options)
+		}
+
+		dht, err := NewDHT(&MemoryStore{}, options)
+		if err != nil {
+			CloseNetwork(dhts)
+			return nil, err
+		}
+
+		dht.networking = &memoryNetworking{transport: transport}
+		err = dht.CreateSocket()
+		if err != nil {
+			CloseNetwork(dhts)
+			return nil, err
+		}
+
+		go dht.Listen()
+
+		dhts = append(dhts, dht)
+	}
+
+	for _, dht := range dhts[1:] {
+		err := dht.Bootstrap()
+		if err != nil {
+			CloseNetwork(dhts)
+			return nil, err
+		}
+	}
+
+	return dhts, nil
+}
+
+// CloseNetwork disconnects every DHT in a network created by BuildNetwork.
+// The first error encountered is returned.
+func CloseNetwork(dhts []*DHT) error {
+	var result error
+	for _, dht := range dhts {
+		err := dht.Disconnect()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// memoryTransport routes messages between the memoryNetworking instances
+// created by BuildNetwork
+type memoryTransport struct {
+	mutex *sync.Mutex
+	nodes map[string]*memoryNetworking
+}
+
+func (mt *memoryTransport) register(addr string, mn *memoryNetworking) error {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	if mt.nodes[addr] != nil {
+		return errors.New("address already in use")
+	}
+	mt.nodes[addr] = mn
+	return nil
+}
+
+func (mt *memoryTransport) unregister(addr string) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	delete(mt.nodes, addr)
+}
+
+func (mt *memoryTransport) lookup(addr string) *memoryNetworking {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	return mt.nodes[addr]
+}
+
+// memoryNetworking implements networking by passing serialized messages
+// through a memoryTransport
+type memoryNetworking struct {
+	transport     *memoryTransport
+	self          *NetworkNode
+	mutex         *sync.Mutex
+	recvChan      chan (*message)
+	dcStartChan   chan (int)
+	dcEndChan     chan (int)
+	dcTimersChan  chan (int)
+	dcMessageChan chan (int)
+	responseMap   map[int64]*expectedResponse
+	msgCounter    int64
+	address       string
+	connected     bool
+	initialized   bool
+	auth          *authenticator
+
+	// How the sender IP claimed by messages is checked against the address
+	// they were sent from
+	sourceIPPolicy int
+
+	// The number of messages dropped because they were malformed. Accessed
+	// atomically.
+	malformedPackets int64
+}
+
+func (mn *memoryNetworking) init(self *NetworkNode, options *Options) {
+	mn.self = self
+	mn.mutex = &sync.Mutex{}
+	mn.recvChan = make(chan (*message))
+	mn.dcStartChan = make(chan (int), 10)
+	mn.dcEndChan = make(chan (int))
+	mn.dcTimersChan = make(chan (int))
+	mn.dcMessageChan = make(chan (int))
+	mn.responseMap = make(map[int64]*expectedResponse)
+	mn.connected = false
+	mn.initialized = true
+	if len(options.NetworkKey) > 0 {
+		mn.auth = newAuthenticator(options.NetworkKey, options.TReplayWindow)
+	}
+	mn.sourceIPPolicy = options.SourceIPPolicy
+}
+
+func (mn *memoryNetworking) isInitialized() bool {
+	return mn.initialized
+}
+
+func (mn *memoryNetworking) getMessage() chan (*message) {
+	return mn.recvChan
+}
+
+func (mn *memoryNetworking) messagesFin() {
+	mn.dcMessageChan <- 1
+}
+
+func (mn *memoryNetworking) getDisconnect() chan (int) {
+	return mn.dcStartChan
+}
+
+func (mn *memoryNetworking) timersFin() {
+	mn.dcTimersChan <- 1
+}
+
+func (mn *memoryNetworking) getNetworkAddr() string {
+	return mn.address
+}
+
+func (mn *memoryNetworking) getSendBackpressureEvents() int64 {
+	return 0
+}
+
+func (mn *memoryNetworking) getMalformedPackets() int64 {
+	return atomic.LoadInt64(&mn.malformedPackets)
+}
+
+func (mn *memoryNetworking) setBanHandler(fn func(ip string)) {}
+
+func (mn *memoryNetworking) createSocket(host string, port string, useStun bool, stunAddr string) (publicHost string, publicPort string, err error) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	if mn.connected {
+		return "", "", errors.New("already connected")
+	}
+
+	address := memoryAddr(net.ParseIP(host), port)
+	err = mn.transport.register(address, mn)
+	if err != nil {
+		return "", "", err
+	}
+
+	mn.address = address
+	mn.connected = true
+
+	return host, port, nil
+}
+
+func (mn *memoryNetworking) sendMessage(msg *message, expectResponse bool, id int64) (*expectedResponse, error) {
+	mn.mutex.Lock()
+	if id == -1 {
+		id = mn.msgCounter
+		mn.msgCounter++
+	}
+	msg.ID = id
+	mn.mutex.Unlock()
+
+	receiver := mn.transport.lookup(memoryAddr(msg.Receiver.IP, strconv.Itoa(msg.Receiver.Port)))
+	if receiver == nil {
+		return nil, errors.New("no node listening at address")
+	}
+
+	// Messages are serialized so that nodes never share pointers
+	var data []byte
+	var err error
+	if mn.auth != nil {
+		data, err = mn.auth.seal(msg)
+	} else {
+		data, err = serializeMessage(msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res *expectedResponse
+	if expectResponse {
+		mn.mutex.Lock()
+		res = &expectedResponse{
+			ch:    make(chan (*message), 1),
+			node:  msg.Receiver,
+			query: msg,
+			id:    id,
+			sent:  time.Now(),
+		}
+		mn.responseMap[id] = res
+		mn.mutex.Unlock()
+	}
+
+	go receiver.deliver(data, mn.address)
+
+	return res, nil
+}
+
+// deliver decodes a message sent by another node from the address from, and
+// passes it to the DHT or to the expected response it answers
+func (mn *memoryNetworking) deliver(data []byte, from string) {
+	var msg *message
+	var err error
+	if mn.auth != nil {
+		msg, err = mn.auth.open(bytes.NewReader(data))
+	} else {
+		msg, err = deserializeMessage(bytes.NewReader(data))
+	}
+	if isAuthError(err) {
+		return
+	}
+	if err != nil || validateMessage(msg) != nil {
+		atomic.AddInt64(&mn.malformedPackets, 1)
+		return
+	}
+
+	if !checkSourceIP(msg, from, mn.sourceIPPolicy) {
+		return
+	}
+
+	isPing := msg.Type == messageTypePing
+
+	if !areNodesEqual(msg.Receiver, mn.self, isPing) || msg.ID < 0 {
+		return
+	}
+
+	if !msg.IsResponse {
+		select {
+		case mn.recvChan <- msg:
+		case <-mn.dcEndChan:
+		}
+		return
+	}
+
+	mn.mutex.Lock()
+	res := mn.responseMap[msg.ID]
+	if res == nil || !mn.connected {
+		mn.mutex.Unlock()
+		return
+	}
+	if !areNodesEqual(res.node, msg.Sender, isPing) {
+		mn.mutex.Unlock()
+		return
+	}
+	delete(mn.responseMap, msg.ID)
+	mn.mutex.Unlock()
+
+	if msg.Type == res.query.Type {
+		res.ch <- msg
+	}
+	close(res.ch)
+}
+
+func (mn *memoryNetworking) cancelResponse(res *expectedResponse) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	if mn.responseMap[res.query.ID] != nil {
+		close(mn.responseMap[res.query.ID].ch)
+		delete(mn.responseMap, res.query.ID)
+	}
+}
+
+func (mn *memoryNetworking) disconnect() error {
+	mn.mutex.Lock()
+	if !mn.connected {
+		mn.mutex.Unlock()
+		return errors.New("not connected")
+	}
+	mn.connected = false
+	mn.mutex.Unlock()
+
+	mn.transport.unregister(mn.address)
+	mn.dcStartChan <- 1
+	mn.dcStartChan <- 1
+	<-mn.dcTimersChan
+	<-mn.dcMessageChan
+	mn.initialized = false
+	close(mn.dcEndChan)
+	return nil
+}
+
+func (mn *memoryNetworking) listen() error {
+	<-mn.dcEndChan
+	return errors.New("closed")
+}
+
+func memoryAddr(ip net.IP, port string) string {
+	return net.JoinHostPort(ip.String(), port)
+}
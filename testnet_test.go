@@ -0,0 +1,99 @@
+package kademlia
+
+import (
+	"testing"
+
+	b58 "github.com/jbenet/go-base58"
+	"github.com/stretchr/testify/assert"
+)
+
+// Builds a network larger than k, stores a value on one node and retrieves it
+// from every other node
+func TestBuildNetwork(t *testing.T) {
+	dhts, err := BuildNetwork(30)
+	assert.NoError(t, err)
+	assert.Equal(t, 30, len(dhts))
+
+	for _, dht := range dhts {
+		assert.True(t, dht.NumNodes() > 0)
+	}
+
+	// IDs are deterministic
+	ids := make(map[string]bool)
+	for _, dht := range dhts {
+		ids[dht.GetSelfID()] = true
+	}
+	assert.Equal(t, 30, len(ids))
+
+	again, err := BuildNetwork(1)
+	assert.NoError(t, err)
+	assert.Equal(t, dhts[0].GetSelfID(), again[0].GetSelfID())
+	assert.NoError(t, CloseNetwork(again))
+
+	key, err := dhts[7].Store([]byte("foo"))
+	assert.NoError(t, err)
+
+	for i, dht := range dhts {
+		value, exists, err := dht.Get(key)
+		assert.NoError(t, err)
+		assert.True(t, exists, "node %d could not find the value", i)
+		assert.Equal(t, []byte("foo"), value)
+	}
+
+	// Not every node should hold the value locally
+	holders := 0
+	for _, dht := range dhts {
+		if _, exists := dht.store.Retrieve(b58.Decode(key)); exists {
+			holders++
+		}
+	}
+	assert.True(t, holders < 30)
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
+
+// Tests paging through the closest nodes to a target, that every node is
+// returned once in distance order, and that pages are unaffected by changes
+// to the routing table made during iteration
+func TestClosestIterator(t *testing.T) {
+	dhts, err := BuildNetwork(10)
+	assert.NoError(t, err)
+
+	target := getIDWithValues(0)
+	it := dhts[0].ClosestIterator(target)
+	assert.Equal(t, 9, it.Len())
+
+	first := it.Next(4)
+	assert.Equal(t, 4, len(first))
+	cursor := it.Cursor()
+	assert.Equal(t, 4, cursor)
+
+	// Removing a node does not change the snapshot
+	assert.True(t, dhts[0].RemovePeer(first[0].ID))
+
+	var all []NetworkNode
+	all = append(all, first...)
+	for {
+		page := it.Next(4)
+		if len(page) == 0 {
+			break
+		}
+		all = append(all, page...)
+	}
+	assert.Equal(t, 9, len(all))
+
+	seen := make(map[string]bool)
+	for i, n := range all {
+		assert.False(t, seen[string(n.ID)])
+		seen[string(n.ID)] = true
+		if i > 0 {
+			assert.Equal(t, 1, getDistance(n.ID, target).Cmp(getDistance(all[i-1].ID, target)))
+		}
+	}
+
+	// Resuming from the cursor returns the same page again
+	it.Seek(cursor)
+	assert.Equal(t, all[4:8], it.Next(4))
+
+	assert.NoError(t, CloseNetwork(dhts))
+}
@@ -0,0 +1,115 @@
+package kademlia
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// LookupEventType is the kind of a LookupEvent
+type LookupEventType int
+
+const (
+	// LookupStarted is emitted once when a lookup begins
+	LookupStarted LookupEventType = iota
+
+	// LookupQuerySent is emitted for each RPC sent by a lookup, including the
+	// STOREs sent once the lookup for a store has finished
+	LookupQuerySent
+
+	// LookupResponseReceived is emitted for each response to a query
+	LookupResponseReceived
+
+	// LookupQueryFailed is emitted for each query which could not be sent or
+	// which was not answered in time
+	LookupQueryFailed
+
+	// LookupFinished is emitted once when a lookup stops, and is the last
+	// event of the lookup. Queries still outstanding when it stops are not
+	// reported.
+	LookupFinished
+)
+
+// LookupEvent describes a step in the lifecycle of a single lookup
+type LookupEvent struct {
+	// Identifies the lookup the event belongs to. Every event of a lookup
+	// carries the same ID, and no two lookups of a DHT share one.
+	LookupID uint64
+
+	Type LookupEventType
+
+	// The node queried, for query and response events
+	Node NetworkNode
+
+	// Why the lookup stopped, for LookupFinished events
+	Termination LookupTermination
+}
+
+// lookupTracerKey is the context key of the tracer added by WithLookupTracer
+type lookupTracerKey struct{}
+
+// WithLookupTracer returns a copy of ctx carrying tracer. Lookups made with
+// the returned context, for example by FindNodeVerbose, StoreContext and
+// GetContext, call tracer with each event of their lifecycle so that the
+// RPCs of a single lookup can be correlated while many run concurrently. The
+// lookup ID is also included in the log lines of the lookup. tracer may be
+// called from multiple goroutines at once and should not block.
+func WithLookupTracer(ctx context.Context, tracer func(e LookupEvent)) context.Context {
+	return context.WithValue(ctx, lookupTracerKey{}, tracer)
+}
+
+// lookupTrace reports the events of a single lookup to the tracer of the
+// context it was started with
+type lookupTrace struct {
+	id     uint64
+	tracer func(e LookupEvent)
+
+	// The origin the RPCs of the lookup are recorded against in the
+	// RPCSchedule
+	origin string
+
+	// Set once LookupFinished has been emitted, after which events are
+	// dropped
+	mutex    *sync.Mutex
+	finished bool
+}
+
+// newLookupTrace assigns a new lookup ID to a lookup of type t, and returns a
+// trace reporting to the tracer carried by ctx if it carries one
+func (dht *DHT) newLookupTrace(ctx context.Context, t int) *lookupTrace {
+	tracer, _ := ctx.Value(lookupTracerKey{}).(func(e LookupEvent))
+	origin := RPCOriginLookup
+	if t == iterateStore {
+		origin = RPCOriginStore
+	}
+	return &lookupTrace{
+		id:     atomic.AddUint64(&dht.lookupCounter, 1),
+		tracer: tracer,
+		origin: rpcOrigin(ctx, origin),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// emit reports an event for node, which may be nil, to the tracer. Events
+// emitted after LookupFinished, for example by queries which time out after
+// the lookup has stopped, are dropped. It is safe to call on a nil trace.
+func (lt *lookupTrace) emit(eventType LookupEventType, node *NetworkNode, termination LookupTermination) {
+	if lt == nil || lt.tracer == nil {
+		return
+	}
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	if lt.finished {
+		return
+	}
+	lt.finished = eventType == LookupFinished
+	e := LookupEvent{
+		LookupID:    lt.id,
+		Type:        eventType,
+		Termination: termination,
+	}
+	if node != nil {
+		e.Node = copyNetworkNode(node)
+	}
+	lt.tracer(e)
+}
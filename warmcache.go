@@ -0,0 +1,102 @@
+package kademlia
+
+import (
+	"sort"
+	"sync"
+)
+
+// warmCache remembers the nodes seen most recently which could not be added
+// to the routing table because their bucket was full. They are used as
+// candidates in lookups, and to replace unresponsive nodes removed from their
+// bucket. Nodes are held least recently seen first, and the least recently
+// seen node is forgotten once more than size nodes are held.
+type warmCache struct {
+	size  int
+	mutex *sync.Mutex
+	nodes []NetworkNode
+}
+
+func newWarmCache(size int) *warmCache {
+	return &warmCache{
+		size:  size,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// add records n as the most recently seen node
+func (c *warmCache) add(n NetworkNode) {
+	if c.size <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeLocked(n.ID)
+	c.nodes = append(c.nodes, n)
+	if len(c.nodes) > c.size {
+		c.nodes = append([]NetworkNode{}, c.nodes[len(c.nodes)-c.size:]...)
+	}
+}
+
+// remove forgets the node with the given ID
+func (c *warmCache) remove(id []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeLocked(id)
+}
+
+// removeLocked forgets the node with the given ID. Must be called with the
+// mutex held.
+func (c *warmCache) removeLocked(id []byte) {
+	for i, n := range c.nodes {
+		if n.Equal(NetworkNode{ID: id}) {
+			c.nodes = append(c.nodes[:i:i], c.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeMatching forgets every node for which match returns true
+func (c *warmCache) removeMatching(match func(id []byte) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var kept []NetworkNode
+	for _, n := range c.nodes {
+		if !match(n.ID) {
+			kept = append(kept, n)
+		}
+	}
+	c.nodes = kept
+}
+
+// closest returns copies of up to num of the held nodes closest to target,
+// sorted by distance
+func (c *warmCache) closest(num int, target []byte) []*NetworkNode {
+	c.mutex.Lock()
+	sl := &shortList{Comparator: target}
+	for _, n := range c.nodes {
+		n := copyNetworkNode(&n)
+		sl.Nodes = append(sl.Nodes, &n)
+	}
+	c.mutex.Unlock()
+
+	sort.Sort(sl)
+	if len(sl.Nodes) > num {
+		return sl.Nodes[:num]
+	}
+	return sl.Nodes
+}
+
+// take removes and returns the most recently seen node for which match
+// returns true
+func (c *warmCache) take(match func(id []byte) bool) (NetworkNode, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := len(c.nodes) - 1; i >= 0; i-- {
+		if match(c.nodes[i].ID) {
+			n := c.nodes[i]
+			c.nodes = append(c.nodes[:i:i], c.nodes[i+1:]...)
+			return n, true
+		}
+	}
+	return NetworkNode{}, false
+}